@@ -0,0 +1,267 @@
+// This file holds the attach & new commands, used to open panes from the
+// host's own terminal
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tuzig/webexec/peers"
+	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// detachKey detaches a local client from its pane, it's Ctrl-]
+const detachKey = 0x1d
+
+// errDetached is returned when the user detached from the pane
+var errDetached = errors.New("detached")
+
+// localClient is a pane client on the host, connected to the agent's
+// websocket over the unix socket
+type localClient struct {
+	conn *websocket.Conn
+	// wm protects writes to the websocket
+	wm     sync.Mutex
+	ref    int
+	m      sync.Mutex
+	paneID uint32
+}
+
+// dialAgent opens a websocket to the agent over its unix socket
+func dialAgent() (*localClient, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", GetSockFP())
+		},
+		HandshakeTimeout: 5 * time.Second,
+	}
+	conn, _, err := dialer.Dial("ws://unix/ws", nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to the agent: %s", err)
+	}
+	return &localClient{conn: conn}, nil
+}
+
+// send writes a frame to the stream with the given id, 0 is the cdc
+func (lc *localClient) send(id uint32, b []byte) error {
+	frame := make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(frame, id)
+	copy(frame[4:], b)
+	lc.wm.Lock()
+	defer lc.wm.Unlock()
+	return lc.conn.WriteMessage(websocket.BinaryMessage, frame)
+}
+
+// sendCTRL sends a control message and returns its reference
+func (lc *localClient) sendCTRL(typ string, args interface{}) (int, error) {
+	lc.m.Lock()
+	lc.ref++
+	ref := lc.ref
+	lc.m.Unlock()
+	msg, err := json.Marshal(peers.CTRLMessage{
+		Time: time.Now().UnixNano() / 1000000, Ref: ref, Type: typ, Args: args})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to marshal %s message: %s", typ, err)
+	}
+	return ref, lc.send(0, msg)
+}
+
+func (lc *localClient) pane() uint32 {
+	lc.m.Lock()
+	defer lc.m.Unlock()
+	return lc.paneID
+}
+
+func (lc *localClient) setPane(id uint32) {
+	lc.m.Lock()
+	if lc.paneID == 0 {
+		lc.paneID = id
+	}
+	lc.m.Unlock()
+}
+
+// resize sets the pane's size
+func (lc *localClient) resize(rows uint16, cols uint16) error {
+	_, err := lc.sendCTRL("resize", peers.ResizeArgs{
+		PaneID: int(lc.pane()), Sx: cols, Sy: rows})
+	return err
+}
+
+// run sends the message that opens a pane and streams the pane to out and
+// in to the pane until the pane exits or the user detaches. Once the pane is
+// open, onOpen is called.
+func (lc *localClient) run(typ string, args interface{}, in io.Reader,
+	out io.Writer, onOpen func()) error {
+
+	ref, err := lc.sendCTRL(typ, args)
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 2)
+	go func() {
+		opened := false
+		for {
+			_, b, err := lc.conn.ReadMessage()
+			if err != nil {
+				done <- fmt.Errorf("Lost connection to the agent: %s", err)
+				return
+			}
+			if len(b) < 4 {
+				continue
+			}
+			id := binary.BigEndian.Uint32(b[:4])
+			if id != 0 {
+				lc.setPane(id)
+				if id != lc.pane() {
+					continue
+				}
+				if len(b) == 4 {
+					// before the ack, a closed stream is followed by a nack
+					if opened {
+						done <- nil
+						return
+					}
+					continue
+				}
+				out.Write(b[4:])
+				continue
+			}
+			var m struct {
+				Type string          `json:"type"`
+				Args json.RawMessage `json:"args"`
+			}
+			if json.Unmarshal(b[4:], &m) != nil {
+				continue
+			}
+			switch m.Type {
+			case "ack":
+				var a peers.AckArgs
+				if json.Unmarshal(m.Args, &a) == nil && a.Ref == ref {
+					id, err := strconv.Atoi(a.Body)
+					if err == nil {
+						lc.setPane(uint32(id))
+					}
+					opened = true
+					if onOpen != nil {
+						go onOpen()
+					}
+				}
+			case "nack":
+				var a peers.NAckArgs
+				if json.Unmarshal(m.Args, &a) == nil && a.Ref == ref {
+					done <- errors.New(a.Desc)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := in.Read(b)
+			if n > 0 {
+				p := b[:n]
+				for i, c := range p {
+					if c == detachKey {
+						if i > 0 {
+							lc.send(lc.pane(), p[:i])
+						}
+						done <- errDetached
+						return
+					}
+				}
+				if id := lc.pane(); id != 0 {
+					lc.send(id, append([]byte{}, p...))
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	err = <-done
+	lc.conn.Close()
+	return err
+}
+
+// runLocal runs a local client in the terminal
+func runLocal(typ string, args interface{}) error {
+	lc, err := dialAgent()
+	if err != nil {
+		return err
+	}
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("Failed to set the terminal to raw mode: %s", err)
+		}
+		defer terminal.Restore(fd, state)
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	resize := func() {
+		cols, rows, err := terminal.GetSize(fd)
+		if err == nil {
+			lc.resize(uint16(rows), uint16(cols))
+		}
+	}
+	// the pane follows our size, until another client resizes it
+	onOpen := func() {
+		resize()
+		for range winch {
+			resize()
+		}
+	}
+	err = lc.run(typ, args, os.Stdin, os.Stdout, onOpen)
+	if errors.Is(err, errDetached) {
+		fmt.Print("\r\n[detached]\r\n")
+		return nil
+	}
+	if err == nil {
+		fmt.Print("\r\n[exited]\r\n")
+	}
+	return err
+}
+
+// attachCMD attaches the terminal to a running pane
+func attachCMD(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("Usage: webexec attach <pane id>")
+	}
+	id, err := strconv.Atoi(c.Args().First())
+	if err != nil || id <= 0 {
+		return fmt.Errorf("Bad pane id: %q", c.Args().First())
+	}
+	return runLocal("reconnect_pane", peers.ReconnectPaneArgs{ID: id})
+}
+
+// newCMD runs a command, or the user's shell, in a new pane and attaches
+// the terminal to it
+func newCMD(c *cli.Context) error {
+	command := c.Args().Slice()
+	if len(command) == 0 {
+		command = []string{"*"}
+	}
+	args := peers.AddPaneArgs{Command: command, Rows: 24, Cols: 80}
+	cols, rows, err := terminal.GetSize(int(os.Stdin.Fd()))
+	if err == nil {
+		args.Rows = uint16(rows)
+		args.Cols = uint16(cols)
+	}
+	return runLocal("add_pane", args)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/fx/fxtest"
+)
+
+func TestLocalAttach(t *testing.T) {
+	logger := initTest(t)
+	lifecycle := fxtest.NewLifecycle(t)
+	conf := peers.Conf{
+		AckTimeout: time.Second,
+		Logger:     logger,
+	}
+	startParams := SocketStartParams{filepath.Join(t.TempDir(), "webexec.sock")}
+	_, err := StartSocketServer(lifecycle, NewSockServer(newServer(&conf), nil, conf.Logger), startParams)
+	require.NoError(t, err)
+	lifecycle.RequireStart()
+	defer lifecycle.RequireStop()
+	// the first client runs a command in a new pane
+	lc1, err := dialAgent()
+	require.NoError(t, err)
+	in1, inW1 := io.Pipe()
+	var out1 syncBuffer
+	opened := make(chan struct{})
+	done1 := make(chan error, 1)
+	go func() {
+		done1 <- lc1.run("add_pane", peers.AddPaneArgs{Rows: 24, Cols: 80,
+			Command: []string{"sh", "-c", "read l; echo got $l"}},
+			in1, &out1, func() { close(opened) })
+	}()
+	select {
+	case <-opened:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the pane")
+	}
+	require.NotZero(t, lc1.pane())
+	// a bad pane id is refused
+	lc, err := dialAgent()
+	require.NoError(t, err)
+	in, _ := io.Pipe()
+	err = lc.run("reconnect_pane", peers.ReconnectPaneArgs{ID: 9999}, in, io.Discard, nil)
+	require.Error(t, err)
+	// the second client attaches to the pane, types & detaches
+	lc2, err := dialAgent()
+	require.NoError(t, err)
+	in2, inW2 := io.Pipe()
+	var out2 syncBuffer
+	done2 := make(chan error, 1)
+	go func() {
+		done2 <- lc2.run("reconnect_pane",
+			peers.ReconnectPaneArgs{ID: int(lc1.pane())}, in2, &out2, nil)
+	}()
+	require.Eventually(t, func() bool { return lc2.pane() != 0 },
+		2*time.Second, 10*time.Millisecond)
+	_, err = inW2.Write([]byte("BADWOLF\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(out2.String(), "BADWOLF")
+	}, 2*time.Second, 10*time.Millisecond)
+	_, err = inW2.Write([]byte{detachKey})
+	require.NoError(t, err)
+	require.ErrorIs(t, <-done2, errDetached)
+	// the first client gets the output & the pane's exit
+	select {
+	case err = <-done1:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the pane to exit")
+	}
+	require.Contains(t, out1.String(), "got BADWOLF")
+	inW1.Close()
+}
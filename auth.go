@@ -2,9 +2,13 @@ package main
 
 import (
 	"bufio"
+	"crypto/subtle"
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/tuzig/webexec/httpserver"
+	"go.uber.org/zap"
 )
 
 // FileAuth is an authentication backend that checks tokens against a file of
@@ -29,12 +33,25 @@ func NewFileAuth(filepath string) *FileAuth {
 	return &FileAuth{TokensFilePath: filepath}
 }
 
+// NewTokenAuth returns the backend of the websocket clients' tokens, read
+// from authorized_tokens. Unlike fingerprints the tokens are secrets, so the
+// file is created readable only by the user.
+func NewTokenAuth() *FileAuth {
+	filepath := ConfPath("authorized_tokens")
+	f, err := os.OpenFile(filepath, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil
+	}
+	f.Close()
+	return &FileAuth{TokensFilePath: filepath}
+}
+
 // ReadAuthorizedTokens reads the tokens file and returns all the tokens in it
 func (a *FileAuth) ReadAuthorizedTokens() ([]string, error) {
 	var tokens []string
 	file, err := os.Open(a.TokensFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to open authorized_fingerprints: %w", err)
+		return nil, fmt.Errorf("Failed to open %s: %w", a.TokensFilePath, err)
 	}
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -56,7 +73,7 @@ func (a *FileAuth) ReadAuthorizedTokens() ([]string, error) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("Failed to read authorized_fingerprints: %s", err)
+		return nil, fmt.Errorf("Failed to read %s: %s", a.TokensFilePath, err)
 	}
 	return tokens, nil
 }
@@ -69,10 +86,22 @@ func (a *FileAuth) IsAuthorized(clientTokens ...string) bool {
 	}
 	for _, ct := range clientTokens {
 		for _, token := range tokens {
-			if token == ct {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(ct)) == 1 {
 				return true
 			}
 		}
 	}
 	return false
 }
+
+// SetWSTokens sets the tokens the websocket transport's clients are
+// authenticated with
+func SetWSTokens(h *httpserver.ConnectHandler, logger *zap.SugaredLogger) {
+	a := NewTokenAuth()
+	if a == nil {
+		logger.Warnf("Failed to open %s, websocket clients are refused",
+			ConfPath("authorized_tokens"))
+		return
+	}
+	h.SetTokens(a)
+}
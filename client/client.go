@@ -0,0 +1,545 @@
+// Package client connects to a webexec agent over WebRTC. It runs the
+// signaling, opens the command & control channel - aka cdc - and offers
+// typed methods for the control messages. Panes are returned as streams.
+// Once the cdc is open the client says hello, exchanging versions &
+// capabilities with the agent.
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/tuzig/webexec/peers"
+)
+
+// ErrClosed is returned when using a closed client
+var ErrClosed = errors.New("client is closed")
+
+// Handler answers a message the agent sent. The returned body is sent in an
+// ack, an error is sent as a nack.
+type Handler func(typ string, args json.RawMessage) (string, error)
+
+// Options holds the client's settings, all are optional
+type Options struct {
+	// Token is sent as a bearer token when using WHIP
+	Token string
+	// Certificate is the client's DTLS certificate, its fingerprint
+	// identifies the client. A new one is generated when nil.
+	Certificate *webrtc.Certificate
+	ICEServers  []webrtc.ICEServer
+	// HTTPClient is used for the WHIP requests
+	HTTPClient *http.Client
+	// OnMessage is called with the messages the agent sends, i.e.
+	// set_clipboard. When nil, the messages are nacked.
+	OnMessage Handler
+	// Version & Capabilities are sent to the agent in the hello message
+	Version      string
+	Capabilities []string
+	// Mux multiplexes the panes over one data channel, when the agent
+	// supports it
+	Mux bool
+}
+
+// reply is an ack or a nack
+type reply struct {
+	body string
+	err  error
+}
+
+// nackError is the error of a nacked message, holding its description
+type nackError string
+
+func (e nackError) Error() string { return string(e) }
+
+// Client is a connection to a webexec agent
+type Client struct {
+	opts Options
+	pc   *webrtc.PeerConnection
+	cdc  *webrtc.DataChannel
+	m    sync.Mutex
+	ref  int
+	// acks holds the channels waiting for replies, by message id
+	acks map[int]chan reply
+	// opening holds the channels waiting for panes, by message id
+	opening map[int]chan *Pane
+	panes   []*Pane
+	closed  chan struct{}
+	once    sync.Once
+	// hello is the agent's reply to the hello message
+	hello *peers.HelloArgs
+	// mux is the data channel the panes share, when using mux
+	mux      *webrtc.DataChannel
+	muxPanes map[uint32]*Pane
+}
+
+// newClient creates a client with a peer connection and a cdc, ready for
+// signaling
+func newClient(opts Options) (*Client, error) {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	config := webrtc.Configuration{ICEServers: opts.ICEServers}
+	if opts.Certificate != nil {
+		config.Certificates = []webrtc.Certificate{*opts.Certificate}
+	}
+	pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a peer connection: %s", err)
+	}
+	c := &Client{
+		opts:     opts,
+		pc:       pc,
+		acks:     make(map[int]chan reply),
+		opening:  make(map[int]chan *Pane),
+		closed:   make(chan struct{}),
+		muxPanes: make(map[uint32]*Pane),
+	}
+	c.cdc, err = pc.CreateDataChannel("%", nil)
+	if err != nil {
+		pc.Close()
+		return nil, fmt.Errorf("Failed to create the control channel: %s", err)
+	}
+	c.cdc.OnMessage(c.onMessage)
+	c.cdc.OnClose(func() { c.Close() })
+	pc.OnDataChannel(c.onDataChannel)
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateFailed ||
+			s == webrtc.PeerConnectionStateClosed {
+			c.Close()
+		}
+	})
+	return c, nil
+}
+
+// waitOpen waits for the cdc to open
+func (c *Client) waitOpen(ctx context.Context) error {
+	opened := make(chan struct{})
+	c.cdc.OnOpen(func() { close(opened) })
+	if c.cdc.ReadyState() == webrtc.DataChannelStateOpen {
+		return nil
+	}
+	select {
+	case <-opened:
+		return nil
+	case <-c.closed:
+		return fmt.Errorf("Failed to connect: %w", ErrClosed)
+	case <-ctx.Done():
+		return fmt.Errorf("Failed to open the control channel: %s", ctx.Err())
+	}
+}
+
+// sayHello exchanges versions & capabilities with the agent and starts
+// mux if the client asked for it. Agents that predate hello nack it and are
+// left with a nil Hello.
+func (c *Client) sayHello(ctx context.Context) error {
+	body, err := c.Send(ctx, "hello", peers.HelloArgs{
+		Version:      c.opts.Version,
+		Protocol:     peers.ProtocolRevision,
+		Capabilities: c.opts.Capabilities,
+	})
+	var nack nackError
+	if errors.As(err, &nack) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var hello peers.HelloArgs
+	err = json.Unmarshal([]byte(body), &hello)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the agent's hello: %s", err)
+	}
+	c.m.Lock()
+	c.hello = &hello
+	c.m.Unlock()
+	if c.opts.Mux {
+		return c.startMux(ctx)
+	}
+	return nil
+}
+
+// Hello returns the agent's version, protocol revision, capabilities and
+// the control messages it handles. It's nil for agents that predate the
+// hello message, using protocol revision 1.
+func (c *Client) Hello() *peers.HelloArgs {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.hello
+}
+
+// Done returns a channel that's closed when the client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Close closes the client & its panes
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.pc.Close()
+		c.m.Lock()
+		panes := c.panes
+		c.m.Unlock()
+		for _, p := range panes {
+			p.setEOF()
+		}
+	})
+	return err
+}
+
+// onDataChannel gets a pane's channel, labeled "<message id>:<pane id>",
+// or the mux channel
+func (c *Client) onDataChannel(d *webrtc.DataChannel) {
+	if d.Label() == peers.MuxLabel {
+		c.onMux(d)
+		return
+	}
+	pane := c.paneOpened(d.Label(), func(id int) *Pane { return newPane(id, d) })
+	if pane == nil {
+		d.Close()
+	}
+}
+
+// paneOpened passes the pane in the label, "<message id>:<pane id>", to the
+// one waiting for it. It returns nil if no one is waiting.
+func (c *Client) paneOpened(label string, newPane func(id int) *Pane) *Pane {
+	fields := strings.SplitN(label, ":", 2)
+	if len(fields) != 2 {
+		return nil
+	}
+	ref, err1 := strconv.Atoi(fields[0])
+	id, err2 := strconv.Atoi(fields[1])
+	c.m.Lock()
+	ch, found := c.opening[ref]
+	delete(c.opening, ref)
+	c.m.Unlock()
+	if err1 != nil || err2 != nil || !found {
+		return nil
+	}
+	pane := newPane(id)
+	c.m.Lock()
+	c.panes = append(c.panes, pane)
+	c.m.Unlock()
+	ch <- pane
+	return pane
+}
+
+// onMux gets the mux channel and demultiplexes its frames to the panes
+func (c *Client) onMux(d *webrtc.DataChannel) {
+	c.m.Lock()
+	c.mux = d
+	c.m.Unlock()
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if len(msg.Data) < 5 {
+			return
+		}
+		id := binary.BigEndian.Uint32(msg.Data[:4])
+		payload := msg.Data[5:]
+		switch msg.Data[4] {
+		case peers.FrameOpen:
+			pane := c.paneOpened(string(payload), func(paneID int) *Pane {
+				return newStreamPane(paneID,
+					func(b []byte) error {
+						return d.Send(peers.NewFrame(id, peers.FrameData, b))
+					},
+					func() error {
+						c.dropMuxPane(id)
+						return d.Send(peers.NewFrame(id, peers.FrameClose, nil))
+					})
+			})
+			if pane == nil {
+				d.Send(peers.NewFrame(id, peers.FrameClose, nil))
+				return
+			}
+			// a reconnect replaces the pane's stream
+			c.dropMuxPane(id)
+			c.m.Lock()
+			c.muxPanes[id] = pane
+			c.m.Unlock()
+		case peers.FrameData:
+			c.m.Lock()
+			pane := c.muxPanes[id]
+			c.m.Unlock()
+			if pane != nil {
+				pane.push(payload)
+			}
+		case peers.FrameClose:
+			c.dropMuxPane(id)
+		}
+	})
+	d.OnClose(func() {
+		c.m.Lock()
+		panes := c.muxPanes
+		c.muxPanes = make(map[uint32]*Pane)
+		c.mux = nil
+		c.m.Unlock()
+		for _, p := range panes {
+			p.setEOF()
+		}
+	})
+}
+
+// dropMuxPane ends the stream of a pane using mux
+func (c *Client) dropMuxPane(id uint32) {
+	c.m.Lock()
+	pane := c.muxPanes[id]
+	delete(c.muxPanes, id)
+	c.m.Unlock()
+	if pane != nil {
+		pane.setEOF()
+	}
+}
+
+// startMux asks the agent to multiplex the panes over one data channel
+func (c *Client) startMux(ctx context.Context) error {
+	hello := c.Hello()
+	if hello == nil || !slices.Contains(hello.Capabilities, peers.CapMux) {
+		return nil
+	}
+	_, err := c.Send(ctx, "mux", nil)
+	if err != nil {
+		return fmt.Errorf("Failed to start mux: %s", err)
+	}
+	return nil
+}
+
+// onMessage handles the messages the agent sends on the cdc
+func (c *Client) onMessage(msg webrtc.DataChannelMessage) {
+	var raw json.RawMessage
+	m := peers.CTRLMessage{Args: &raw}
+	if json.Unmarshal(msg.Data, &m) != nil {
+		return
+	}
+	switch m.Type {
+	case "ack":
+		var a peers.AckArgs
+		if json.Unmarshal(raw, &a) == nil {
+			c.reply(a.Ref, reply{body: a.Body})
+		}
+	case "nack":
+		var a peers.NAckArgs
+		if json.Unmarshal(raw, &a) == nil {
+			c.reply(a.Ref, reply{err: nackError(a.Desc)})
+		}
+	default:
+		go c.handle(m, raw)
+	}
+}
+
+// reply passes a reply to the one waiting for it
+func (c *Client) reply(ref int, r reply) {
+	c.m.Lock()
+	ch, found := c.acks[ref]
+	delete(c.acks, ref)
+	c.m.Unlock()
+	if found {
+		ch <- r
+	}
+}
+
+// handle answers a message the agent sent
+func (c *Client) handle(m peers.CTRLMessage, raw json.RawMessage) {
+	if c.opts.OnMessage == nil {
+		c.send("nack", peers.NAckArgs{Ref: m.Ref, Desc: "Unsupported message"})
+		return
+	}
+	body, err := c.opts.OnMessage(m.Type, raw)
+	if err != nil {
+		c.send("nack", peers.NAckArgs{Ref: m.Ref, Desc: err.Error()})
+		return
+	}
+	c.send("ack", peers.AckArgs{Ref: m.Ref, Body: body})
+}
+
+// send sends a control message and returns its id
+func (c *Client) send(typ string, args interface{}) (int, error) {
+	c.m.Lock()
+	c.ref++
+	ref := c.ref
+	c.m.Unlock()
+	return ref, c.sendRef(ref, typ, args)
+}
+
+func (c *Client) sendRef(ref int, typ string, args interface{}) error {
+	msg, err := json.Marshal(peers.CTRLMessage{
+		Time: time.Now().UnixNano() / 1000000, Ref: ref, Type: typ, Args: args})
+	if err != nil {
+		return fmt.Errorf("Failed to marshal %s message: %s", typ, err)
+	}
+	err = c.cdc.Send(msg)
+	if err != nil {
+		return fmt.Errorf("Failed to send %s message: %s", typ, err)
+	}
+	return nil
+}
+
+// Send sends a control message and waits for its ack. It returns the
+// ack's body or the nack's description as an error.
+func (c *Client) Send(ctx context.Context, typ string, args interface{}) (string, error) {
+	ch := make(chan reply, 1)
+	c.m.Lock()
+	c.ref++
+	ref := c.ref
+	c.acks[ref] = ch
+	c.m.Unlock()
+	body, err := c.wait(ctx, ref, typ, args, ch)
+	if err != nil {
+		c.m.Lock()
+		delete(c.acks, ref)
+		c.m.Unlock()
+	}
+	return body, err
+}
+
+func (c *Client) wait(ctx context.Context, ref int, typ string,
+	args interface{}, ch chan reply) (string, error) {
+
+	err := c.sendRef(ref, typ, args)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case r := <-ch:
+		return r.body, r.err
+	case <-c.closed:
+		return "", ErrClosed
+	case <-ctx.Done():
+		return "", fmt.Errorf("Timed out waiting for %s ack: %s", typ, ctx.Err())
+	}
+}
+
+// openPane sends a message that opens a pane and returns the pane's stream
+func (c *Client) openPane(ctx context.Context, typ string, args interface{}) (*Pane, error) {
+	ch := make(chan reply, 1)
+	paneCh := make(chan *Pane, 1)
+	c.m.Lock()
+	c.ref++
+	ref := c.ref
+	c.acks[ref] = ch
+	c.opening[ref] = paneCh
+	c.m.Unlock()
+	body, err := c.wait(ctx, ref, typ, args, ch)
+	if err != nil {
+		c.m.Lock()
+		delete(c.acks, ref)
+		delete(c.opening, ref)
+		c.m.Unlock()
+		return nil, err
+	}
+	// the agent acks once the pane's channel is open
+	select {
+	case pane := <-paneCh:
+		return pane, nil
+	case <-c.closed:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		c.m.Lock()
+		delete(c.opening, ref)
+		c.m.Unlock()
+		return nil, fmt.Errorf("Timed out waiting for pane %s: %s", body, ctx.Err())
+	}
+}
+
+// AddPane runs a command in a new pane. The command "*" runs the user's
+// shell.
+func (c *Client) AddPane(ctx context.Context, args peers.AddPaneArgs) (*Pane, error) {
+	return c.openPane(ctx, "add_pane", args)
+}
+
+// Reconnect connects to a running pane. The pane's buffer is replayed,
+// starting from the marker when the client restored one.
+func (c *Client) Reconnect(ctx context.Context, id int) (*Pane, error) {
+	return c.openPane(ctx, "reconnect_pane", peers.ReconnectPaneArgs{ID: id})
+}
+
+// Resize sets the size of a pane
+func (c *Client) Resize(ctx context.Context, paneID int, rows uint16, cols uint16) error {
+	_, err := c.Send(ctx, "resize", peers.ResizeArgs{PaneID: paneID, Sx: cols, Sy: rows})
+	return err
+}
+
+// Mark marks the panes' buffers and returns the marker. After
+// reconnecting, Restore with the marker gets only the output that followed it.
+func (c *Client) Mark(ctx context.Context) (int, error) {
+	body, err := c.Send(ctx, "mark", nil)
+	if err != nil {
+		return 0, err
+	}
+	marker, err := strconv.Atoi(body)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse the marker %q: %s", body, err)
+	}
+	return marker, nil
+}
+
+// Restore sets the marker the panes are replayed from and returns the
+// payload
+func (c *Client) Restore(ctx context.Context, marker int) (json.RawMessage, error) {
+	body, err := c.Send(ctx, "restore", peers.RestoreArgs{Marker: marker})
+	return rawBody(body), err
+}
+
+// GetPayload returns the payload clients share
+func (c *Client) GetPayload(ctx context.Context) (json.RawMessage, error) {
+	body, err := c.Send(ctx, "get_payload", nil)
+	return rawBody(body), err
+}
+
+// SetPayload sets the payload clients share
+func (c *Client) SetPayload(ctx context.Context, payload json.RawMessage) error {
+	_, err := c.Send(ctx, "set_payload", peers.SetPayloadArgs{Payload: payload})
+	return err
+}
+
+// GetLayout returns the panes' layout
+func (c *Client) GetLayout(ctx context.Context) (peers.Layout, error) {
+	var layout peers.Layout
+	body, err := c.Send(ctx, "get_layout", nil)
+	if err != nil {
+		return layout, err
+	}
+	err = json.Unmarshal([]byte(body), &layout)
+	if err != nil {
+		return layout, fmt.Errorf("Failed to parse the layout: %s", err)
+	}
+	return layout, nil
+}
+
+// SetLayout sets the panes' layout. version is the version of the layout
+// the change is based on.
+func (c *Client) SetLayout(ctx context.Context, version int, layout peers.Layout) error {
+	_, err := c.Send(ctx, "set_layout", peers.SetLayoutArgs{Version: version, Layout: layout})
+	return err
+}
+
+// EchoHints turns the pane's echo hints on or off
+func (c *Client) EchoHints(ctx context.Context, paneID int, enable bool) error {
+	_, err := c.Send(ctx, "echo_hints", peers.EchoHintsArgs{PaneID: paneID, Enable: enable})
+	return err
+}
+
+// Subscribe subscribes to the event types, replacing the current
+// subscription. The events are passed to OnMessage as "event" messages.
+func (c *Client) Subscribe(ctx context.Context, events ...string) error {
+	_, err := c.Send(ctx, "subscribe", peers.SubscribeArgs{Events: events})
+	return err
+}
+
+// rawBody returns an ack's body as json, nil when it's empty
+func rawBody(body string) json.RawMessage {
+	if body == "" {
+		return nil
+	}
+	return json.RawMessage(body)
+}
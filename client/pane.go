@@ -0,0 +1,82 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Pane is a stream of a pane running on the agent. Reads return the pane's
+// output and io.EOF once the pane exits or the stream is closed, writes are
+// sent as the pane's input.
+type Pane struct {
+	// ID is the pane's id on the agent
+	ID int
+	// send & close are the pane's data channel or mux stream methods
+	send  func([]byte) error
+	close func() error
+	m     sync.Mutex
+	c     *sync.Cond
+	buf   bytes.Buffer
+	eof   bool
+}
+
+// newPane returns a pane using its own data channel
+func newPane(id int, d *webrtc.DataChannel) *Pane {
+	p := newStreamPane(id, d.Send, d.Close)
+	d.OnMessage(func(msg webrtc.DataChannelMessage) { p.push(msg.Data) })
+	d.OnClose(p.setEOF)
+	return p
+}
+
+// newStreamPane returns a pane using the given methods to write & close
+func newStreamPane(id int, send func([]byte) error, close func() error) *Pane {
+	p := &Pane{ID: id, send: send, close: close}
+	p.c = sync.NewCond(&p.m)
+	return p
+}
+
+// push adds output to the pane
+func (p *Pane) push(b []byte) {
+	p.m.Lock()
+	p.buf.Write(b)
+	p.m.Unlock()
+	p.c.Broadcast()
+}
+
+func (p *Pane) setEOF() {
+	p.m.Lock()
+	p.eof = true
+	p.m.Unlock()
+	p.c.Broadcast()
+}
+
+// Read reads the pane's output
+func (p *Pane) Read(b []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	for p.buf.Len() == 0 && !p.eof {
+		p.c.Wait()
+	}
+	if p.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.buf.Read(b)
+}
+
+// Write sends input to the pane
+func (p *Pane) Write(b []byte) (int, error) {
+	err := p.send(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the stream, the pane keeps running on the agent
+func (p *Pane) Close() error {
+	p.setEOF()
+	return p.close()
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// PeerbookOptions holds the settings for connecting through peerbook
+type PeerbookOptions struct {
+	// Host is the peerbook server, i.e. "api.peerbook.io"
+	Host string
+	// UID is the peerbook user id. The client's certificate must be
+	// verified for this user.
+	UID string
+	// Name is the name the client uses in peerbook
+	Name string
+	// Insecure uses ws instead of wss
+	Insecure bool
+}
+
+// pbMessage is a signaling message from peerbook
+type pbMessage struct {
+	SourceFP  string                     `json:"source_fp"`
+	Answer    *webrtc.SessionDescription `json:"answer"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate"`
+}
+
+// DialPeerbook connects to the agent with the fingerprint fp, using the
+// peerbook server for signaling. It returns once the cdc is open and the
+// agent replied to the hello.
+func DialPeerbook(ctx context.Context, pb PeerbookOptions, fp string, opts Options) (*Client, error) {
+	if opts.Certificate == nil {
+		return nil, fmt.Errorf("Peerbook requires a verified certificate")
+	}
+	fps, err := opts.Certificate.GetFingerprints()
+	if err != nil || len(fps) == 0 {
+		return nil, fmt.Errorf("Failed to get the certificate's fingerprint: %v", err)
+	}
+	c, err := newClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Add("fp", peerbookFP(fps[0].Value))
+	params.Add("name", pb.Name)
+	params.Add("kind", "client")
+	params.Add("uid", pb.UID)
+	scheme := "wss"
+	if pb.Insecure {
+		scheme = "ws"
+	}
+	u := url.URL{Scheme: scheme, Host: pb.Host, Path: "/ws", RawQuery: params.Encode()}
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed to connect to peerbook: %s", err)
+	}
+	defer ws.Close()
+	var wm sync.Mutex
+	send := func(m map[string]interface{}) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		wm.Lock()
+		defer wm.Unlock()
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return ws.WriteMessage(websocket.TextMessage, b)
+	}
+	c.pc.OnICECandidate(func(can *webrtc.ICECandidate) {
+		if can != nil {
+			send(map[string]interface{}{"target": fp, "candidate": can.ToJSON()})
+		}
+	})
+	offer, err := c.pc.CreateOffer(nil)
+	if err == nil {
+		err = c.pc.SetLocalDescription(offer)
+	}
+	if err == nil {
+		err = send(map[string]interface{}{"target": fp, "offer": offer})
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed to send the offer: %s", err)
+	}
+	// peerbook is needed until the cdc opens, read it in the background
+	go func() {
+		for {
+			var m pbMessage
+			if ws.ReadJSON(&m) != nil {
+				return
+			}
+			if m.SourceFP != fp {
+				continue
+			}
+			if m.Answer != nil {
+				c.pc.SetRemoteDescription(*m.Answer)
+			}
+			if m.Candidate != nil {
+				c.pc.AddICECandidate(*m.Candidate)
+			}
+		}
+	}()
+	err = c.waitOpen(ctx)
+	if err == nil {
+		err = c.sayHello(ctx)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// peerbookFP returns the fingerprint the way peerbook uses it
+func peerbookFP(fp string) string {
+	return strings.ToUpper(strings.Replace(fp, ":", "", -1))
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// candidatesResponse is the agent's reply to a GET of the session's
+// candidates
+type candidatesResponse struct {
+	Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	Complete   bool                      `json:"complete"`
+}
+
+// Dial connects to the agent's http server, i.e. "https://host:7777", using
+// WHIP and returns once the cdc is open and the agent replied to the hello.
+// Candidates are trickled both ways.
+func Dial(ctx context.Context, url string, opts Options) (*Client, error) {
+	c, err := newClient(opts)
+	if err != nil {
+		return nil, err
+	}
+	err = c.whip(ctx, strings.TrimSuffix(url, "/"))
+	if err == nil {
+		err = c.waitOpen(ctx)
+	}
+	if err == nil {
+		err = c.sayHello(ctx)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// whip posts the offer and starts exchanging candidates
+func (c *Client) whip(ctx context.Context, url string) error {
+	var (
+		m        sync.Mutex
+		location string
+		pending  []webrtc.ICECandidateInit
+	)
+	c.pc.OnICECandidate(func(can *webrtc.ICECandidate) {
+		if can == nil {
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		if location == "" {
+			pending = append(pending, can.ToJSON())
+			return
+		}
+		go c.patchCandidate(ctx, location, can.ToJSON())
+	})
+	offer, err := c.pc.CreateOffer(&webrtc.OfferOptions{
+		OfferAnswerOptions: webrtc.OfferAnswerOptions{ICETricklingSupported: true}})
+	if err != nil {
+		return fmt.Errorf("Failed to create an offer: %s", err)
+	}
+	err = c.pc.SetLocalDescription(offer)
+	if err != nil {
+		return fmt.Errorf("Failed to set the local description: %s", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/offer",
+		strings.NewReader(offer.SDP))
+	if err != nil {
+		return fmt.Errorf("Failed to create the offer request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.Token)
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to send the offer: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to read the answer: %s", err)
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Offer failed: %s %s", resp.Status,
+			strings.TrimSpace(string(body)))
+	}
+	err = c.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer, SDP: string(body)})
+	if err != nil {
+		return fmt.Errorf("Failed to set the remote description: %s", err)
+	}
+	m.Lock()
+	location = resp.Header.Get("Location")
+	for _, can := range pending {
+		go c.patchCandidate(ctx, location, can)
+	}
+	m.Unlock()
+	go c.pollCandidates(location)
+	return nil
+}
+
+// patchCandidate sends a local candidate to the agent
+func (c *Client) patchCandidate(ctx context.Context, location string,
+	can webrtc.ICECandidateInit) {
+
+	b, err := json.Marshal(can)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "PATCH", location, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// pollCandidates adds the agent's candidates until gathering is complete
+func (c *Client) pollCandidates(location string) {
+	from := 0
+	for {
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+		resp, err := c.opts.HTTPClient.Get(fmt.Sprintf("%s?from=%d", location, from))
+		if err != nil {
+			return
+		}
+		var r candidatesResponse
+		err = json.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return
+		}
+		for _, can := range r.Candidates {
+			c.pc.AddICECandidate(can)
+		}
+		from += len(r.Candidates)
+		if r.Complete {
+			return
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/tuzig/webexec/httpserver"
 	"github.com/tuzig/webexec/peers"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
@@ -35,8 +37,11 @@ udp_port_max = 61000
 [timeouts]
 ack = 3000
 disconnect = 3000
+drain = 0
 failed = 6000
 ice_gathering = 5000
+ice_refresh = 3600000
+ice_restart = 30000
 keep_alive = 500
 peerbook = 3000
 [[ice_servers]]
@@ -56,55 +61,73 @@ type ICEServer struct {
 	URLs     []string `toml:"urls"`
 	Username string   `toml:"username,omitempty"`
 	Password string   `toml:"password,omitempty"`
+	// Secret is the shared secret of a TURN REST server. When set, every
+	// peer gets its own credentials, valid for TTL milliseconds.
+	Secret string `toml:"secret,omitempty"`
+	TTL    int64  `toml:"ttl,omitempty"`
 }
 
-// Conf hold the configuration variables
-var Conf struct {
+// AgentConf holds the agent's configuration
+type AgentConf struct {
 	logFilePath     string
 	logLevel        zapcore.Level
 	errFilePath     string
 	peerbookTimeout time.Duration
-	iceServers      []webrtc.ICEServer
+	drain           time.Duration
+	iceServers      []ICEServer
+	iceRefresh      time.Duration
 	peerbookHost    string
 	insecure        bool
 	peerbookUID     string
 	name            string
 	peerConf        *peers.Conf
+	httpOptions     *httpserver.ServerOptions
+	turn            *TURNConf
+	ice             *ICEConf
+	ssh             *SSHConf
 	T               *toml.Tree
+	// address is the address of the http server
+	address httpserver.AddressType
 }
 
 var emailRegex = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
-// parseConf loads a configuration from a toml string and fills all Conf value.
+// parseConf parses a configuration from a toml string.
 //
-//	If a key is missing LoadConf will load the default value
-func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
+//	If a key is missing the default value is used
+func parseConf(s string) (*AgentConf, error) {
 	t, err := toml.Load(s)
 	if err != nil {
-		return nil, "", fmt.Errorf("toml parsing failed: %s", err)
+		return nil, fmt.Errorf("toml parsing failed: %s", err)
 	}
-	Conf.T = t
-	Conf.logFilePath = logFilePath("log.file", "webexec.log")
-	Conf.errFilePath = logFilePath("log.error", "webexec.err")
-	Conf.logLevel = zapcore.ErrorLevel
-	v := Conf.T.Get("log.level")
+	conf := &AgentConf{T: t}
+	conf.logFilePath = logFilePath(t, "log.file", "webexec.log")
+	conf.errFilePath = logFilePath(t, "log.error", "webexec.err")
+	conf.logLevel = zapcore.ErrorLevel
+	v := conf.T.Get("log.level")
 	if v != nil {
 		l := v.(string)
 		if l == "info" {
-			Conf.logLevel = zapcore.InfoLevel
+			conf.logLevel = zapcore.InfoLevel
 		} else if l == "warn" {
-			Conf.logLevel = zapcore.WarnLevel
+			conf.logLevel = zapcore.WarnLevel
 		} else if l == "debug" {
-			Conf.logLevel = zapcore.DebugLevel
+			conf.logLevel = zapcore.DebugLevel
 		}
 	} else {
-		Conf.logLevel = zapcore.WarnLevel
+		conf.logLevel = zapcore.WarnLevel
 	}
 	v = t.Get("timeouts.peerbook")
 	if v != nil {
-		Conf.peerbookTimeout = time.Duration(v.(int64)) * time.Millisecond
+		conf.peerbookTimeout = time.Duration(v.(int64)) * time.Millisecond
 	} else {
-		Conf.peerbookTimeout = 3 * time.Second
+		conf.peerbookTimeout = 3 * time.Second
+	}
+	v = t.Get("timeouts.drain")
+	if v != nil {
+		conf.drain = time.Duration(v.(int64)) * time.Millisecond
+	} else {
+		conf.drain = 0
 	}
 	// start of peers configuration
 	peersConf := &peers.Conf{}
@@ -132,39 +155,64 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 	} else {
 		peersConf.GatheringTimeout = 3 * time.Second
 	}
+	v = t.Get("timeouts.ice_restart")
+	if v != nil {
+		peersConf.RestartTimeout = time.Duration(v.(int64)) * time.Millisecond
+	} else {
+		peersConf.RestartTimeout = 30 * time.Second
+	}
+	v = t.Get("timeouts.ice_refresh")
+	if v != nil {
+		conf.iceRefresh = time.Duration(v.(int64)) * time.Millisecond
+	} else {
+		conf.iceRefresh = time.Hour
+	}
 	v = t.Get("timeouts.ack")
 	if v != nil {
 		peersConf.AckTimeout = time.Duration(v.(int64)) * time.Millisecond
 	} else {
 		peersConf.AckTimeout = 3 * time.Second
 	}
+	v = t.Get("panes.resize_policy")
+	if v != nil {
+		peersConf.ResizePolicy = v.(string)
+		if !peers.ValidResizePolicy(peersConf.ResizePolicy) {
+			return nil, fmt.Errorf("Unknown resize policy: %q", peersConf.ResizePolicy)
+		}
+	}
 	v = t.Get("ice_servers")
 	if v != nil {
-		Conf.iceServers = []webrtc.ICEServer{}
+		conf.iceServers = []ICEServer{}
 		for _, u2 := range v.([]*toml.Tree) {
 			var u ICEServer
 			err := u2.Unmarshal(&u)
 			if err != nil {
-				return nil, "", fmt.Errorf("failed to parse ice server configuration: %s", err)
+				return nil, fmt.Errorf("failed to parse ice server configuration: %s", err)
 			}
-			s := webrtc.ICEServer{
-				URLs:           u.URLs,
-				Username:       u.Username,
-				Credential:     u.Password,
-				CredentialType: webrtc.ICECredentialTypePassword,
-			}
-			Conf.iceServers = append(Conf.iceServers, s)
+			conf.iceServers = append(conf.iceServers, u)
 		}
 	}
 	// no address is set, let's see if the conf file has it
-	var addr httpserver.AddressType
 	v = t.Get("net.http_server")
 	if v != nil {
-		addr = httpserver.AddressType(v.(string))
+		conf.address = httpserver.AddressType(v.(string))
 	} else {
 		// when no address is given, this is the default address
-		addr = defaultHTTPServer
+		conf.address = defaultHTTPServer
+	}
+	conf.httpOptions, err = parseHTTPOptions(t)
+	if err != nil {
+		return nil, err
+	}
+	conf.turn, err = parseTURNConf(t)
+	if err != nil {
+		return nil, err
+	}
+	conf.ice, err = parseICEConf(t)
+	if err != nil {
+		return nil, err
 	}
+	conf.ssh = parseSSHConf(t)
 	// get the udp ports
 	v = t.Get("net.udp_port_min")
 	if v != nil {
@@ -181,7 +229,7 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 	// unsecured cotrol which shema to use
 	v = t.Get("peerbook.insecure")
 	if v != nil {
-		Conf.insecure = v.(bool)
+		conf.insecure = v.(bool)
 	}
 	// get env vars
 	peersConf.Env = map[string]string{"WEBEXEC": GetSockFP()}
@@ -193,30 +241,152 @@ func parseConf(s string) (*peers.Conf, httpserver.AddressType, error) {
 	}
 	v = t.Get("peerbook.user_id")
 	if v != nil {
-		Conf.peerbookUID = v.(string)
+		conf.peerbookUID = v.(string)
 		host := t.Get("peerbook.host")
 		if host != nil {
-			Conf.peerbookHost = host.(string)
+			conf.peerbookHost = host.(string)
 		} else {
-			Conf.peerbookHost = defaultPeerbookHost
+			conf.peerbookHost = defaultPeerbookHost
 		}
 		name := t.Get("peerbook.name")
 		if name != nil {
-			Conf.name = name.(string)
+			conf.name = name.(string)
 		} else {
-			Conf.name, err = os.Hostname()
+			conf.name, err = os.Hostname()
 			if err != nil {
-				Logger.Warnf("Failed to get hostname, using `anonymous`")
-				name = "anonymous"
+				conf.name = "anonymous"
 			}
 		}
 	}
-	Conf.peerConf = peersConf
-	return peersConf, addr, nil
+	conf.peerConf = peersConf
+	return conf, nil
+}
+
+// parseHTTPOptions parses the http server's TLS & CORS configuration
+func parseHTTPOptions(t *toml.Tree) (*httpserver.ServerOptions, error) {
+	opts := &httpserver.ServerOptions{}
+	v := t.Get("net.cors_origins")
+	if v != nil {
+		for _, o := range v.([]interface{}) {
+			opts.CORSOrigins = append(opts.CORSOrigins, o.(string))
+		}
+	}
+	if v = t.Get("net.web_client"); v != nil {
+		opts.WebClient = v.(bool)
+	}
+	v = t.Get("net.tls")
+	if v == nil {
+		return opts, nil
+	}
+	tlsConf := &httpserver.TLSConf{}
+	tt := v.(*toml.Tree)
+	if v = tt.Get("self_signed"); v != nil {
+		tlsConf.SelfSigned = v.(bool)
+	}
+	if v = tt.Get("cert"); v != nil {
+		tlsConf.Cert = v.(string)
+	}
+	if v = tt.Get("key"); v != nil {
+		tlsConf.Key = v.(string)
+	}
+	if v = tt.Get("client_ca"); v != nil {
+		tlsConf.ClientCA = v.(string)
+	}
+	if tlsConf.SelfSigned {
+		if tlsConf.Cert == "" {
+			tlsConf.Cert = ConfPath("tls-cert.pem")
+		}
+		if tlsConf.Key == "" {
+			tlsConf.Key = ConfPath("tls-key.pem")
+		}
+	}
+	if tlsConf.Cert == "" || tlsConf.Key == "" {
+		return nil, fmt.Errorf("net.tls needs both cert & key or self_signed")
+	}
+	opts.TLS = tlsConf
+	return opts, nil
 }
 
-func logFilePath(path string, def string) string {
-	v := Conf.T.Get(path)
+// parseTURNConf parses the embedded TURN server's configuration. It returns
+// nil when the server is not configured.
+func parseTURNConf(t *toml.Tree) (*TURNConf, error) {
+	v := t.Get("turn.listen")
+	if v == nil {
+		return nil, nil
+	}
+	c := &TURNConf{
+		Listen:       v.(string),
+		Realm:        "webexec",
+		RelayPortMin: 61001,
+		RelayPortMax: 62000,
+		TTL:          10 * time.Minute,
+	}
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Bad turn.listen address %q: %s", c.Listen, err)
+	}
+	if v = t.Get("turn.public_ip"); v != nil {
+		c.PublicIP = v.(string)
+	} else if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		c.PublicIP = host
+	} else {
+		return nil, fmt.Errorf("turn.public_ip is required when listening on %q", c.Listen)
+	}
+	if v = t.Get("turn.realm"); v != nil {
+		c.Realm = v.(string)
+	}
+	if v = t.Get("turn.relay_port_min"); v != nil {
+		c.RelayPortMin = uint16(v.(int64))
+	}
+	if v = t.Get("turn.relay_port_max"); v != nil {
+		c.RelayPortMax = uint16(v.(int64))
+	}
+	if v = t.Get("turn.ttl"); v != nil {
+		c.TTL = time.Duration(v.(int64)) * time.Millisecond
+	}
+	return c, nil
+}
+
+// parseSSHConf parses the ssh section. It returns nil when the ssh server
+// is disabled.
+func parseSSHConf(t *toml.Tree) *SSHConf {
+	v := t.Get("ssh.listen")
+	if v == nil {
+		return nil
+	}
+	c := &SSHConf{
+		Listen:         v.(string),
+		HostKey:        ConfPath("ssh_host_key"),
+		AuthorizedKeys: ConfPath("authorized_keys"),
+	}
+	if v = t.Get("ssh.host_key"); v != nil {
+		c.HostKey = v.(string)
+	}
+	if v = t.Get("ssh.authorized_keys"); v != nil {
+		c.AuthorizedKeys = v.(string)
+	}
+	return c
+}
+
+// GetHTTPOptions returns the http server's options
+func GetHTTPOptions(conf *AgentConf) *httpserver.ServerOptions {
+	return conf.httpOptions
+}
+
+// HTTPAddress returns the address of the http server
+func HTTPAddress(conf *AgentConf) httpserver.AddressType {
+	return conf.address
+}
+
+// PeersConf returns the configuration of the peers, logging to the logger
+func PeersConf(conf *AgentConf, logger *zap.SugaredLogger) *peers.Conf {
+	conf.peerConf.Logger = logger
+	conf.peerConf.GetWelcome = func() string { return GetWelcome(logger) }
+	return conf.peerConf
+}
+
+func logFilePath(t *toml.Tree, path string, def string) string {
+	v := t.Get(path)
 	if v == nil {
 		return LogPath(def)
 	}
@@ -227,30 +397,25 @@ func logFilePath(path string, def string) string {
 	return ret
 }
 
-// loadConf load the conf file
-func LoadConf(certs []webrtc.Certificate) (*peers.Conf, httpserver.AddressType, error) {
+// LoadConf loads the conf file
+func LoadConf(certs []webrtc.Certificate) (*AgentConf, error) {
 	confPath := ConfPath("webexec.conf")
 	_, err := os.Stat(confPath)
 	if os.IsNotExist(err) {
-		return nil, "", fmt.Errorf("Missing conf file, run `webexec init` to create")
+		return nil, fmt.Errorf("Missing conf file, run `webexec init` to create")
 	}
 	b, err := ioutil.ReadFile(confPath)
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to read conf file %q: %s", confPath,
+		return nil, fmt.Errorf("Failed to read conf file %q: %s", confPath,
 			err)
 	}
-	conf, addr, err := parseConf(string(b))
+	conf, err := parseConf(string(b))
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to parse conf file %q: %s", confPath,
+		return nil, fmt.Errorf("Failed to parse conf file %q: %s", confPath,
 			err)
 	}
-	conf.Certificate = &certs[0]
-	conf.Logger = Logger
-	conf.GetICEServers = GetICEServers
-	conf.GetWelcome = GetWelcome
-	conf.OnCTRLMsg = handleCTRLMsg
-
-	return conf, addr, err
+	conf.peerConf.Certificate = &certs[0]
+	return conf, nil
 }
 
 func isValidEmail(email string) bool {
@@ -300,6 +465,29 @@ func RunPath(suffix string) string {
 	return filepath.Join(dir, suffix)
 }
 
+// LayoutPath returns the full path of the file the layout is saved in.
+// It includes the host name as the home directory can be shared.
+func LayoutPath() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return RunPath(fmt.Sprintf("layout-%s.json", host))
+}
+
+// LoadLayout loads the server's saved layout and sends its changes to all
+// the server's peers
+func LoadLayout(server *peers.Server, logger *zap.SugaredLogger) error {
+	server.Layout.OnChange = func(l peers.Layout) {
+		server.BroadcastAll("layout", l)
+	}
+	err := server.Layout.Load(LayoutPath())
+	if err != nil {
+		logger.Warnf("Failed to load the layout: %s", err)
+	}
+	return nil
+}
+
 // LogPath returns the full path of a run file: socket & pid
 func LogPath(suffix string) string {
 	usr, _ := user.Current()
@@ -8,7 +8,37 @@ import (
 )
 
 func TestConfEnv(t *testing.T) {
-	initTest(t)
-	require.EqualValues(t, Conf.peerConf.Env["TERM"], "xterm-256color")
-	require.EqualValues(t, Conf.peerConf.Env["COLORTERM"], "truecolor")
+	conf, err := parseConf(defaultConf)
+	require.NoError(t, err)
+	require.Equal(t, "0.0.0.0:7777", string(conf.address))
+	require.EqualValues(t, conf.peerConf.Env["TERM"], "xterm-256color")
+	require.EqualValues(t, conf.peerConf.Env["COLORTERM"], "truecolor")
+}
+
+func TestConfTLS(t *testing.T) {
+	conf, err := parseConf(defaultConf)
+	require.NoError(t, err)
+	require.Nil(t, conf.httpOptions.TLS)
+	conf, err = parseConf(`[net]
+cors_origins = [ "https://terminal7.dev" ]
+[net.tls]
+cert = "/tmp/cert.pem"
+key = "/tmp/key.pem"
+client_ca = "/tmp/ca.pem"
+`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://terminal7.dev"}, conf.httpOptions.CORSOrigins)
+	require.Equal(t, "/tmp/cert.pem", conf.httpOptions.TLS.Cert)
+	require.Equal(t, "/tmp/key.pem", conf.httpOptions.TLS.Key)
+	require.Equal(t, "/tmp/ca.pem", conf.httpOptions.TLS.ClientCA)
+	_, err = parseConf("[net.tls]\ncert = \"/tmp/cert.pem\"\n")
+	require.Error(t, err)
+}
+
+func TestConfResizePolicy(t *testing.T) {
+	conf, err := parseConf("[panes]\nresize_policy = \"smallest\"\n")
+	require.NoError(t, err)
+	require.Equal(t, "smallest", conf.peerConf.ResizePolicy)
+	_, err = parseConf("[panes]\nresize_policy = \"biggest\"\n")
+	require.Error(t, err)
 }
@@ -0,0 +1,191 @@
+// This file holds the connect command, a terminal client of a remote agent
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tuzig/webexec/client"
+	"github.com/tuzig/webexec/peers"
+	"github.com/urfave/cli/v2"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// connectTimeout is the time to connect & open the pane
+const connectTimeout = 30 * time.Second
+
+// agentURL returns the url of the agent's http server, the default is plain
+// http on port 7777
+func agentURL(host string) string {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	scheme := strings.SplitN(host, "://", 2)
+	if !strings.Contains(scheme[1], ":") {
+		host += ":7777"
+	}
+	return host
+}
+
+// onAgentMessage handles the messages the agent sends. The clipboard is
+// set using OSC 52 so it's the local terminal that sets it.
+func onAgentMessage(typ string, raw json.RawMessage) (string, error) {
+	if typ != "set_clipboard" {
+		return "", fmt.Errorf("Unsupported message: %s", typ)
+	}
+	var args peers.SetClipboardArgs
+	err := json.Unmarshal(raw, &args)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse set_clipboard args: %s", err)
+	}
+	fmt.Printf("\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(args.Data)))
+	return "", nil
+}
+
+// dialRemote connects to the remote agent, using its http server or peerbook
+func dialRemote(ctx context.Context, c *cli.Context, host string) (*client.Client, error) {
+	certs, err := GetCerts()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the certificates: %s", err)
+	}
+	opts := client.Options{
+		Token:       c.String("token"),
+		Certificate: &certs[0],
+		OnMessage:   onAgentMessage,
+		Version:     version,
+	}
+	if !c.Bool("peerbook") {
+		if c.Bool("insecure") {
+			opts.HTTPClient = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		}
+		return client.Dial(ctx, agentURL(host), opts)
+	}
+	conf, err := LoadConf(certs)
+	if err != nil {
+		return nil, err
+	}
+	if conf.peerbookUID == "" {
+		return nil, fmt.Errorf("Peerbook is not configured, run `webexec init`")
+	}
+	opts.ICEServers, err = NewICEServers(conf, zap.NewNop().Sugar()).Get()
+	if err != nil {
+		return nil, err
+	}
+	return client.DialPeerbook(ctx, client.PeerbookOptions{
+		Host:     conf.peerbookHost,
+		UID:      conf.peerbookUID,
+		Name:     conf.name,
+		Insecure: conf.insecure,
+	}, strings.ToUpper(strings.Replace(host, ":", "", -1)), opts)
+}
+
+// connectCMD opens a pane on a remote agent and attaches the terminal to it
+func connectCMD(c *cli.Context) error {
+	if c.NArg() < 1 {
+		return fmt.Errorf("Usage: webexec connect <host> [command [args...]]")
+	}
+	fd := int(os.Stdin.Fd())
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	rc, err := dialRemote(ctx, c, c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var pane *client.Pane
+	if c.IsSet("attach") {
+		pane, err = rc.Reconnect(ctx, c.Int("attach"))
+	} else {
+		command := c.Args().Tail()
+		if len(command) == 0 {
+			command = []string{"*"}
+		}
+		args := peers.AddPaneArgs{Command: command, Rows: 24, Cols: 80}
+		cols, rows, sizeErr := terminal.GetSize(fd)
+		if sizeErr == nil {
+			args.Rows = uint16(rows)
+			args.Cols = uint16(cols)
+		}
+		pane, err = rc.AddPane(ctx, args)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open a pane: %s", err)
+	}
+	if terminal.IsTerminal(fd) {
+		state, err := terminal.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("Failed to set the terminal to raw mode: %s", err)
+		}
+		defer terminal.Restore(fd, state)
+	}
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+	go func() {
+		for range winch {
+			cols, rows, err := terminal.GetSize(fd)
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				rc.Resize(ctx, pane.ID, uint16(rows), uint16(cols))
+				cancel()
+			}
+		}
+	}()
+	if c.IsSet("attach") {
+		winch <- syscall.SIGWINCH
+	}
+	err = pipePane(pane, os.Stdin, os.Stdout)
+	if errors.Is(err, errDetached) {
+		fmt.Printf("\r\n[detached from pane %d]\r\n", pane.ID)
+		return nil
+	}
+	fmt.Print("\r\n[exited]\r\n")
+	return err
+}
+
+// pipePane copies in to the pane and the pane to out until the pane exits
+// or the user detaches
+func pipePane(pane io.ReadWriteCloser, in io.Reader, out io.Writer) error {
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(out, pane)
+		done <- err
+	}()
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := in.Read(b)
+			if n > 0 {
+				i := bytes.IndexByte(b[:n], detachKey)
+				if i >= 0 {
+					if i > 0 {
+						pane.Write(b[:i])
+					}
+					done <- errDetached
+					return
+				}
+				_, err = pane.Write(b[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	err := <-done
+	pane.Close()
+	return err
+}
@@ -8,121 +8,259 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/riywo/loginshell"
 	"github.com/tuzig/webexec/peers"
+	"github.com/tuzig/webexec/tmux"
+	"go.uber.org/zap"
 )
 
 // handleResize handles resize control messages.
-func handleResize(peer *peers.Peer, m peers.CTRLMessage, rawArgs json.RawMessage) {
-	var resizeArgs peers.ResizeArgs
-	err := json.Unmarshal(rawArgs, &resizeArgs)
-	if err != nil {
-		Logger.Infof("Failed to parse incoming control message: %v", err)
-		return
-	}
+func (h *ctrlHandlers) handleResize(peer *peers.Peer, m peers.CTRLMessage, resizeArgs peers.ResizeArgs) {
 	cID := resizeArgs.PaneID
-	pane := peers.Panes.Get(cID)
+	pane := peer.Server.Panes.Get(cID)
 	if pane == nil {
-		Logger.Error("Failed to parse resize message pane_id out of range")
+		h.logger.Error("Failed to parse resize message pane_id out of range")
 		return
 	}
 	if pane.TTY == nil {
-		Logger.Warnf("Tried to resize a pane with no tty")
+		h.logger.Warnf("Tried to resize a pane with no tty")
 		peer.SendNack(m, "Tried to resize a pane with no tty")
 		return
 	}
-	var ws pty.Winsize
-	ws.Cols = resizeArgs.Sx
-	ws.Rows = resizeArgs.Sy
-	pane.Resize(&ws)
-	err = peer.Broadcast("resize", resizeArgs)
+	// the pane's resize policy decides its size, sent to the other peers
+	size := pane.SetViewport(peer, &pty.Winsize{Rows: resizeArgs.Sy,
+		Cols: resizeArgs.Sx, X: resizeArgs.X, Y: resizeArgs.Y})
+	body, err := json.Marshal(peers.ResizeArgs{PaneID: pane.ID,
+		Sx: size.Cols, Sy: size.Rows, X: size.X, Y: size.Y})
+	if err != nil {
+		h.logger.Errorf("Failed to marshal the pane's size: %v", err)
+		peer.SendNack(m, "Failed to marshal the pane's size")
+		return
+	}
+	err = peer.SendAck(m, string(body))
+	if err != nil {
+		h.logger.Errorf("#%d: Failed to send a resize ack: %v", peer.FP, err)
+	}
+}
+
+// handleEchoHints handles echo_hints control messages.
+// The ack's body holds the pane's current echo hint.
+func (h *ctrlHandlers) handleEchoHints(peer *peers.Peer, m peers.CTRLMessage, args peers.EchoHintsArgs) {
+	pane := peer.Server.Panes.Get(args.PaneID)
+	if pane == nil {
+		peer.SendNack(m, fmt.Sprintf("Unknown pane: %d", args.PaneID))
+		return
+	}
+	seq := pane.SetEchoHints(peer, args.Enable)
+	hint, err := json.Marshal(pane.EchoHint(seq))
+	if err != nil {
+		h.logger.Errorf("Failed to marshal echo hint: %v", err)
+		peer.SendNack(m, "Failed to marshal echo hint")
+		return
+	}
+	err = peer.SendAck(m, string(hint))
+	if err != nil {
+		h.logger.Errorf("#%d: Failed to send echo_hints ack: %v", peer.FP, err)
+	}
+}
+
+// ctrlHandlers handles webexec's control messages of a server. Every server
+// has its own tmux sessions as pane ids are unique only in a server.
+type ctrlHandlers struct {
+	logger      *zap.SugaredLogger
+	controllers *tmux.Registry
+}
+
+func newCTRLHandlers(logger *zap.SugaredLogger) *ctrlHandlers {
+	return &ctrlHandlers{logger: logger, controllers: tmux.NewRegistry()}
+}
+
+// handleAttach handles tmux_attach control messages.
+// The ack's body holds the session's layout.
+func (h *ctrlHandlers) handleAttach(peer *peers.Peer, m peers.CTRLMessage, args peers.TmuxAttachArgs) {
+	var ws *pty.Winsize
+	if args.Session == "" {
+		peer.SendNack(m, "Missing tmux session")
+		return
+	}
+	if args.Rows > 0 && args.Cols > 0 {
+		ws = &pty.Winsize{Rows: args.Rows, Cols: args.Cols}
+	}
+	c, err := h.controllers.Attach(peer, args.Session, ws, tmuxLayoutPublisher(peer))
+	if err != nil {
+		h.logger.Warnf("Failed to attach to tmux session %q: %s", args.Session, err)
+		peer.SendNack(m, fmt.Sprintf("Failed to attach to tmux: %s", err))
+		return
+	}
+	layout, err := json.Marshal(c.Layout())
+	if err != nil {
+		h.logger.Errorf("Failed to marshal tmux layout: %v", err)
+		peer.SendNack(m, "Failed to marshal tmux layout")
+		return
+	}
+	err = peer.SendAck(m, string(layout))
 	if err != nil {
-		Logger.Errorf("Failed to broadcast resize message: %v", err)
-		peer.SendNack(m, "Failed to broadcast resize message")
+		h.logger.Errorf("#%s: Failed to send tmux_attach ack: %v", peer.FP, err)
+	}
+}
+
+// tmuxLayoutPublisher returns a function that sends tmux layout changes to
+// all the connected peers
+func tmuxLayoutPublisher(peer *peers.Peer) func(*tmux.Controller, tmux.Layout) {
+	return func(_ *tmux.Controller, layout tmux.Layout) {
+		peer.Server.BroadcastAll("tmux_layout", layout)
+	}
+}
+
+// handleSplit handles tmux_split control messages.
+func (h *ctrlHandlers) handleSplit(peer *peers.Peer, m peers.CTRLMessage, args peers.TmuxSplitArgs) {
+	c, tmuxID := h.controllers.ForPane(args.PaneID)
+	if c == nil {
+		peer.SendNack(m, fmt.Sprintf("Not a tmux pane: %d", args.PaneID))
+		return
+	}
+	if args.Type != "topbottom" && args.Type != "leftright" {
+		peer.SendNack(m, fmt.Sprintf("Unknown split type: %q", args.Type))
+		return
+	}
+	err := c.Split(tmuxID, args.Type == "topbottom", args.Size)
+	if err != nil {
+		peer.SendNack(m, fmt.Sprintf("Failed to split pane: %s", err))
 		return
 	}
 	err = peer.SendAck(m, "")
 	if err != nil {
-		Logger.Errorf("#%d: Failed to send a resize ack: %v", peer.FP, err)
+		h.logger.Errorf("#%s: Failed to send tmux_split ack: %v", peer.FP, err)
 	}
 }
 
-// handleRestore handles restore control messages.
-func handleRestore(peer *peers.Peer, m peers.CTRLMessage, rawArgs json.RawMessage) {
-	var args peers.RestoreArgs
-	err := json.Unmarshal(rawArgs, &args)
+// handleZoom handles tmux_zoom control messages.
+func (h *ctrlHandlers) handleZoom(peer *peers.Peer, m peers.CTRLMessage, args peers.TmuxZoomArgs) {
+	c, tmuxID := h.controllers.ForPane(args.PaneID)
+	if c == nil {
+		peer.SendNack(m, fmt.Sprintf("Not a tmux pane: %d", args.PaneID))
+		return
+	}
+	err := c.Zoom(tmuxID)
 	if err != nil {
-		Logger.Infof("Failed to parse incoming control message: %v", err)
+		peer.SendNack(m, fmt.Sprintf("Failed to zoom pane: %s", err))
 		return
 	}
+	err = peer.SendAck(m, "")
+	if err != nil {
+		h.logger.Errorf("#%s: Failed to send tmux_zoom ack: %v", peer.FP, err)
+	}
+}
+
+// handleRestore handles restore control messages.
+// The ack's body holds the layout for clients with the layout capability
+// and the deprecated payload for the rest.
+func (h *ctrlHandlers) handleRestore(peer *peers.Peer, m peers.CTRLMessage, args peers.RestoreArgs) {
 	peer.Marker = args.Marker
-	err = peer.SendAck(m, string(peers.Payload))
+	body := peer.Server.Payload()
+	if peer.HasCapability(peers.CapLayout) {
+		var err error
+		body, err = json.Marshal(peer.Server.Layout.Get())
+		if err != nil {
+			h.logger.Errorf("Failed to marshal layout: %v", err)
+			peer.SendNack(m, "Failed to marshal layout")
+			return
+		}
+	}
+	err := peer.SendAck(m, string(body))
 	if err != nil {
-		Logger.Errorf("#%d: Failed to send restore ack: %v", peer.FP, err)
+		h.logger.Errorf("#%d: Failed to send restore ack: %v", peer.FP, err)
 	}
 }
 
 // handleGetPayload handles get_payload control messages.
-func handleGetPayload(peer *peers.Peer, m peers.CTRLMessage) {
-	err := peer.SendAck(m, string(peers.Payload))
+func (h *ctrlHandlers) handleGetPayload(peer *peers.Peer, m peers.CTRLMessage, _ json.RawMessage) {
+	err := peer.SendAck(m, string(peer.Server.Payload()))
 	if err != nil {
-		Logger.Errorf("#%d: Failed to send get_payload ack: %v", peer.FP, err)
+		h.logger.Errorf("#%d: Failed to send get_payload ack: %v", peer.FP, err)
 	}
 }
 
 // handleSetPayload handles set_payload control messages.
-func handleSetPayload(peer *peers.Peer, m peers.CTRLMessage, rawArgs json.RawMessage) {
-	var payloadArgs peers.SetPayloadArgs
-	err := json.Unmarshal(rawArgs, &payloadArgs)
+func (h *ctrlHandlers) handleSetPayload(peer *peers.Peer, m peers.CTRLMessage, payloadArgs peers.SetPayloadArgs) {
+	peer.Server.SetPayload(payloadArgs.Payload)
+	// send the set_payload message to all connected peers
+	peer.Broadcast("set_payload", payloadArgs)
+	err := peer.SendAck(m, string(peer.Server.Payload()))
 	if err != nil {
-		Logger.Infof("Failed to parse incoming control message: %v", err)
+		h.logger.Errorf("#%d: Failed to send set_payload ack: %v", peer.FP, err)
+	}
+}
+
+// handleGetLayout handles get_layout control messages.
+// The ack's body holds the layout.
+func (h *ctrlHandlers) handleGetLayout(peer *peers.Peer, m peers.CTRLMessage, _ json.RawMessage) {
+	layout, err := json.Marshal(peer.Server.Layout.Get())
+	if err != nil {
+		h.logger.Errorf("Failed to marshal layout: %v", err)
+		peer.SendNack(m, "Failed to marshal layout")
 		return
 	}
-	peers.Payload = payloadArgs.Payload
-	// send the set_payload message to all connected peers
-	peer.Broadcast("set_payload", payloadArgs)
-	err = peer.SendAck(m, string(peers.Payload))
+	err = peer.SendAck(m, string(layout))
 	if err != nil {
-		Logger.Errorf("#%d: Failed to send set_payload ack: %v", peer.FP, err)
+		h.logger.Errorf("#%s: Failed to send get_layout ack: %v", peer.FP, err)
+	}
+}
+
+// handleSetLayout handles set_layout control messages.
+// The update fails if the layout was changed since the version in the
+// message. On success all peers get a layout message and the ack's body
+// holds the new layout.
+func (h *ctrlHandlers) handleSetLayout(peer *peers.Peer, m peers.CTRLMessage, args peers.SetLayoutArgs) {
+	l, err := peer.Server.Layout.Set(args.Version, args.Layout)
+	if err != nil {
+		h.logger.Warnf("Failed to set layout: %s", err)
+		peer.SendNack(m, err.Error())
+		return
+	}
+	layout, err := json.Marshal(l)
+	if err != nil {
+		h.logger.Errorf("Failed to marshal layout: %v", err)
+		peer.SendNack(m, "Failed to marshal layout")
+		return
+	}
+	err = peer.SendAck(m, string(layout))
+	if err != nil {
+		h.logger.Errorf("#%s: Failed to send set_layout ack: %v", peer.FP, err)
 	}
 }
 
 // handlemark handles mark control messages.
-func handleMark(peer *peers.Peer, m peers.CTRLMessage) {
-	markerM.Lock()
-	lastMarker++
-	peer.Marker = lastMarker
-	markerM.Unlock()
-	for _, pane := range peers.Panes.All() {
+func (h *ctrlHandlers) handleMark(peer *peers.Peer, m peers.CTRLMessage, _ json.RawMessage) {
+	peer.Marker = peer.Server.NextMarker()
+	for _, pane := range peer.Server.Panes.All() {
 		pane.Buffer.Mark(peer.Marker)
 	}
 	err := peer.SendAck(m, fmt.Sprintf("%d", peer.Marker))
 	if err != nil {
-		Logger.Errorf("#%d: Failed to send mark ack: %v", peer.FP, err)
+		h.logger.Errorf("#%d: Failed to send mark ack: %v", peer.FP, err)
 	}
 }
 
 // handleReconnectPane handles reconnect_pane control messages.
-func handleReconnectPane(peer *peers.Peer, m peers.CTRLMessage, raw json.RawMessage) {
-	var a peers.ReconnectPaneArgs
-	t := true
-	dcOpts := &webrtc.DataChannelInit{Ordered: &t}
-	err := json.Unmarshal(raw, &a)
+func (h *ctrlHandlers) handleReconnectPane(peer *peers.Peer, m peers.CTRLMessage, a peers.ReconnectPaneArgs) {
+	h.logger.Infof("@%d: got reconnect_pane", a.ID)
+	compressor, err := peers.NewCompressor(a.Compression)
 	if err != nil {
-		Logger.Infof("Failed to parse incoming control message: %v", err)
+		h.logger.Warnf("Failed to reconnect pane: %s", err)
+		peer.SendNack(m, err.Error())
 		return
 	}
-	Logger.Infof("@%d: got reconnect_pane", a.ID)
 
 	l := fmt.Sprintf("%d:%d", m.Ref, a.ID)
-	d, err := peer.PC.CreateDataChannel(l, dcOpts)
+	d, err := peer.CreateChannel(l)
 	if err != nil {
-		Logger.Warnf("Failed to create data channel : %v", err)
+		h.logger.Warnf("Failed to create data channel : %v", err)
 		return
 	}
 	d.OnOpen(func() {
-		Logger.Info("open is completed!!!")
-		pane, err := peer.Reconnect(d, a.ID)
+		h.logger.Info("open is completed!!!")
+		pane, err := peer.Reconnect(d, a.ID, compressor)
 		if err != nil || pane == nil {
-			Logger.Warnf("Failed to reconnect to pane  data channel : %v", err)
+			h.logger.Warnf("Failed to reconnect to pane  data channel : %v", err)
 			peer.SendNack(m, fmt.Sprintf("Failed to reconnect to: %d", a.ID))
 			return
 		} else {
@@ -130,66 +268,76 @@ func handleReconnectPane(peer *peers.Peer, m peers.CTRLMessage, raw json.RawMess
 		}
 	})
 }
-func handleAddPane(peer *peers.Peer, m peers.CTRLMessage, raw json.RawMessage) {
-	var a peers.AddPaneArgs
+func (h *ctrlHandlers) handleAddPane(peer *peers.Peer, m peers.CTRLMessage, a peers.AddPaneArgs) {
 	var ws *pty.Winsize
-	t := true
-	dcOpts := &webrtc.DataChannelInit{Ordered: &t}
-	err := json.Unmarshal(raw, &a)
-	if err != nil {
-		Logger.Infof("Failed to parse incoming control message: %v", err)
-		return
-	}
-	Logger.Infof("got add_pane: %v", a)
+	h.logger.Infof("got add_pane: %v", a)
 	if a.Rows > 0 && a.Cols > 0 {
 		ws = &pty.Winsize{Rows: a.Rows, Cols: a.Cols, X: a.X, Y: a.Y}
 	} else {
 		ws = &pty.Winsize{Rows: 24, Cols: 80}
-		Logger.Warn("Got an add_pane commenad with no rows or cols")
+		h.logger.Warn("Got an add_pane commenad with no rows or cols")
 	}
 
 	if a.Command[0] == "*" {
 		shell, err := loginshell.Shell()
 		if err != nil {
-			Logger.Warnf("Failed to determine user's shell: %v", err)
+			h.logger.Warnf("Failed to determine user's shell: %v", err)
 			a.Command[0] = "/bin/bash"
 		} else {
-			Logger.Infof("Using %s for shell", shell)
+			h.logger.Infof("Using %s for shell", shell)
 			a.Command[0] = shell
 		}
 	}
 	cmd := a.Command
+	if !peers.ValidResizePolicy(a.ResizePolicy) {
+		peer.SendNack(m, fmt.Sprintf("Unknown resize policy: %q", a.ResizePolicy))
+		return
+	}
+	compressor, err := peers.NewCompressor(a.Compression)
+	if err != nil {
+		h.logger.Warnf("Failed to add a new pane: %s", err)
+		peer.SendNack(m, err.Error())
+		return
+	}
 	pane, err := peers.NewPane(peer, ws, a.Parent)
 	if err != nil {
-		Logger.Warnf("Failed to add a new pane: %v", err)
+		h.logger.Warnf("Failed to add a new pane: %v", err)
 		return
 	}
+	pane.ResizePolicy = a.ResizePolicy
 	l := fmt.Sprintf("%d:%d", m.Ref, pane.ID)
-	d, err := peer.PC.CreateDataChannel(l, dcOpts)
+	d, err := peer.CreateChannel(l)
 	if err != nil {
 		msg := fmt.Sprintf("Failed to create data channel : %s", l)
 		peer.SendNack(m, msg)
-		Logger.Warnf(msg)
+		h.logger.Warnf(msg)
 		return
 	}
 	d.OnOpen(func() {
+		c := peer.Server.CDB.AddCompressed(d, pane, peer, compressor)
+		pane.SetViewport(peer, ws)
 		if peer.Conf.GetWelcome != nil {
 			msg := peer.Conf.GetWelcome()
-			Logger.Infof("Sending welcome message: %s", msg)
-			err := d.Send([]byte(msg))
+			h.logger.Infof("Sending welcome message: %s", msg)
+			err := c.Send([]byte(msg))
 			if err != nil {
-				Logger.Warnf("Failed to send welcome message: %v", err)
+				h.logger.Warnf("Failed to send welcome message: %v", err)
 			}
 		}
-		pane.Run(cmd)
-		c := peers.CDB.Add(d, pane, peer)
-		Logger.Infof("opened data channel for pane %d", pane.ID)
+		err := pane.Run(cmd)
+		if err != nil {
+			h.logger.Warnf("Failed to run pane %d: %s", pane.ID, err)
+			peer.SendNack(m, err.Error())
+			pane.Kill()
+			return
+		}
+		h.logger.Infof("opened data channel for pane %d", pane.ID)
 		peer.SendAck(m, fmt.Sprintf("%d", pane.ID))
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
 			pane.OnMessage(peer, msg)
 		})
 		d.OnClose(func() {
-			peers.CDB.Delete(c)
+			peer.Server.CDB.Delete(c)
 		})
 	})
 }
@@ -7,6 +7,9 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -19,6 +22,9 @@ import (
 
 const SessionTTL = time.Second * 30
 
+// LongPollTimeout is the longest a GET request for candidates waits
+const LongPollTimeout = time.Second * 10
+
 type AddressType string
 
 type AuthBackend interface {
@@ -27,9 +33,14 @@ type AuthBackend interface {
 }
 type ConnectHandler struct {
 	authBackend AuthBackend
-	peerConf    *peers.Conf
-	logger      *zap.SugaredLogger
-	sessions    map[uuid.UUID]*peers.Peer
+	// tokens checks the secret tokens of websocket clients
+	tokens    AuthBackend
+	server    *peers.Server
+	logger    *zap.SugaredLogger
+	sessions  map[uuid.UUID]*session
+	sessionsM sync.Mutex
+	// origins are the origins allowed to access the server, empty for all
+	origins []string
 }
 
 // ConnectRequest is the schema for the connect POST request
@@ -40,52 +51,81 @@ type ConnectRequest struct {
 }
 
 func NewConnectHandler(
-	backend AuthBackend, conf *peers.Conf, logger *zap.SugaredLogger) *ConnectHandler {
+	backend AuthBackend, server *peers.Server, logger *zap.SugaredLogger) *ConnectHandler {
 
 	return &ConnectHandler{
 		authBackend: backend,
-		peerConf:    conf,
+		server:      server,
 		logger:      logger,
-		sessions:    make(map[uuid.UUID]*peers.Peer),
+		sessions:    make(map[uuid.UUID]*session),
 	}
 }
 
+// SetTokens sets the backend checking the secret tokens websocket clients
+// authenticate with. Without one, websocket clients are refused.
+func (h *ConnectHandler) SetTokens(backend AuthBackend) {
+	h.tokens = backend
+}
+
 // StartHTTPServer starts a http server that listens to the given address
-// and serves the connect endpoint.
+// and serves the connect endpoint. When opts.TLS is set it serves HTTPS.
 func StartHTTPServer(lc fx.Lifecycle, c *ConnectHandler, address AddressType,
-	logger *zap.SugaredLogger) *http.Server {
+	opts *ServerOptions, logger *zap.SugaredLogger) (*http.Server, error) {
 
-	c.peerConf.Logger = logger
-	c.AddHandlers(http.DefaultServeMux)
+	mux := http.NewServeMux()
+	c.AddHandlers(mux)
+	if opts.WebClient {
+		mux.Handle("/", WebClientHandler())
+	}
 	server := &http.Server{
 		Addr:    string(address),
-		Handler: c.GetHandler()}
+		Handler: c.GetHandler(mux, opts.CORSOrigins)}
+	if opts.TLS != nil {
+		tlsConf, err := opts.TLS.Config()
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConf
+	}
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
-			logger.Info("Starting HTTP server")
-			go server.ListenAndServe()
+			if server.TLSConfig != nil {
+				logger.Info("Starting HTTPS server")
+				go server.ListenAndServeTLS("", "")
+			} else {
+				logger.Info("Starting HTTP server")
+				go server.ListenAndServe()
+			}
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			// peers.Shutdown()
 			logger.Info("Stopping HTTP server")
 			return server.Shutdown(ctx)
 		},
 	})
-	return server
+	return server, nil
 }
-func (h *ConnectHandler) GetHandler() http.Handler {
+
+// GetHandler wraps the server's mux, allowing cross origin requests from the
+// given origins or from all origins when none are given
+func (h *ConnectHandler) GetHandler(mux *http.ServeMux, origins []string) http.Handler {
+	h.origins = origins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
 	handler := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"POST", "PATCH", "DELETE"},
+		AllowedOrigins: origins,
+		AllowedMethods: []string{"GET", "POST", "PATCH", "DELETE"},
 		AllowedHeaders: []string{"*"},
-	}).Handler(http.DefaultServeMux)
+		ExposedHeaders: []string{"Location", "ETag"},
+	}).Handler(mux)
 	return handler
 }
 func (h *ConnectHandler) AddHandlers(mux *http.ServeMux) {
 	mux.HandleFunc("/connect", h.HandleConnect)
 	mux.HandleFunc("/offer", h.HandleOffer)
 	mux.HandleFunc("/candidates/", h.HandleCandidate)
+	mux.HandleFunc("/ws", h.HandleWebSocket)
 }
 
 func (h *ConnectHandler) IsAuthorized(r *http.Request, fp string) bool {
@@ -105,7 +145,10 @@ func (h *ConnectHandler) IsAuthorized(r *http.Request, fp string) bool {
 
 // HandleOffer is called when a client requests the whip endpoint
 // it should be a post and the body webrtc's client offer.
-// In reponse the handlers send the server's webrtc's offer.
+// In reponse the handlers send the server's webrtc's answer. When the offer
+// advertises trickle ICE the answer doesn't wait for ICE gathering and the
+// server's candidates are available from the session URL in the Location
+// header. Otherwise the answer holds the server's candidates.
 func (h *ConnectHandler) HandleOffer(w http.ResponseWriter, r *http.Request) {
 	h.logger.Debugf("Got request from %s", r.RemoteAddr)
 	if r.Method != "POST" {
@@ -132,35 +175,31 @@ func (h *ConnectHandler) HandleOffer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	peer, err := peers.NewPeer(fp, h.peerConf)
+	peer, err := h.server.NewPeer(fp)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create a new peer: %s", err), http.StatusInternalServerError)
 		return
 	}
-	answer, err := peer.Listen(offer)
+	sess := newSession(peer)
+	answer, err := peer.ListenTrickle(offer, sess.onCandidate)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Peer failed to listen : %s", err), http.StatusInternalServerError)
 		return
 	}
 	sessionID := uuid.New()
-	h.sessions[sessionID] = peer
-	go func() {
-		time.Sleep(SessionTTL)
-		_, found := h.sessions[sessionID]
-		if !found {
-			return
-		}
-		delete(h.sessions, sessionID)
-	}()
-
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Expose-Headers", "Location")
+	h.sessionsM.Lock()
+	h.sessions[sessionID] = sess
+	h.sessionsM.Unlock()
+	time.AfterFunc(SessionTTL, func() { h.expireSession(sessionID) })
 
 	w.Header().Set("Content-Type", "application/sdp")
 	w.Header().Set("ETag", fmt.Sprintf("%x", time.Now().Unix()))
 	scheme := r.Header.Get("X-Forwarded-Proto")
 	if scheme == "" {
 		scheme = "http" // Assume http if header is missing.
+		if r.TLS != nil {
+			scheme = "https"
+		}
 	}
 	url := fmt.Sprintf("%s://%s/candidates/%s", scheme, r.Host, sessionID)
 	w.Header().Set("Location", url)
@@ -168,8 +207,29 @@ func (h *ConnectHandler) HandleOffer(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(answer.SDP))
 }
 
-// HandleCandidate is called when a client requests the candidate endpoint
-// it should be a patch and the body webrtc's client candidate.
+// expireSession removes a session once its peer is closed. Sessions of live
+// peers are kept so clients can restart ICE.
+func (h *ConnectHandler) expireSession(id uuid.UUID) {
+	h.sessionsM.Lock()
+	defer h.sessionsM.Unlock()
+	sess, found := h.sessions[id]
+	if !found {
+		return
+	}
+	sess.peer.Lock()
+	closed := sess.peer.PC == nil
+	sess.peer.Unlock()
+	if closed {
+		delete(h.sessions, id)
+		return
+	}
+	time.AfterFunc(SessionTTL, func() { h.expireSession(id) })
+}
+
+// HandleCandidate is called when a client requests the candidate endpoint.
+// A PATCH adds the client candidate in the body or, when the body is an sdp
+// fragment with new ICE credentials, restarts ICE. A GET returns the
+// server's candidates and a DELETE ends the session.
 func (h *ConnectHandler) HandleCandidate(w http.ResponseWriter, r *http.Request) {
 	sessionID, err := uuid.Parse(r.URL.Path[len("/candidates/"):])
 	if err != nil {
@@ -178,25 +238,42 @@ func (h *ConnectHandler) HandleCandidate(w http.ResponseWriter, r *http.Request)
 	}
 	if r.Method == "DELETE" {
 		// get the session id from the url
+		h.sessionsM.Lock()
 		delete(h.sessions, sessionID)
+		h.sessionsM.Unlock()
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	if r.Method != "PATCH" {
+	if r.Method != "PATCH" && r.Method != "GET" {
 		http.Error(w, "Invalid method", http.StatusBadRequest)
 		return
 	}
 	// ensure uuid is valid
-	peer, found := h.sessions[sessionID]
+	h.sessionsM.Lock()
+	sess, found := h.sessions[sessionID]
+	h.sessionsM.Unlock()
 	if !found {
 		http.Error(w, "Session not found", http.StatusNotFound)
 		return
 	}
+	if r.Method == "GET" {
+		if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+			h.streamCandidates(w, r, sess)
+		} else {
+			h.pollCandidates(w, r, sess)
+		}
+		return
+	}
+	peer := sess.peer
 	candidateData, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), SDPFragType) {
+		h.patchSDPFrag(w, sess, string(candidateData))
+		return
+	}
 	var candidate webrtc.ICECandidateInit
 	err = json.Unmarshal(candidateData, &candidate)
 	if err != nil {
@@ -212,6 +289,113 @@ func (h *ConnectHandler) HandleCandidate(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// patchSDPFrag handles a trickle ICE sdp fragment. If the fragment's ICE
+// credentials are new, it restarts ICE and replies with the server's new
+// credentials.
+func (h *ConnectHandler) patchSDPFrag(w http.ResponseWriter, sess *session, body string) {
+	peer := sess.peer
+	frag := parseSDPFrag(body)
+	peer.Lock()
+	pc := peer.PC
+	peer.Unlock()
+	if pc == nil {
+		http.Error(w, "Peer is closed", http.StatusNotFound)
+		return
+	}
+	remote := pc.RemoteDescription()
+	var restarted *webrtc.SessionDescription
+	if frag.ufrag != "" && frag.pwd != "" && remote != nil {
+		offer := webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  replaceICECredentials(remote.SDP, frag.ufrag, frag.pwd),
+		}
+		if peer.IsRestart(offer) {
+			sess.restart()
+			var err error
+			restarted, err = peer.Restart(offer)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	for _, c := range frag.candidates {
+		err := peer.AddCandidate(c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if restarted == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	ufrag, pwd := peers.ICECredentials(restarted.SDP)
+	w.Header().Set("Content-Type", SDPFragType)
+	w.Header().Set("ETag", fmt.Sprintf("%x", time.Now().Unix()))
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "a=ice-ufrag:%s\r\na=ice-pwd:%s\r\n", ufrag, pwd)
+}
+
+// pollCandidates replies with the server's candidates after the first
+// `from` ones. If there are none, it waits for new candidates for up to
+// LongPollTimeout.
+func (h *ConnectHandler) pollCandidates(w http.ResponseWriter, r *http.Request, sess *session) {
+	var from int
+	if f := r.URL.Query().Get("from"); f != "" {
+		var err error
+		from, err = strconv.Atoi(f)
+		if err != nil {
+			http.Error(w, "Invalid from parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), LongPollTimeout)
+	defer cancel()
+	b, err := json.Marshal(sess.wait(ctx, from))
+	if err != nil {
+		http.Error(w, "Failed to marshal candidates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// streamCandidates sends the server's candidates as server sent events,
+// ending with an end-of-candidates event
+func (h *ConnectHandler) streamCandidates(w http.ResponseWriter, r *http.Request, sess *session) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	from := 0
+	for {
+		resp := sess.wait(r.Context(), from)
+		if r.Context().Err() != nil {
+			return
+		}
+		for _, c := range resp.Candidates {
+			b, err := json.Marshal(c)
+			if err != nil {
+				h.logger.Errorf("Failed to marshal candidate: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: candidate\ndata: %s\n\n", b)
+		}
+		from += len(resp.Candidates)
+		if resp.Complete {
+			fmt.Fprint(w, "event: end-of-candidates\ndata:\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+	}
+}
+
 // HandleConnect is called when a client requests the connect endpoint
 // it should be a post and the body webrtc's client offer.
 // In reponse the handlers send the server's webrtc's offer.
@@ -239,7 +423,7 @@ func (h *ConnectHandler) HandleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	peer, err := peers.NewPeer(fp, h.peerConf)
+	peer, err := h.server.NewPeer(fp)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to create a new peer: %s", err), http.StatusInternalServerError)
 		return
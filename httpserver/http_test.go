@@ -1,6 +1,7 @@
 package httpserver
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -10,15 +11,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 	"github.com/tuzig/webexec/peers"
+	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -146,7 +151,7 @@ func TestConnectGoodFP(t *testing.T) {
 		}
 		h := &ConnectHandler{
 			authBackend: a,
-			peerConf:    conf,
+			server:      peers.NewServer(conf),
 			logger:      logger,
 		}
 		h.HandleConnect(w, req)
@@ -204,7 +209,7 @@ func TestConnectBadFP(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusUnauthorized, w.Code)
 	}
@@ -251,7 +256,7 @@ func TestConnectWithBearer(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusOK, w.Code)
 	}
@@ -299,7 +304,7 @@ func TestConnectWithBadBearer(t *testing.T) {
 				return nil, nil
 			},
 		}
-		h := NewConnectHandler(a, conf, logger)
+		h := NewConnectHandler(a, peers.NewServer(conf), logger)
 		h.HandleConnect(w, req)
 		require.Equal(t, http.StatusUnauthorized, w.Code)
 	}
@@ -352,7 +357,7 @@ func FuncTestOffer(t *testing.T) {
 	}
 	h := &ConnectHandler{
 		authBackend: a,
-		peerConf:    conf,
+		server:      peers.NewServer(conf),
 		logger:      logger,
 	}
 	h.HandleOffer(w, req)
@@ -392,3 +397,245 @@ func FuncTestOffer(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestOfferTrickle(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	client, cert, err := newClient(t)
+	require.NoError(t, err, "Failed to create a client: %q", err)
+	defer client.Close()
+	fp, err := peers.ExtractFP(cert)
+	require.NoError(t, err, "Failed to extract the fingerprint: %q", err)
+	conf := &peers.Conf{
+		Certificate: newCert(t),
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		// a long gathering timeout as the answer should not wait for it
+		GatheringTimeout: 10 * time.Second,
+		GetICEServers: func() ([]webrtc.ICEServer, error) {
+			return nil, nil
+		},
+	}
+	h := NewConnectHandler(&MockAuthBackend{authorized: fp}, peers.NewServer(conf), logger)
+	mux := http.NewServeMux()
+	h.AddHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	opened := make(chan bool)
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.NoError(t, err, "Failed to create the control data channel: %q", err)
+	cdc.OnOpen(func() { opened <- true })
+	offer, err := client.CreateOffer(&webrtc.OfferOptions{
+		OfferAnswerOptions: webrtc.OfferAnswerOptions{ICETricklingSupported: true}})
+	require.NoError(t, err, "Failed to create client offer: %q", err)
+	err = client.SetLocalDescription(offer)
+	require.NoError(t, err, "Failed to set client's local description: %q", err)
+	start := time.Now()
+	resp, err := http.Post(server.URL+"/offer", "application/sdp",
+		bytes.NewBufferString(offer.SDP))
+	require.NoError(t, err, "Failed to post the offer: %q", err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Less(t, time.Since(start), time.Second)
+	answer, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	cansURL := resp.Header.Get("Location")
+	require.Contains(t, cansURL, "/candidates/")
+	err = client.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer, SDP: string(answer)})
+	require.NoError(t, err, "Failed to set the answer: %q", err)
+	client.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			return
+		}
+		b, err := json.Marshal(c.ToJSON())
+		require.NoError(t, err)
+		req, err := http.NewRequest(http.MethodPatch, cansURL, bytes.NewBuffer(b))
+		require.NoError(t, err)
+		r, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		r.Body.Close()
+		require.Equal(t, http.StatusNoContent, r.StatusCode)
+	})
+	// read the server's candidates as server sent events
+	req, err := http.NewRequest(http.MethodGet, cansURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	event := ""
+	count := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			event = line[7:]
+		}
+		if event == "candidate" && strings.HasPrefix(line, "data: ") {
+			var c webrtc.ICECandidateInit
+			err = json.Unmarshal([]byte(line[6:]), &c)
+			require.NoError(t, err)
+			require.NoError(t, client.AddICECandidate(c))
+			count++
+		}
+		if event == "end-of-candidates" {
+			break
+		}
+	}
+	require.Equal(t, "end-of-candidates", event)
+	require.Greater(t, count, 0)
+	select {
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for the cdc to open")
+	case <-opened:
+	}
+	// long polling returns the candidates after `from`
+	resp, err = http.Get(cansURL + "?from=1")
+	require.NoError(t, err)
+	var cr CandidatesResponse
+	err = json.NewDecoder(resp.Body).Decode(&cr)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, cr.Complete)
+	require.Len(t, cr.Candidates, count-1)
+}
+
+func TestOfferNoTrickle(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	client, cert, err := newClient(t)
+	require.NoError(t, err, "Failed to create a client: %q", err)
+	defer client.Close()
+	fp, err := peers.ExtractFP(cert)
+	require.NoError(t, err, "Failed to extract the fingerprint: %q", err)
+	conf := &peers.Conf{
+		Certificate: newCert(t),
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		GatheringTimeout:  5 * time.Second,
+		GetICEServers: func() ([]webrtc.ICEServer, error) {
+			return nil, nil
+		},
+	}
+	h := NewConnectHandler(&MockAuthBackend{authorized: fp}, peers.NewServer(conf), logger)
+	mux := http.NewServeMux()
+	h.AddHandlers(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	opened := make(chan bool)
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.NoError(t, err, "Failed to create the control data channel: %q", err)
+	cdc.OnOpen(func() { opened <- true })
+	// a client that can't trickle sends its candidates in the offer
+	gathered := webrtc.GatheringCompletePromise(client)
+	offer, err := client.CreateOffer(nil)
+	require.NoError(t, err, "Failed to create client offer: %q", err)
+	err = client.SetLocalDescription(offer)
+	require.NoError(t, err, "Failed to set client's local description: %q", err)
+	<-gathered
+	resp, err := http.Post(server.URL+"/offer", "application/sdp",
+		bytes.NewBufferString(client.LocalDescription().SDP))
+	require.NoError(t, err, "Failed to post the offer: %q", err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	answer, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Contains(t, string(answer), "a=candidate:")
+	err = client.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer, SDP: string(answer)})
+	require.NoError(t, err, "Failed to set the answer: %q", err)
+	select {
+	case <-time.After(5 * time.Second):
+		t.Error("Timeout waiting for the cdc to open")
+	case <-opened:
+	}
+}
+
+func TestParseSDPFrag(t *testing.T) {
+	frag := parseSDPFrag("a=ice-ufrag:EsAw\r\na=ice-pwd:P2uYro0UCOQ4zxjKXaWCBui1\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:0\r\n" +
+		"a=candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host\r\n" +
+		"a=end-of-candidates\r\n")
+	require.Equal(t, "EsAw", frag.ufrag)
+	require.Equal(t, "P2uYro0UCOQ4zxjKXaWCBui1", frag.pwd)
+	require.Len(t, frag.candidates, 1)
+	require.Equal(t, "candidate:1387637174 1 udp 2122260223 192.0.2.1 61764 typ host",
+		frag.candidates[0].Candidate)
+	require.Equal(t, "0", *frag.candidates[0].SDPMid)
+	sdp := replaceICECredentials("v=0\r\na=ice-ufrag:old\r\na=ice-pwd:oldpwd\r\n", "new", "newpwd")
+	require.Equal(t, "v=0\r\na=ice-ufrag:new\r\na=ice-pwd:newpwd\r\n", sdp)
+}
+
+func TestSelfSignedTLS(t *testing.T) {
+	dir := t.TempDir()
+	conf := &TLSConf{
+		Cert:       dir + "/cert.pem",
+		Key:        dir + "/key.pem",
+		SelfSigned: true,
+	}
+	tlsConf, err := conf.Config()
+	require.NoError(t, err)
+	require.Len(t, tlsConf.Certificates, 1)
+	fp, err := conf.Fingerprint()
+	require.NoError(t, err)
+	require.Len(t, fp, 95)
+	// the certificate is generated only once
+	_, err = conf.Config()
+	require.NoError(t, err)
+	fp2, err := conf.Fingerprint()
+	require.NoError(t, err)
+	require.Equal(t, fp, fp2)
+	// a client CA file turns on mutual TLS
+	conf.ClientCA = conf.Cert
+	tlsConf, err = conf.Config()
+	require.NoError(t, err)
+	require.NotNil(t, tlsConf.ClientCAs)
+}
+
+func TestWebClient(t *testing.T) {
+	ts := httptest.NewServer(WebClientHandler())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Security-Policy"), "default-src 'self'")
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `src="app.js"`)
+	for _, name := range []string{"app.js", "term.js"} {
+		resp, err := http.Get(ts.URL + "/" + name)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		// browsers require a javascript mime type for modules
+		require.Contains(t, resp.Header.Get("Content-Type"), "javascript")
+	}
+}
+
+func TestTwoHTTPServers(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+	peersLogger := zap.NewNop().Sugar()
+	conf := &peers.Conf{Logger: peersLogger}
+	lc := fxtest.NewLifecycle(t)
+	opts := &ServerOptions{WebClient: true}
+	// every server has its own mux so both can register their handlers
+	for i := 0; i < 2; i++ {
+		h := NewConnectHandler(&MockAuthBackend{}, peers.NewServer(conf), logger)
+		server, err := StartHTTPServer(lc, h, "127.0.0.1:0", opts, logger)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		server.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	// the peers keep their own logger
+	require.Same(t, peersLogger, conf.Logger)
+}
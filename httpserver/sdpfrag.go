@@ -0,0 +1,56 @@
+package httpserver
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// SDPFragType is the content type of trickle ICE & ICE restart PATCH requests
+const SDPFragType = "application/trickle-ice-sdpfrag"
+
+// sdpFrag holds the parts of an sdp fragment webexec uses
+type sdpFrag struct {
+	ufrag      string
+	pwd        string
+	candidates []webrtc.ICECandidateInit
+}
+
+// parseSDPFrag parses a trickle ICE sdp fragment as defined in RFC 8840
+func parseSDPFrag(body string) sdpFrag {
+	var (
+		frag sdpFrag
+		mid  *string
+	)
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = line[len("a=ice-ufrag:"):]
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			frag.pwd = line[len("a=ice-pwd:"):]
+		case strings.HasPrefix(line, "a=mid:"):
+			m := line[len("a=mid:"):]
+			mid = &m
+		case strings.HasPrefix(line, "a=candidate:"):
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate: line[len("a="):],
+				SDPMid:    mid,
+			})
+		}
+	}
+	return frag
+}
+
+// replaceICECredentials returns the sdp with its ice-ufrag & ice-pwd replaced
+func replaceICECredentials(sdp string, ufrag string, pwd string) string {
+	lines := strings.Split(sdp, "\r\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			lines[i] = "a=ice-ufrag:" + ufrag
+		} else if strings.HasPrefix(line, "a=ice-pwd:") {
+			lines[i] = "a=ice-pwd:" + pwd
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
@@ -0,0 +1,87 @@
+package httpserver
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/tuzig/webexec/peers"
+)
+
+// session holds a WHIP session's peer and the candidates the server
+// gathered so far
+type session struct {
+	peer       *peers.Peer
+	m          sync.Mutex
+	candidates []webrtc.ICECandidateInit
+	// complete is set when ICE gathering is complete
+	complete bool
+	// update is closed and replaced when a candidate is added
+	update chan struct{}
+}
+
+// CandidatesResponse is the reply to a GET request of a session's candidates
+type CandidatesResponse struct {
+	Candidates []webrtc.ICECandidateInit `json:"candidates"`
+	// Complete is true when the server has no more candidates to send
+	Complete bool `json:"complete"`
+}
+
+func newSession(peer *peers.Peer) *session {
+	return &session{
+		peer:       peer,
+		candidates: []webrtc.ICECandidateInit{},
+		update:     make(chan struct{}),
+	}
+}
+
+// onCandidate is called by the peer connection with every new candidate and
+// with nil when gathering is complete
+func (s *session) onCandidate(c *webrtc.ICECandidate) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if c == nil {
+		s.complete = true
+	} else {
+		s.candidates = append(s.candidates, c.ToJSON())
+	}
+	close(s.update)
+	s.update = make(chan struct{})
+}
+
+// restart clears the candidates before the server gathers new ones for an
+// ICE restart
+func (s *session) restart() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.candidates = []webrtc.ICECandidateInit{}
+	s.complete = false
+	close(s.update)
+	s.update = make(chan struct{})
+}
+
+// wait waits until there are candidates after the first from, gathering is
+// complete or the context is done. It returns the new candidates.
+func (s *session) wait(ctx context.Context, from int) CandidatesResponse {
+	for {
+		s.m.Lock()
+		if from < 0 || from > len(s.candidates) {
+			from = len(s.candidates)
+		}
+		if len(s.candidates) > from || s.complete {
+			r := CandidatesResponse{
+				Candidates: append([]webrtc.ICECandidateInit{}, s.candidates[from:]...),
+				Complete:   s.complete,
+			}
+			s.m.Unlock()
+			return r
+		}
+		update := s.update
+		s.m.Unlock()
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return CandidatesResponse{Candidates: []webrtc.ICECandidateInit{}}
+		}
+	}
+}
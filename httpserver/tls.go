@@ -0,0 +1,139 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ServerOptions holds the http server's options
+type ServerOptions struct {
+	// TLS is nil when the server uses plain HTTP
+	TLS *TLSConf
+	// CORSOrigins are the origins allowed to access the server, defaults to all
+	CORSOrigins []string
+	// WebClient serves the embedded browser client at the root
+	WebClient bool
+}
+
+// TLSConf holds the http server's TLS configuration
+type TLSConf struct {
+	// Cert & Key are the paths of the PEM encoded certificate & key
+	Cert string
+	Key  string
+	// SelfSigned generates a self signed certificate when Cert & Key are
+	// missing
+	SelfSigned bool
+	// ClientCA is the path of a PEM file of CAs. When set, clients must
+	// present a certificate signed by one of them.
+	ClientCA string
+}
+
+// Config returns the tls configuration, generating a self signed certificate
+// if needed
+func (c *TLSConf) Config() (*tls.Config, error) {
+	if c.SelfSigned {
+		_, err := os.Stat(c.Cert)
+		if errors.Is(err, os.ErrNotExist) {
+			err = GenerateSelfSigned(c.Cert, c.Key)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load TLS certificate: %s", err)
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCA != "" {
+		b, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("No certificates found in %q", c.ClientCA)
+		}
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ret, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the server's certificate
+func (c *TLSConf) Fingerprint() (string, error) {
+	b, err := os.ReadFile(c.Cert)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read TLS certificate: %s", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", fmt.Errorf("Failed to decode TLS certificate %q", c.Cert)
+	}
+	sum := sha256.Sum256(block.Bytes)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":"), nil
+}
+
+// GenerateSelfSigned creates a self signed certificate for the host and
+// saves it and its key in PEM files
+func GenerateSelfSigned(certPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate TLS key: %s", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("Failed to generate serial number: %s", err)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{hostname, "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("Failed to create TLS certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal TLS key: %s", err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to save TLS key: %s", err)
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to save TLS certificate: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package httpserver
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// webClientFS holds the browser client's assets
+//
+//go:embed webclient
+var webClientFS embed.FS
+
+// WebClientHandler serves the embedded browser client
+func WebClientHandler() http.Handler {
+	sub, err := fs.Sub(webClientFS, "webclient")
+	if err != nil {
+		// can't happen, the directory is embedded
+		panic(err)
+	}
+	files := http.FileServer(http.FS(sub))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the client only uses its own assets & the server's endpoints.
+		// The terminal renders colors with inline styles.
+		w.Header().Set("Content-Security-Policy",
+			"default-src 'self'; style-src 'self' 'unsafe-inline'")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		files.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,358 @@
+// webexec's browser client. It connects using the WHIP endpoint, opens the
+// `%` control channel and shows the panes in tabs.
+"use strict"
+
+import { Terminal } from "./term.js"
+
+const RECONNECT_DELAY = 2000
+const ACK_TIMEOUT = 5000
+
+const $ = (id) => document.getElementById(id)
+const encoder = new TextEncoder()
+
+class Pane {
+    constructor(client, id) {
+        this.client = client
+        this.id = id
+        this.dc = null
+        this.view = document.createElement("div")
+        this.view.className = "pane"
+        $("panes").appendChild(this.view)
+        this.term = new Terminal(this.view)
+        this.term.onData((s) => {
+            if (this.dc && this.dc.readyState == "open")
+                this.dc.send(encoder.encode(s))
+        })
+        this.tab = document.createElement("button")
+        this.tab.className = "tab"
+        this.tab.onclick = () => client.activate(this)
+        $("tabs").appendChild(this.tab)
+        this.setTitle()
+    }
+
+    setTitle(suffix) {
+        this.tab.textContent = `${this.id || "…"}${suffix ? " " + suffix : ""}`
+    }
+
+    // attach connects the pane to the server's data channel
+    attach(dc) {
+        this.dc = dc
+        dc.binaryType = "arraybuffer"
+        dc.onmessage = (m) => this.term.write(
+            typeof m.data == "string" ? m.data : new Uint8Array(m.data))
+        this.setTitle()
+    }
+
+    // exited is called when the pane's process is done
+    exited() {
+        this.id = null
+        this.tab.remove()
+        this.view.remove()
+    }
+}
+
+class Client {
+    constructor() {
+        this.panes = []
+        this.active = null
+        this.ref = 0
+        this.pending = {}
+        this.pc = null
+        this.cdc = null
+        this.token = null
+    }
+
+    status(msg) {
+        $("status").textContent = msg
+    }
+
+    // connect runs the WHIP handshake and opens the control channel
+    async connect() {
+        this.status("Connecting…")
+        const pc = new RTCPeerConnection({ iceServers: [] })
+        this.pc = pc
+        let location = null
+        const localCandidates = []
+        const sendCandidate = (c) => fetch(location, {
+            method: "PATCH",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify(c),
+        })
+        pc.onicecandidate = (e) => {
+            if (!e.candidate)
+                return
+            if (location)
+                sendCandidate(e.candidate.toJSON())
+            else
+                localCandidates.push(e.candidate.toJSON())
+        }
+        pc.onconnectionstatechange = () => {
+            this.status(pc.connectionState)
+            if (pc == this.pc && (pc.connectionState == "failed" || pc.connectionState == "closed"))
+                this.reconnect()
+        }
+        pc.ondatachannel = (e) => this.onDataChannel(e.channel)
+        const cdc = pc.createDataChannel("%")
+        cdc.binaryType = "arraybuffer"
+        cdc.onopen = () => this.onCDCOpen(cdc)
+        cdc.onmessage = (m) => this.onCTRLMessage(m.data)
+        await pc.setLocalDescription(await pc.createOffer())
+        const resp = await fetch("/offer", {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/sdp",
+                "Authorization": `Bearer ${this.token}`,
+            },
+            body: pc.localDescription.sdp,
+        })
+        if (resp.status == 401) {
+            pc.close()
+            this.pc = null
+            localStorage.removeItem("webexec-token")
+            this.askToken("The token was refused")
+            return
+        }
+        if (resp.status != 201)
+            throw new Error(`Offer failed: ${resp.status} ${await resp.text()}`)
+        await pc.setRemoteDescription({ type: "answer", sdp: await resp.text() })
+        location = resp.headers.get("Location")
+        localCandidates.forEach(sendCandidate)
+        this.pollCandidates(pc, location)
+    }
+
+    // pollCandidates adds the server's candidates until gathering completes
+    async pollCandidates(pc, location) {
+        let from = 0
+        while (pc == this.pc && pc.connectionState != "closed") {
+            const resp = await fetch(`${location}?from=${from}`)
+            if (!resp.ok)
+                return
+            const r = await resp.json()
+            for (const c of r.candidates)
+                await pc.addIceCandidate(c)
+            from += r.candidates.length
+            if (r.complete)
+                return
+        }
+    }
+
+    reconnect() {
+        if (this.reconnecting)
+            return
+        this.reconnecting = true
+        this.status("Disconnected, reconnecting…")
+        setTimeout(() => {
+            this.reconnecting = false
+            this.connect().catch((e) => {
+                this.status(e.message)
+                this.reconnect()
+            })
+        }, RECONNECT_DELAY)
+    }
+
+    onCDCOpen(cdc) {
+        this.cdc = cdc
+        this.status("Connected")
+        const ids = this.panes.filter((p) => p.id).map((p) => p.id)
+        // after a page reload, reconnect to the panes we had open
+        if (ids.length == 0)
+            JSON.parse(localStorage.getItem("webexec-panes") || "[]").forEach((id) => {
+                const pane = new Pane(this, id)
+                this.panes.push(pane)
+                ids.push(id)
+            })
+        if (ids.length == 0)
+            this.addPane()
+        else
+            this.panes.filter((p) => p.id).forEach((p) => this.reconnectPane(p))
+    }
+
+    savePanes() {
+        localStorage.setItem("webexec-panes",
+            JSON.stringify(this.panes.filter((p) => p.id).map((p) => p.id)))
+    }
+
+    // sendCTRL sends a control message and returns a promise of its ack
+    sendCTRL(type, args) {
+        const ref = ++this.ref
+        const msg = { time: Date.now(), message_id: ref, type, args }
+        return new Promise((resolve, reject) => {
+            const timer = setTimeout(() => {
+                delete this.pending[ref]
+                reject(new Error(`${type} timed out`))
+            }, ACK_TIMEOUT)
+            this.pending[ref] = {
+                resolve: (v) => { clearTimeout(timer); resolve(v) },
+                reject: (e) => { clearTimeout(timer); reject(e) },
+            }
+            this.cdc.send(JSON.stringify(msg))
+        })
+    }
+
+    reply(m, body) {
+        this.cdc.send(JSON.stringify({
+            time: Date.now(), message_id: ++this.ref, type: "ack",
+            args: { ref: m.message_id, body },
+        }))
+    }
+
+    async onCTRLMessage(data) {
+        if (typeof data != "string")
+            data = new TextDecoder().decode(data)
+        const m = JSON.parse(data)
+        const args = m.args || {}
+        switch (m.type) {
+        case "ack":
+        case "nack": {
+            const p = this.pending[args.ref]
+            if (!p)
+                return
+            delete this.pending[args.ref]
+            if (m.type == "ack")
+                p.resolve(args.body)
+            else
+                p.reject(new Error(args.desc))
+            break
+        }
+        case "get_clipboard":
+            try {
+                this.reply(m, await navigator.clipboard.readText())
+            } catch (e) {
+                this.status(`Failed to read the clipboard: ${e.message}`)
+            }
+            break
+        case "set_clipboard":
+            try {
+                await navigator.clipboard.writeText(args.data)
+                this.reply(m, "")
+            } catch (e) {
+                this.status(`Failed to write the clipboard: ${e.message}`)
+            }
+            break
+        }
+    }
+
+    // onDataChannel gets a pane's channel, labeled "<message id>:<pane id>"
+    onDataChannel(dc) {
+        const [ref, id] = dc.label.split(":").map((v) => parseInt(v))
+        const pane = this.panes.find((p) => p.ref == ref)
+        if (!pane) {
+            dc.close()
+            return
+        }
+        pane.id = id
+        pane.attach(dc)
+        dc.onclose = () => {
+            if (pane.dc == dc)
+                this.onPaneClosed(pane)
+        }
+        this.savePanes()
+    }
+
+    // onPaneClosed checks whether the pane exited or the connection dropped
+    onPaneClosed(pane) {
+        pane.dc = null
+        if (this.pc && this.pc.connectionState == "connected") {
+            pane.exited()
+            this.panes = this.panes.filter((p) => p != pane)
+            this.savePanes()
+            if (this.active == pane)
+                this.activate(this.panes[0] || null)
+        } else {
+            pane.setTitle("(detached)")
+        }
+    }
+
+    activate(pane) {
+        this.active = pane
+        this.panes.forEach((p) => {
+            p.view.classList.toggle("active", p == pane)
+            p.tab.classList.toggle("active", p == pane)
+        })
+        if (pane) {
+            pane.term.fit()
+            pane.term.focus()
+            this.resize(pane)
+        }
+    }
+
+    async addPane() {
+        const pane = new Pane(this, null)
+        this.panes.push(pane)
+        this.activate(pane)
+        const { rows, cols } = pane.term.fit()
+        const p = this.sendCTRL("add_pane", { command: ["*"], rows, cols })
+        pane.ref = this.ref
+        try {
+            pane.id = parseInt(await p)
+            pane.setTitle()
+            this.savePanes()
+        } catch (e) {
+            this.status(`Failed to add a pane: ${e.message}`)
+            pane.exited()
+            this.panes = this.panes.filter((p) => p != pane)
+        }
+    }
+
+    async reconnectPane(pane) {
+        const p = this.sendCTRL("reconnect_pane", { id: pane.id })
+        pane.ref = this.ref
+        // the server restores the screen, start from a clean one
+        pane.term.reset()
+        try {
+            await p
+            if (!this.active)
+                this.activate(pane)
+            else if (pane == this.active)
+                this.resize(pane)
+        } catch (e) {
+            this.status(`Pane ${pane.id}: ${e.message}`)
+            pane.exited()
+            this.panes = this.panes.filter((p) => p != pane)
+            this.savePanes()
+        }
+    }
+
+    resize(pane) {
+        if (!pane.id || !this.cdc || this.cdc.readyState != "open")
+            return
+        const { rows, cols } = pane.term.fit()
+        this.sendCTRL("resize", { pane_id: pane.id, sx: cols, sy: rows })
+            .catch((e) => this.status(`Resize failed: ${e.message}`))
+    }
+
+    askToken(msg) {
+        $("token-msg").textContent = msg || ""
+        $("login").classList.add("open")
+        $("token").focus()
+    }
+}
+
+const client = new Client()
+
+$("login").onsubmit = (e) => {
+    e.preventDefault()
+    client.token = $("token").value.trim()
+    localStorage.setItem("webexec-token", client.token)
+    $("login").classList.remove("open")
+    client.connect().catch((e) => client.status(e.message))
+}
+$("add").onclick = () => client.addPane()
+let resizeTimer = null
+window.addEventListener("resize", () => {
+    clearTimeout(resizeTimer)
+    resizeTimer = setTimeout(() => client.active && client.resize(client.active), 200)
+})
+
+// an invite link holds the token in the fragment, which isn't sent to the
+// server: https://host:7777/#token=...
+const hash = new URLSearchParams(window.location.hash.slice(1))
+if (hash.get("token")) {
+    localStorage.setItem("webexec-token", hash.get("token"))
+    history.replaceState(null, "", window.location.pathname)
+}
+client.token = localStorage.getItem("webexec-token")
+if (client.token)
+    client.connect().catch((e) => client.status(e.message))
+else
+    client.askToken()
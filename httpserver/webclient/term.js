@@ -0,0 +1,700 @@
+// A small VT100 / xterm terminal emulator rendering into a <pre>.
+// It supports what shells & common full screen programs use: cursor
+// movement, erasing, scroll regions, SGR colors, the alternate screen,
+// application cursor keys & bracketed paste.
+"use strict"
+
+const SCROLLBACK = 1000
+
+const PALETTE = [
+    "#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+    "#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+]
+
+// color256 returns the css color of an xterm 256 color index
+function color256(n) {
+    if (n < 16)
+        return PALETTE[n]
+    if (n < 232) {
+        n -= 16
+        const level = (v) => v == 0 ? 0 : 55 + v * 40
+        return `rgb(${level(Math.floor(n / 36))},${level(Math.floor(n / 6) % 6)},${level(n % 6)})`
+    }
+    const gray = 8 + (n - 232) * 10
+    return `rgb(${gray},${gray},${gray})`
+}
+
+const DEFAULT_ATTR = Object.freeze({
+    fg: null, bg: null, bold: false, dim: false, italic: false,
+    underline: false, inverse: false,
+})
+
+function escapeHTML(s) {
+    return s.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;")
+}
+
+const KEYS = {
+    Enter: "\r", Backspace: "\x7f", Tab: "\t", Escape: "\x1b",
+    Home: "\x1b[H", End: "\x1b[F", Insert: "\x1b[2~", Delete: "\x1b[3~",
+    PageUp: "\x1b[5~", PageDown: "\x1b[6~",
+    F1: "\x1bOP", F2: "\x1bOQ", F3: "\x1bOR", F4: "\x1bOS",
+    F5: "\x1b[15~", F6: "\x1b[17~", F7: "\x1b[18~", F8: "\x1b[19~",
+    F9: "\x1b[20~", F10: "\x1b[21~", F11: "\x1b[23~", F12: "\x1b[24~",
+}
+const ARROWS = { ArrowUp: "A", ArrowDown: "B", ArrowRight: "C", ArrowLeft: "D" }
+
+export class Terminal {
+    constructor(parent) {
+        this.el = document.createElement("pre")
+        this.el.className = "term"
+        this.el.tabIndex = 0
+        parent.appendChild(this.el)
+        this.decoder = new TextDecoder("utf-8")
+        this.dataListeners = []
+        this.rows = 24
+        this.cols = 80
+        this.scrollback = []
+        this.reset()
+        this.el.addEventListener("keydown", (e) => this.onKeyDown(e))
+        this.el.addEventListener("paste", (e) => {
+            e.preventDefault()
+            this.paste(e.clipboardData.getData("text/plain"))
+        })
+    }
+
+    reset() {
+        this.screen = this.newScreen()
+        this.alt = null
+        this.cx = 0
+        this.cy = 0
+        this.attr = DEFAULT_ATTR
+        this.top = 0
+        this.bottom = this.rows - 1
+        this.wrapPending = false
+        this.appCursor = false
+        this.autowrap = true
+        this.cursorVisible = true
+        this.bracketedPaste = false
+        this.saved = null
+        this.lastChar = " "
+        this.state = "ground"
+        this.dirty = true
+        this.scheduleRender()
+    }
+
+    // onData registers a listener for the user's input
+    onData(f) {
+        this.dataListeners.push(f)
+    }
+
+    emit(s) {
+        this.dataListeners.forEach((f) => f(s))
+    }
+
+    paste(text) {
+        text = text.replace(/\r?\n/g, "\r")
+        if (this.bracketedPaste)
+            text = "\x1b[200~" + text + "\x1b[201~"
+        this.emit(text)
+    }
+
+    focus() {
+        this.el.focus()
+    }
+
+    blankLine(attr) {
+        const a = attr || DEFAULT_ATTR
+        const line = []
+        for (let i = 0; i < this.cols; i++)
+            line.push({ ch: " ", a })
+        return line
+    }
+
+    newScreen() {
+        const s = []
+        for (let i = 0; i < this.rows; i++)
+            s.push(this.blankLine())
+        return s
+    }
+
+    // eraseAttr is the attribute of erased cells, keeping the background
+    eraseAttr() {
+        if (this.attr.bg == null)
+            return DEFAULT_ATTR
+        return Object.freeze({ ...DEFAULT_ATTR, bg: this.attr.bg })
+    }
+
+    // write parses & displays the pane's output
+    write(data) {
+        const s = typeof data == "string" ? data : this.decoder.decode(data, { stream: true })
+        for (const ch of s)
+            this.parse(ch)
+        this.dirty = true
+        this.scheduleRender()
+    }
+
+    parse(ch) {
+        const c = ch.codePointAt(0)
+        switch (this.state) {
+        case "ground":
+            if (c == 0x1b)
+                this.state = "esc"
+            else if (c < 0x20)
+                this.control(c)
+            else if (c != 0x7f)
+                this.print(ch)
+            return
+        case "esc":
+            this.state = "ground"
+            switch (ch) {
+            case "[":
+                this.params = ""
+                this.state = "csi"
+                break
+            case "]":
+                this.oscBuf = ""
+                this.state = "osc"
+                break
+            case "P": case "X": case "^": case "_":
+                this.state = "string"
+                break
+            case "(": case ")": case "*": case "+":
+                this.state = "charset"
+                break
+            case "7":
+                this.saveCursor()
+                break
+            case "8":
+                this.restoreCursor()
+                break
+            case "D":
+                this.index()
+                break
+            case "E":
+                this.cx = 0
+                this.index()
+                break
+            case "M":
+                this.reverseIndex()
+                break
+            case "c":
+                this.reset()
+                break
+            }
+            return
+        case "charset":
+            this.state = "ground"
+            return
+        case "csi":
+            if (c >= 0x40 && c <= 0x7e) {
+                this.state = "ground"
+                this.csi(ch)
+            } else if (c == 0x1b) {
+                this.state = "esc"
+            } else {
+                this.params += ch
+            }
+            return
+        case "osc":
+            if (c == 7) {
+                this.osc()
+                this.state = "ground"
+            } else if (c == 0x1b) {
+                this.osc()
+                this.state = "stringEsc"
+            } else {
+                this.oscBuf += ch
+            }
+            return
+        case "string":
+            if (c == 7)
+                this.state = "ground"
+            else if (c == 0x1b)
+                this.state = "stringEsc"
+            return
+        case "stringEsc":
+            // the ESC of the ST, ESC \
+            this.state = "ground"
+            if (ch != "\\")
+                this.parse(ch)
+            return
+        }
+    }
+
+    control(c) {
+        switch (c) {
+        case 8:
+            if (this.cx > 0)
+                this.cx--
+            this.wrapPending = false
+            break
+        case 9:
+            this.cx = Math.min(this.cols - 1, (Math.floor(this.cx / 8) + 1) * 8)
+            break
+        case 10: case 11: case 12:
+            this.index()
+            break
+        case 13:
+            this.cx = 0
+            this.wrapPending = false
+            break
+        }
+    }
+
+    print(ch) {
+        if (this.wrapPending) {
+            if (this.autowrap) {
+                this.cx = 0
+                this.index()
+            }
+            this.wrapPending = false
+        }
+        this.screen[this.cy][this.cx] = { ch, a: this.attr }
+        this.lastChar = ch
+        if (this.cx == this.cols - 1)
+            this.wrapPending = true
+        else
+            this.cx++
+    }
+
+    osc() {
+        const i = this.oscBuf.indexOf(";")
+        const cmd = this.oscBuf.slice(0, i)
+        if (cmd == "0" || cmd == "2")
+            this.title = this.oscBuf.slice(i + 1)
+    }
+
+    // index moves the cursor down, scrolling at the bottom of the region
+    index() {
+        this.wrapPending = false
+        if (this.cy == this.bottom)
+            this.scrollUp(1)
+        else if (this.cy < this.rows - 1)
+            this.cy++
+    }
+
+    reverseIndex() {
+        this.wrapPending = false
+        if (this.cy == this.top)
+            this.scrollDown(1)
+        else if (this.cy > 0)
+            this.cy--
+    }
+
+    scrollUp(n) {
+        for (let i = 0; i < n; i++) {
+            const line = this.screen.splice(this.top, 1)[0]
+            if (this.top == 0 && this.alt == null) {
+                this.scrollback.push(line)
+                if (this.scrollback.length > SCROLLBACK)
+                    this.scrollback.shift()
+            }
+            this.screen.splice(this.bottom, 0, this.blankLine(this.eraseAttr()))
+        }
+    }
+
+    scrollDown(n) {
+        for (let i = 0; i < n; i++) {
+            this.screen.splice(this.bottom, 1)
+            this.screen.splice(this.top, 0, this.blankLine(this.eraseAttr()))
+        }
+    }
+
+    saveCursor() {
+        this.saved = { cx: this.cx, cy: this.cy, attr: this.attr }
+    }
+
+    restoreCursor() {
+        if (this.saved) {
+            this.cx = Math.min(this.saved.cx, this.cols - 1)
+            this.cy = Math.min(this.saved.cy, this.rows - 1)
+            this.attr = this.saved.attr
+        }
+        this.wrapPending = false
+    }
+
+    eraseCells(y, from, to) {
+        const a = this.eraseAttr()
+        for (let x = Math.max(0, from); x < Math.min(to, this.cols); x++)
+            this.screen[y][x] = { ch: " ", a }
+    }
+
+    csi(final) {
+        let p = this.params
+        let prefix = ""
+        if (p.length && "?>=<".includes(p[0])) {
+            prefix = p[0]
+            p = p.slice(1)
+        }
+        const params = p.replace(/:/g, ";").split(";").map((v) => parseInt(v) || 0)
+        const n = Math.max(1, params[0])
+        this.wrapPending = false
+        if (prefix == "?") {
+            if (final == "h" || final == "l")
+                params.forEach((m) => this.privateMode(m, final == "h"))
+            return
+        }
+        if (prefix != "")
+            return
+        switch (final) {
+        case "@": {
+            const line = this.screen[this.cy]
+            for (let i = 0; i < n; i++) {
+                line.splice(this.cx, 0, { ch: " ", a: this.eraseAttr() })
+                line.pop()
+            }
+            break
+        }
+        case "A":
+            this.cy = Math.max(this.cy < this.top ? 0 : this.top, this.cy - n)
+            break
+        case "B":
+            this.cy = Math.min(this.cy > this.bottom ? this.rows - 1 : this.bottom, this.cy + n)
+            break
+        case "C":
+            this.cx = Math.min(this.cols - 1, this.cx + n)
+            break
+        case "D":
+            this.cx = Math.max(0, this.cx - n)
+            break
+        case "E":
+            this.cx = 0
+            this.cy = Math.min(this.rows - 1, this.cy + n)
+            break
+        case "F":
+            this.cx = 0
+            this.cy = Math.max(0, this.cy - n)
+            break
+        case "G": case "`":
+            this.cx = Math.min(this.cols - 1, n - 1)
+            break
+        case "H": case "f":
+            this.cy = Math.min(this.rows - 1, Math.max(1, params[0]) - 1)
+            this.cx = Math.min(this.cols - 1, Math.max(1, params[1] || 0) - 1)
+            break
+        case "J":
+            if (params[0] == 0) {
+                this.eraseCells(this.cy, this.cx, this.cols)
+                for (let y = this.cy + 1; y < this.rows; y++)
+                    this.eraseCells(y, 0, this.cols)
+            } else if (params[0] == 1) {
+                for (let y = 0; y < this.cy; y++)
+                    this.eraseCells(y, 0, this.cols)
+                this.eraseCells(this.cy, 0, this.cx + 1)
+            } else {
+                for (let y = 0; y < this.rows; y++)
+                    this.eraseCells(y, 0, this.cols)
+                if (params[0] == 3)
+                    this.scrollback = []
+            }
+            break
+        case "K":
+            if (params[0] == 0)
+                this.eraseCells(this.cy, this.cx, this.cols)
+            else if (params[0] == 1)
+                this.eraseCells(this.cy, 0, this.cx + 1)
+            else
+                this.eraseCells(this.cy, 0, this.cols)
+            break
+        case "L":
+            if (this.cy >= this.top && this.cy <= this.bottom)
+                for (let i = 0; i < n; i++) {
+                    this.screen.splice(this.bottom, 1)
+                    this.screen.splice(this.cy, 0, this.blankLine(this.eraseAttr()))
+                }
+            break
+        case "M":
+            if (this.cy >= this.top && this.cy <= this.bottom)
+                for (let i = 0; i < n; i++) {
+                    this.screen.splice(this.cy, 1)
+                    this.screen.splice(this.bottom, 0, this.blankLine(this.eraseAttr()))
+                }
+            break
+        case "P": {
+            const line = this.screen[this.cy]
+            for (let i = 0; i < n; i++) {
+                line.splice(this.cx, 1)
+                line.push({ ch: " ", a: this.eraseAttr() })
+            }
+            break
+        }
+        case "S":
+            this.scrollUp(n)
+            break
+        case "T":
+            this.scrollDown(n)
+            break
+        case "X":
+            this.eraseCells(this.cy, this.cx, this.cx + n)
+            break
+        case "b":
+            for (let i = 0; i < n; i++)
+                this.print(this.lastChar)
+            break
+        case "d":
+            this.cy = Math.min(this.rows - 1, n - 1)
+            break
+        case "m":
+            this.sgr(params)
+            break
+        case "r":
+            this.top = Math.max(1, params[0]) - 1
+            this.bottom = Math.min(this.rows, params[1] || this.rows) - 1
+            if (this.top >= this.bottom) {
+                this.top = 0
+                this.bottom = this.rows - 1
+            }
+            this.cx = 0
+            this.cy = 0
+            break
+        case "s":
+            this.saveCursor()
+            break
+        case "u":
+            this.restoreCursor()
+            break
+        }
+    }
+
+    privateMode(mode, on) {
+        switch (mode) {
+        case 1:
+            this.appCursor = on
+            break
+        case 7:
+            this.autowrap = on
+            break
+        case 25:
+            this.cursorVisible = on
+            break
+        case 47: case 1047: case 1049:
+            if (mode == 1049 && on)
+                this.saveCursor()
+            if (on && this.alt == null) {
+                this.alt = this.screen
+                this.screen = this.newScreen()
+            } else if (!on && this.alt != null) {
+                this.screen = this.alt
+                this.alt = null
+            }
+            if (mode == 1049 && !on)
+                this.restoreCursor()
+            break
+        case 2004:
+            this.bracketedPaste = on
+            break
+        }
+    }
+
+    sgr(params) {
+        const a = { ...this.attr }
+        for (let i = 0; i < params.length; i++) {
+            const p = params[i]
+            if (p == 0)
+                Object.assign(a, DEFAULT_ATTR)
+            else if (p == 1)
+                a.bold = true
+            else if (p == 2)
+                a.dim = true
+            else if (p == 3)
+                a.italic = true
+            else if (p == 4)
+                a.underline = true
+            else if (p == 7)
+                a.inverse = true
+            else if (p == 22)
+                a.bold = a.dim = false
+            else if (p == 23)
+                a.italic = false
+            else if (p == 24)
+                a.underline = false
+            else if (p == 27)
+                a.inverse = false
+            else if (p >= 30 && p <= 37)
+                a.fg = PALETTE[p - 30]
+            else if (p >= 40 && p <= 47)
+                a.bg = PALETTE[p - 40]
+            else if (p >= 90 && p <= 97)
+                a.fg = PALETTE[p - 82]
+            else if (p >= 100 && p <= 107)
+                a.bg = PALETTE[p - 92]
+            else if (p == 39)
+                a.fg = null
+            else if (p == 49)
+                a.bg = null
+            else if (p == 38 || p == 48) {
+                let color = null
+                if (params[i + 1] == 5) {
+                    color = color256(params[i + 2] || 0)
+                    i += 2
+                } else if (params[i + 1] == 2) {
+                    color = `rgb(${params[i + 2] || 0},${params[i + 3] || 0},${params[i + 4] || 0})`
+                    i += 4
+                }
+                if (p == 38)
+                    a.fg = color
+                else
+                    a.bg = color
+            }
+        }
+        this.attr = Object.freeze(a)
+    }
+
+    // resize changes the terminal's size, keeping the lines near the cursor
+    resize(rows, cols) {
+        if (rows == this.rows && cols == this.cols)
+            return
+        const fit = (screen) => {
+            // shrinking drops the lines above the cursor first
+            while (screen.length > rows) {
+                if (screen == this.screen && this.cy >= rows) {
+                    const line = screen.shift()
+                    if (this.alt == null)
+                        this.scrollback.push(line)
+                    this.cy--
+                } else {
+                    screen.pop()
+                }
+            }
+            for (const line of screen) {
+                while (line.length < cols)
+                    line.push({ ch: " ", a: DEFAULT_ATTR })
+                line.length = cols
+            }
+        }
+        this.cols = cols
+        fit(this.screen)
+        if (this.alt != null)
+            fit(this.alt)
+        this.rows = rows
+        while (this.screen.length < rows)
+            this.screen.push(this.blankLine())
+        while (this.alt != null && this.alt.length < rows)
+            this.alt.push(this.blankLine())
+        this.cy = Math.min(this.cy, rows - 1)
+        this.cx = Math.min(this.cx, cols - 1)
+        this.top = 0
+        this.bottom = rows - 1
+        this.wrapPending = false
+        this.dirty = true
+        this.scheduleRender()
+    }
+
+    // fit resizes the terminal to fill its element and returns the new size
+    fit() {
+        const probe = document.createElement("span")
+        probe.textContent = "W".repeat(10)
+        this.el.appendChild(probe)
+        const rect = probe.getBoundingClientRect()
+        this.el.removeChild(probe)
+        const cw = rect.width / 10
+        const ch = rect.height
+        if (cw == 0 || ch == 0)
+            return { rows: this.rows, cols: this.cols }
+        const style = getComputedStyle(this.el)
+        const width = this.el.clientWidth - parseFloat(style.paddingLeft) - parseFloat(style.paddingRight)
+        const height = this.el.clientHeight - parseFloat(style.paddingTop) - parseFloat(style.paddingBottom)
+        const cols = Math.max(2, Math.floor(width / cw))
+        const rows = Math.max(1, Math.floor(height / ch))
+        this.resize(rows, cols)
+        return { rows, cols }
+    }
+
+    scheduleRender() {
+        if (this.renderPending)
+            return
+        this.renderPending = true
+        requestAnimationFrame(() => {
+            this.renderPending = false
+            if (this.dirty)
+                this.render()
+        })
+    }
+
+    style(a, cursor) {
+        let fg = a.fg, bg = a.bg
+        if (a.inverse != cursor) {
+            [fg, bg] = [bg || "var(--bg)", fg || "var(--fg)"]
+        }
+        let s = ""
+        if (fg)
+            s += `color:${fg};`
+        if (bg)
+            s += `background:${bg};`
+        if (a.bold)
+            s += "font-weight:bold;"
+        if (a.dim)
+            s += "opacity:0.7;"
+        if (a.italic)
+            s += "font-style:italic;"
+        if (a.underline)
+            s += "text-decoration:underline;"
+        return s
+    }
+
+    renderLine(line, cursorX) {
+        let html = ""
+        let run = ""
+        let runStyle = null
+        for (let x = 0; x < line.length; x++) {
+            const cell = line[x]
+            const st = this.style(cell.a, x == cursorX)
+            if (st != runStyle) {
+                if (run)
+                    html += runStyle ? `<span style="${runStyle}">${escapeHTML(run)}</span>` : escapeHTML(run)
+                run = ""
+                runStyle = st
+            }
+            run += cell.ch
+        }
+        if (run)
+            html += runStyle ? `<span style="${runStyle}">${escapeHTML(run)}</span>` : escapeHTML(run)
+        return html
+    }
+
+    render() {
+        this.dirty = false
+        const atBottom = this.el.scrollTop + this.el.clientHeight >= this.el.scrollHeight - 4
+        const lines = []
+        if (this.alt == null)
+            for (const line of this.scrollback)
+                lines.push(this.renderLine(line, -1))
+        for (let y = 0; y < this.rows; y++) {
+            const cursorX = this.cursorVisible && y == this.cy ? this.cx : -1
+            lines.push(this.renderLine(this.screen[y], cursorX))
+        }
+        this.el.innerHTML = lines.join("\n")
+        if (atBottom)
+            this.el.scrollTop = this.el.scrollHeight
+    }
+
+    onKeyDown(e) {
+        let s = null
+        if (e.metaKey || (e.ctrlKey && e.shiftKey))
+            // leave copy & paste shortcuts to the browser
+            return
+        if (e.key in ARROWS)
+            s = (this.appCursor ? "\x1bO" : "\x1b[") + ARROWS[e.key]
+        else if (e.key in KEYS)
+            s = KEYS[e.key]
+        else if (e.key.length == 1) {
+            s = e.key
+            if (e.ctrlKey) {
+                const c = e.key.toUpperCase().charCodeAt(0)
+                if (c >= 64 && c <= 95)
+                    s = String.fromCharCode(c - 64)
+                else if (e.key == " ")
+                    s = "\x00"
+                else
+                    return
+            }
+            if (e.altKey)
+                s = "\x1b" + s
+        }
+        if (s == null)
+            return
+        e.preventDefault()
+        this.el.scrollTop = this.el.scrollHeight
+        this.emit(s)
+    }
+}
@@ -0,0 +1,63 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// WSProtocol is the websocket subprotocol of the transport
+const WSProtocol = "webexec"
+
+// wsTokenPrefix prefixes the token in the subprotocols of browsers, which
+// can't set the Authorization header
+const wsTokenPrefix = "bearer."
+
+// HandleWebSocket serves the websocket transport, used by clients when
+// webrtc can't connect. The cdc and the panes are multiplexed over the
+// websocket.
+// As there's no DTLS fingerprint to check, clients must send a secret token,
+// either in the Authorization header or, as browsers can't set headers, as
+// a "bearer.<token>" subprotocol next to the webexec subprotocol. Tokens
+// are not accepted in the URL as it ends up in access logs.
+func (h *ConnectHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	var token string
+	if a := r.Header.Get("Authorization"); strings.HasPrefix(a, "Bearer ") {
+		token = a[len("Bearer "):]
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if token == "" && strings.HasPrefix(p, wsTokenPrefix) {
+			token = p[len(wsTokenPrefix):]
+		}
+	}
+	if token == "" || h.tokens == nil || !h.tokens.IsAuthorized(token) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: h.checkOrigin,
+		Subprotocols: []string{WSProtocol}}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		h.logger.Warnf("Failed to upgrade to websocket: %s", err)
+		return
+	}
+	fp := "ws-" + uuid.New().String()
+	h.logger.Infof("Client %s connected over websocket from %s", fp, r.RemoteAddr)
+	h.server.ServeWebSocket(fp, conn)
+}
+
+// checkOrigin allows the configured origins, or all when none are set
+func (h *ConnectHandler) checkOrigin(r *http.Request) bool {
+	if len(h.origins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, o := range h.origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+// This file holds the ICE networking options: single port UDP, ICE-TCP,
+// NAT 1:1 mapping, candidate filters & ICE-lite
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// ICEConf holds the ICE networking configuration
+type ICEConf struct {
+	// UDPPort serves all peers from a single UDP port when set
+	UDPPort int
+	// TCPPort is the port of the passive ICE-TCP listener when set
+	TCPPort int
+	// NAT1To1IPs are the public IPs of a host behind a 1:1 NAT
+	NAT1To1IPs []string
+	// Interfaces & Networks limit the candidates to these interfaces
+	// & networks
+	Interfaces []string
+	Networks   []*net.IPNet
+	// Lite makes webexec an ICE-lite agent
+	Lite bool
+}
+
+// parseICEConf parses the ICE options in the net section. It returns nil
+// when none are set.
+func parseICEConf(t *toml.Tree) (*ICEConf, error) {
+	c := &ICEConf{}
+	if v := t.Get("net.udp_port"); v != nil {
+		c.UDPPort = int(v.(int64))
+	}
+	if v := t.Get("net.tcp_port"); v != nil {
+		c.TCPPort = int(v.(int64))
+	}
+	if v := t.Get("net.nat_1to1_ips"); v != nil {
+		for _, ip := range v.([]interface{}) {
+			if net.ParseIP(ip.(string)) == nil {
+				return nil, fmt.Errorf("Bad NAT 1:1 IP: %q", ip)
+			}
+			c.NAT1To1IPs = append(c.NAT1To1IPs, ip.(string))
+		}
+	}
+	if v := t.Get("net.interfaces"); v != nil {
+		for _, i := range v.([]interface{}) {
+			c.Interfaces = append(c.Interfaces, i.(string))
+		}
+	}
+	if v := t.Get("net.networks"); v != nil {
+		for _, n := range v.([]interface{}) {
+			_, ipNet, err := net.ParseCIDR(n.(string))
+			if err != nil {
+				return nil, fmt.Errorf("Bad network %q: %s", n, err)
+			}
+			c.Networks = append(c.Networks, ipNet)
+		}
+	}
+	if v := t.Get("net.ice_lite"); v != nil {
+		c.Lite = v.(bool)
+	}
+	if c.UDPPort == 0 && c.TCPPort == 0 && len(c.NAT1To1IPs) == 0 &&
+		len(c.Interfaces) == 0 && len(c.Networks) == 0 && !c.Lite {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// SettingEngine returns a webrtc setting engine configured with the ICE
+// options and the listeners it uses
+func (c *ICEConf) SettingEngine() (*webrtc.SettingEngine, []io.Closer, error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	s := &webrtc.SettingEngine{}
+	var interfaceFilter func(string) bool
+	if len(c.Interfaces) > 0 {
+		interfaceFilter = func(name string) bool {
+			for _, i := range c.Interfaces {
+				if i == name {
+					return true
+				}
+			}
+			return false
+		}
+		s.SetInterfaceFilter(interfaceFilter)
+	}
+	var ipFilter func(net.IP) bool
+	if len(c.Networks) > 0 {
+		ipFilter = func(ip net.IP) bool {
+			for _, n := range c.Networks {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+		s.SetIPFilter(ipFilter)
+	}
+	networkTypes := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if c.UDPPort != 0 {
+		// the mux gathers its own addresses so it needs the filters too
+		opts := []ice.UDPMuxFromPortOption{}
+		if interfaceFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithInterfaceFilter(interfaceFilter))
+		}
+		if ipFilter != nil {
+			opts = append(opts, ice.UDPMuxFromPortWithIPFilter(ipFilter))
+		}
+		mux, err := ice.NewMultiUDPMuxFromPort(c.UDPPort, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to listen on UDP port %d: %s", c.UDPPort, err)
+		}
+		closers = append(closers, mux)
+		s.SetICEUDPMux(mux)
+	}
+	if c.TCPPort != 0 {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: c.TCPPort})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("Failed to listen on TCP port %d: %s", c.TCPPort, err)
+		}
+		mux := webrtc.NewICETCPMux(nil, l, 8)
+		closers = append(closers, mux)
+		s.SetICETCPMux(mux)
+		networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	s.SetNetworkTypes(networkTypes)
+	if len(c.NAT1To1IPs) > 0 {
+		err := s.SetICEAddressRewriteRules(webrtc.ICEAddressRewriteRule{
+			External:        c.NAT1To1IPs,
+			AsCandidateType: webrtc.ICECandidateTypeHost,
+			Mode:            webrtc.ICEAddressRewriteReplace,
+		})
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("Failed to set NAT 1:1 IPs: %s", err)
+		}
+	}
+	s.SetLite(c.Lite)
+	return s, closers, nil
+}
+
+// StartICE opens the ICE listeners and sets the peers' webrtc settings
+func StartICE(lc fx.Lifecycle, conf *AgentConf, peersConf *peers.Conf,
+	logger *zap.SugaredLogger) {
+
+	var closers []io.Closer
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			if conf.ice == nil {
+				return nil
+			}
+			s, c, err := conf.ice.SettingEngine()
+			if err != nil {
+				return err
+			}
+			closers = c
+			peersConf.WebrtcSetting = s
+			if conf.ice.UDPPort != 0 {
+				// all the peers use the single port
+				peersConf.PortMin = 0
+				peersConf.PortMax = 0
+				logger.Infof("Serving ICE on UDP port %d", conf.ice.UDPPort)
+			}
+			if conf.ice.TCPPort != 0 {
+				logger.Infof("Serving ICE-TCP on port %d", conf.ice.TCPPort)
+			}
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			for _, c := range closers {
+				c.Close()
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,70 @@
+// This files contains tests of the ICE networking options
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	toml "github.com/pelletier/go-toml"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+// freePort returns a port that's free for both UDP & TCP
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+func TestICESinglePort(t *testing.T) {
+	port := freePort(t)
+	tree, err := toml.Load(fmt.Sprintf(`[net]
+udp_port = %d
+tcp_port = %d
+nat_1to1_ips = [ "203.0.113.4" ]
+networks = [ "0.0.0.0/0" ]
+`, port, port))
+	require.NoError(t, err)
+	c, err := parseICEConf(tree)
+	require.NoError(t, err)
+	s, closers, err := c.SettingEngine()
+	require.NoError(t, err)
+	defer func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(*s))
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer pc.Close()
+	_, err = pc.CreateDataChannel("test", nil)
+	require.NoError(t, err)
+	offer, err := pc.CreateOffer(nil)
+	require.NoError(t, err)
+	gatherComplete := webrtc.GatheringCompletePromise(pc)
+	require.NoError(t, pc.SetLocalDescription(offer))
+	<-gatherComplete
+	var udp, tcp int
+	for _, line := range strings.Split(pc.LocalDescription().SDP, "\r\n") {
+		if !strings.HasPrefix(line, "a=candidate:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		require.Equal(t, "203.0.113.4", fields[4])
+		require.Equal(t, fmt.Sprint(port), fields[5])
+		if strings.ToLower(fields[2]) == "udp" {
+			udp++
+		} else {
+			tcp++
+			require.Contains(t, line, "tcptype passive")
+		}
+	}
+	require.Greater(t, udp, 0)
+	require.Greater(t, tcp, 0)
+}
@@ -3,12 +3,16 @@
 package main
 
 import (
+	"compress/flate"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -16,10 +20,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/client"
+	"github.com/tuzig/webexec/httpserver"
 	"github.com/tuzig/webexec/peers"
 	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
 )
 
 // SendRestore sends an restore message
@@ -122,8 +130,8 @@ func ParseAck(t *testing.T, msg webrtc.DataChannelMessage) peers.AckArgs {
 }
 
 func TestSimpleEcho(t *testing.T) {
-	initTest(t)
-	Logger.Infof("TestSimpleEcho")
+	logger := initTest(t)
+	logger.Infof("TestSimpleEcho")
 	closed := make(chan bool)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
@@ -134,11 +142,11 @@ func TestSimpleEcho(t *testing.T) {
 	dc, err := client.CreateDataChannel("echo,hello world", nil)
 	require.Nil(t, err, "Failed to create the echo data channel: %v", err)
 	dc.OnOpen(func() {
-		Logger.Infof("Channel %q opened", dc.Label())
+		logger.Infof("Channel %q opened", dc.Label())
 	})
 	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 		// first get a channel Id and then "hello world" text
-		Logger.Infof("got message: #%d %q", count, string(msg.Data))
+		logger.Infof("got message: #%d %q", count, string(msg.Data))
 		if count == 0 {
 			_, err = strconv.Atoi(string(msg.Data))
 			require.Nil(t, err, "Failed to cover channel it to int: %v", err)
@@ -149,16 +157,16 @@ func TestSimpleEcho(t *testing.T) {
 		count++
 	})
 	dc.OnClose(func() {
-		Logger.Info("Client Data channel closed")
+		logger.Info("Client Data channel closed")
 		closed <- true
 	})
 	err = SignalPair(client, peer)
 	require.NoError(t, err, "Signaling failed: %v", err)
 	// TODO: add timeout
-	Logger.Infof("Waiting for the channel to close")
+	logger.Infof("Waiting for the channel to close")
 	<-closed
-	Logger.Infof("TestSimpleEcho done")
-	panes := peers.Panes.All()
+	logger.Infof("TestSimpleEcho done")
+	panes := peer.Server.Panes.All()
 	lp := panes[len(panes)-1]
 
 	waitForChild(lp.C.Process.Pid, time.Second)
@@ -170,7 +178,7 @@ func TestSimpleEcho(t *testing.T) {
 }
 
 func TestResizeCommand(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	done := make(chan bool)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
@@ -189,7 +197,7 @@ func TestResizeCommand(t *testing.T) {
 			&addPaneArgs}
 		addPaneMsg, err := json.Marshal(m)
 		require.NoError(t, err, "failed marshilng ctrl msg: %s", err)
-		Logger.Info("Sending the addPane message")
+		logger.Info("Sending the addPane message")
 		cdc.Send(addPaneMsg)
 	})
 	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
@@ -200,12 +208,12 @@ func TestResizeCommand(t *testing.T) {
 			paneID, err := strconv.Atoi(string(ack.Body))
 			require.NoError(t, err, "failed to unmarshal ack body: %s", err)
 			require.NotEqual(t, -1, paneID, "Got a bad pane id: %d", paneID)
-			resizeArgs := peers.ResizeArgs{paneID, 80, 24}
+			resizeArgs := peers.ResizeArgs{PaneID: paneID, Sx: 80, Sy: 24}
 			m := peers.CTRLMessage{time.Now().UnixNano(), 456, "resize",
 				&resizeArgs}
 			resizeMsg, err := json.Marshal(m)
 			require.Nil(t, err, "failed marshilng ctrl msg: %v", err)
-			Logger.Info("Sending the resize message")
+			logger.Info("Sending the resize message")
 			cdc.Send(resizeMsg)
 
 		} else if ack.Ref == 456 {
@@ -222,7 +230,7 @@ func TestResizeCommand(t *testing.T) {
 }
 
 func TestPayloadOperations(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	done := make(chan bool)
 	client, certs, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
@@ -238,12 +246,12 @@ func TestPayloadOperations(t *testing.T) {
 			"set_payload", &args}
 		setMsg, err := json.Marshal(setPayload)
 		require.Nil(t, err, "Failed to marshal the auth args: %v", err)
-		Logger.Info("Sending set_payload msg")
+		logger.Info("Sending set_payload msg")
 		cdc.Send(setMsg)
 	})
 	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
 		// we should get an ack for the auth message and the get payload
-		Logger.Infof("Got a ctrl msg: %s", msg.Data)
+		logger.Infof("Got a ctrl msg: %s", msg.Data)
 		args := ParseAck(t, msg)
 		if args.Ref == 777 {
 			require.Nil(t, err, "Failed to unmarshall the control data channel: %v", err)
@@ -260,8 +268,66 @@ func TestPayloadOperations(t *testing.T) {
 	}
 	// TODO: now get_payload and make sure it's the same
 }
+func TestLayoutOperations(t *testing.T) {
+	logger := initTest(t)
+	done := make(chan bool)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	defer client.Close()
+	peer := newPeer(t, "A", certs)
+	peer.Server.Layout.OnChange = func(l peers.Layout) {
+		peer.Server.BroadcastAll("layout", l)
+	}
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "Failed to create the control data channel: %v", err)
+	sendSet := func(ref int) {
+		args := peers.SetLayoutArgs{
+			Version: 0,
+			Layout:  peers.Layout{Gates: []peers.Gate{{Name: "home"}}},
+		}
+		msg, err := json.Marshal(peers.CTRLMessage{
+			Time: time.Now().UnixNano(), Ref: ref, Type: "set_layout", Args: &args})
+		require.Nil(t, err, "Failed to marshal set_layout: %v", err)
+		cdc.Send(msg)
+	}
+	cdc.OnOpen(func() {
+		time.Sleep(10 * time.Millisecond)
+		sendSet(777)
+	})
+	gotLayout := false
+	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var cm peers.CTRLMessage
+		logger.Infof("Got a ctrl msg: %s", msg.Data)
+		err := json.Unmarshal(msg.Data, &cm)
+		require.Nil(t, err, "Failed to unmarshal the server msg: %v", err)
+		switch cm.Type {
+		case "layout":
+			gotLayout = true
+		case "ack":
+			args := ParseAck(t, msg)
+			require.Equal(t, 777, args.Ref)
+			var l peers.Layout
+			err = json.Unmarshal([]byte(args.Body), &l)
+			require.Nil(t, err, "Failed to unmarshal the layout: %v", err)
+			require.Equal(t, 1, l.Version)
+			require.Equal(t, "home", l.Gates[0].Name)
+			// the same update again should conflict
+			sendSet(778)
+		case "nack":
+			require.True(t, gotLayout, "Expected a layout message")
+			done <- true
+		}
+	})
+	SignalPair(client, peer)
+	select {
+	case <-time.After(3 * time.Second):
+		t.Error("Timeout waiting for layout nack")
+	case <-done:
+	}
+}
+
 func TestMarkerRestore(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	var (
 		cID         string
 		dc          *webrtc.DataChannel
@@ -285,11 +351,11 @@ func TestMarkerRestore(t *testing.T) {
 	// count the incoming messages
 	count := 0
 	cdc.OnOpen(func() {
-		Logger.Info("cdc is opened")
+		logger.Info("cdc is opened")
 		cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			// we should get an ack for the auth message
 			var cm peers.CTRLMessage
-			Logger.Infof("Got a ctrl msg: %s", msg.Data)
+			logger.Infof("Got a ctrl msg: %s", msg.Data)
 			err := json.Unmarshal(msg.Data, &cm)
 			require.Nil(t, err, "Failed to marshal the server msg: %v", err)
 			if cm.Type == "ack" {
@@ -300,7 +366,7 @@ func TestMarkerRestore(t *testing.T) {
 					// convert the body to int
 					marker, err = strconv.Atoi(string(args.Body))
 					require.NoError(t, err)
-					Logger.Infof("Got marker: %d", marker)
+					logger.Infof("Got marker: %d", marker)
 					gotSetMarkerAck <- true
 				}
 			}
@@ -309,14 +375,14 @@ func TestMarkerRestore(t *testing.T) {
 			"24x80,bash,-c,echo 123456 ; sleep 1; echo 789; sleep 9", nil)
 		require.Nil(t, err, "Failed to create the echo data channel: %v", err)
 		dc.OnOpen(func() {
-			Logger.Infof("Channel %q opened", dc.Label())
+			logger.Infof("Channel %q opened", dc.Label())
 		})
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			Logger.Infof("DC Got msg #%d: %s", count, msg.Data)
+			logger.Infof("DC Got msg #%d: %s", count, msg.Data)
 			if len(msg.Data) > 0 {
 				if count == 0 {
 					cID = string(msg.Data)
-					Logger.Infof("Client got a channel id: %q", cID)
+					logger.Infof("Client got a channel id: %q", cID)
 				}
 				if count == 1 {
 					require.Contains(t, string(msg.Data), "123456")
@@ -340,10 +406,10 @@ func TestMarkerRestore(t *testing.T) {
 		t.Error("Timeout waiting for marker ack")
 	case <-gotSetMarkerAck:
 	}
-	client2, certs, err := NewClient(true)
+	client2, _, err := NewClient(true)
 	require.Nil(t, err, "Failed to create the second client %v", err)
 	defer client2.Close()
-	peer2 := newPeer(t, "A", certs)
+	peer2 := newServerPeer(t, peer.Server, "A")
 	require.Nil(t, err, "Failed to start a new server %v", err)
 	// create the command & control data channel
 	SignalPair(client2, peer2)
@@ -358,7 +424,7 @@ func TestMarkerRestore(t *testing.T) {
 			var cm peers.CTRLMessage
 			err := json.Unmarshal(msg.Data, &cm)
 			require.Nil(t, err, "Failed to marshal the server msg: %v", err)
-			Logger.Info("client2 got msg: %v", cm)
+			logger.Info("client2 got msg: %v", cm)
 			if cm.Type == "ack" {
 				gotAck <- true
 			}
@@ -368,7 +434,7 @@ func TestMarkerRestore(t *testing.T) {
 		dc, err = client2.CreateDataChannel(">"+cID, nil)
 		require.Nil(t, err, "Failed to create the echo data channel: %v", err)
 		dc.OnOpen(func() {
-			Logger.Infof("TS> Channel %q re-opened", dc.Label())
+			logger.Infof("TS> Channel %q re-opened", dc.Label())
 		})
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			// ignore null messages
@@ -386,7 +452,7 @@ func TestMarkerRestore(t *testing.T) {
 	}
 }
 func TestAddPaneMessage(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	var wg sync.WaitGroup
 	// the trinity: a new datachannel, an ack and BADWOLF (aka command output)
 	wg.Add(3)
@@ -397,24 +463,24 @@ func TestAddPaneMessage(t *testing.T) {
 	done := make(chan bool)
 	client.OnDataChannel(func(d *webrtc.DataChannel) {
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			Logger.Infof("Got a new datachannel message: %s", string(msg.Data))
+			logger.Infof("Got a new datachannel message: %s", string(msg.Data))
 			require.Equal(t, "BADWOLF", string(msg.Data[:7]))
-			Logger.Infof(string(msg.Data))
+			logger.Infof(string(msg.Data))
 			wg.Done()
 		})
 		l := d.Label()
-		Logger.Infof("Got a new datachannel: %s", l)
+		logger.Infof("Got a new datachannel: %s", l)
 		require.Regexp(t, regexp.MustCompile("^456:[0-9]+"), l)
 		wg.Done()
 	})
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "failed to create the control data channel: %v", err)
 	cdc.OnOpen(func() {
-		Logger.Info("cdc opened")
+		logger.Info("cdc opened")
 		cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			ack := ParseAck(t, msg)
 			if ack.Ref == 456 {
-				Logger.Infof("Got the ACK")
+				logger.Infof("Got the ACK")
 				wg.Done()
 			}
 		})
@@ -438,8 +504,57 @@ func TestAddPaneMessage(t *testing.T) {
 	case <-done:
 	}
 }
-func TestReconnectPane(t *testing.T) {
+func TestAddPaneCompressed(t *testing.T) {
 	initTest(t)
+	client, certs, err := NewClient(true)
+	require.Nil(t, err, "Failed to create a new client %v", err)
+	defer client.Close()
+	peer := newPeer(t, "A", certs)
+	done := make(chan bool)
+	pr, pw := io.Pipe()
+	go func() {
+		// all the messages are parts of a single deflate stream
+		r := flate.NewReaderDict(pr, peers.CompressionDict)
+		b := make([]byte, 4096)
+		var out []byte
+		for {
+			l, err := r.Read(b)
+			out = append(out, b[:l]...)
+			if strings.Contains(string(out), "BADWOLF") {
+				done <- true
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	client.OnDataChannel(func(d *webrtc.DataChannel) {
+		d.OnMessage(func(msg webrtc.DataChannelMessage) {
+			pw.Write(msg.Data)
+		})
+	})
+	cdc, err := client.CreateDataChannel("%", nil)
+	require.Nil(t, err, "failed to create the control data channel: %v", err)
+	cdc.OnOpen(func() {
+		addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
+			Command: []string{"echo", "BADWOLF"}, Compression: "deflate"}
+		m := peers.CTRLMessage{Time: time.Now().UnixNano(), Ref: 456,
+			Type: "add_pane", Args: &addPaneArgs}
+		msg, err := json.Marshal(m)
+		require.Nil(t, err, "failed marshilng ctrl msg: %v", msg)
+		time.Sleep(time.Second / 10)
+		cdc.Send(msg)
+	})
+	SignalPair(client, peer)
+	select {
+	case <-time.After(6 * time.Second):
+		t.Error("Timeout waiting for compressed output")
+	case <-done:
+	}
+}
+func TestReconnectPane(t *testing.T) {
+	logger := initTest(t)
 	var (
 		wg     sync.WaitGroup
 		gotMsg sync.WaitGroup
@@ -454,22 +569,22 @@ func TestReconnectPane(t *testing.T) {
 		//fs := strings.Split(d.Label(), ",")
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
 			if len(msg.Data) > 0 {
-				Logger.Infof("Got a message in %s: %s", l, string(msg.Data))
+				logger.Infof("Got a message in %s: %s", l, string(msg.Data))
 				if strings.Contains(string(msg.Data), "BADWOLF") {
 					gotMsg.Done()
 				}
 			}
 		})
-		Logger.Infof("Got a new datachannel: %s", l)
+		logger.Infof("Got a new datachannel: %s", l)
 		require.Regexp(t, regexp.MustCompile("^45[67]:[0-9]+"), l)
 		wg.Done()
 	})
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "failed to create the control data channel: %v", err)
 	cdc.OnOpen(func() {
-		Logger.Info("cdc opened")
+		logger.Info("cdc opened")
 		cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
-			Logger.Infof("cdc got an ack: %v", string(msg.Data))
+			logger.Infof("cdc got an ack: %v", string(msg.Data))
 			ack := ParseAck(t, msg)
 			if ack.Ref == 456 {
 				ci, err = strconv.Atoi(string(ack.Body))
@@ -490,7 +605,7 @@ func TestReconnectPane(t *testing.T) {
 	gotMsg.Add(2)
 	SignalPair(client, peer)
 	wg.Wait()
-	Logger.Infof("After first wait")
+	logger.Infof("After first wait")
 	wg.Add(1)
 	a := peers.ReconnectPaneArgs{ID: ci}
 	m := peers.CTRLMessage{time.Now().UnixNano(), 457, "reconnect_pane",
@@ -532,16 +647,17 @@ func TestExecCommandWithParent(t *testing.T) {
 }
 func TestPasteCommand(t *testing.T) {
 	done := make(chan bool)
-	initTest(t)
+	logger := initTest(t)
 	// init socket server
 	lifecycle := fxtest.NewLifecycle(t)
 	k := KeyType{}
 	certificate, err := k.generate()
 	require.NoError(t, err, "Failed to generate a certificate", err)
 	conf := peers.Conf{
-		Certificate:       certificate,
-		AckTimeout:        time.Second,
-		Logger:            Logger,
+		Certificate: certificate,
+		AckTimeout:  time.Second,
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
 		DisconnectTimeout: time.Second,
 		FailedTimeout:     time.Second,
 		KeepAliveInterval: time.Second,
@@ -550,7 +666,8 @@ func TestPasteCommand(t *testing.T) {
 			return nil, nil
 		},
 	}
-	sockServer := NewSockServer(&conf)
+	ps := newServer(&conf)
+	sockServer := NewSockServer(ps, nil, conf.Logger)
 	require.NotNil(t, sockServer, "Failed to create a new server")
 	startParams := SocketStartParams{t.TempDir()}
 	server, err := StartSocketServer(lifecycle, sockServer, startParams)
@@ -558,11 +675,11 @@ func TestPasteCommand(t *testing.T) {
 	require.NotNil(t, server, "Failed to start a new server")
 	lifecycle.RequireStart()
 	defer lifecycle.RequireStop()
-	client, certs, err := NewClient(true)
+	client, _, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client %v", err)
 	defer client.Close()
-	peer := newPeer(t, "A", certs)
-	peers.SetLastPeer(peer)
+	peer := newServerPeer(t, ps, "A")
+	ps.SetLastPeer(peer)
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "failed to create the control data channel: %v", err)
 	cdc.OnOpen(func() {
@@ -572,7 +689,7 @@ func TestPasteCommand(t *testing.T) {
 			&addPaneArgs}
 		addPaneMsg, err := json.Marshal(m)
 		require.NoError(t, err, "failed marshilng ctrl msg: %s", err)
-		Logger.Info("Sending the addPane message")
+		logger.Info("Sending the addPane message")
 		cdc.Send(addPaneMsg)
 	})
 	cdc.OnMessage(func(msg webrtc.DataChannelMessage) {
@@ -584,7 +701,7 @@ func TestPasteCommand(t *testing.T) {
 		case "ack":
 			go func() {
 				fp := GetSockFP()
-				Logger.Infof("Got a fp: %s", fp)
+				logger.Infof("Got a fp: %s", fp)
 				httpc := http.Client{
 					Transport: &http.Transport{
 						DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
@@ -607,7 +724,7 @@ func TestPasteCommand(t *testing.T) {
 			ackMsg, err := json.Marshal(ack)
 			require.Nil(t, err)
 			cdc.Send(ackMsg)
-			Logger.Info("Sent the ack")
+			logger.Info("Sent the ack")
 		default:
 			t.Errorf("Got a bad message: %s", cm.Type)
 		}
@@ -622,7 +739,7 @@ func TestPasteCommand(t *testing.T) {
 
 func TestCopyCommand(t *testing.T) {
 	done := make(chan bool)
-	initTest(t) // Setup test dependencies
+	logger := initTest(t) // Setup test dependencies
 
 	// Initialize socket server
 	lifecycle := fxtest.NewLifecycle(t)
@@ -632,9 +749,18 @@ func TestCopyCommand(t *testing.T) {
 	conf := peers.Conf{
 		Certificate: certificate,
 		AckTimeout:  time.Second,
-		// Remaining configuration similar to TestPasteCommand
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		GatheringTimeout:  time.Second,
+		GetICEServers: func() ([]webrtc.ICEServer, error) {
+			return nil, nil
+		},
 	}
-	sockServer := NewSockServer(&conf)
+	ps := newServer(&conf)
+	sockServer := NewSockServer(ps, nil, conf.Logger)
 	require.NotNil(t, sockServer, "Failed to create a new server")
 	startParams := SocketStartParams{t.TempDir()}
 	server, err := StartSocketServer(lifecycle, sockServer, startParams)
@@ -643,11 +769,11 @@ func TestCopyCommand(t *testing.T) {
 	lifecycle.RequireStart()
 	defer lifecycle.RequireStop()
 
-	client, certs, err := NewClient(true)
+	client, _, err := NewClient(true)
 	require.Nil(t, err, "Failed to create a new client")
 	defer client.Close()
-	peer := newPeer(t, "B", certs)
-	peers.SetLastPeer(peer)
+	peer := newServerPeer(t, ps, "B")
+	ps.SetLastPeer(peer)
 	cdc, err := client.CreateDataChannel("%", nil)
 	require.Nil(t, err, "failed to create the control data channel")
 
@@ -658,7 +784,7 @@ func TestCopyCommand(t *testing.T) {
 			&addPaneArgs}
 		addPaneMsg, err := json.Marshal(m)
 		require.NoError(t, err, "failed marshilng ctrl msg: %s", err)
-		Logger.Info("Sending the addPane message")
+		logger.Info("Sending the addPane message")
 		cdc.Send(addPaneMsg)
 	})
 
@@ -670,7 +796,7 @@ func TestCopyCommand(t *testing.T) {
 		switch cm.Type {
 		case "ack":
 			go func() {
-				Logger.Infof("Got a fp: %s", startParams.fp)
+				logger.Infof("Got a fp: %s", startParams.fp)
 				httpc := http.Client{
 					Transport: &http.Transport{
 						DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
@@ -709,3 +835,219 @@ func TestCopyCommand(t *testing.T) {
 	}
 
 }
+
+func TestWebSocketTransport(t *testing.T) {
+	logger := initTest(t)
+	fps, err := os.CreateTemp(t.TempDir(), "authorized_fingerprints")
+	require.NoError(t, err)
+	fps.WriteString("wsfingerprint\n")
+	fps.Close()
+	tokens, err := os.CreateTemp(t.TempDir(), "authorized_tokens")
+	require.NoError(t, err)
+	tokens.WriteString("wstoken\n")
+	tokens.Close()
+	conf := &peers.Conf{
+		AckTimeout: time.Second,
+		Logger:     logger,
+	}
+	h := httpserver.NewConnectHandler(NewFileAuth(fps.Name()), newServer(conf), logger)
+	h.SetTokens(NewFileAuth(tokens.Name()))
+	ts := httptest.NewServer(http.HandlerFunc(h.HandleWebSocket))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+	// bad tokens, fingerprints & tokens in the URL are refused
+	for _, header := range []http.Header{
+		{"Authorization": []string{"Bearer bad"}},
+		{"Authorization": []string{"Bearer wsfingerprint"}},
+		nil,
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"?access_token=wstoken", header)
+		require.Error(t, err)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+	// browsers send the token as a subprotocol
+	dialer := websocket.Dialer{Subprotocols: []string{httpserver.WSProtocol, "bearer.wstoken"}}
+	conn, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	require.Equal(t, httpserver.WSProtocol, conn.Subprotocol())
+	conn.Close()
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{
+		"Authorization": []string{"Bearer wstoken"}})
+	require.NoError(t, err)
+	defer conn.Close()
+	send := func(id uint32, b []byte) {
+		frame := make([]byte, 4+len(b))
+		binary.BigEndian.PutUint32(frame, id)
+		copy(frame[4:], b)
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, frame))
+	}
+	addPaneArgs := peers.AddPaneArgs{Rows: 12, Cols: 34,
+		Command: []string{"sh", "-c", "read l; echo got $l"}}
+	msg, err := json.Marshal(peers.CTRLMessage{
+		Time: time.Now().UnixNano(), Ref: 456, Type: "add_pane", Args: &addPaneArgs})
+	require.NoError(t, err)
+	send(0, msg)
+	var paneID uint32
+	var output string
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(output, "got BADWOLF") {
+		_, b, err := conn.ReadMessage()
+		require.NoError(t, err)
+		id := binary.BigEndian.Uint32(b[:4])
+		if id == 0 {
+			ack := ParseAck(t, webrtc.DataChannelMessage{Data: b[4:]})
+			if ack.Ref == 456 {
+				i, err := strconv.Atoi(ack.Body)
+				require.NoError(t, err)
+				paneID = uint32(i)
+				send(paneID, []byte("BADWOLF\n"))
+			}
+			continue
+		}
+		require.NotZero(t, paneID)
+		require.Equal(t, paneID, id)
+		output += string(b[4:])
+	}
+	// the pane's stream is closed with an empty frame when the pane exits
+	for {
+		_, b, err := conn.ReadMessage()
+		require.NoError(t, err)
+		if binary.BigEndian.Uint32(b[:4]) == paneID && len(b) == 4 {
+			break
+		}
+	}
+}
+
+// newClientTestServer returns an http server with a peers server authorizing
+// "clienttoken"
+func newClientTestServer(t *testing.T) *httptest.Server {
+	f, err := os.CreateTemp(t.TempDir(), "authorized_fingerprints")
+	require.NoError(t, err)
+	f.WriteString("clienttoken\n")
+	f.Close()
+	k := KeyType{}
+	certificate, err := k.generate()
+	require.NoError(t, err)
+	conf := &peers.Conf{
+		Certificate: certificate,
+		AckTimeout:  time.Second,
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		GatheringTimeout:  time.Second,
+		GetICEServers: func() ([]webrtc.ICEServer, error) {
+			return []webrtc.ICEServer{}, nil
+		},
+	}
+	h := httpserver.NewConnectHandler(NewFileAuth(f.Name()), newServer(conf), conf.Logger)
+	mux := http.NewServeMux()
+	h.AddHandlers(mux)
+	return httptest.NewServer(mux)
+}
+
+func TestClient(t *testing.T) {
+	initTest(t)
+	ts := newClientTestServer(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// a bad token is refused
+	_, err := client.Dial(ctx, ts.URL, client.Options{Token: "bad"})
+	require.Error(t, err)
+	c, err := client.Dial(ctx, ts.URL, client.Options{Token: "clienttoken"})
+	require.NoError(t, err)
+	hello := c.Hello()
+	require.NotNil(t, hello)
+	require.Equal(t, peers.ProtocolRevision, hello.Protocol)
+	require.Contains(t, hello.Capabilities, "tmux")
+	require.Contains(t, hello.Messages, "add_pane")
+	defer c.Close()
+	pane, err := c.AddPane(ctx, peers.AddPaneArgs{Rows: 12, Cols: 34,
+		Command: []string{"sh", "-c", "read l; echo got $l"}})
+	require.NoError(t, err)
+	require.NotZero(t, pane.ID)
+	require.NoError(t, c.Resize(ctx, pane.ID, 24, 80))
+	require.NoError(t, c.SetPayload(ctx, json.RawMessage(`{"a":1}`)))
+	payload, err := c.GetPayload(ctx)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":1}`, string(payload))
+	marker, err := c.Mark(ctx)
+	require.NoError(t, err)
+	payload, err = c.Restore(ctx, marker)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":1}`, string(payload))
+	// a second stream of the same pane gets the output too
+	pane2, err := c.Reconnect(ctx, pane.ID)
+	require.NoError(t, err)
+	require.Equal(t, pane.ID, pane2.ID)
+	_, err = pane.Write([]byte("BADWOLF\n"))
+	require.NoError(t, err)
+	// the stream ends when the pane exits
+	output, err := io.ReadAll(pane)
+	require.NoError(t, err)
+	require.Contains(t, string(output), "got BADWOLF")
+	_, err = c.Reconnect(ctx, 9999)
+	require.Error(t, err)
+}
+
+func TestClientMux(t *testing.T) {
+	initTest(t)
+	ts := newClientTestServer(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, ts.URL, client.Options{Token: "clienttoken", Mux: true})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Contains(t, c.Hello().Capabilities, peers.CapMux)
+	// both panes share the mux channel
+	var panes []*client.Pane
+	for i := 0; i < 2; i++ {
+		pane, err := c.AddPane(ctx, peers.AddPaneArgs{Rows: 12, Cols: 34,
+			Command: []string{"sh", "-c", "read l; echo got $l"}})
+		require.NoError(t, err)
+		panes = append(panes, pane)
+	}
+	require.NotEqual(t, panes[0].ID, panes[1].ID)
+	for i, pane := range panes {
+		_, err = pane.Write([]byte(fmt.Sprintf("PANE%d\n", i)))
+		require.NoError(t, err)
+	}
+	for i, pane := range panes {
+		output, err := io.ReadAll(pane)
+		require.NoError(t, err)
+		require.Contains(t, string(output), fmt.Sprintf("got PANE%d", i))
+	}
+}
+
+func TestClientEvents(t *testing.T) {
+	initTest(t)
+	ts := newClientTestServer(t)
+	defer ts.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events := make(chan peers.EventArgs, 10)
+	c, err := client.Dial(ctx, ts.URL, client.Options{Token: "clienttoken",
+		OnMessage: func(typ string, args json.RawMessage) (string, error) {
+			var ev peers.EventArgs
+			err := json.Unmarshal(args, &ev)
+			if err == nil && typ == "event" {
+				events <- ev
+			}
+			return "", err
+		}})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Contains(t, c.Hello().Capabilities, peers.CapEvents)
+	require.Error(t, c.Subscribe(ctx, "foo"))
+	require.NoError(t, c.Subscribe(ctx, peers.EventPaneCreated, peers.EventPaneExited))
+	pane, err := c.AddPane(ctx, peers.AddPaneArgs{Rows: 12, Cols: 34,
+		Command: []string{"sh", "-c", "read l"}})
+	require.NoError(t, err)
+	require.Equal(t, peers.EventArgs{Type: peers.EventPaneCreated, PaneID: pane.ID}, <-events)
+	_, err = pane.Write([]byte("bye\n"))
+	require.NoError(t, err)
+	require.Equal(t, peers.EventArgs{Type: peers.EventPaneExited, PaneID: pane.ID}, <-events)
+}
@@ -72,12 +72,6 @@ func GetCerts() ([]webrtc.Certificate, error) {
 			cert, err = webrtc.CertificateFromPEM(string(pb))
 			if err != nil {
 				return nil, fmt.Errorf("Failed to decode certificate at - %s", fPath)
-				Logger.Infof("Failed to decode certificate, generating a fresh one: %w", err)
-				cert, err = key.generate()
-				if err != nil {
-					return nil, err
-				}
-				key.save(cert)
 			}
 		}
 		key.certs = []webrtc.Certificate{*cert}
@@ -24,7 +24,7 @@ func TestGetCerts(t *testing.T) {
 	require.Equal(t, 1, len(cs))
 }
 func TestCertsCache(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	f, err := ioutil.TempFile("", "private.key")
 	require.Nil(t, err)
 	f.Close()
@@ -33,18 +33,18 @@ func TestCertsCache(t *testing.T) {
 	// test to ensure we're not hitting the disk - mock ioutil.ReadFile
 	cs2, err := GetCerts()
 	require.Nil(t, err)
-	Logger.Infof("%v\n%v", cs1, cs2)
+	logger.Infof("%v\n%v", cs1, cs2)
 	require.True(t, cs1[0].Equals(cs2[0]))
 }
 func TestKeyConsistency(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	f, err := ioutil.TempFile("", "private.key")
 	require.Nil(t, err)
 	f.Close()
 	cs1, err := GetCerts()
 	require.Nil(t, err)
 	cs2, err := GetCerts()
-	Logger.Infof("%v\n%v", cs1, cs2)
+	logger.Infof("%v\n%v", cs1, cs2)
 	require.Nil(t, err)
 	//	require.True(t, cs1[0].Equals(cs2[0]))
 	fps1, err := cs1[0].GetFingerprints()
@@ -17,68 +17,107 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/tuzig/webexec/peers"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 const writeWait = time.Second * 10
 
-var PBICEServers []webrtc.ICEServer
 var wsWriteM sync.Mutex
 
+// ICEServers holds the ICE servers a new peer gets: the embedded TURN
+// server, the configured ones and peerbook's, which are cached until they
+// expire
+type ICEServers struct {
+	conf     *AgentConf
+	logger   *zap.SugaredLogger
+	m        sync.Mutex
+	turn     *TURNServer
+	pb       []webrtc.ICEServer
+	pbExpire time.Time
+}
+
+// NewICEServers returns an empty set of ICE servers
+func NewICEServers(conf *AgentConf, logger *zap.SugaredLogger) *ICEServers {
+	return &ICEServers{conf: conf, logger: logger}
+}
+
+// SetICEServers makes the peers use the ICE servers
+func SetICEServers(conf *peers.Conf, ice *ICEServers) {
+	conf.GetICEServers = ice.Get
+}
+
+// setTURN sets the embedded TURN server, nil when it's stopped
+func (i *ICEServers) setTURN(s *TURNServer) {
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.turn = s
+}
+
 // outChan is used to send messages to peerbook
 type PeerbookClient struct {
-	outChan  chan []byte
-	ws       *websocket.Conn
-	peerConf *peers.Conf
-	host     string
+	outChan chan []byte
+	ws      *websocket.Conn
+	server  *peers.Server
+	host    string
+	conf    *AgentConf
+	logger  *zap.SugaredLogger
 }
 
-func NewPeerbookClient(peerConf *peers.Conf) *PeerbookClient {
+func NewPeerbookClient(server *peers.Server, conf *AgentConf, logger *zap.SugaredLogger) *PeerbookClient {
 	return &PeerbookClient{
-		outChan:  make(chan []byte),
-		peerConf: peerConf,
+		outChan: make(chan []byte),
+		server:  server,
+		conf:    conf,
+		logger:  logger,
 	}
 }
-func StartPeerbookClient(lc fx.Lifecycle, client *PeerbookClient) {
+func StartPeerbookClient(lc fx.Lifecycle, client *PeerbookClient, ice *ICEServers) {
+	ctx, cancel := context.WithCancel(context.Background())
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
-			if Conf.peerbookUID == "" {
-				Logger.Info("No peerbook user ID configured, skipping peerbook connection")
+			if client.conf.peerbookUID == "" {
+				client.logger.Info("No peerbook user ID configured, skipping peerbook connection")
 				return nil
 			}
 
-			verified, err := verifyPeer(Conf.peerbookHost)
+			verified, err := verifyPeer(client.conf)
 			if err != nil {
-				Logger.Warnf("Got an error verifying peer: %s", err)
+				client.logger.Warnf("Got an error verifying peer: %s", err)
 			}
 			if verified {
-				Logger.Infof("Verified by %s as %s", Conf.peerbookHost, Conf.peerbookUID)
+				client.logger.Infof("Verified by %s as %s", client.conf.peerbookHost, client.conf.peerbookUID)
 			} else {
-				fp := getFP()
-				Logger.Infof("Unverified, please use Terminal7 to verify fingerprint: %s", fp)
+				fp, _ := getFP()
+				client.logger.Infof("Unverified, please use Terminal7 to verify fingerprint: %s", fp)
 			}
 			go client.Go()
-			Logger.Info("Started peerbook client")
+			go ice.refreshPB(ctx)
+			client.logger.Info("Started peerbook client")
 			return nil
 		},
-		OnStop: func(ctx context.Context) error {
-			Logger.Info("TODO: stop peerbook client")
+		OnStop: func(context.Context) error {
+			cancel()
+			client.logger.Info("TODO: stop peerbook client")
 			return nil
 		},
 	})
 }
-func verifyPeer(host string) (bool, error) {
-	fp := getFP()
+func verifyPeer(conf *AgentConf) (bool, error) {
+	fp, err := getFP()
+	if err != nil {
+		return false, err
+	}
 	msg := map[string]string{
 		"fp":   fp,
-		"uid":  Conf.peerbookUID,
+		"uid":  conf.peerbookUID,
 		"kind": "webexec",
-		"name": Conf.name}
+		"name": conf.name}
 	m, err := json.Marshal(msg)
 	schema := "https"
-	if Conf.insecure {
+	if conf.insecure {
 		schema = "http"
 	}
-	url := url.URL{Scheme: schema, Host: host, Path: "/verify"}
+	url := url.URL{Scheme: schema, Host: conf.peerbookHost, Path: "/verify"}
 	resp, err := http.Post(url.String(), "application/json", bytes.NewBuffer(m))
 	if err != nil {
 		return false, err
@@ -100,33 +139,109 @@ func verifyPeer(host string) (bool, error) {
 		return false, fmt.Errorf("No verified field in response")
 	}
 }
-func GetICEServers() ([]webrtc.ICEServer, error) {
-	host := Conf.peerbookHost
-	if host == "" {
-		return Conf.iceServers, nil
-	}
-	if len(PBICEServers) == 0 {
-		schema := "https"
-		if Conf.insecure {
-			schema = "http"
+
+// Get returns the ICE servers for a new peer: the embedded TURN server, the
+// configured servers and peerbook's servers. When peerbook's servers can't
+// be refreshed the cached ones are used.
+func (i *ICEServers) Get() ([]webrtc.ICEServer, error) {
+	servers := []webrtc.ICEServer{}
+	i.m.Lock()
+	turn := i.turn
+	i.m.Unlock()
+	if turn != nil {
+		// every peer gets its own short lived credentials
+		s, err := turn.ICEServer()
+		if err != nil {
+			i.logger.Errorf("Failed to get the embedded TURN server: %s", err)
+		} else {
+			servers = append(servers, s)
 		}
-		url := url.URL{Scheme: schema, Host: host, Path: "/turn"}
-		resp, err := http.Post(url.String(), "application/json", nil)
+	}
+	for _, s := range i.conf.iceServers {
+		servers = append(servers, s.WebRTC(time.Now()))
+	}
+	if i.conf.peerbookHost == "" {
+		return servers, nil
+	}
+	pbServers, err := i.getPB()
+	if err != nil {
+		i.logger.Warnf("Failed to refresh peerbook's ICE servers, using %d cached: %s",
+			len(pbServers), err)
+	}
+	return append(servers, pbServers...), nil
+}
+
+// getPB returns peerbook's ICE servers, fetching them if they're missing or
+// expired. When fetching fails, it returns the cached servers with the error.
+func (i *ICEServers) getPB() ([]webrtc.ICEServer, error) {
+	i.m.Lock()
+	cached := i.pb
+	fresh := len(cached) > 0 && time.Now().Before(i.pbExpire)
+	i.m.Unlock()
+	if fresh {
+		return cached, nil
+	}
+	servers, err := fetchPBICEServers(i.conf)
+	if err != nil {
+		return cached, err
+	}
+	i.m.Lock()
+	defer i.m.Unlock()
+	i.pb = servers
+	i.pbExpire = iceServersExpire(servers, time.Now().Add(i.conf.iceRefresh))
+	i.logger.Infof("Got %d ICE servers from peerbook, expiring at %s",
+		len(i.pb), i.pbExpire)
+	return i.pb, nil
+}
+
+// fetchPBICEServers gets the ICE servers from peerbook
+func fetchPBICEServers(conf *AgentConf) ([]webrtc.ICEServer, error) {
+	schema := "https"
+	if conf.insecure {
+		schema = "http"
+	}
+	url := url.URL{Scheme: schema, Host: conf.peerbookHost, Path: "/turn"}
+	httpc := http.Client{Timeout: conf.peerbookTimeout}
+	resp, err := httpc.Post(url.String(), "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, errors.New(string(b))
+	}
+	var servers []webrtc.ICEServer
+	err = json.NewDecoder(resp.Body).Decode(&servers)
+	if err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// refreshPB refreshes peerbook's ICE servers before they expire so long
+// running agents don't use stale TURN credentials
+func (i *ICEServers) refreshPB(ctx context.Context) {
+	for {
+		_, err := i.getPB()
+		wait := i.conf.iceRefresh
 		if err != nil {
-			return nil, err
+			i.logger.Warnf("Failed to refresh ICE servers: %s", err)
+			wait = i.conf.peerbookTimeout
+		} else {
+			i.m.Lock()
+			wait = time.Until(i.pbExpire)
+			i.m.Unlock()
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode != 200 {
-			b, _ := ioutil.ReadAll(resp.Body)
-			return nil, errors.New(string(b))
+		if wait < time.Minute {
+			wait = time.Minute
 		}
-		err = json.NewDecoder(resp.Body).Decode(&PBICEServers)
-		if err != nil {
-			return nil, err
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
 		}
 	}
-	Logger.Infof("Got %d ICE servers from peerbook", len(PBICEServers))
-	return append(Conf.iceServers, PBICEServers...), nil
 }
 
 func (pb *PeerbookClient) Go() error {
@@ -136,31 +251,31 @@ func (pb *PeerbookClient) Go() error {
 		defer close(done)
 		for {
 			if pb.ws == nil {
-				Logger.Infof("Dialing PeerBook in %s", time.Now())
+				pb.logger.Infof("Dialing PeerBook in %s", time.Now())
 				err := pb.Dial()
 				if err != nil {
-					Logger.Errorf("Failed to dial the peerbook server: %q", err)
+					pb.logger.Errorf("Failed to dial the peerbook server: %q", err)
 					pb.ws = nil
-					time.Sleep(Conf.peerbookTimeout)
+					time.Sleep(pb.conf.peerbookTimeout)
 					continue
 				}
 			}
 
 			mType, m, err := pb.ws.ReadMessage()
 			if err != nil {
-				Logger.Warnf("Signaling read error: %w", err)
-				time.Sleep(Conf.peerbookTimeout)
+				pb.logger.Warnf("Signaling read error: %w", err)
+				time.Sleep(pb.conf.peerbookTimeout)
 				pb.ws = nil
 				continue
 			}
 			if mType == websocket.TextMessage {
-				Logger.Infof("Received text message %s", string(m))
+				pb.logger.Infof("Received text message %s", string(m))
 				err = pb.handleMessage(m)
 				if err != nil {
-					Logger.Errorf("Failed to handle message: %w", err)
+					pb.logger.Errorf("Failed to handle message: %w", err)
 				}
 			} else {
-				Logger.Infof("Ignoring mssage of type %d", mType)
+				pb.logger.Infof("Ignoring mssage of type %d", mType)
 			}
 		}
 	}()
@@ -172,16 +287,16 @@ func (pb *PeerbookClient) Go() error {
 				return
 			case msg, ok := <-pb.outChan:
 				if !ok {
-					Logger.Errorf("Got a bad message to send")
+					pb.logger.Errorf("Got a bad message to send")
 					continue
 				}
-				Logger.Infof("sending to pb: %s", msg)
+				pb.logger.Infof("sending to pb: %s", msg)
 				pb.ws.SetWriteDeadline(time.Now().Add(writeWait))
 				err := pb.ws.WriteMessage(websocket.TextMessage, msg)
 				if err != nil {
 					if websocket.IsUnexpectedCloseError(err,
 						websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-						Logger.Warnf("Failed to send websocket message: %s", err)
+						pb.logger.Warnf("Failed to send websocket message: %s", err)
 						return
 					}
 					continue
@@ -191,20 +306,18 @@ func (pb *PeerbookClient) Go() error {
 	}()
 	return nil
 }
-func getFP() string {
+func getFP() (string, error) {
 	certs, err := GetCerts()
 	if err != nil {
-		Logger.Errorf("Failed to get certs: %w", err)
-		return ""
+		return "", fmt.Errorf("Failed to get certs: %s", err)
 	}
 	// TODO: is 0 the right choice?
 	fps, err := certs[0].GetFingerprints()
 	if err != nil {
-		Logger.Error("Failed to get fingerprints: %w", err)
-		return ""
+		return "", fmt.Errorf("Failed to get fingerprints: %s", err)
 	}
 	s := strings.Replace(fps[0].Value, ":", "", -1)
-	return strings.ToUpper(s)
+	return strings.ToUpper(s), nil
 }
 
 func (pb *PeerbookClient) Dial() error {
@@ -212,19 +325,22 @@ func (pb *PeerbookClient) Dial() error {
 		ReadBufferSize:  4096,
 		WriteBufferSize: 4096,
 	}
-	fp := getFP()
+	fp, err := getFP()
+	if err != nil {
+		return err
+	}
 
 	params := url.Values{}
 	params.Add("fp", fp)
-	params.Add("name", Conf.name)
+	params.Add("name", pb.conf.name)
 	params.Add("kind", "webexec")
-	params.Add("uid", Conf.peerbookUID)
+	params.Add("uid", pb.conf.peerbookUID)
 
 	schema := "wss"
-	if Conf.insecure {
+	if pb.conf.insecure {
 		schema = "ws"
 	}
-	url := url.URL{Scheme: schema, Host: Conf.peerbookHost, Path: "/ws",
+	url := url.URL{Scheme: schema, Host: pb.conf.peerbookHost, Path: "/ws",
 		RawQuery: params.Encode()}
 	conn, resp, err := cstDialer.Dial(url.String(), nil)
 	if err != nil {
@@ -256,7 +372,7 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 		if err != nil {
 			return fmt.Errorf("Failed to decode message: %w", err)
 		}
-		Logger.Infof("Got a status message: %v %d", code, codeInt)
+		pb.logger.Infof("Got a status message: %v %d", code, codeInt)
 		return nil
 	}
 	_, found = m["peers"]
@@ -279,8 +395,8 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 		if err != nil {
 			return fmt.Errorf("Failed to decode peer_update: %w", err)
 		}
-		peer, found := peers.Peers[fp]
-		if found && peer.PC != nil && !pu["verified"].(bool) {
+		peer := pb.server.Peer(fp)
+		if peer != nil && peer.PC != nil && !pu["verified"].(bool) {
 			peer.Close()
 		}
 	}
@@ -296,12 +412,17 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 			return fmt.Errorf("Failed to get offer's fingerprint: %w", err)
 		}
 		if offerFP != fp {
-			peers.Peers[fp].Close()
-			Logger.Warnf("Refusing connection because fp mismatch: %s", fp)
+			if peer := pb.server.Peer(fp); peer != nil {
+				peer.Close()
+			}
+			pb.logger.Warnf("Refusing connection because fp mismatch: %s", fp)
 			return fmt.Errorf("Mismatched fingerprint: %s", fp)
 		}
-		Logger.Info("Authenticated!")
-		peer, err := peers.NewPeer(offerFP, pb.peerConf)
+		pb.logger.Info("Authenticated!")
+		if peer := pb.server.Peer(fp); peer != nil && peer.IsRestart(offer) {
+			return pb.restartPeer(peer, offer)
+		}
+		peer, err := pb.server.NewPeer(offerFP)
 		if err != nil {
 			return fmt.Errorf("Failed to create a new peer: %w", err)
 		}
@@ -309,10 +430,10 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 			if can != nil && peer.PC.ConnectionState() != webrtc.PeerConnectionStateConnected {
 				m := map[string]interface{}{
 					"target": fp, "candidate": can.ToJSON()}
-				Logger.Infof("Sending candidate: %v", m)
+				pb.logger.Infof("Sending candidate: %v", m)
 				j, err := json.Marshal(m)
 				if err != nil {
-					Logger.Errorf("Failed to encode offer : %w", err)
+					pb.logger.Errorf("Failed to encode offer : %w", err)
 					return
 				}
 				pb.outChan <- j
@@ -328,7 +449,7 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 		}
 		err = peer.PC.SetLocalDescription(answer)
 		m := map[string]interface{}{"answer": answer, "target": fp}
-		Logger.Infof("Sending answer: %v", m)
+		pb.logger.Infof("Sending answer: %v", m)
 		j, err := json.Marshal(m)
 		if err != nil {
 			return fmt.Errorf("Failed to encode offer : %w", err)
@@ -338,14 +459,14 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 	}
 	can, found := m["candidate"]
 	if found {
-		peer, found := peers.Peers[fp]
-		if found {
+		peer := pb.server.Peer(fp)
+		if peer != nil {
 			var can2 webrtc.ICECandidateInit
 			err = json.Unmarshal(can, &can2)
 			if err != nil {
 				return fmt.Errorf("Failed to decode candidate: %w", err)
 			}
-			Logger.Debugf("Adding candidate %v", can2)
+			pb.logger.Debugf("Adding candidate %v", can2)
 			err := peer.AddCandidate(can2)
 			if err != nil {
 				return fmt.Errorf("Failed to add ice candidate: %w", err)
@@ -356,3 +477,32 @@ func (pb *PeerbookClient) handleMessage(message []byte) error {
 	}
 	return nil
 }
+
+// restartPeer answers an ICE restart offer of an existing peer, keeping its
+// data channels
+func (pb *PeerbookClient) restartPeer(peer *peers.Peer, offer webrtc.SessionDescription) error {
+	fp := peer.FP
+	pb.logger.Infof("Restarting ICE of peer %s", fp)
+	peer.PC.OnICECandidate(func(can *webrtc.ICECandidate) {
+		if can == nil {
+			return
+		}
+		m := map[string]interface{}{"target": fp, "candidate": can.ToJSON()}
+		j, err := json.Marshal(m)
+		if err != nil {
+			pb.logger.Errorf("Failed to encode candidate: %s", err)
+			return
+		}
+		pb.outChan <- j
+	})
+	answer, err := peer.Restart(offer)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(map[string]interface{}{"answer": answer, "target": fp})
+	if err != nil {
+		return fmt.Errorf("Failed to encode answer: %s", err)
+	}
+	pb.outChan <- j
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerPID returns the pid of the process on the other side of a unix socket
+func peerPID(c net.Conn) (int, error) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, fmt.Errorf("Not a unix socket connection")
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		pid  int
+		perr error
+	)
+	err = raw.Control(func(fd uintptr) {
+		pid, perr = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if perr != nil {
+		return 0, fmt.Errorf("Failed to get the peer's pid: %s", perr)
+	}
+	return pid, nil
+}
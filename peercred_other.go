@@ -0,0 +1,15 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerPID is not supported on this platform, the calling pane is found by
+// its environment only
+func peerPID(c net.Conn) (int, error) {
+	return 0, fmt.Errorf("Peer credentials are not supported")
+}
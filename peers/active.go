@@ -0,0 +1,77 @@
+// This file holds the tracking of the panes' active clients, used to route
+// the clipboard & terminal queries of a pane to the device using it
+package peers
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// PaneEnvVar is the environment variable holding the pane's id, set for
+// the panes' commands
+const PaneEnvVar = "WEBEXEC_PANE"
+
+// env returns the environment of the pane's command, the conf's env or
+// the server's when there's none, with the pane's id
+func (pane *Pane) env() map[string]string {
+	ret := make(map[string]string)
+	if pane.peer.Conf.Env != nil {
+		for k, v := range pane.peer.Conf.Env {
+			ret[k] = v
+		}
+	} else {
+		for _, kv := range os.Environ() {
+			k, v, _ := strings.Cut(kv, "=")
+			ret[k] = v
+		}
+	}
+	ret[PaneEnvVar] = fmt.Sprintf("%d", pane.ID)
+	return ret
+}
+
+// ActivePeer returns the peer that typed in the pane last if it's still
+// attached to the pane. Otherwise, it returns the server's active peer.
+func (pane *Pane) ActivePeer() *Peer {
+	pane.sizeM.Lock()
+	active := pane.active
+	pane.sizeM.Unlock()
+	if active != nil {
+		for _, c := range pane.server().CDB.All4Pane(pane) {
+			if c.peer == active {
+				return active
+			}
+		}
+	}
+	return pane.server().ActivePeer()
+}
+
+// PaneOfProcess returns the pane running the process or one of its
+// ancestors, nil if there's none
+func (s *Server) PaneOfProcess(pid int) *Pane {
+	pids := make(map[int32]*Pane)
+	for _, p := range s.Panes.All() {
+		if p.C != nil && p.C.Process != nil {
+			pids[int32(p.C.Process.Pid)] = p
+		}
+	}
+	if len(pids) == 0 {
+		return nil
+	}
+	for p := int32(pid); p > 1; {
+		if pane, found := pids[p]; found {
+			return pane
+		}
+		proc, err := process.NewProcess(p)
+		if err != nil {
+			return nil
+		}
+		p, err = proc.Ppid()
+		if err != nil {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package peers
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestPaneEnv(t *testing.T) {
+	s := newTestServer(t)
+	s.Conf.Env = map[string]string{"TERM": "xterm-256color"}
+	var env map[string]string
+	s.Conf.RunCommand = func(_ []string, e map[string]string, _ *pty.Winsize, _ int, _ string) (*exec.Cmd, io.ReadWriteCloser, error) {
+		env = e
+		return nil, newHandlerTTY(), nil
+	}
+	peer := &Peer{Server: s, Conf: s.Conf}
+	peer.logger = zap.NewNop().Sugar()
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.Run([]string{"sh"}))
+	defer pane.Kill()
+	require.Equal(t, map[string]string{"TERM": "xterm-256color",
+		PaneEnvVar: strconv.Itoa(pane.ID)}, env)
+	// the conf's env is not changed
+	require.Len(t, s.Conf.Env, 1)
+}
+
+func TestPaneActivePeer(t *testing.T) {
+	peer, _ := newRegistryPeer(t)
+	s := peer.Server
+	other := &Peer{Server: s, Conf: s.Conf, FP: "B"}
+	other.logger = zaptest.NewLogger(t).Sugar()
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	mc := newMuxConn(peer, func(uint32, byte, []byte) error { return nil }, nil)
+	defer mc.close()
+	s.CDB.Add(mc.addStream(1, "1:1"), pane, peer)
+	c := s.CDB.Add(mc.addStream(2, "2:1"), pane, other)
+	require.Nil(t, pane.ActivePeer())
+	// typing in another pane makes the peer the server's active peer only
+	s.SetLastPeer(peer)
+	pane.touch(other)
+	require.Equal(t, other, pane.ActivePeer())
+	// once the active peer detaches, the server's active peer is used
+	require.NoError(t, s.CDB.Delete(c))
+	require.Equal(t, peer, pane.ActivePeer())
+}
+
+func TestPaneOfProcess(t *testing.T) {
+	if PtyMux == nil {
+		PtyMux = PtyMuxType{}
+	}
+	s := newTestServer(t)
+	peer := &Peer{Server: s, Conf: s.Conf}
+	// the pane's read loop outlives the test so it can't use the test's logger
+	peer.logger = zap.NewNop().Sugar()
+	require.Nil(t, s.PaneOfProcess(os.Getpid()))
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.Run([]string{"sleep", "10"}))
+	defer pane.Kill()
+	require.Equal(t, pane, s.PaneOfProcess(pane.C.Process.Pid))
+	require.Nil(t, s.PaneOfProcess(os.Getpid()))
+}
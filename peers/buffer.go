@@ -45,6 +45,13 @@ func (buffer *Buffer) Mark(id int) {
 	buffer.m.Unlock()
 }
 
+// Unmark deletes a marker
+func (buffer *Buffer) Unmark(id int) {
+	buffer.m.Lock()
+	delete(buffer.markers, id)
+	buffer.m.Unlock()
+}
+
 // GetSinceMarker returns a byte slice with all the accumlated data
 // since a given marker id and deltes the marker. If the marker is too ancient
 // cycle or id is -1 then all the buffer's data is returned.
@@ -36,12 +36,22 @@ type SetPayloadArgs struct {
 	Payload json.RawMessage `json:"payload"`
 }
 
+// SetLayoutArgs holds the args of a set_layout message. Version is the
+// version of the layout the update is based on.
+type SetLayoutArgs struct {
+	Version int    `json:"version"`
+	Layout  Layout `json:"layout"`
+}
+
 // ResizeArgs is a type that holds the argumnet to the resize pty command
 // ResizeArgs is a type that holds the argumnet to the resize pty command
 type ResizeArgs struct {
 	PaneID int    `json:"pane_id"`
 	Sx     uint16 `json:"sx"`
 	Sy     uint16 `json:"sy"`
+	// X & Y are the size in pixels
+	X uint16 `json:"x,omitempty"`
+	Y uint16 `json:"y,omitempty"`
 }
 
 type AddPaneArgs struct {
@@ -51,10 +61,101 @@ type AddPaneArgs struct {
 	X       uint16   `json:"x, omitempty"`
 	Y       uint16   `json:"y, omitempty"`
 	Parent  int      `json:"parent,omitempty"`
+	// Compression is the compression mode of the pane's output, i.e. "deflate"
+	Compression string `json:"compression,omitempty"`
+	// ResizePolicy is the pane's resize policy, i.e. "smallest"
+	ResizePolicy string `json:"resize_policy,omitempty"`
 }
 
 type ReconnectPaneArgs struct {
-	ID int `json:"id"`
+	ID          int    `json:"id"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// EchoHintsArgs holds the args of an echo_hints message, used to subscribe to
+// a pane's echo hints
+type EchoHintsArgs struct {
+	PaneID int  `json:"pane_id"`
+	Enable bool `json:"enable"`
+}
+
+// EchoHintArgs holds the args of an echo_hint message, sent to help clients
+// predict the echo of their keystrokes
+type EchoHintArgs struct {
+	PaneID int `json:"pane_id"`
+	// Seq is the number of input messages the hint confirms
+	Seq int `json:"seq"`
+	// X & Y hold the cursor position, zero based
+	X int `json:"x"`
+	Y int `json:"y"`
+	// Echo is true when the pty echoes input
+	Echo bool `json:"echo"`
+	// Canonical is true when the pty is in line editing mode
+	Canonical bool `json:"canonical"`
+}
+
+// TmuxAttachArgs holds the args of a tmux_attach message
+type TmuxAttachArgs struct {
+	Session string `json:"session"`
+	// Rows & Cols hold the size of the tmux client and are optional
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// TmuxSplitArgs holds the args of a tmux_split message
+type TmuxSplitArgs struct {
+	PaneID int `json:"pane_id"`
+	// Type is either "topbottom" or "leftright"
+	Type string `json:"type"`
+	// Size is the new pane's size in lines or columns, or a percentage
+	Size string `json:"size,omitempty"`
+}
+
+// TmuxZoomArgs holds the args of a tmux_zoom message
+type TmuxZoomArgs struct {
+	PaneID int `json:"pane_id"`
+}
+
+// HelloArgs holds the args of a hello message and the body of its ack.
+// The client declares its version, protocol revision & capabilities and the
+// server replies with its own and the control messages it handles.
+type HelloArgs struct {
+	Version      string   `json:"version"`
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities"`
+	Messages     []string `json:"messages,omitempty"`
+}
+
+// SubscribeArgs holds the event types a client subscribes to. It replaces
+// the client's subscription, an empty list unsubscribes.
+type SubscribeArgs struct {
+	Events []string `json:"events"`
+}
+
+// EventArgs is the args of the event message sent to subscribed clients
+type EventArgs struct {
+	Type   string `json:"type"`
+	PaneID int    `json:"pane_id,omitempty"`
+	// FP is the fingerprint of the peer that connected, disconnected,
+	// attached or detached
+	FP string `json:"fp,omitempty"`
+	// Name is the pane's new name, the title its process set
+	Name string `json:"name,omitempty"`
+	// Clients holds the fingerprints of the peers attached to the pane
+	Clients []string `json:"clients,omitempty"`
+	// Version is the version of the changed layout
+	Version int `json:"version,omitempty"`
+}
+
+// ShutdownArgs is the args of the server_shutdown message, sent to all the
+// clients when the server starts shutting down
+type ShutdownArgs struct {
+	Reason string `json:"reason"`
+	// Drain is the time, in msec, until the server closes the connections
+	Drain int64 `json:"drain"`
+	// ETA is the time, in msec, until the server is expected back, zero when
+	// it's unknown
+	ETA int64 `json:"eta,omitempty"`
 }
 
 type SetClipboardArgs struct {
@@ -0,0 +1,47 @@
+package peers
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Channel is a message stream between a client and a pane or the cdc.
+// It's implemented by webrtc data channels and by websocket streams.
+type Channel interface {
+	Label() string
+	ID() *uint16
+	Send([]byte) error
+	Close() error
+	ReadyState() webrtc.DataChannelState
+	BufferedAmount() uint64
+	SetBufferedAmountLowThreshold(uint64)
+	OnBufferedAmountLow(func())
+	OnOpen(func())
+	OnMessage(func(webrtc.DataChannelMessage))
+	OnClose(func())
+}
+
+// CreateChannel opens a new channel to the client, over the peer
+// connection, the mux data channel or the websocket the peer is using
+func (peer *Peer) CreateChannel(label string) (Channel, error) {
+	if peer.ws != nil {
+		return peer.ws.newStream(label)
+	}
+	peer.Lock()
+	pc := peer.PC
+	mux := peer.mux
+	peer.Unlock()
+	if mux != nil {
+		return mux.newStream(label)
+	}
+	if pc == nil {
+		return nil, fmt.Errorf("Peer is closed")
+	}
+	t := true
+	d, err := pc.CreateDataChannel(label, &webrtc.DataChannelInit{Ordered: &t})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
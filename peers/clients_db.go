@@ -4,23 +4,43 @@ package peers
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/pion/webrtc/v4"
+	"github.com/creack/pty"
 )
 
 // Client ties together the dta channel, its peer and the pane
 type Client struct {
-	dc   *webrtc.DataChannel
+	dc   Channel
 	pane *Pane
 	peer *Peer
 	id   int
+	// lagging is set when output was dropped because the client's data
+	// channel could not keep up. marker is the id of the pane's buffer
+	// marker the client is resynced from, unique to the client.
+	lagging bool
+	marker  int
+	// compressor is used to compress the client's output, nil if the
+	// client didn't ask for compression
+	compressor *Compressor
+	// viewport is the client's size of the pane, nil when unknown
+	viewport *pty.Winsize
+	// active is the last time the client resized or typed
+	active time.Time
 }
 
+// lastLagMarker is used to generate buffer markers for lagging clients.
+// It counts down from -1 so it never collides with the peers' markers.
+var lastLagMarker int32 = -1
+
 // ClientsDB represents a data channels data base
 type ClientsDB struct {
 	clients map[int]*Client
 	m       sync.RWMutex
 	lastID  int
+	// onChange is called after a client is added or deleted
+	onChange func(c *Client, attached bool)
 }
 
 // NewClientsDB return new data channels data base
@@ -29,13 +49,28 @@ func NewClientsDB() *ClientsDB {
 }
 
 // Add adds a Client to the db
-func (db *ClientsDB) Add(dc *webrtc.DataChannel, pane *Pane, peer *Peer) *Client {
+func (db *ClientsDB) Add(dc Channel, pane *Pane, peer *Peer) *Client {
+	return db.AddCompressed(dc, pane, peer, nil)
+}
+
+// AddCompressed adds a Client that compresses its output to the db
+func (db *ClientsDB) AddCompressed(dc Channel, pane *Pane, peer *Peer,
+	compressor *Compressor) *Client {
+
 	db.m.Lock()
-	defer db.m.Unlock()
 	id := db.lastID
 	db.lastID++
-	c := &Client{dc, pane, peer, id}
+	c := &Client{dc: dc, pane: pane, peer: peer, id: id, compressor: compressor,
+		marker: int(atomic.AddInt32(&lastLagMarker, -1))}
 	db.clients[id] = c
+	if dc != nil && pane != nil {
+		dc.SetBufferedAmountLowThreshold(BufferedAmountLow)
+		dc.OnBufferedAmountLow(pane.onDrained)
+	}
+	db.m.Unlock()
+	if db.onChange != nil {
+		db.onChange(c, true)
+	}
 	return c
 }
 
@@ -72,16 +107,54 @@ func (db *ClientsDB) All4Pane(pane *Pane) []*Client {
 	return r
 }
 
+// Send sends a message to the client, compressing it if needed
+func (c *Client) Send(b []byte) error {
+	if c.compressor == nil {
+		return c.dc.Send(b)
+	}
+	// the lock ensures the compressed chunks are sent in order
+	c.compressor.m.Lock()
+	defer c.compressor.m.Unlock()
+	z, err := c.compressor.compress(b)
+	if err != nil {
+		return fmt.Errorf("Failed to compress output: %w", err)
+	}
+	return c.dc.Send(z)
+}
+
+// saturated returns true if the client's data channel has too much data
+// waiting to be sent or the client is already lagging
+func (c *Client) saturated() bool {
+	return c.lagging || c.dc.BufferedAmount() > MaxBufferedAmount
+}
+
+// lag marks the client as lagging and marks the pane's buffer so the client
+// could be resynced once its data channel drains
+func (c *Client) lag() {
+	if c.marker == 0 {
+		c.marker = int(atomic.AddInt32(&lastLagMarker, -1))
+	}
+	c.lagging = true
+	c.pane.Buffer.Mark(c.marker)
+}
+
 // Delete removes a client from the database
 func (db *ClientsDB) Delete(c *Client) error {
 	db.m.Lock()
-	defer db.m.Unlock()
-
 	for k, v := range db.clients {
 		if v.dc.ID() == c.dc.ID() && v.pane.ID == c.pane.ID {
 			delete(db.clients, k)
+			db.m.Unlock()
+			// a client deleted while lagging leaves its marker behind
+			if c.marker != 0 && c.pane.Buffer != nil {
+				c.pane.Buffer.Unmark(c.marker)
+			}
+			if db.onChange != nil {
+				db.onChange(c, false)
+			}
 			return nil
 		}
 	}
+	db.m.Unlock()
 	return fmt.Errorf("Failed to delete as data channel not found: %v", c)
 }
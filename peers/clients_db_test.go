@@ -1,8 +1,12 @@
 package peers
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 )
 
@@ -10,3 +14,73 @@ func TestClientsDB(t *testing.T) {
 	db := NewClientsDB()
 	require.NotNil(t, db)
 }
+
+func TestClientLag(t *testing.T) {
+	pane := &Pane{Buffer: NewBuffer(100)}
+	c := &Client{pane: pane}
+	pane.Buffer.Add([]byte("before"))
+	c.lag()
+	require.True(t, c.lagging)
+	require.Less(t, c.marker, -1, "lag markers should not collide with peer markers")
+	pane.Buffer.Add([]byte("missed"))
+	require.Equal(t, "missed", string(pane.Buffer.GetSinceMarker(c.marker)))
+	c2 := &Client{pane: pane}
+	c2.lag()
+	require.NotEqual(t, c.marker, c2.marker)
+}
+
+// slowChannel is an open data channel with a settable buffered amount,
+// recording the data sent on it
+type slowChannel struct {
+	Channel
+	id       uint16
+	buffered uint64
+	received []byte
+}
+
+func (c *slowChannel) ID() *uint16                          { return &c.id }
+func (c *slowChannel) ReadyState() webrtc.DataChannelState  { return webrtc.DataChannelStateOpen }
+func (c *slowChannel) BufferedAmount() uint64               { return c.buffered }
+func (c *slowChannel) SetBufferedAmountLowThreshold(uint64) {}
+func (c *slowChannel) OnBufferedAmountLow(func())           {}
+func (c *slowChannel) Send(b []byte) error {
+	c.received = append(c.received, b...)
+	return nil
+}
+
+func TestClientResync(t *testing.T) {
+	pane := newTestPane(t)
+	pane.ID = 1
+	pane.Buffer = NewBuffer(PaneBufferSize)
+	cdb := pane.server().CDB
+	fast := &slowChannel{id: 1}
+	slow := &slowChannel{id: 2}
+	cdb.Add(fast, pane, pane.peer)
+	c := cdb.Add(slow, pane, pane.peer)
+	var sent []byte
+	// write like the sender does, sending before adding to the buffer
+	write := func(b []byte) {
+		pane.send(context.Background(), b)
+		pane.Buffer.Add(b)
+		sent = append(sent, b...)
+	}
+	write([]byte("before the lag "))
+	slow.buffered = MaxBufferedAmount + 1
+	// more than the old 100KB buffer is missed while the client drains
+	for i := 0; i < 100; i++ {
+		write([]byte(strings.Repeat(fmt.Sprintf("%d", i%10), 3000)))
+	}
+	require.True(t, c.lagging)
+	require.Equal(t, sent, fast.received)
+	slow.buffered = 0
+	pane.resync()
+	require.False(t, c.lagging)
+	require.Equal(t, sent, slow.received)
+	// a client deleted while lagging removes its marker
+	slow.buffered = MaxBufferedAmount + 1
+	write([]byte("after"))
+	require.True(t, c.lagging)
+	require.Contains(t, pane.Buffer.markers, c.marker)
+	require.NoError(t, cdb.Delete(c))
+	require.NotContains(t, pane.Buffer.markers, c.marker)
+}
@@ -0,0 +1,72 @@
+// This file holds the code used to compress pane output
+package peers
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"sync"
+)
+
+const (
+	// CompressionNone is the default - pane output is sent as is
+	CompressionNone = ""
+	// CompressionDeflate compresses pane output using a single deflate stream
+	CompressionDeflate = "deflate"
+)
+
+// CompressionDict is the preset dictionary used by the deflate compression.
+// It holds escape sequences common in terminal output and clients must use
+// the same dictionary when inflating.
+var CompressionDict = []byte("\x1b[?25l\x1b[?25h\x1b[?2004h\x1b[?2004l\x1b[?1049h\x1b[?1049l" +
+	"\x1b[38;2;\x1b[48;2;\x1b[38;5;\x1b[48;5;\x1b[39m\x1b[49m\x1b[0m\x1b[1m\x1b[7m\x1b[27m" +
+	"\x1b[m\x1b[K\x1b[J\x1b[2J\x1b[H\x1b[A\x1b[B\x1b[C\x1b[D\x1b]0;\x07\r\n    \r\n")
+
+// Compressor compresses the output sent to a single client.
+// The client's messages are all parts of one deflate stream, each ending
+// with a sync flush so it can be inflated as soon as it's received.
+type Compressor struct {
+	m   sync.Mutex
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+// NewCompressor returns a compressor for the given mode or nil when the
+// mode is CompressionNone
+func NewCompressor(mode string) (*Compressor, error) {
+	switch mode {
+	case CompressionNone:
+		return nil, nil
+	case CompressionDeflate:
+		c := &Compressor{}
+		w, err := flate.NewWriterDict(&c.buf, flate.BestSpeed, CompressionDict)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a deflate writer: %w", err)
+		}
+		c.w = w
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unsupported compression: %q", mode)
+}
+
+// Compress compresses b and returns the next chunk of the stream
+func (c *Compressor) Compress(b []byte) ([]byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.compress(b)
+}
+
+func (c *Compressor) compress(b []byte) ([]byte, error) {
+	c.buf.Reset()
+	_, err := c.w.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	err = c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+	r := make([]byte, c.buf.Len())
+	copy(r, c.buf.Bytes())
+	return r, nil
+}
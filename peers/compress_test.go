@@ -0,0 +1,37 @@
+package peers
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressorStream(t *testing.T) {
+	c, err := NewCompressor(CompressionDeflate)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	chunks := []string{"\x1b[0mhello\r\n", "\x1b[0mworld\r\n", "\x1b[2J\x1b[H"}
+	var stream bytes.Buffer
+	for _, s := range chunks {
+		b, err := c.Compress([]byte(s))
+		require.NoError(t, err)
+		require.NotEmpty(t, b)
+		stream.Write(b)
+	}
+	r := flate.NewReaderDict(&stream, CompressionDict)
+	out := make([]byte, 64)
+	n, err := io.ReadAtLeast(r, out, len("\x1b[0mhello\r\n\x1b[0mworld\r\n\x1b[2J\x1b[H"))
+	require.NoError(t, err)
+	require.Equal(t, "\x1b[0mhello\r\n\x1b[0mworld\r\n\x1b[2J\x1b[H", string(out[:n]))
+}
+
+func TestNewCompressorModes(t *testing.T) {
+	c, err := NewCompressor(CompressionNone)
+	require.NoError(t, err)
+	require.Nil(t, c)
+	_, err = NewCompressor("zstd")
+	require.Error(t, err)
+}
@@ -0,0 +1,144 @@
+// This file holds the code that sends clients hints they can use to predict
+// the echo of their keystrokes
+package peers
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// echoHintTimeout is how long to wait for output before confirming input
+const echoHintTimeout = 50 * time.Millisecond
+
+// echoHintDelay is how long to wait for more output before sending the hints
+const echoHintDelay = 5 * time.Millisecond
+
+// echoState holds the state of a peer that subscribed to a pane's echo hints
+type echoState struct {
+	// seq counts the input messages received from the peer
+	seq     int
+	pending bool
+}
+
+// SetEchoHints subscribes or unsubscribes a peer to the pane's echo hints.
+// It returns the number of input messages already counted for the peer.
+func (pane *Pane) SetEchoHints(peer *Peer, enable bool) int {
+	pane.hintsM.Lock()
+	defer pane.hintsM.Unlock()
+	if !enable {
+		delete(pane.hints, peer)
+		return 0
+	}
+	if pane.hints == nil {
+		pane.hints = make(map[*Peer]*echoState)
+	}
+	state, found := pane.hints[peer]
+	if !found {
+		state = &echoState{}
+		pane.hints[peer] = state
+	}
+	return state.seq
+}
+
+// dropEchoHints unsubscribes a peer from the pane's echo hints when it has
+// no clients of the pane left
+func (pane *Pane) dropEchoHints(peer *Peer) {
+	for _, c := range pane.server().CDB.All4Pane(pane) {
+		if c.peer == peer {
+			return
+		}
+	}
+	pane.SetEchoHints(peer, false)
+}
+
+// EchoHint returns the pane's current echo hint for a given input sequence
+// number. The cursor position is read from the headless terminal and the echo
+// & canonical modes from the pty's termios.
+func (pane *Pane) EchoHint(seq int) EchoHintArgs {
+	hint := EchoHintArgs{PaneID: pane.ID, Seq: seq}
+	if pane.vt != nil {
+		pane.vt.Lock()
+		c := pane.vt.Cursor()
+		pane.vt.Unlock()
+		hint.X = c.X
+		hint.Y = c.Y
+	}
+	hint.Echo, hint.Canonical = pane.ttyModes()
+	return hint
+}
+
+// ttyModes returns whether the pty echoes input and is in canonical mode.
+// When the modes can not be read both are false so clients will not predict.
+func (pane *Pane) ttyModes() (echo bool, canonical bool) {
+	f, ok := pane.TTY.(*os.File)
+	if !ok {
+		return false, false
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false, false
+	}
+	var termios *unix.Termios
+	rc.Control(func(fd uintptr) {
+		termios, err = unix.IoctlGetTermios(int(fd), ioctlReadTermios)
+	})
+	if err != nil || termios == nil {
+		return false, false
+	}
+	return termios.Lflag&unix.ECHO != 0, termios.Lflag&unix.ICANON != 0
+}
+
+// countInput counts an input message from a peer subscribed to echo hints
+// and schedules its confirmation
+func (pane *Pane) countInput(sender *Peer) {
+	pane.hintsM.Lock()
+	state, found := pane.hints[sender]
+	if found {
+		state.seq++
+		state.pending = true
+	}
+	pane.hintsM.Unlock()
+	if found {
+		time.AfterFunc(echoHintTimeout, pane.flushEchoHints)
+	}
+}
+
+// scheduleEchoHints flushes the echo hints after a short delay, so a burst
+// of output chunks sends a single hint
+func (pane *Pane) scheduleEchoHints() {
+	pane.hintsM.Lock()
+	defer pane.hintsM.Unlock()
+	if len(pane.hints) == 0 || pane.hintsTimer != nil {
+		return
+	}
+	pane.hintsTimer = time.AfterFunc(echoHintDelay, pane.flushEchoHints)
+}
+
+// flushEchoHints sends an echo hint to all the peers with unconfirmed input.
+// The hints are sent after releasing hintsM so a slow peer doesn't block
+// the others.
+func (pane *Pane) flushEchoHints() {
+	type pendingHint struct {
+		peer *Peer
+		seq  int
+	}
+	var pending []pendingHint
+	pane.hintsM.Lock()
+	pane.hintsTimer = nil
+	for peer, state := range pane.hints {
+		if !state.pending || peer.getCDC() == nil {
+			continue
+		}
+		state.pending = false
+		pending = append(pending, pendingHint{peer, state.seq})
+	}
+	pane.hintsM.Unlock()
+	for _, h := range pending {
+		err := h.peer.SendControlMessage("echo_hint", pane.EchoHint(h.seq))
+		if err != nil {
+			h.peer.logger.Warnf("Failed to send an echo hint: %s", err)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/vt10x"
+	"golang.org/x/sys/unix"
+)
+
+func TestEchoHintCursor(t *testing.T) {
+	p := newTestPane(t)
+	p.TTY = &mockTTY{}
+	p.vt = vt10x.New(vt10x.WithSize(80, 24))
+	p.vt.Write([]byte("hello\r\nab"))
+	hint := p.EchoHint(3)
+	require.Equal(t, 3, hint.Seq)
+	require.Equal(t, 2, hint.X)
+	require.Equal(t, 1, hint.Y)
+	// modes of a non pty are unknown so clients should not predict
+	require.False(t, hint.Echo)
+}
+
+func TestEchoHintsCountInput(t *testing.T) {
+	p := newTestPane(t)
+	p.TTY = &mockTTY{}
+	require.Equal(t, 0, p.SetEchoHints(p.peer, true))
+	p.OnMessage(p.peer, webrtc.DataChannelMessage{Data: []byte("a")})
+	p.OnMessage(p.peer, webrtc.DataChannelMessage{Data: []byte("b")})
+	require.Equal(t, 2, p.SetEchoHints(p.peer, true))
+	p.SetEchoHints(p.peer, false)
+	p.OnMessage(p.peer, webrtc.DataChannelMessage{Data: []byte("c")})
+	require.Equal(t, 0, p.SetEchoHints(p.peer, true))
+}
+
+func TestEchoHintTTYModes(t *testing.T) {
+	ptmx, tty, err := pty.Open()
+	require.NoError(t, err)
+	defer ptmx.Close()
+	defer tty.Close()
+	p := newTestPane(t)
+	p.TTY = ptmx
+	echo, canonical := p.ttyModes()
+	require.True(t, echo)
+	require.True(t, canonical)
+	termios, err := unix.IoctlGetTermios(int(tty.Fd()), ioctlReadTermios)
+	require.NoError(t, err)
+	termios.Lflag &^= unix.ECHO | unix.ICANON
+	err = unix.IoctlSetTermios(int(tty.Fd()), ioctlWriteTermios, termios)
+	require.NoError(t, err)
+	echo, canonical = p.ttyModes()
+	require.False(t, echo)
+	require.False(t, canonical)
+}
+
+func TestEchoHintsDropped(t *testing.T) {
+	p := newTestPane(t)
+	p.ID = 1
+	s := p.server()
+	s.Panes.Add(p)
+	c := s.CDB.Add(&slowChannel{id: 1}, p, p.peer)
+	p.SetEchoHints(p.peer, true)
+	require.Len(t, p.hints, 1)
+	// the peer's last client of the pane detaches
+	require.NoError(t, s.CDB.Delete(c))
+	require.Empty(t, p.hints)
+	s.CDB.Add(&slowChannel{id: 2}, p, p.peer)
+	p.SetEchoHints(p.peer, true)
+	// a failed peer keeps its hints while it waits for an ICE restart
+	s.peerStateChanged(p.peer, webrtc.PeerConnectionStateFailed)
+	require.Len(t, p.hints, 1)
+	s.peerStateChanged(p.peer, webrtc.PeerConnectionStateClosed)
+	require.Empty(t, p.hints)
+}
+
+// blockingChannel is a control channel whose Send blocks until it's released
+type blockingChannel struct {
+	slowChannel
+	sent    chan []byte
+	release chan struct{}
+}
+
+func (c *blockingChannel) Send(b []byte) error {
+	c.sent <- b
+	<-c.release
+	return nil
+}
+
+func TestEchoHintsFlush(t *testing.T) {
+	p := newTestPane(t)
+	p.TTY = &mockTTY{}
+	cdc := &blockingChannel{sent: make(chan []byte, 10), release: make(chan struct{})}
+	p.peer.setCDC(cdc)
+	p.SetEchoHints(p.peer, true)
+	p.OnMessage(p.peer, webrtc.DataChannelMessage{Data: []byte("a")})
+	// a burst of output schedules a single flush
+	for i := 0; i < 3; i++ {
+		p.scheduleEchoHints()
+	}
+	select {
+	case m := <-cdc.sent:
+		require.Contains(t, string(m), "echo_hint")
+	case <-time.After(time.Second):
+		t.Fatal("Timeout waiting for the echo hint")
+	}
+	// the hints are not locked while the hint is sent
+	done := make(chan struct{})
+	go func() {
+		p.SetEchoHints(p.peer, true)
+		done <- struct{}{}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("SetEchoHints is blocked by a slow peer")
+	}
+	close(cdc.release)
+	select {
+	case m := <-cdc.sent:
+		t.Errorf("Got a second echo hint: %s", m)
+	case <-time.After(2 * echoHintTimeout):
+	}
+}
@@ -0,0 +1,121 @@
+// This file holds the events stream, letting clients subscribe to changes
+// made by other clients and by the server
+package peers
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The types of events clients can subscribe to
+const (
+	EventPaneCreated      = "pane_created"
+	EventPaneExited       = "pane_exited"
+	EventPaneRenamed      = "pane_renamed"
+	EventClientAttached   = "client_attached"
+	EventClientDetached   = "client_detached"
+	EventPeerConnected    = "peer_connected"
+	EventPeerDisconnected = "peer_disconnected"
+	EventLayoutChanged    = "layout_changed"
+	EventShuttingDown     = "shutting_down"
+)
+
+// EventTypes holds all the event types
+var EventTypes = []string{
+	EventPaneCreated, EventPaneExited, EventPaneRenamed,
+	EventClientAttached, EventClientDetached,
+	EventPeerConnected, EventPeerDisconnected,
+	EventLayoutChanged, EventShuttingDown,
+}
+
+// handleSubscribe sets the event types the client is subscribed to
+func (s *Server) handleSubscribe(peer *Peer, m CTRLMessage, args SubscribeArgs) {
+	for _, e := range args.Events {
+		if !slices.Contains(EventTypes, e) {
+			peer.SendNack(m, fmt.Sprintf("Unknown event type: %q", e))
+			return
+		}
+	}
+	peer.Lock()
+	peer.events = args.Events
+	peer.Unlock()
+	peer.logger.Infof("#%s subscribed to %v", peer.FP, args.Events)
+	err := peer.SendAck(m, "")
+	if err != nil {
+		peer.logger.Errorf("#%s: Failed to send subscribe ack: %v", peer.FP, err)
+	}
+}
+
+// Subscribed returns true if the client is subscribed to the event type
+func (peer *Peer) Subscribed(typ string) bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return slices.Contains(peer.events, typ)
+}
+
+// Emit sends an event message to all the clients subscribed to its type
+func (s *Server) Emit(ev EventArgs) {
+	for _, p := range s.AllPeers() {
+		if p.getCDC() == nil || !p.Subscribed(ev.Type) {
+			continue
+		}
+		err := p.SendControlMessage("event", ev)
+		if err != nil {
+			p.logger.Warnf("Failed to send a %s event: %v", ev.Type, err)
+		}
+	}
+}
+
+// paneClients returns the sorted fingerprints of the peers attached to
+// the pane
+func (s *Server) paneClients(pane *Pane) []string {
+	var ret []string
+	for _, c := range s.CDB.All4Pane(pane) {
+		if c.peer != nil && !slices.Contains(ret, c.peer.FP) {
+			ret = append(ret, c.peer.FP)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// clientChanged emits the client_attached & client_detached events,
+// resizes the pane and drops the echo hints of detached peers
+func (s *Server) clientChanged(c *Client, attached bool) {
+	if c.pane == nil || c.peer == nil {
+		return
+	}
+	if !attached {
+		c.pane.dropEchoHints(c.peer)
+	}
+	typ := EventClientDetached
+	if attached {
+		typ = EventClientAttached
+	}
+	s.Emit(EventArgs{Type: typ, PaneID: c.pane.ID, FP: c.peer.FP,
+		Clients: s.paneClients(c.pane)})
+	// the clients' viewports decide the pane's size
+	c.pane.arbitrate(nil)
+}
+
+// peerStateChanged emits the peer_connected & peer_disconnected events,
+// drops the echo hints of disconnected peers and calls the configuration's
+// OnStateChange. A failed peer is kept for an ICE restart, so it's
+// disconnected only when it's closed, i.e. when the restart timer fires.
+func (s *Server) peerStateChanged(peer *Peer, state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnected:
+		s.Emit(EventArgs{Type: EventPeerConnected, FP: peer.FP})
+	case webrtc.PeerConnectionStateClosed:
+		s.Emit(EventArgs{Type: EventPeerDisconnected, FP: peer.FP})
+		for _, pane := range s.Panes.All() {
+			pane.SetEchoHints(peer, false)
+		}
+	}
+	if s.Conf.OnStateChange != nil {
+		s.Conf.OnStateChange(peer, state)
+	}
+}
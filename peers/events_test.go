@@ -0,0 +1,60 @@
+package peers
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// events returns the args of the event messages sent
+func (c *sentChannel) events(t *testing.T) []EventArgs {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var ret []EventArgs
+	for _, m := range c.sent {
+		if m.Type != "event" {
+			continue
+		}
+		b, err := json.Marshal(m.Args)
+		require.NoError(t, err)
+		var ev EventArgs
+		require.NoError(t, json.Unmarshal(b, &ev))
+		ret = append(ret, ev)
+	}
+	return ret
+}
+
+func TestSubscribe(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	s := peer.Server
+	s.addPeer(peer)
+	s.Messages.Dispatch(peer, CTRLMessage{Type: "subscribe"},
+		json.RawMessage(`{"events": ["pane_created", "foo"]}`))
+	require.Equal(t, []string{"nack"}, cdc.types())
+	require.False(t, peer.Subscribed(EventPaneCreated))
+	s.Messages.Dispatch(peer, CTRLMessage{Type: "subscribe"},
+		json.RawMessage(`{"events": ["client_attached", "client_detached", "layout_changed"]}`))
+	require.Equal(t, []string{"nack", "ack"}, cdc.types())
+	// events of other types are not sent
+	s.Emit(EventArgs{Type: EventPaneCreated, PaneID: 1})
+	pane := &Pane{ID: 3, peer: peer}
+	other := &Peer{Server: s, FP: "B"}
+	mc := newMuxConn(peer, func(uint32, byte, []byte) error { return nil }, nil)
+	defer mc.close()
+	c := s.CDB.Add(mc.addStream(1, "1:3"), pane, other)
+	s.CDB.Add(mc.addStream(2, "2:3"), pane, peer)
+	require.NoError(t, s.CDB.Delete(c))
+	_, err := s.Layout.Set(0, Layout{Gates: []Gate{}})
+	require.NoError(t, err)
+	require.Equal(t, []EventArgs{
+		{Type: EventClientAttached, PaneID: 3, FP: "B", Clients: []string{"B"}},
+		{Type: EventClientAttached, PaneID: 3, FP: "A", Clients: []string{"A", "B"}},
+		{Type: EventClientDetached, PaneID: 3, FP: "B", Clients: []string{"A"}},
+		{Type: EventLayoutChanged, Version: 1},
+	}, cdc.events(t))
+	// an empty list unsubscribes
+	s.Messages.Dispatch(peer, CTRLMessage{Type: "subscribe"}, json.RawMessage(`{"events": []}`))
+	s.Emit(EventArgs{Type: EventLayoutChanged, Version: 2})
+	require.Len(t, cdc.events(t), 4)
+}
@@ -0,0 +1,59 @@
+// This file holds the in-process pane handlers, letting embedders serve
+// panes without spawning a process
+package peers
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/creack/pty"
+)
+
+// HandlerPrefix starts the command of panes served by a handler, i.e. "@admin"
+const HandlerPrefix = "@"
+
+// PaneHandler serves a pane in-process. It gets the command's arguments, the
+// pane's size and the peer's fingerprint and returns the pane's tty. If the
+// tty implements Resizer it's called when the pane is resized. The pane
+// exits when the tty's Read returns an error and the tty is closed when the
+// pane is killed.
+type PaneHandler func(args []string, ws *pty.Winsize, fp string) (io.ReadWriteCloser, error)
+
+// HandlePane registers a handler for panes opened with the command
+// "@<name>". Registering a nil handler removes it.
+func (s *Server) HandlePane(name string, h PaneHandler) {
+	s.handlersM.Lock()
+	defer s.handlersM.Unlock()
+	if h == nil {
+		delete(s.handlers, name)
+		return
+	}
+	s.handlers[name] = h
+}
+
+// PaneHandler returns the handler serving the command or nil if the command
+// is not a registered handler
+func (s *Server) PaneHandler(command []string) PaneHandler {
+	if len(command) == 0 || !strings.HasPrefix(command[0], HandlerPrefix) {
+		return nil
+	}
+	s.handlersM.Lock()
+	defer s.handlersM.Unlock()
+	return s.handlers[strings.TrimPrefix(command[0], HandlerPrefix)]
+}
+
+// runHandler starts a pane served by a handler
+func (pane *Pane) runHandler(command []string) error {
+	h := pane.server().PaneHandler(command)
+	if h == nil {
+		return fmt.Errorf("Unknown pane handler: %s", command[0])
+	}
+	tty, err := h(command[1:], pane.Ws, pane.peer.FP)
+	if err != nil {
+		return fmt.Errorf("Failed to start %s: %s", command[0], err)
+	}
+	pane.Handler = strings.TrimPrefix(command[0], HandlerPrefix)
+	pane.RunTTY(tty)
+	return nil
+}
@@ -0,0 +1,114 @@
+package peers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+)
+
+// handlerTTY is a handler's tty, echoing its input and recording resizes
+type handlerTTY struct {
+	io.Reader
+	w      *io.PipeWriter
+	sizes  chan *pty.Winsize
+	closed chan bool
+}
+
+func newHandlerTTY() *handlerTTY {
+	r, w := io.Pipe()
+	return &handlerTTY{Reader: r, w: w,
+		sizes: make(chan *pty.Winsize, 1), closed: make(chan bool, 1)}
+}
+func (h *handlerTTY) Write(p []byte) (int, error) { return h.w.Write(p) }
+func (h *handlerTTY) Close() error {
+	h.closed <- true
+	return h.w.Close()
+}
+func (h *handlerTTY) Resize(ws *pty.Winsize) error {
+	h.sizes <- ws
+	return nil
+}
+
+func TestPaneHandler(t *testing.T) {
+	s := newTestServer(t)
+	peer := &Peer{Server: s, FP: "fingerprint", Conf: s.Conf}
+	// the pane's read loop outlives the test so it can't use the test's logger
+	peer.logger = zap.NewNop().Sugar()
+	tty := newHandlerTTY()
+	var gotArgs []string
+	var gotFP string
+	s.HandlePane("admin", func(args []string, ws *pty.Winsize, fp string) (io.ReadWriteCloser, error) {
+		gotArgs = args
+		gotFP = fp
+		return tty, nil
+	})
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.Run([]string{"@admin", "status"}))
+	require.Equal(t, []string{"status"}, gotArgs)
+	require.Equal(t, "fingerprint", gotFP)
+	require.Equal(t, "admin", pane.Handler)
+	require.Nil(t, pane.C)
+	// the handler's output reaches the pane's screen
+	go tty.Write([]byte("hello"))
+	require.Eventually(t, func() bool {
+		return bytes.Contains(pane.dumpVT(), []byte("hello"))
+	}, time.Second, 10*time.Millisecond)
+	pane.Resize(&pty.Winsize{Rows: 30, Cols: 100})
+	ws := <-tty.sizes
+	require.Equal(t, uint16(30), ws.Rows)
+	pane.Kill()
+	require.True(t, <-tty.closed)
+	require.False(t, pane.IsRunning)
+}
+
+func TestPaneHandlerUnknown(t *testing.T) {
+	s := newTestServer(t)
+	peer := &Peer{Server: s, Conf: s.Conf}
+	peer.logger = zaptest.NewLogger(t).Sugar()
+	s.HandlePane("admin", func([]string, *pty.Winsize, string) (io.ReadWriteCloser, error) {
+		return newHandlerTTY(), nil
+	})
+	s.HandlePane("admin", nil)
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.Error(t, pane.Run([]string{"@admin"}))
+	require.False(t, pane.IsRunning)
+}
+
+func TestPaneExitStatus(t *testing.T) {
+	if PtyMux == nil {
+		PtyMux = PtyMuxType{}
+	}
+	s := newTestServer(t)
+	peer := &Peer{Server: s, Conf: s.Conf}
+	// the panes' read loops outlive the test so they can't use the test's logger
+	peer.logger = zap.NewNop().Sugar()
+	tty := newHandlerTTY()
+	s.HandlePane("admin", func([]string, *pty.Winsize, string) (io.ReadWriteCloser, error) {
+		return tty, nil
+	})
+	run := func(command ...string) *Pane {
+		pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+		require.NoError(t, err)
+		require.NoError(t, pane.Run(command))
+		return pane
+	}
+	require.Equal(t, 3, run("sh", "-c", "exit 3").ExitStatus(5*time.Second))
+	// a handler's pane fails when its tty does
+	pane := run("@admin")
+	require.Equal(t, -1, pane.ExitStatus(10*time.Millisecond))
+	tty.w.CloseWithError(errors.New("admin failed"))
+	require.Equal(t, 1, pane.ExitStatus(time.Second))
+	tty = newHandlerTTY()
+	pane = run("@admin")
+	tty.w.Close()
+	require.Equal(t, 0, pane.ExitStatus(time.Second))
+}
@@ -0,0 +1,90 @@
+// This file holds the hello handshake, exchanging the versions & capabilities
+// of the server and the client when the cdc opens
+package peers
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// ProtocolRevision is the revision of the control protocol. Revision 1 is
+// the protocol of servers & clients that don't know hello.
+const ProtocolRevision = 2
+
+// Capabilities of the peers package. Embedders add theirs with
+// Server.AddCapabilities.
+const (
+	// CapCompression is the deflate compression of pane output
+	CapCompression = "compression"
+	// CapEchoHints is the echo_hints message
+	CapEchoHints = "echo_hints"
+	// CapLayout is the layout model. Clients declaring it get the layout in
+	// the restore ack instead of the deprecated payload.
+	CapLayout = "layout"
+	// CapPaneHandlers is the in-process panes opened with "@<name>"
+	CapPaneHandlers = "pane_handlers"
+	// CapMux is the mux message, multiplexing the panes over one data
+	// channel
+	CapMux = "mux"
+	// CapEvents is the subscribe message and the event stream
+	CapEvents = "events"
+)
+
+// AddCapabilities adds capabilities the server reports in the hello ack
+func (s *Server) AddCapabilities(caps ...string) {
+	s.capsM.Lock()
+	defer s.capsM.Unlock()
+	for _, c := range caps {
+		if !slices.Contains(s.caps, c) {
+			s.caps = append(s.caps, c)
+		}
+	}
+	sort.Strings(s.caps)
+}
+
+// Capabilities returns the capabilities of the server
+func (s *Server) Capabilities() []string {
+	s.capsM.Lock()
+	defer s.capsM.Unlock()
+	return append([]string(nil), s.caps...)
+}
+
+// Hello returns the server's hello
+func (s *Server) Hello() HelloArgs {
+	return HelloArgs{
+		Version:      s.Version,
+		Protocol:     ProtocolRevision,
+		Capabilities: s.Capabilities(),
+		Messages:     s.Messages.Types(),
+	}
+}
+
+// handleHello saves the client's protocol & capabilities and acks with the
+// server's hello
+func (s *Server) handleHello(peer *Peer, m CTRLMessage, args HelloArgs) {
+	peer.Lock()
+	peer.Protocol = args.Protocol
+	peer.Capabilities = args.Capabilities
+	peer.Unlock()
+	peer.logger.Infof("Got hello from a %s client, protocol %d, capabilities %v",
+		args.Version, args.Protocol, args.Capabilities)
+	body, err := json.Marshal(s.Hello())
+	if err != nil {
+		peer.SendNack(m, fmt.Sprintf("Failed to marshal hello: %s", err))
+		return
+	}
+	err = peer.SendAck(m, string(body))
+	if err != nil {
+		peer.logger.Errorf("#%s: Failed to send hello ack: %v", peer.FP, err)
+	}
+}
+
+// HasCapability returns true if the client declared the capability in its
+// hello
+func (peer *Peer) HasCapability(c string) bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return slices.Contains(peer.Capabilities, c)
+}
@@ -0,0 +1,435 @@
+// This file contains the server side model of the clients' layout
+package peers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLayoutConflict is returned when a layout update is based on an old version
+var ErrLayoutConflict = errors.New("Layout version conflict")
+
+// Layout describes how clients arrange the panes on the screen
+type Layout struct {
+	// Version is incremented on every change
+	Version int    `json:"version"`
+	Gates   []Gate `json:"gates"`
+}
+
+// Gate is a named set of windows
+type Gate struct {
+	Name    string   `json:"name"`
+	Windows []Window `json:"windows"`
+}
+
+// Window holds a tree of panes
+type Window struct {
+	Name   string `json:"name"`
+	Active bool   `json:"active,omitempty"`
+	// Zoomed holds the id of the zoomed pane or 0
+	Zoomed int         `json:"zoomed,omitempty"`
+	Root   *LayoutCell `json:"root"`
+}
+
+// LayoutCell is a node in a window's split tree. A leaf holds a pane and
+// other cells are split between their children.
+type LayoutCell struct {
+	// Size is the cell's part of its parent, between 0 and 1
+	Size   float64 `json:"size"`
+	PaneID int     `json:"pane_id,omitempty"`
+	// Dir is either "topbottom" or "leftright"
+	Dir      string        `json:"dir,omitempty"`
+	Children []*LayoutCell `json:"children,omitempty"`
+}
+
+// PaneInfo identifies a pane in the saved layout, as pane ids are reused
+// after a restart
+type PaneInfo struct {
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+}
+
+// savedLayout is the layout file's content
+type savedLayout struct {
+	Layout Layout           `json:"layout"`
+	Panes  map[int]PaneInfo `json:"panes"`
+}
+
+// info returns the pane's identity
+func (pane *Pane) info() PaneInfo {
+	command := pane.Handler
+	if pane.C != nil {
+		command = strings.Join(pane.C.Args, " ")
+	}
+	return PaneInfo{Command: command, Started: pane.started}
+}
+
+// LayoutStore holds the layout and saves it to disk
+type LayoutStore struct {
+	m      sync.Mutex
+	layout Layout
+	path   string
+	// panes holds the panes the layout refers to
+	panes *PanesDB
+	// OnChange is called after the layout is changed
+	OnChange func(Layout)
+	// onEvent is called after the layout is changed, before OnChange
+	onEvent func(Layout)
+	// closed is set when the server shuts down and the layout is final
+	closed bool
+}
+
+// NewLayoutStore returns a new store with an empty layout of the panes
+func NewLayoutStore(panes *PanesDB) *LayoutStore {
+	return &LayoutStore{layout: Layout{Gates: []Gate{}}, panes: panes}
+}
+
+// Load reads the layout from path, which is later used to save it.
+// A missing file is not an error. Pane ids are not stable across restarts,
+// so panes that don't match a live pane's command and start time are
+// dropped and new panes get ids above the saved ones.
+func (s *LayoutStore) Load(path string) error {
+	s.m.Lock()
+	s.path = path
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.m.Unlock()
+		return nil
+	}
+	if err != nil {
+		s.m.Unlock()
+		return fmt.Errorf("Failed to read layout file: %s", err)
+	}
+	var saved savedLayout
+	err = json.Unmarshal(b, &saved)
+	if err != nil {
+		s.m.Unlock()
+		return fmt.Errorf("Failed to parse layout file %q: %s", path, err)
+	}
+	if saved.Layout.Gates == nil && saved.Panes == nil {
+		// files saved before the panes' info was added hold just the layout
+		json.Unmarshal(b, &saved.Layout)
+	}
+	l := saved.Layout
+	if l.Gates == nil {
+		l.Gates = []Gate{}
+	}
+	s.panes.reserve(l.maxPaneID())
+	l, changed := l.pruned(func(id int) bool {
+		info, found := saved.Panes[id]
+		if !found || !paneAlive(s.panes, id) {
+			return false
+		}
+		current := s.panes.Get(id).info()
+		return current.Command == info.Command && current.Started.Equal(info.Started)
+	})
+	if changed {
+		l.Version = saved.Layout.Version + 1
+	}
+	s.layout = l
+	if changed {
+		err = s.save(l)
+	}
+	s.m.Unlock()
+	return err
+}
+
+// Get returns the current layout
+func (s *LayoutStore) Get() Layout {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.layout
+}
+
+// Set replaces the layout if version is the current version.
+// It returns the new layout, with the version incremented. When the layout
+// can't be saved it's left unchanged.
+func (s *LayoutStore) Set(version int, l Layout) (Layout, error) {
+	err := l.Validate(s.panes)
+	if err != nil {
+		return Layout{}, err
+	}
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return Layout{}, fmt.Errorf("The server is shutting down")
+	}
+	if version != s.layout.Version {
+		current := s.layout.Version
+		s.m.Unlock()
+		return Layout{}, fmt.Errorf("%w: current version is %d", ErrLayoutConflict, current)
+	}
+	if l.Gates == nil {
+		l.Gates = []Gate{}
+	}
+	l.Version = version + 1
+	err = s.save(l)
+	if err != nil {
+		s.m.Unlock()
+		return Layout{}, err
+	}
+	s.layout = l
+	s.m.Unlock()
+	s.changed(l)
+	return l, nil
+}
+
+// Prune removes panes that no longer exist from the layout and returns
+// true if the layout changed. Once the store is closed, the layout is
+// no longer pruned.
+func (s *LayoutStore) Prune() (bool, error) {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return false, nil
+	}
+	l, changed := s.layout.pruned(func(id int) bool {
+		return paneAlive(s.panes, id)
+	})
+	if !changed {
+		s.m.Unlock()
+		return false, nil
+	}
+	l.Version = s.layout.Version + 1
+	s.layout = l
+	err := s.save(l)
+	s.m.Unlock()
+	s.changed(l)
+	return true, err
+}
+
+func (s *LayoutStore) changed(l Layout) {
+	if s.onEvent != nil {
+		s.onEvent(l)
+	}
+	if s.OnChange != nil {
+		s.OnChange(l)
+	}
+}
+
+// Close saves the layout and stops changing it, so the panes exiting when
+// the server shuts down are kept in the saved layout
+func (s *LayoutStore) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	return s.save(s.layout)
+}
+
+// save writes a layout to disk. it's called with the lock held.
+func (s *LayoutStore) save(l Layout) error {
+	if s.path == "" {
+		return nil
+	}
+	saved := savedLayout{Layout: l, Panes: make(map[int]PaneInfo)}
+	for _, id := range l.paneIDs() {
+		if pane := s.panes.Get(id); pane != nil {
+			saved.Panes[id] = pane.info()
+		}
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal layout: %s", err)
+	}
+	tmp := s.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write layout file: %s", err)
+	}
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		return fmt.Errorf("Failed to write layout file: %s", err)
+	}
+	return nil
+}
+
+// Validate checks the layout's split trees and that all the panes exist
+func (l Layout) Validate(panes *PanesDB) error {
+	seen := make(map[int]bool)
+	for _, g := range l.Gates {
+		for _, w := range g.Windows {
+			if w.Root == nil {
+				return fmt.Errorf("Window %q has no panes", w.Name)
+			}
+			err := w.Root.validate(panes, seen)
+			if err != nil {
+				return fmt.Errorf("Bad layout of window %q: %s", w.Name, err)
+			}
+			if w.Zoomed != 0 && w.Root.find(w.Zoomed) == nil {
+				return fmt.Errorf("Zoomed pane %d is not in window %q", w.Zoomed, w.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *LayoutCell) validate(panes *PanesDB, seen map[int]bool) error {
+	if c.Size <= 0 || c.Size > 1 {
+		return fmt.Errorf("Bad cell size: %g", c.Size)
+	}
+	if len(c.Children) == 0 {
+		if c.PaneID == 0 {
+			return fmt.Errorf("A cell with no pane and no children")
+		}
+		if panes.Get(c.PaneID) == nil {
+			return fmt.Errorf("Unknown pane: %d", c.PaneID)
+		}
+		if seen[c.PaneID] {
+			return fmt.Errorf("Pane %d appears more than once", c.PaneID)
+		}
+		seen[c.PaneID] = true
+		return nil
+	}
+	if c.PaneID != 0 {
+		return fmt.Errorf("A split cell with pane %d", c.PaneID)
+	}
+	if c.Dir != "topbottom" && c.Dir != "leftright" {
+		return fmt.Errorf("Unknown split direction: %q", c.Dir)
+	}
+	if len(c.Children) < 2 {
+		return fmt.Errorf("A split cell with %d children", len(c.Children))
+	}
+	var total float64
+	for _, child := range c.Children {
+		err := child.validate(panes, seen)
+		if err != nil {
+			return err
+		}
+		total += child.Size
+	}
+	if math.Abs(total-1) > 0.01 {
+		return fmt.Errorf("Children sizes add up to %g", total)
+	}
+	return nil
+}
+
+func (c *LayoutCell) find(paneID int) *LayoutCell {
+	if c.PaneID == paneID {
+		return c
+	}
+	for _, child := range c.Children {
+		if found := child.find(paneID); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// paneIDs returns the ids of the layout's panes
+func (l Layout) paneIDs() []int {
+	var ids []int
+	for _, g := range l.Gates {
+		for _, w := range g.Windows {
+			ids = w.Root.paneIDs(ids)
+		}
+	}
+	return ids
+}
+
+// maxPaneID returns the highest pane id in the layout or 0
+func (l Layout) maxPaneID() int {
+	max := 0
+	for _, id := range l.paneIDs() {
+		if id > max {
+			max = id
+		}
+	}
+	return max
+}
+
+func (c *LayoutCell) paneIDs(ids []int) []int {
+	if c == nil {
+		return ids
+	}
+	if c.PaneID != 0 {
+		ids = append(ids, c.PaneID)
+	}
+	for _, child := range c.Children {
+		ids = child.paneIDs(ids)
+	}
+	return ids
+}
+
+// pruned returns a copy of the layout with only the panes keep returns
+// true for
+func (l Layout) pruned(keep func(int) bool) (Layout, bool) {
+	changed := false
+	ret := Layout{Version: l.Version, Gates: make([]Gate, 0, len(l.Gates))}
+	for _, g := range l.Gates {
+		gate := Gate{Name: g.Name, Windows: make([]Window, 0, len(g.Windows))}
+		for _, w := range g.Windows {
+			root, c := w.Root.pruned(keep)
+			changed = changed || c
+			if root == nil {
+				continue
+			}
+			root.Size = 1
+			if w.Zoomed != 0 && root.find(w.Zoomed) == nil {
+				w.Zoomed = 0
+			}
+			w.Root = root
+			gate.Windows = append(gate.Windows, w)
+		}
+		ret.Gates = append(ret.Gates, gate)
+	}
+	return ret, changed
+}
+
+// pruned returns a copy of the cell with only the panes keep returns true
+// for. Splits left with a single child are replaced by the child and the
+// children sizes are scaled to fill the cell.
+func (c *LayoutCell) pruned(keep func(int) bool) (*LayoutCell, bool) {
+	if c == nil {
+		return nil, false
+	}
+	if len(c.Children) == 0 {
+		if keep(c.PaneID) {
+			ret := *c
+			return &ret, false
+		}
+		return nil, true
+	}
+	changed := false
+	children := make([]*LayoutCell, 0, len(c.Children))
+	var total float64
+	for _, child := range c.Children {
+		p, ch := child.pruned(keep)
+		changed = changed || ch
+		if p != nil {
+			children = append(children, p)
+			total += p.Size
+		}
+	}
+	switch len(children) {
+	case 0:
+		return nil, true
+	case 1:
+		children[0].Size = c.Size
+		return children[0], true
+	}
+	if changed {
+		for _, child := range children {
+			child.Size /= total
+		}
+	}
+	ret := *c
+	ret.Children = children
+	return &ret, changed
+}
+
+// paneAlive returns true if the pane exists and wasn't killed
+func paneAlive(panes *PanesDB, id int) bool {
+	pane := panes.Get(id)
+	if pane == nil {
+		return false
+	}
+	pane.Lock()
+	defer pane.Unlock()
+	return !pane.killed
+}
@@ -0,0 +1,182 @@
+package peers
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newLayoutPane(t *testing.T, panes *PanesDB) *Pane {
+	t.Helper()
+	p := newTestPane(t)
+	p.started = time.Now()
+	panes.Add(p)
+	return p
+}
+
+func splitLayout(ids ...int) Layout {
+	root := &LayoutCell{Size: 1, Dir: "leftright"}
+	for _, id := range ids {
+		root.Children = append(root.Children,
+			&LayoutCell{Size: 1 / float64(len(ids)), PaneID: id})
+	}
+	return Layout{Gates: []Gate{{
+		Name:    "home",
+		Windows: []Window{{Name: "main", Active: true, Root: root}},
+	}}}
+}
+
+func TestLayoutValidate(t *testing.T) {
+	panes := NewPanesDB()
+	a := newLayoutPane(t, panes)
+	b := newLayoutPane(t, panes)
+	require.NoError(t, splitLayout(a.ID, b.ID).Validate(panes))
+	require.Error(t, splitLayout(a.ID, a.ID).Validate(panes))
+	require.Error(t, splitLayout(a.ID, 9999).Validate(panes))
+	l := splitLayout(a.ID, b.ID)
+	l.Gates[0].Windows[0].Root.Dir = "diagonal"
+	require.Error(t, l.Validate(panes))
+	l = splitLayout(a.ID, b.ID)
+	l.Gates[0].Windows[0].Root.Children[0].Size = 0.9
+	require.Error(t, l.Validate(panes))
+	l = splitLayout(a.ID, b.ID)
+	l.Gates[0].Windows[0].Zoomed = 9999
+	require.Error(t, l.Validate(panes))
+}
+
+func TestLayoutSetVersions(t *testing.T) {
+	panes := NewPanesDB()
+	a := newLayoutPane(t, panes)
+	s := NewLayoutStore(panes)
+	var changes []Layout
+	s.OnChange = func(l Layout) { changes = append(changes, l) }
+	l, err := s.Set(0, splitLayout(a.ID))
+	require.Error(t, err, "a split with one child is not valid")
+	l, err = s.Set(0, Layout{Gates: []Gate{{Name: "home"}}})
+	require.NoError(t, err)
+	require.Equal(t, 1, l.Version)
+	_, err = s.Set(0, Layout{})
+	require.True(t, errors.Is(err, ErrLayoutConflict))
+	require.Equal(t, "home", s.Get().Gates[0].Name)
+	require.Len(t, changes, 1)
+}
+
+func TestLayoutPrunePersist(t *testing.T) {
+	panes := NewPanesDB()
+	a := newLayoutPane(t, panes)
+	b := newLayoutPane(t, panes)
+	c := newLayoutPane(t, panes)
+	path := filepath.Join(t.TempDir(), "layout.json")
+	s := NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	l := splitLayout(a.ID, b.ID)
+	// split the second cell between b & c
+	l.Gates[0].Windows[0].Root.Children[1] = &LayoutCell{
+		Size: 0.5,
+		Dir:  "topbottom",
+		Children: []*LayoutCell{
+			{Size: 0.75, PaneID: b.ID},
+			{Size: 0.25, PaneID: c.ID},
+		},
+	}
+	l.Gates[0].Windows[0].Zoomed = b.ID
+	_, err := s.Set(0, l)
+	require.NoError(t, err)
+	changed, err := s.Prune()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	b.killed = true
+	changed, err = s.Prune()
+	require.NoError(t, err)
+	require.True(t, changed)
+	w := s.Get().Gates[0].Windows[0]
+	require.Zero(t, w.Zoomed)
+	require.Equal(t, 2, s.Get().Version)
+	require.Len(t, w.Root.Children, 2)
+	require.Equal(t, &LayoutCell{Size: 0.5, PaneID: c.ID}, w.Root.Children[1])
+
+	// the layout survives a reload and panes that are gone are dropped
+	panes.Delete(a.ID)
+	s = NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	l = s.Get()
+	require.Equal(t, 3, l.Version)
+	require.Equal(t, &LayoutCell{Size: 1, PaneID: c.ID}, l.Gates[0].Windows[0].Root)
+	panes.Delete(c.ID)
+	_, err = s.Prune()
+	require.NoError(t, err)
+	require.Empty(t, s.Get().Gates[0].Windows)
+	require.Equal(t, "home", s.Get().Gates[0].Name)
+}
+
+func TestLayoutSetSaveFails(t *testing.T) {
+	panes := NewPanesDB()
+	s := NewLayoutStore(panes)
+	require.NoError(t, s.Load(filepath.Join(t.TempDir(), "missing", "layout.json")))
+	var changes []Layout
+	s.OnChange = func(l Layout) { changes = append(changes, l) }
+	_, err := s.Set(0, Layout{Gates: []Gate{{Name: "home"}}})
+	require.Error(t, err)
+	require.Zero(t, s.Get().Version)
+	require.Empty(t, s.Get().Gates)
+	require.Empty(t, changes)
+}
+
+func TestLayoutClose(t *testing.T) {
+	panes := NewPanesDB()
+	a := newLayoutPane(t, panes)
+	path := filepath.Join(t.TempDir(), "layout.json")
+	s := NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	_, err := s.Set(0, Layout{Gates: []Gate{{Name: "home", Windows: []Window{
+		{Name: "main", Root: &LayoutCell{Size: 1, PaneID: a.ID}}}}}})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+	// panes exiting on shutdown are kept in the saved layout
+	a.killed = true
+	changed, err := s.Prune()
+	require.NoError(t, err)
+	require.False(t, changed)
+	_, err = s.Set(1, Layout{})
+	require.Error(t, err)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var saved savedLayout
+	require.NoError(t, json.Unmarshal(b, &saved))
+	require.Equal(t, a.ID, saved.Layout.Gates[0].Windows[0].Root.PaneID)
+	require.Equal(t, a.info().Started.UnixNano(), saved.Panes[a.ID].Started.UnixNano())
+}
+
+func TestLayoutRestart(t *testing.T) {
+	panes := NewPanesDB()
+	a := newLayoutPane(t, panes)
+	b := newLayoutPane(t, panes)
+	path := filepath.Join(t.TempDir(), "layout.json")
+	s := NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	_, err := s.Set(0, splitLayout(a.ID, b.ID))
+	require.NoError(t, err)
+	// after a restart the ids are reused by new, unrelated panes
+	panes = NewPanesDB()
+	c := newLayoutPane(t, panes)
+	require.Equal(t, a.ID, c.ID)
+	s = NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	l := s.Get()
+	require.Equal(t, 2, l.Version)
+	require.Equal(t, "home", l.Gates[0].Name)
+	require.Empty(t, l.Gates[0].Windows)
+	// new panes get ids above the saved ones
+	d := newLayoutPane(t, panes)
+	require.Greater(t, d.ID, b.ID)
+	// the pruned layout is saved
+	s = NewLayoutStore(panes)
+	require.NoError(t, s.Load(path))
+	require.Equal(t, 2, s.Get().Version)
+}
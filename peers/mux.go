@@ -0,0 +1,413 @@
+// This file holds the multiplexer of pane streams over a single connection,
+// used by the websocket transport and the mux data channel
+package peers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// MuxLabel is the label of the mux data channel
+const MuxLabel = "mux"
+
+// The types of the mux data channel frames
+const (
+	// FrameData holds a pane's output or input
+	FrameData byte = 0
+	// FrameOpen opens a pane's stream, its payload is the stream's label,
+	// "<message id>:<pane id>"
+	FrameOpen byte = 1
+	// FrameClose closes a pane's stream
+	FrameClose byte = 2
+)
+
+// muxConn multiplexes streams over a connection. Every stream has an id,
+// the pane's id, and write writes the stream's frames to the connection.
+// Frames are queued without a limit so sending never blocks, the bytes a
+// stream has in the queue are its buffered amount, letting the pane's flow
+// control pause when the connection is slow.
+type muxConn struct {
+	peer    *Peer
+	m       sync.Mutex
+	streams map[uint32]*muxStream
+	// out holds the frames waiting to be written, in order
+	out []muxFrame
+	// wake is signaled when frames are queued
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+	// write writes a frame to the connection
+	write func(id uint32, typ byte, payload []byte) error
+	// onClose closes the connection
+	onClose func()
+}
+
+type muxFrame struct {
+	stream  *muxStream
+	typ     byte
+	payload []byte
+}
+
+// muxStream is a Channel over a muxConn
+type muxStream struct {
+	c     *muxConn
+	id    uint32
+	chID  uint16
+	label string
+	// buffered is the number of bytes waiting to be written
+	buffered     uint64
+	lowThreshold uint64
+	m            sync.Mutex
+	closed       bool
+	onMessage    func(webrtc.DataChannelMessage)
+	onClose      func()
+	onLow        func()
+}
+
+func newMuxConn(peer *Peer, write func(uint32, byte, []byte) error, onClose func()) *muxConn {
+	c := &muxConn{
+		peer:    peer,
+		streams: make(map[uint32]*muxStream),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		write:   write,
+		onClose: onClose,
+	}
+	go c.writeLoop()
+	return c
+}
+
+// newStream opens a stream for the pane in the label, "<ref>:<pane id>"
+func (c *muxConn) newStream(label string) (Channel, error) {
+	i := strings.LastIndex(label, ":")
+	id, err := strconv.Atoi(label[i+1:])
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("Bad stream label: %q", label)
+	}
+	select {
+	case <-c.done:
+		return nil, fmt.Errorf("Connection is closed")
+	default:
+	}
+	c.m.Lock()
+	old := c.streams[uint32(id)]
+	c.m.Unlock()
+	// a client has one stream per pane
+	if old != nil {
+		old.closeLocal()
+	}
+	s := c.addStream(uint32(id), label)
+	err = s.queue(FrameOpen, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *muxConn) addStream(id uint32, label string) *muxStream {
+	s := &muxStream{c: c, id: id, chID: uint16(id), label: label}
+	c.m.Lock()
+	c.streams[id] = s
+	c.m.Unlock()
+	return s
+}
+
+// deliver passes a frame read from the connection to its stream
+func (c *muxConn) deliver(id uint32, typ byte, payload []byte) {
+	c.m.Lock()
+	s := c.streams[id]
+	c.m.Unlock()
+	if s == nil {
+		c.peer.logger.Warnf("Ignoring a frame for unknown stream %d", id)
+		return
+	}
+	switch typ {
+	case FrameClose:
+		if id != 0 {
+			s.closeLocal()
+		}
+	case FrameData:
+		s.m.Lock()
+		f := s.onMessage
+		s.m.Unlock()
+		if f != nil {
+			f(webrtc.DataChannelMessage{IsString: false, Data: payload})
+		}
+	default:
+		c.peer.logger.Warnf("Ignoring a frame of unknown type %d", typ)
+	}
+}
+
+// push queues a frame and wakes the write loop
+func (c *muxConn) push(f muxFrame) error {
+	c.m.Lock()
+	select {
+	case <-c.done:
+		c.m.Unlock()
+		return fmt.Errorf("Connection is closed")
+	default:
+	}
+	c.out = append(c.out, f)
+	c.m.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop returns the next frame to write, or false if there's none
+func (c *muxConn) pop() (muxFrame, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if len(c.out) == 0 {
+		return muxFrame{}, false
+	}
+	f := c.out[0]
+	c.out[0] = muxFrame{}
+	c.out = c.out[1:]
+	return f, true
+}
+
+func (c *muxConn) writeLoop() {
+	for {
+		f, ok := c.pop()
+		if !ok {
+			select {
+			case <-c.done:
+				return
+			case <-c.wake:
+			}
+			continue
+		}
+		err := c.write(f.stream.id, f.typ, f.payload)
+		if err != nil {
+			c.peer.logger.Warnf("Failed to write a frame: %s", err)
+			c.close()
+			return
+		}
+		f.stream.sent(uint64(len(f.payload)))
+	}
+}
+
+// close closes the connection and all its streams
+func (c *muxConn) close() {
+	c.once.Do(func() {
+		c.m.Lock()
+		close(c.done)
+		c.out = nil
+		c.m.Unlock()
+		if c.onClose != nil {
+			c.onClose()
+		}
+		c.m.Lock()
+		streams := make([]*muxStream, 0, len(c.streams))
+		for _, s := range c.streams {
+			streams = append(streams, s)
+		}
+		c.m.Unlock()
+		for _, s := range streams {
+			s.closeLocal()
+		}
+	})
+}
+
+// parseFrame parses a mux data channel frame: a 4 byte big endian pane id,
+// the frame's type and the payload
+func parseFrame(b []byte) (uint32, byte, []byte, error) {
+	if len(b) < 5 {
+		return 0, 0, nil, fmt.Errorf("Frame is too short: %d bytes", len(b))
+	}
+	return binary.BigEndian.Uint32(b[:4]), b[4], b[5:], nil
+}
+
+// NewFrame returns a mux data channel frame
+func NewFrame(id uint32, typ byte, payload []byte) []byte {
+	b := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(b, id)
+	b[4] = typ
+	copy(b[5:], payload)
+	return b
+}
+
+func (s *muxStream) Label() string { return s.label }
+func (s *muxStream) ID() *uint16   { return &s.chID }
+
+// Send queues the payload to be written to the connection, it never blocks
+func (s *muxStream) Send(b []byte) error {
+	return s.queue(FrameData, b)
+}
+
+func (s *muxStream) queue(typ byte, b []byte) error {
+	s.m.Lock()
+	closed := s.closed
+	s.m.Unlock()
+	if closed {
+		return fmt.Errorf("Stream %d is closed", s.id)
+	}
+	atomic.AddUint64(&s.buffered, uint64(len(b)))
+	err := s.c.push(muxFrame{stream: s, typ: typ, payload: b})
+	if err != nil {
+		atomic.AddUint64(&s.buffered, ^(uint64(len(b)) - 1))
+	}
+	return err
+}
+
+// sent is called after a frame is written
+func (s *muxStream) sent(n uint64) {
+	left := atomic.AddUint64(&s.buffered, ^(n - 1))
+	s.m.Lock()
+	f := s.onLow
+	threshold := s.lowThreshold
+	s.m.Unlock()
+	if f != nil && left <= threshold && left+n > threshold {
+		f()
+	}
+}
+
+// Close closes the stream and lets the client know
+func (s *muxStream) Close() error {
+	s.m.Lock()
+	closed := s.closed
+	s.m.Unlock()
+	if !closed && s.id != 0 {
+		s.queue(FrameClose, []byte{})
+	}
+	s.closeLocal()
+	return nil
+}
+
+// closeLocal marks the stream closed and removes it from the connection
+func (s *muxStream) closeLocal() {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return
+	}
+	s.closed = true
+	f := s.onClose
+	s.m.Unlock()
+	s.c.m.Lock()
+	if s.c.streams[s.id] == s {
+		delete(s.c.streams, s.id)
+	}
+	s.c.m.Unlock()
+	if f != nil {
+		f()
+	}
+}
+
+func (s *muxStream) ReadyState() webrtc.DataChannelState {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return webrtc.DataChannelStateClosed
+	}
+	return webrtc.DataChannelStateOpen
+}
+
+func (s *muxStream) BufferedAmount() uint64 {
+	return atomic.LoadUint64(&s.buffered)
+}
+
+func (s *muxStream) SetBufferedAmountLowThreshold(th uint64) {
+	s.m.Lock()
+	s.lowThreshold = th
+	s.m.Unlock()
+}
+
+func (s *muxStream) OnBufferedAmountLow(f func()) {
+	s.m.Lock()
+	s.onLow = f
+	s.m.Unlock()
+}
+
+// OnOpen calls f as streams are open when they're created
+func (s *muxStream) OnOpen(f func()) {
+	go f()
+}
+
+func (s *muxStream) OnMessage(f func(webrtc.DataChannelMessage)) {
+	s.m.Lock()
+	s.onMessage = f
+	s.m.Unlock()
+}
+
+func (s *muxStream) OnClose(f func()) {
+	s.m.Lock()
+	s.onClose = f
+	s.m.Unlock()
+}
+
+// handleMux opens the mux data channel, carrying the streams of the panes
+// the client opens from now on. The message is acked once it's open.
+func (s *Server) handleMux(peer *Peer, m CTRLMessage, _ json.RawMessage) {
+	peer.Lock()
+	pc := peer.PC
+	peer.Unlock()
+	if pc == nil {
+		peer.SendNack(m, "mux requires a webrtc connection")
+		return
+	}
+	t := true
+	d, err := pc.CreateDataChannel(MuxLabel, &webrtc.DataChannelInit{Ordered: &t})
+	if err != nil {
+		peer.SendNack(m, fmt.Sprintf("Failed to create the mux channel: %s", err))
+		return
+	}
+	low := make(chan struct{}, 1)
+	d.SetBufferedAmountLowThreshold(BufferedAmountLow)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case low <- struct{}{}:
+		default:
+		}
+	})
+	var c *muxConn
+	c = newMuxConn(peer, func(id uint32, typ byte, payload []byte) error {
+		// wait for the channel to drain so the streams' buffers fill up
+		// and the panes' flow control kicks in
+		for d.BufferedAmount() > MaxBufferedAmount {
+			select {
+			case <-low:
+			case <-c.done:
+				return fmt.Errorf("Connection is closed")
+			}
+		}
+		return d.Send(NewFrame(id, typ, payload))
+	}, func() { d.Close() })
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		id, typ, payload, err := parseFrame(msg.Data)
+		if err != nil {
+			peer.logger.Warnf("Ignoring a bad mux frame: %s", err)
+			return
+		}
+		c.deliver(id, typ, payload)
+	})
+	d.OnClose(func() {
+		c.close()
+		// back to a data channel per pane
+		peer.Lock()
+		if peer.mux == c {
+			peer.mux = nil
+		}
+		peer.Unlock()
+	})
+	d.OnOpen(func() {
+		peer.Lock()
+		old := peer.mux
+		peer.mux = c
+		peer.Unlock()
+		if old != nil {
+			old.close()
+		}
+		peer.SendAck(m, "")
+	})
+}
@@ -0,0 +1,89 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMuxFrames(t *testing.T) {
+	id, typ, payload, err := parseFrame(NewFrame(7, FrameOpen, []byte("12:7")))
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), id)
+	require.Equal(t, FrameOpen, typ)
+	require.Equal(t, "12:7", string(payload))
+	_, _, _, err = parseFrame([]byte{0, 0, 0, 7})
+	require.Error(t, err)
+}
+
+func TestMuxConn(t *testing.T) {
+	peer := &Peer{logger: zaptest.NewLogger(t).Sugar()}
+	frames := make(chan []byte, 10)
+	c := newMuxConn(peer, func(id uint32, typ byte, payload []byte) error {
+		frames <- NewFrame(id, typ, payload)
+		return nil
+	}, nil)
+	defer c.close()
+	_, err := c.newStream("12:0")
+	require.Error(t, err)
+	s, err := c.newStream("12:7")
+	require.NoError(t, err)
+	require.Equal(t, NewFrame(7, FrameOpen, []byte("12:7")), <-frames)
+	require.NoError(t, s.Send([]byte("hello")))
+	require.Equal(t, NewFrame(7, FrameData, []byte("hello")), <-frames)
+	got := make(chan string, 1)
+	s.OnMessage(func(msg webrtc.DataChannelMessage) { got <- string(msg.Data) })
+	c.deliver(7, FrameData, []byte("ls\n"))
+	require.Equal(t, "ls\n", <-got)
+	// the client closes the stream
+	closed := make(chan bool, 1)
+	s.OnClose(func() { closed <- true })
+	c.deliver(7, FrameClose, nil)
+	require.True(t, <-closed)
+	require.Equal(t, webrtc.DataChannelStateClosed, s.ReadyState())
+	require.Error(t, s.Send([]byte("bye")))
+}
+
+func TestMuxSendNeverBlocks(t *testing.T) {
+	peer := &Peer{logger: zaptest.NewLogger(t).Sugar()}
+	release := make(chan struct{})
+	c := newMuxConn(peer, func(uint32, byte, []byte) error {
+		<-release
+		return nil
+	}, nil)
+	defer c.close()
+	ch, err := c.newStream("12:7")
+	require.NoError(t, err)
+	s := ch.(*muxStream)
+	low := make(chan bool, 1)
+	s.SetBufferedAmountLowThreshold(BufferedAmountLow)
+	s.OnBufferedAmountLow(func() { low <- true })
+	// the connection is stuck, yet sending many small frames doesn't block
+	// and the stream looks saturated
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 1024; i++ {
+			require.NoError(t, s.Send(make([]byte, 1024)))
+		}
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked")
+	}
+	require.Greater(t, s.BufferedAmount(), uint64(MaxBufferedAmount))
+	client := &Client{dc: s}
+	require.True(t, client.saturated())
+	close(release)
+	select {
+	case <-low:
+	case <-time.After(time.Second):
+		t.Fatal("the stream didn't drain")
+	}
+	require.Eventually(t, func() bool { return s.BufferedAmount() == 0 },
+		time.Second, 10*time.Millisecond)
+}
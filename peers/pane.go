@@ -8,7 +8,9 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/creack/pty"
@@ -19,28 +21,62 @@ import (
 
 const OutBufSize = 4096
 
-// Panes is an array that hol;ds all the panes
-var Panes = NewPanesDB()
+const (
+	// MaxBufferedAmount is the number of bytes a client's data channel can
+	// buffer before the client is considered saturated
+	MaxBufferedAmount = 256 * 1024
+	// BufferedAmountLow is the threshold under which a saturated client is
+	// considered drained
+	BufferedAmountLow = 64 * 1024
+	// PaneBufferSize is the size of a pane's output history. It's a few
+	// times MaxBufferedAmount so a lagging client's marker is still in the
+	// buffer when its data channel drains.
+	PaneBufferSize = 4 * MaxBufferedAmount
+)
 
 // Pane type hold a command, a pseudo tty and the connected data channels
 type Pane struct {
 	sync.Mutex
 	ID     int
 	parent int
-	// C holds the exectuted command
-	C            *exec.Cmd
+	// C holds the exectuted command, it's nil for panes served by a handler
+	C *exec.Cmd
+	// Handler is the name of the handler serving the pane, if any
+	Handler      string
 	IsRunning    bool
+	killed       bool
 	TTY          io.ReadWriteCloser
 	Buffer       *Buffer
 	Ws           *pty.Winsize
 	vt           vt10x.Terminal
 	outbuf       chan []byte
+	drained      chan struct{}
 	cancelRWLoop context.CancelFunc
 	ctx          context.Context
 	peer         *Peer
+	// title is the last title the pane's process set, used by the sender
+	title string
+	// ResizePolicy is the pane's resize policy, the conf's policy when empty
+	ResizePolicy string
+	// active is the peer that typed or resized last, guarded by sizeM
+	active *Peer
+	sizeM  sync.Mutex
+	// hints holds the peers subscribed to the pane's echo hints
+	hints map[*Peer]*echoState
+	// hintsTimer flushes the echo hints after output, nil when none is due
+	hintsTimer *time.Timer
+	hintsM     sync.Mutex
+	// exitStatus is the exit code of the pane's process, or 1 when a
+	// handler's tty failed. exited is closed once it's set.
+	exitStatus int
+	exited     chan struct{}
+	exitOnce   sync.Once
+	// started is when the pane was created
+	started time.Time
 }
 
-// ExecCommand in ahelper function for executing a command
+// ExecCommand in ahelper function for executing a command.
+// The command is waited for by the pane running it.
 func ExecCommand(command []string, env map[string]string, ws *pty.Winsize, pID int, fp string) (*exec.Cmd, io.ReadWriteCloser, error) {
 
 	var (
@@ -80,26 +116,32 @@ func ExecCommand(command []string, env map[string]string, ws *pty.Winsize, pID i
 	if err != nil {
 		return nil, nil, fmt.Errorf("Failed launching %q: %q %s", command, err, fp)
 	}
-	go func() {
-		cmd.Process.Wait()
-	}()
-
 	return cmd, tty, nil
 }
 
+// server returns the server the pane belongs to
+func (pane *Pane) server() *Server {
+	return pane.peer.Server
+}
+
 // NewPane opens a new pane
 func NewPane(peer *Peer, ws *pty.Winsize, parent int) (*Pane, error) {
 
 	var vt vt10x.Terminal
 	if parent != 0 {
-		parentPane := Panes.Get(parent)
+		parentPane := peer.Server.Panes.Get(parent)
 		if parentPane == nil {
 			return nil, fmt.Errorf(
 				"Got a pane request with an illegal parrent pane id: %d", parent)
 		}
 		//TODO: handle a crash here, when there's a parent pane but no process yet
 		//      https://github.com/tuzig/webexec/issues/106
-		parent = parentPane.C.Process.Pid
+		if parentPane.C != nil {
+			parent = parentPane.C.Process.Pid
+		} else {
+			// handler panes have no process to inherit the cwd from
+			parent = 0
+		}
 	}
 	if ws != nil {
 		vt = vt10x.New(vt10x.WithSize(int(ws.Cols), int(ws.Rows)))
@@ -108,48 +150,101 @@ func NewPane(peer *Peer, ws *pty.Winsize, parent int) (*Pane, error) {
 	pane := &Pane{
 		parent:       parent,
 		IsRunning:    false,
-		Buffer:       NewBuffer(100000), //TODO: get the number from conf
+		Buffer:       NewBuffer(PaneBufferSize), //TODO: get the number from conf
 		Ws:           ws,
 		vt:           vt,
 		outbuf:       make(chan []byte, OutBufSize),
+		drained:      make(chan struct{}, 1),
+		exited:       make(chan struct{}),
 		ctx:          ctx,
 		cancelRWLoop: cancel,
 		peer:         peer,
+		started:      time.Now(),
 	}
-	Panes.Add(pane) // This will set pane.ID
+	peer.Server.Panes.Add(pane) // This will set pane.ID
 	return pane, nil
 }
 
 // start starts the command and pty
 func (pane *Pane) Run(command []string) error {
 	logger := pane.peer.logger
+	if strings.HasPrefix(command[0], HandlerPrefix) {
+		logger.Infof("Starting handler: %v", command)
+		return pane.runHandler(command)
+	}
 	run := pane.peer.Conf.RunCommand
 	if run == nil {
 		run = ExecCommand
 	}
 	logger.Infof("Starting command: %v", command)
 	cmd, tty, err := run(
-		command, pane.peer.Conf.Env, pane.Ws, pane.parent, pane.peer.FP)
+		command, pane.env(), pane.Ws, pane.parent, pane.peer.FP)
 	if err != nil {
 		logger.Warnf("command failed: %s", err)
 		return err
 	}
 	pane.C = cmd
-	pane.Lock()
-	pane.IsRunning = true
-	pane.Unlock()
-	pane.TTY = tty
 	errbuf := new(bytes.Buffer)
 	if cmd != nil {
 		cmd.Stderr = errbuf
+		go pane.wait()
 	}
 	go pane.stderrLoop(errbuf)
-	go pane.ReadLoop()
+	pane.RunTTY(tty)
 	return nil
 }
 
+// wait waits for the pane's process to exit and sets its exit status
+func (pane *Pane) wait() {
+	state, err := pane.C.Process.Wait()
+	if err != nil {
+		pane.peer.logger.Warnf("@%d: Failed to wait for the process: %s", pane.ID, err)
+		pane.setExit(1)
+		return
+	}
+	status := state.ExitCode()
+	// like shells, a process killed by a signal exits with 128+signal
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status = 128 + int(ws.Signal())
+	}
+	pane.setExit(status)
+}
+
+// setExit sets the pane's exit status, once
+func (pane *Pane) setExit(status int) {
+	if pane.exited == nil {
+		return
+	}
+	pane.exitOnce.Do(func() {
+		pane.exitStatus = status
+		close(pane.exited)
+	})
+}
+
+// ExitStatus waits up to timeout for the pane to exit and returns its exit
+// status or -1 if it didn't exit
+func (pane *Pane) ExitStatus(timeout time.Duration) int {
+	select {
+	case <-pane.exited:
+		return pane.exitStatus
+	case <-time.After(timeout):
+		return -1
+	}
+}
+
+// RunTTY starts reading a tty that was opened outside of the pane,
+// i.e. a tmux pane
+func (pane *Pane) RunTTY(tty io.ReadWriteCloser) {
+	pane.Lock()
+	pane.IsRunning = true
+	pane.Unlock()
+	pane.TTY = tty
+	go pane.ReadLoop()
+	pane.server().Emit(EventArgs{Type: EventPaneCreated, PaneID: pane.ID})
+}
+
 // sendFirstMessage sends the pane id and dimensions
-func (pane *Pane) sendFirstMessage(dc *webrtc.DataChannel) {
+func (pane *Pane) sendFirstMessage(dc Channel) {
 	var r string
 	if pane.Ws != nil {
 		r = fmt.Sprintf("%d,%dx%d", pane.ID, pane.Ws.Rows, pane.Ws.Cols)
@@ -167,6 +262,13 @@ func (pane *Pane) ReadLoop() {
 	sctx, cancel := context.WithCancel(context.Background())
 	go pane.sender(sctx)
 	logger.Infof("readding from tty: %v", pane.TTY)
+	// panes with no process, like handlers' panes, fail when their tty does
+	status := 0
+	defer func() {
+		if pane.C == nil {
+			pane.setExit(status)
+		}
+	}()
 loop:
 	for {
 		select {
@@ -182,6 +284,7 @@ loop:
 		}
 		if rerr != nil {
 			logger.Errorf("Got an error reqading from pty#%d: %s", id, rerr)
+			status = 1
 			break loop
 		}
 		if l == 0 {
@@ -205,8 +308,12 @@ loop:
 	// TODO: find a better way to wait for all the messages to be sent
 	time.AfterFunc(time.Second/10, func() {
 		cancel()
-		pane = Panes.Get(id)
-		pane.Kill()
+		p := pane.server().Panes.Get(id)
+		p.Kill()
+		_, err := p.server().Layout.Prune()
+		if err != nil {
+			logger.Errorf("Failed to prune the layout: %s", err)
+		}
 	})
 }
 
@@ -217,28 +324,17 @@ loop:
 		select {
 		case <-ctx.Done():
 			break loop
+		case <-pane.drained:
+			pane.resync()
 		case m, ok := <-pane.outbuf:
 			if !ok {
 				break loop
 			}
-			// We need to get the dcs from Panes for an updated version
-			cs := CDB.All4Pane(pane)
-			logger.Infof("@%d: Sending %d bytes to %d dcs", pane.ID, len(m), len(cs))
-			for _, d := range cs {
-				s := d.dc.ReadyState()
-				if s == webrtc.DataChannelStateOpen {
-					err := d.dc.Send(m)
-					if err != nil {
-						logger.Errorf("got an error when sending message: %v", err)
-					}
-				} else {
-					logger.Infof("closing & removing dc because state: %q", s)
-					CDB.Delete(d)
-					d.dc.Close()
-				}
-			}
+			pane.send(ctx, m)
 			if pane.vt != nil {
 				pane.vt.Write(m)
+				pane.scheduleEchoHints()
+				pane.checkTitle()
 			}
 			pane.Buffer.Add(m)
 		}
@@ -246,19 +342,127 @@ loop:
 	logger.Infof("Exiting the sender loop for pane %d ", pane.ID)
 }
 
+// checkTitle emits a pane_renamed event when the process changes the title
+func (pane *Pane) checkTitle() {
+	pane.vt.Lock()
+	title := pane.vt.Title()
+	pane.vt.Unlock()
+	if title != pane.title {
+		pane.title = title
+		pane.server().Emit(EventArgs{Type: EventPaneRenamed, PaneID: pane.ID,
+			Name: title})
+	}
+}
+
+// send sends a message to all the pane's clients.
+// When all the clients are saturated, send waits for one of them to drain.
+// As the sender stops reading outbuf, the read loop blocks and the pty is
+// paused. A single lagging client is skipped and resynced once it drains.
+func (pane *Pane) send(ctx context.Context, m []byte) {
+	logger := pane.peer.logger
+	for pane.allSaturated() {
+		logger.Infof("@%d: all clients are saturated, pausing", pane.ID)
+		select {
+		case <-ctx.Done():
+			return
+		case <-pane.drained:
+			pane.resync()
+		}
+	}
+	// We need to get the dcs from Panes for an updated version
+	cdb := pane.server().CDB
+	cs := cdb.All4Pane(pane)
+	logger.Infof("@%d: Sending %d bytes to %d dcs", pane.ID, len(m), len(cs))
+	for _, d := range cs {
+		s := d.dc.ReadyState()
+		if s != webrtc.DataChannelStateOpen {
+			logger.Infof("closing & removing dc because state: %q", s)
+			cdb.Delete(d)
+			d.dc.Close()
+			continue
+		}
+		if d.lagging {
+			continue
+		}
+		if d.saturated() {
+			logger.Infof("@%d: client %d is lagging, dropping output", pane.ID, d.id)
+			d.lag()
+			continue
+		}
+		err := d.Send(m)
+		if err != nil {
+			logger.Errorf("got an error when sending message: %v", err)
+		}
+	}
+}
+
+// allSaturated returns true if the pane has open clients and all of them
+// are saturated
+func (pane *Pane) allSaturated() bool {
+	cs := pane.server().CDB.All4Pane(pane)
+	open := 0
+	for _, d := range cs {
+		if d.dc.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if !d.saturated() {
+			return false
+		}
+		open++
+	}
+	return open > 0
+}
+
+// resync sends lagging clients whose data channel drained all the output
+// they missed
+func (pane *Pane) resync() {
+	logger := pane.peer.logger
+	for _, d := range pane.server().CDB.All4Pane(pane) {
+		if !d.lagging || d.dc.BufferedAmount() > BufferedAmountLow {
+			continue
+		}
+		b := pane.Buffer.GetSinceMarker(d.marker)
+		d.lagging = false
+		logger.Infof("@%d: resyncing client %d with %d bytes", pane.ID, d.id, len(b))
+		err := d.Send(b)
+		if err != nil {
+			logger.Errorf("got an error when resyncing a client: %v", err)
+		}
+	}
+}
+
+// onDrained is called when one of the pane's data channels buffered amount
+// drops below BufferedAmountLow
+func (pane *Pane) onDrained() {
+	select {
+	case pane.drained <- struct{}{}:
+	default:
+	}
+}
+
 // Kill takes a pane to the sands of Rishon and buries it
 func (pane *Pane) Kill() {
 	logger := pane.peer.logger
 	logger.Infof("Killing a pane")
-	for _, d := range CDB.All4Pane(pane) {
+	cdb := pane.server().CDB
+	for _, d := range cdb.All4Pane(pane) {
 		if d.dc.ReadyState() == webrtc.DataChannelStateOpen {
 			d.dc.Close()
 		}
-		CDB.Delete(d)
+		cdb.Delete(d)
 	}
+	exited := false
+	// the event is emitted after the pane is unlocked
+	defer func() {
+		if exited {
+			pane.server().Emit(EventArgs{Type: EventPaneExited, PaneID: pane.ID})
+		}
+	}()
 	pane.Lock()
 	defer pane.Unlock()
+	pane.killed = true
 	if pane.IsRunning {
+		exited = true
 		pane.cancelRWLoop()
 		if pane.C != nil {
 			err := pane.C.Process.Kill()
@@ -282,7 +486,8 @@ func (pane *Pane) Kill() {
 //   - CPR/DSR/DA queries are answered directly from vt10x state or hardcoded
 //     responses and routed through outbuf to all clients.
 //   - OSC 10/11 color queries are forwarded to the PTY only from the
-//     most-recently-active client; other clients' color queries are dropped.
+//     pane's most-recently-active client; other clients' color queries are
+//     dropped.
 //   - All other input passes through to the PTY unchanged.
 func (pane *Pane) OnMessage(sender *Peer, msg webrtc.DataChannelMessage) {
 	logger := pane.peer.logger
@@ -302,7 +507,8 @@ func (pane *Pane) OnMessage(sender *Peer, msg webrtc.DataChannelMessage) {
 	// not intercepted query sequences.  This prevents the race where
 	// SetLastPeer would run before OnMessage, making every OSC color
 	// query appear to come from the active peer.
-	SetLastPeer(sender)
+	pane.server().SetLastPeer(sender)
+	pane.touch(sender)
 
 	l, err := pane.TTY.Write(p)
 	if err == os.ErrClosed {
@@ -318,6 +524,7 @@ func (pane *Pane) OnMessage(sender *Peer, msg webrtc.DataChannelMessage) {
 		logger.Warnf("pty of %d wrote %d instead of %d bytes",
 			pane.ID, l, len(p))
 	}
+	pane.countInput(sender)
 }
 
 // Terminal query response constants shared by interceptQuery and filterPTYOutput.
@@ -381,9 +588,10 @@ func (pane *Pane) interceptQuery(sender *Peer, p []byte) ([]byte, bool) {
 	}
 
 	switch {
-	// OSC 10/11 color queries — forward to PTY from active peer only
+	// OSC 10/11 color queries — forward to PTY from the pane's active peer
+	// only
 	case isOSCColorQuery(p):
-		activePeer := GetActivePeer()
+		activePeer := pane.ActivePeer()
 		if activePeer != sender {
 			return nil, true // drop from non-active peer
 		}
@@ -393,7 +601,7 @@ func (pane *Pane) interceptQuery(sender *Peer, p []byte) ([]byte, bool) {
 	// active peer only, to prevent N copies of the response from reaching
 	// the program when N clients all respond to the broadcast query.
 	case isOSCColorResponse(p):
-		activePeer := GetActivePeer()
+		activePeer := pane.ActivePeer()
 		if activePeer != sender {
 			return nil, true // drop from non-active peer
 		}
@@ -535,17 +743,37 @@ func (pane *Pane) synthesizeCPR() []byte {
 	return []byte(fmt.Sprintf("\x1b[%d;%dR", c.Y+1, c.X+1))
 }
 
+// Resizer is implemented by ttys that are not a pty and need to handle
+// pane resizing themselves
+type Resizer interface {
+	Resize(ws *pty.Winsize) error
+}
+
 // Resize is used to resize the pane's tty.
 // the function does nothing if it's given a nil size or the current size
 func (pane *Pane) Resize(ws *pty.Winsize) {
 	logger := pane.peer.logger
-	if ws != nil && (ws.Rows != pane.Ws.Rows || ws.Cols != pane.Ws.Cols) {
+	if ws != nil && *ws != *pane.Ws {
 		logger.Infof("Changing pty size for pane %d: %v", pane.ID, ws)
-		pane.Ws = ws
-		pty.Setsize(pane.TTY.(*os.File), ws)
-		if pane.vt != nil {
-			pane.vt.Resize(int(ws.Cols), int(ws.Rows))
+		switch tty := pane.TTY.(type) {
+		case Resizer:
+			err := tty.Resize(ws)
+			if err != nil {
+				logger.Warnf("Failed to resize pane %d: %s", pane.ID, err)
+			}
+		case *os.File:
+			pty.Setsize(tty, ws)
 		}
+		pane.SetSize(ws)
+	}
+}
+
+// SetSize updates the pane's size without resizing its tty. It's used when
+// the tty was resized by someone else.
+func (pane *Pane) SetSize(ws *pty.Winsize) {
+	pane.Ws = ws
+	if pane.vt != nil {
+		pane.vt.Resize(int(ws.Cols), int(ws.Rows))
 	}
 }
 
@@ -605,11 +833,11 @@ func printColorChange(fg, bg vt10x.Color) string {
 // If the peer has a marker data will be read from the buffer and sent over.
 // If no marker, Restore uses our headless terminal emulator to restore the
 // screen.
-func (pane *Pane) Restore(d *webrtc.DataChannel, marker int) {
+func (pane *Pane) Restore(c *Client, marker int) {
 	logger := pane.peer.logger
 	if marker == -1 {
 		if pane.vt != nil {
-			id := d.ID()
+			id := c.dc.ID()
 			if id == nil {
 				logger.Error(
 					"Failed restoring to a data channel that has no id")
@@ -618,7 +846,7 @@ func (pane *Pane) Restore(d *webrtc.DataChannel, marker int) {
 				"Sending scrren dump to pane: %d, dc: %d", pane.ID, *id)
 			//TODO: this and the next afterfunc is silly
 			time.AfterFunc(time.Second/10, func() {
-				d.Send(pane.dumpVT())
+				c.Send(pane.dumpVT())
 			})
 		} else {
 			logger.Warn("not restoring as st is null")
@@ -626,7 +854,7 @@ func (pane *Pane) Restore(d *webrtc.DataChannel, marker int) {
 	} else {
 		logger.Infof("Sending history buffer since marker: %d", marker)
 		time.AfterFunc(time.Second/10, func() {
-			d.Send(pane.Buffer.GetSinceMarker(marker))
+			c.Send(pane.Buffer.GetSinceMarker(marker))
 		})
 	}
 }
@@ -3,7 +3,6 @@ package peers
 import (
 	"io"
 	"testing"
-	"time"
 
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
@@ -22,21 +21,15 @@ func (m *mockTTY) Write(p []byte) (int, error) {
 }
 func (m *mockTTY) Close() error { return nil }
 
-// resetActivePeer resets the package-level active-peer globals and registers
-// a cleanup so subsequent tests see a clean slate.
-func resetActivePeer(t *testing.T) {
+// newTestServer returns a server with a clean slate of peers & panes
+func newTestServer(t *testing.T) *Server {
 	t.Helper()
-	mostRecentPeer = nil
-	lastReceived = time.Time{}
-	t.Cleanup(func() {
-		mostRecentPeer = nil
-		lastReceived = time.Time{}
-	})
+	return NewServer(&Conf{Logger: zaptest.NewLogger(t).Sugar()})
 }
 
 func newTestPane(t *testing.T) *Pane {
 	t.Helper()
-	peer := &Peer{}
+	peer := &Peer{Server: newTestServer(t)}
 	peer.logger = zaptest.NewLogger(t).Sugar()
 	return &Pane{
 		peer:   peer,
@@ -112,10 +105,9 @@ func TestIsOSCColorQuery(t *testing.T) {
 }
 
 func TestInterceptQueryOSCColorFromActivePeer(t *testing.T) {
-	resetActivePeer(t)
 	p := newTestPane(t)
 
-	SetLastPeer(p.peer)
+	p.server().SetLastPeer(p.peer)
 
 	resp, handled := p.interceptQuery(p.peer, []byte("\x1b]11;?\x07"))
 	require.False(t, handled, "active peer OSC should pass through to PTY")
@@ -123,7 +115,6 @@ func TestInterceptQueryOSCColorFromActivePeer(t *testing.T) {
 }
 
 func TestInterceptQueryOSCColorFromInactivePeer(t *testing.T) {
-	resetActivePeer(t)
 	p := newTestPane(t)
 
 	// No active peer — OSC query should be dropped
@@ -136,10 +127,10 @@ func TestInterceptQueryOSCColorFromInactivePeer(t *testing.T) {
 // reconnects to a pane originally created by peerA, the OSC color query
 // is filtered against the *sender* (peerB), not pane.peer (peerA).
 func TestInterceptQueryOSCColorFromReconnectingPeer(t *testing.T) {
-	resetActivePeer(t)
-	peerA := &Peer{}
+	s := newTestServer(t)
+	peerA := &Peer{Server: s}
 	peerA.logger = zaptest.NewLogger(t).Sugar()
-	peerB := &Peer{}
+	peerB := &Peer{Server: s}
 	peerB.logger = zaptest.NewLogger(t).Sugar()
 
 	// Pane was created by peerA, but peerB is now connected
@@ -149,7 +140,7 @@ func TestInterceptQueryOSCColorFromReconnectingPeer(t *testing.T) {
 	}
 
 	// peerB is the active peer (from real typing)
-	SetLastPeer(peerB)
+	s.SetLastPeer(peerB)
 
 	// peerB sends OSC 11 — active peer, should pass through
 	resp, handled := p.interceptQuery(peerB, []byte("\x1b]11;?\x07"))
@@ -165,8 +156,8 @@ func TestInterceptQueryOSCColorFromReconnectingPeer(t *testing.T) {
 // TestOnMessagePassthroughSetsLastPeer verifies that real input (keystrokes)
 // flowing through OnMessage updates the active peer via SetLastPeer.
 func TestOnMessagePassthroughSetsLastPeer(t *testing.T) {
-	resetActivePeer(t)
-	peer := &Peer{}
+	s := newTestServer(t)
+	peer := &Peer{Server: s}
 	peer.logger = zaptest.NewLogger(t).Sugar()
 	tty := &mockTTY{}
 	p := &Pane{
@@ -177,15 +168,15 @@ func TestOnMessagePassthroughSetsLastPeer(t *testing.T) {
 
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("echo hello\r")})
 
-	require.Same(t, peer, mostRecentPeer, "pass-through input should set last peer")
+	require.Same(t, peer, s.mostRecentPeer, "pass-through input should set last peer")
 	require.Equal(t, []byte("echo hello\r"), tty.written)
 }
 
 // TestOnMessageQueryDoesNotSetLastPeer verifies that intercepted query
 // sequences do NOT update the active peer — this is the race condition fix.
 func TestOnMessageQueryDoesNotSetLastPeer(t *testing.T) {
-	resetActivePeer(t)
-	peer := &Peer{}
+	s := newTestServer(t)
+	peer := &Peer{Server: s}
 	peer.logger = zaptest.NewLogger(t).Sugar()
 	tty := &mockTTY{}
 	p := &Pane{
@@ -197,25 +188,25 @@ func TestOnMessageQueryDoesNotSetLastPeer(t *testing.T) {
 	// DSR cursor position query — should be intercepted, not written to PTY
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("\x1b[6n")})
 
-	require.Nil(t, mostRecentPeer, "intercepted query should not set last peer")
+	require.Nil(t, s.mostRecentPeer, "intercepted query should not set last peer")
 	require.Empty(t, tty.written, "intercepted query should not reach PTY")
 
 	// DSR device status query
-	mostRecentPeer = nil
+	s.mostRecentPeer = nil
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("\x1b[5n")})
-	require.Nil(t, mostRecentPeer, "intercepted DSR should not set last peer")
+	require.Nil(t, s.mostRecentPeer, "intercepted DSR should not set last peer")
 
 	// Device attributes query
-	mostRecentPeer = nil
+	s.mostRecentPeer = nil
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("\x1b[c")})
-	require.Nil(t, mostRecentPeer, "intercepted DA should not set last peer")
+	require.Nil(t, s.mostRecentPeer, "intercepted DA should not set last peer")
 }
 
 // TestOnMessageOSCColorDroppedDoesNotSetLastPeer verifies that an OSC color
 // query from a non-active peer is dropped and does not update the active peer.
 func TestOnMessageOSCColorDroppedDoesNotSetLastPeer(t *testing.T) {
-	resetActivePeer(t)
-	peer := &Peer{}
+	s := newTestServer(t)
+	peer := &Peer{Server: s}
 	peer.logger = zaptest.NewLogger(t).Sugar()
 	tty := &mockTTY{}
 	p := &Pane{
@@ -227,7 +218,7 @@ func TestOnMessageOSCColorDroppedDoesNotSetLastPeer(t *testing.T) {
 	// No active peer — OSC query should be dropped
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("\x1b]11;?\x07")})
 
-	require.Nil(t, mostRecentPeer, "dropped OSC query should not set last peer")
+	require.Nil(t, s.mostRecentPeer, "dropped OSC query should not set last peer")
 	require.Empty(t, tty.written, "dropped OSC query should not reach PTY")
 }
 
@@ -235,8 +226,8 @@ func TestOnMessageOSCColorDroppedDoesNotSetLastPeer(t *testing.T) {
 // query from the active peer passes through to the PTY and updates the
 // active peer (since it's real input heading to the PTY).
 func TestOnMessageOSCColorActivePeerPassesThrough(t *testing.T) {
-	resetActivePeer(t)
-	peer := &Peer{}
+	s := newTestServer(t)
+	peer := &Peer{Server: s}
 	peer.logger = zaptest.NewLogger(t).Sugar()
 	tty := &mockTTY{}
 	p := &Pane{
@@ -246,11 +237,11 @@ func TestOnMessageOSCColorActivePeerPassesThrough(t *testing.T) {
 	}
 
 	// Set this peer as active
-	SetLastPeer(peer)
+	s.SetLastPeer(peer)
 
 	p.OnMessage(peer, webrtc.DataChannelMessage{Data: []byte("\x1b]11;?\x07")})
 
-	require.Same(t, peer, mostRecentPeer, "active peer OSC pass-through should update last peer")
+	require.Same(t, peer, s.mostRecentPeer, "active peer OSC pass-through should update last peer")
 	require.Equal(t, []byte("\x1b]11;?\x07"), tty.written, "active peer OSC should reach PTY")
 }
 
@@ -258,9 +249,9 @@ func TestOnMessageOSCColorActivePeerPassesThrough(t *testing.T) {
 // two different peers send OSC 11 queries, only the active peer's query
 // reaches the PTY; the other is dropped.
 func TestOnMessageMultiplePeersOSCNoAmplification(t *testing.T) {
-	resetActivePeer(t)
-	peerA := &Peer{}
-	peerB := &Peer{}
+	s := newTestServer(t)
+	peerA := &Peer{Server: s}
+	peerB := &Peer{Server: s}
 	logger := zaptest.NewLogger(t).Sugar()
 	peerA.logger = logger
 	peerB.logger = logger
@@ -276,7 +267,7 @@ func TestOnMessageMultiplePeersOSCNoAmplification(t *testing.T) {
 	// Simulate: peerA typed something first (becoming active)
 	p.OnMessage(peerA, webrtc.DataChannelMessage{Data: []byte("ls\r")})
 	require.Equal(t, []byte("ls\r"), tty.written)
-	require.Same(t, peerA, GetActivePeer())
+	require.Same(t, peerA, s.ActivePeer())
 	tty.written = nil
 
 	// Now peerA sends OSC 11 — active peer, should pass through
@@ -286,7 +277,7 @@ func TestOnMessageMultiplePeersOSCNoAmplification(t *testing.T) {
 
 	// peerB sends OSC 11 — NOT active peer, should be dropped
 	// (peerA is still active because only pass-through updates SetLastPeer)
-	require.Same(t, peerA, GetActivePeer())
+	require.Same(t, peerA, s.ActivePeer())
 	p.OnMessage(peerB, webrtc.DataChannelMessage{Data: []byte("\x1b]11;?\x07")})
 	require.Empty(t, tty.written, "inactive peer OSC should be dropped")
 }
@@ -295,9 +286,9 @@ func TestOnMessageMultiplePeersOSCNoAmplification(t *testing.T) {
 // peerB reconnects to a pane created by peerA, the active-peer tracking
 // uses the sender (peerB), not pane.peer (peerA).
 func TestOnMessageReconnectingPeerUsesSenderNotPanePeer(t *testing.T) {
-	resetActivePeer(t)
-	peerA := &Peer{}
-	peerB := &Peer{}
+	s := newTestServer(t)
+	peerA := &Peer{Server: s}
+	peerB := &Peer{Server: s}
 	logger := zaptest.NewLogger(t).Sugar()
 	peerA.logger = logger
 	peerB.logger = logger
@@ -312,7 +303,7 @@ func TestOnMessageReconnectingPeerUsesSenderNotPanePeer(t *testing.T) {
 
 	// peerB types — should become active (not peerA)
 	p.OnMessage(peerB, webrtc.DataChannelMessage{Data: []byte("ls\r")})
-	require.Same(t, peerB, mostRecentPeer, "sender peerB should be set as active, not pane.peer peerA")
+	require.Same(t, peerB, s.mostRecentPeer, "sender peerB should be set as active, not pane.peer peerA")
 	require.Equal(t, []byte("ls\r"), tty.written)
 }
 
@@ -557,10 +548,9 @@ func TestIsOSCColorResponse(t *testing.T) {
 }
 
 func TestInterceptQueryOSCColorResponseFromActivePeer(t *testing.T) {
-	resetActivePeer(t)
 	p := newTestPane(t)
 
-	SetLastPeer(p.peer)
+	p.server().SetLastPeer(p.peer)
 
 	resp, handled := p.interceptQuery(p.peer, []byte("\x1b]11;rgb:0000/0000/0000\x07"))
 	require.False(t, handled, "active peer OSC response should pass through to PTY")
@@ -568,7 +558,6 @@ func TestInterceptQueryOSCColorResponseFromActivePeer(t *testing.T) {
 }
 
 func TestInterceptQueryOSCColorResponseFromInactivePeer(t *testing.T) {
-	resetActivePeer(t)
 	p := newTestPane(t)
 
 	// No active peer — OSC response should be dropped
@@ -581,9 +570,9 @@ func TestInterceptQueryOSCColorResponseFromInactivePeer(t *testing.T) {
 // multiple clients send OSC 11 color responses, only the active peer's
 // response reaches the PTY.
 func TestOnMessageMultiplePeersOSCResponseNoAmplification(t *testing.T) {
-	resetActivePeer(t)
-	peerA := &Peer{}
-	peerB := &Peer{}
+	s := newTestServer(t)
+	peerA := &Peer{Server: s}
+	peerB := &Peer{Server: s}
 	logger := zaptest.NewLogger(t).Sugar()
 	peerA.logger = logger
 	peerB.logger = logger
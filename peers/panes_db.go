@@ -27,6 +27,16 @@ func (pd *PanesDB) Add(p *Pane) {
 	pd.panes[p.ID] = p
 }
 
+// reserve makes sure new panes get ids above id, so ids saved before a
+// restart don't point at new panes
+func (pd *PanesDB) reserve(id int) {
+	pd.m.Lock()
+	defer pd.m.Unlock()
+	if id > pd.nextID {
+		pd.nextID = id
+	}
+}
+
 // All returns a slice with all the panes in the database
 func (pd *PanesDB) All() []*Pane {
 	pd.m.Lock()
@@ -25,21 +25,7 @@ const keepAliveInterval = 2 * time.Second
 // RunCommandInterface is an interface for a function that runs a command
 type RunCommandInterface func([]string, map[string]string, *pty.Winsize, int, string) (*exec.Cmd, io.ReadWriteCloser, error)
 
-var (
-	// Peers holds all the peers (connected and disconnected)
-	Peers map[string]*Peer
-	// Payload holds the client's payload
-	Payload []byte
-	// WebRTCAPI is the gateway to webrtc calls
-	WebRTCAPI  *webrtc.API
-	webrtcAPIM sync.Mutex
-	peersM     sync.Mutex
-	CDB        = NewClientsDB()
-	msgIDM     sync.Mutex
-	// theses two go together - the last peer and the time it was last seen
-	mostRecentPeer *Peer
-	lastReceived   time.Time
-)
+var msgIDM sync.Mutex
 
 type Conf struct {
 	AckTimeout        time.Duration
@@ -52,12 +38,20 @@ type Conf struct {
 	GetWelcome        func() string
 	KeepAliveInterval time.Duration
 	Logger            *zap.SugaredLogger
-	OnCTRLMsg         func(*Peer, *CTRLMessage, json.RawMessage)
-	OnStateChange     func(*Peer, webrtc.PeerConnectionState)
-	PortMax           uint16
-	PortMin           uint16
-	RunCommand        RunCommandInterface
-	WebrtcSetting     *webrtc.SettingEngine
+	// OnCTRLMsg is called with a nil message when the cdc opens and with
+	// the control messages that have no handler in the server's registry
+	OnCTRLMsg     func(*Peer, *CTRLMessage, json.RawMessage)
+	OnStateChange func(*Peer, webrtc.PeerConnectionState)
+	PortMax       uint16
+	PortMin       uint16
+	// RestartTimeout is how long a failed peer waits for an ICE restart
+	// before it's closed. When zero, failed peers are closed at once.
+	RestartTimeout time.Duration
+	RunCommand     RunCommandInterface
+	WebrtcSetting  *webrtc.SettingEngine
+	// ResizePolicy is the default resize policy of panes, ResizeLatest when
+	// empty
+	ResizePolicy string
 }
 
 // Peer is a type used to remember a client.
@@ -70,11 +64,30 @@ type Peer struct {
 	LastContact       *time.Time
 	LastRef           int
 	PC                *webrtc.PeerConnection
-	cdc               *webrtc.DataChannel
+	cdc               Channel
+	cdcM              sync.Mutex // guards cdc
 	Marker            int
 	pendingCandidates chan *webrtc.ICECandidateInit
 	logger            *zap.SugaredLogger
 	Conf              *Conf
+	// Server is the server the peer belongs to
+	Server *Server
+	// Protocol is the protocol revision the client declared in its hello,
+	// zero if it didn't send one
+	Protocol int
+	// Capabilities holds the capabilities the client declared in its hello
+	Capabilities []string
+	// closeTimer closes a failed peer unless it's restarted
+	closeTimer *time.Timer
+	// ws is set when the peer uses the websocket transport
+	ws *WSConn
+	// ssh is set when the peer is an ssh session
+	ssh *sshChannel
+	// mux is set when the client asked for the panes to share one data
+	// channel
+	mux *muxConn
+	// events holds the event types the client subscribed to
+	events []string
 }
 
 // CandidatePairStats is a struct that holds the values of a ICE candidate pair
@@ -96,23 +109,8 @@ func (p *CandidatePairStats) Write(w *tabwriter.Writer) {
 }
 
 // NewPeer funcions starts listening to incoming peer connection from a remote
-func NewPeer(fp string, conf *Conf) (*Peer, error) {
-	webrtcAPIM.Lock()
-	if WebRTCAPI == nil {
-		var s *webrtc.SettingEngine
-		if conf.WebrtcSetting != nil {
-			s = conf.WebrtcSetting
-		} else {
-			s = &webrtc.SettingEngine{}
-		}
-		if conf.PortMax > 0 {
-			s.SetEphemeralUDPPortRange(conf.PortMin, conf.PortMax)
-		}
-		s.SetICETimeouts(
-			conf.DisconnectTimeout, conf.FailedTimeout, conf.KeepAliveInterval)
-		WebRTCAPI = webrtc.NewAPI(webrtc.WithSettingEngine(*s))
-	}
-	webrtcAPIM.Unlock()
+func (s *Server) NewPeer(fp string) (*Peer, error) {
+	conf := s.Conf
 	var iceServers []webrtc.ICEServer
 	if conf.GetICEServers != nil {
 		var err error
@@ -126,7 +124,7 @@ func NewPeer(fp string, conf *Conf) (*Peer, error) {
 		ICEServers:   iceServers,
 		Certificates: []webrtc.Certificate{*conf.Certificate},
 	}
-	pc, err := WebRTCAPI.NewPeerConnection(config)
+	pc, err := s.webrtcAPI().NewPeerConnection(config)
 	if err != nil {
 		return nil, fmt.Errorf("NewPeerConnection failed: %s", err)
 	}
@@ -140,19 +138,18 @@ func NewPeer(fp string, conf *Conf) (*Peer, error) {
 		pendingCandidates: make(chan *webrtc.ICECandidateInit, 8),
 		logger:            conf.Logger,
 		Conf:              conf,
+		Server:            s,
 		acks:              make(map[int]chan string),
 	}
-	peersM.Lock()
-	if Peers == nil {
-		Peers = make(map[string]*Peer)
-	}
-	Peers[fp] = &peer
-	peersM.Unlock()
+	s.addPeer(&peer)
 	// Status changes happend when the peer has connected/disconnected
 	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		peer.logger.Infof("WebRTC Connection State change: %s", state.String())
 		if state == webrtc.PeerConnectionStateFailed {
-			peer.Close()
+			peer.closeAfter(peer.Conf.RestartTimeout)
+		}
+		if state == webrtc.PeerConnectionStateConnected {
+			peer.cancelClose()
 		}
 		if state == webrtc.PeerConnectionStateConnecting {
 			for c := range peer.pendingCandidates {
@@ -162,30 +159,36 @@ func NewPeer(fp string, conf *Conf) (*Peer, error) {
 				}
 			}
 		}
-		if peer.Conf.OnStateChange != nil {
-			peer.Conf.OnStateChange(&peer, state)
-		}
+		s.peerStateChanged(&peer, state)
 	})
 	pc.OnDataChannel(peer.OnChannelReq)
 	return &peer, nil
 }
 
-// Listen get's a client offer, starts listens to it and returns an answear
+// newTransportPeer creates a peer with no peer connection, used by the
+// websocket & ssh transports, and adds it to the server's peers
+func (s *Server) newTransportPeer(fp string) *Peer {
+	peer := &Peer{
+		FP:                fp,
+		Marker:            -1,
+		pendingCandidates: make(chan *webrtc.ICECandidateInit, 8),
+		logger:            s.Conf.Logger,
+		Conf:              s.Conf,
+		Server:            s,
+		acks:              make(map[int]chan string),
+	}
+	s.addPeer(peer)
+	return peer
+}
+
+// Listen get's a client offer, starts listens to it and returns an answear.
+// The answer includes the candidates gathered until gathering completed or
+// GatheringTimeout passed.
 func (peer *Peer) Listen(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
 	peer.logger.Infof("Listening to: %v", offer)
-	err := peer.PC.SetRemoteDescription(offer)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to set remote description: %s", err)
-	}
-	answer, err := peer.PC.CreateAnswer(nil)
-	if err != nil {
-		return nil, err
-	}
-	// Sets the LocalDescription, and starts listning for UDP packets
 	// Create channel that is blocked until ICE Gathering is complete
-	// TODO: remove this and erplace with ICE trickle
 	gatherComplete := webrtc.GatheringCompletePromise(peer.PC)
-	err = peer.PC.SetLocalDescription(answer)
+	err := peer.answer(offer)
 	if err != nil {
 		return nil, err
 	}
@@ -196,6 +199,129 @@ func (peer *Peer) Listen(offer webrtc.SessionDescription) (*webrtc.SessionDescri
 	return peer.PC.LocalDescription(), nil
 }
 
+// ListenTrickle get's a client offer, starts listening to it and returns
+// an answer with the candidates gathered so far. onCandidate is called with
+// every candidate gathered and with nil when gathering is complete.
+// When the offer doesn't advertise trickle ICE, the answer waits like
+// Listen's for gathering to complete or GatheringTimeout to pass.
+func (peer *Peer) ListenTrickle(offer webrtc.SessionDescription,
+	onCandidate func(*webrtc.ICECandidate)) (*webrtc.SessionDescription, error) {
+
+	peer.logger.Infof("Listening with trickle ICE to: %v", offer)
+	peer.PC.OnICECandidate(onCandidate)
+	gatherComplete := webrtc.GatheringCompletePromise(peer.PC)
+	err := peer.answer(offer)
+	if err != nil {
+		return nil, err
+	}
+	if peer.PC.CanTrickleICECandidates() != webrtc.ICETrickleCapabilitySupported {
+		select {
+		case <-time.After(peer.Conf.GatheringTimeout):
+		case <-gatherComplete:
+		}
+	}
+	return peer.PC.LocalDescription(), nil
+}
+
+// answer sets the remote description, creates an answer and sets it as the
+// local description which starts ICE gathering
+func (peer *Peer) answer(offer webrtc.SessionDescription) error {
+	err := peer.PC.SetRemoteDescription(offer)
+	if err != nil {
+		return fmt.Errorf("Failed to set remote description: %s", err)
+	}
+	answer, err := peer.PC.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	// Sets the LocalDescription, and starts listning for UDP packets
+	return peer.PC.SetLocalDescription(answer)
+}
+
+// Restart handles an ICE restart offer for a connected or failed peer,
+// keeping its data channels. It returns the answer with the new ICE
+// credentials.
+func (peer *Peer) Restart(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	peer.Lock()
+	pc := peer.PC
+	peer.Unlock()
+	if pc == nil {
+		return nil, fmt.Errorf("Can not restart a closed peer")
+	}
+	peer.logger.Infof("Restarting ICE")
+	peer.cancelClose()
+	err := peer.answer(offer)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to restart ICE: %s", err)
+	}
+	return pc.LocalDescription(), nil
+}
+
+// IsRestart returns true if the offer is an ICE restart of the peer's
+// connection - it belongs to the same session and has new ICE credentials.
+// Offers of a new connection from the same client have a different
+// session id.
+func (peer *Peer) IsRestart(offer webrtc.SessionDescription) bool {
+	peer.Lock()
+	pc := peer.PC
+	peer.Unlock()
+	if pc == nil || pc.RemoteDescription() == nil {
+		return false
+	}
+	remote, err := pc.RemoteDescription().Unmarshal()
+	if err != nil {
+		return false
+	}
+	parsed, err := offer.Unmarshal()
+	if err != nil || parsed.Origin.SessionID != remote.Origin.SessionID {
+		return false
+	}
+	ufrag, _ := ICECredentials(pc.RemoteDescription().SDP)
+	newUfrag, _ := ICECredentials(offer.SDP)
+	return newUfrag != "" && newUfrag != ufrag
+}
+
+// ICECredentials returns the first ice-ufrag and ice-pwd in an sdp
+func ICECredentials(sdp string) (string, string) {
+	var ufrag, pwd string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if ufrag == "" && strings.HasPrefix(line, "a=ice-ufrag:") {
+			ufrag = line[len("a=ice-ufrag:"):]
+		}
+		if pwd == "" && strings.HasPrefix(line, "a=ice-pwd:") {
+			pwd = line[len("a=ice-pwd:"):]
+		}
+	}
+	return ufrag, pwd
+}
+
+// closeAfter closes the peer after a timeout, giving the client time to
+// restart ICE
+func (peer *Peer) closeAfter(timeout time.Duration) {
+	if timeout == 0 {
+		peer.Close()
+		return
+	}
+	peer.logger.Infof("Waiting %s for an ICE restart", timeout)
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.closeTimer != nil {
+		peer.closeTimer.Stop()
+	}
+	peer.closeTimer = time.AfterFunc(timeout, peer.Close)
+}
+
+// cancelClose cancels closing a failed peer
+func (peer *Peer) cancelClose() {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.closeTimer != nil {
+		peer.closeTimer.Stop()
+		peer.closeTimer = nil
+	}
+}
+
 // OnChannelReq starts the cdc channel.
 // Upon establishing the connection, the client opens this channel with the
 // api version he uses
@@ -218,12 +344,12 @@ func (peer *Peer) OnChannelReq(d *webrtc.DataChannel) {
 			peer.logger.Errorf(msg)
 		}
 		if pane != nil {
-			c := CDB.Add(d, pane, peer)
+			c := peer.Server.CDB.Add(d, pane, peer)
 			d.OnMessage(func(msg webrtc.DataChannelMessage) {
 				pane.OnMessage(peer, msg)
 			})
 			d.OnClose(func() {
-				CDB.Delete(c)
+				peer.Server.CDB.Delete(c)
 			})
 		}
 		if label != "%" {
@@ -236,15 +362,6 @@ func (peer *Peer) OnChannelReq(d *webrtc.DataChannel) {
 	})
 }
 
-// GetActivePeer returns the last active peer or nil if no peer has been
-// active for a while
-func GetActivePeer() *Peer {
-	if mostRecentPeer == nil ||
-		lastReceived.Add(keepAliveInterval).Before(time.Now()) {
-		return nil
-	}
-	return mostRecentPeer
-}
 func (peer *Peer) handleCTRLMsg(msg webrtc.DataChannelMessage) {
 	var raw json.RawMessage
 	m := CTRLMessage{
@@ -262,7 +379,7 @@ func (peer *Peer) handleCTRLMsg(msg webrtc.DataChannelMessage) {
 	case "nack":
 		peer.handleNack(m, raw)
 	default:
-		peer.Conf.OnCTRLMsg(peer, &m, raw)
+		peer.Server.Messages.Dispatch(peer, m, raw)
 	}
 }
 
@@ -295,7 +412,7 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 	if l[0] == '%' {
 		//TODO: if there's an older cdc close it
 		peer.logger.Info("Got a request to open a control channel")
-		peer.cdc = d
+		peer.setCDC(d)
 		d.OnMessage(peer.handleCTRLMsg)
 		peer.handleCTRLMsg(webrtc.DataChannelMessage{})
 		return nil, nil
@@ -324,7 +441,7 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 				fields[cmdIndex])
 		}
 		peer.logger.Infof("Got a reconnect request to pane %d", id)
-		return peer.Reconnect(d, id)
+		return peer.Reconnect(d, id, nil)
 	}
 	pane, err = NewPane(peer, ws, 0)
 	if err != nil {
@@ -346,22 +463,24 @@ func (peer *Peer) GetOrCreatePane(d *webrtc.DataChannel) (*Pane, error) {
 // Reconnect reconnects to a pane and restore the screen/buffer
 // buffer from that marker if not we use our headless terminal emulator to
 // send over the current screen.
-func (peer *Peer) Reconnect(d *webrtc.DataChannel, id int) (*Pane, error) {
-	pane := Panes.Get(id)
+// compressor is used to compress the pane's output and can be nil.
+func (peer *Peer) Reconnect(d Channel, id int, compressor *Compressor) (*Pane, error) {
+	cdb := peer.Server.CDB
+	pane := peer.Server.Panes.Get(id)
 	if pane == nil {
 		return nil, fmt.Errorf("Got a bad pane id: %d", id)
 	}
 	pane.Lock()
 	defer pane.Unlock()
 	if pane.IsRunning {
-		c := CDB.Add(d, pane, peer)
+		c := cdb.AddCompressed(d, pane, peer, compressor)
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
 			pane.OnMessage(peer, msg)
 		})
 		d.OnClose(func() {
-			CDB.Delete(c)
+			cdb.Delete(c)
 		})
-		pane.Restore(d, peer.Marker)
+		pane.Restore(c, peer.Marker)
 		return pane, nil
 	}
 	d.Close()
@@ -474,7 +593,25 @@ func (peer *Peer) SendControlMessageAndWait(typ string, args interface{}) (strin
 // SendMessage marshales a message and sends it over the cdc
 func (peer *Peer) SendMessage(msg []byte) error {
 	peer.logger.Infof("Sending message: %s", msg)
-	return peer.cdc.Send(msg)
+	cdc := peer.getCDC()
+	if cdc == nil {
+		return fmt.Errorf("Peer %s has no control channel", peer.FP)
+	}
+	return cdc.Send(msg)
+}
+
+// getCDC returns the peer's control channel or nil if it has none
+func (peer *Peer) getCDC() Channel {
+	peer.cdcM.Lock()
+	defer peer.cdcM.Unlock()
+	return peer.cdc
+}
+
+// setCDC sets the peer's control channel
+func (peer *Peer) setCDC(cdc Channel) {
+	peer.cdcM.Lock()
+	defer peer.cdcM.Unlock()
+	peer.cdc = cdc
 }
 
 // Peer.AddCandidate adds a new ICE candidate to the peer
@@ -489,8 +626,8 @@ func (peer *Peer) AddCandidate(candidate webrtc.ICECandidateInit) error {
 }
 
 func (peer *Peer) Broadcast(typ string, args interface{}) error {
-	for _, p := range Peers {
-		if p != peer && p.cdc != nil {
+	for _, p := range peer.Server.AllPeers() {
+		if p != peer && p.getCDC() != nil {
 			err := p.SendControlMessage(typ, args)
 			if err != nil {
 				peer.logger.Warnf("Failed to send a broadcast message: %v", err)
@@ -499,6 +636,7 @@ func (peer *Peer) Broadcast(typ string, args interface{}) error {
 	}
 	return nil
 }
+
 func (peer *Peer) GetCandidatePair(ret *CandidatePairStats) error {
 	ret.FP = peer.FP
 	if peer.PC == nil {
@@ -547,6 +685,12 @@ func (peer *Peer) Close() {
 		peer.PC.Close()
 		peer.PC = nil
 	}
+	if peer.ws != nil {
+		peer.ws.close()
+	}
+	if peer.ssh != nil {
+		go peer.ssh.closeLocal()
+	}
 }
 
 // GetFingerprint extract the fingerprints from a client's offer and returns
@@ -609,27 +753,3 @@ func ExtractFP(certificate *webrtc.Certificate) (string, error) {
 	}
 	return CompressFP(fp[0].Value), nil
 }
-
-// Shutdown is called when it's time to go.Sweet dreams.
-func Shutdown() {
-	var logger *zap.SugaredLogger
-	var err error
-	for _, peer := range Peers {
-		if logger == nil {
-			logger = peer.logger
-		}
-		peer.Close()
-	}
-	for _, p := range Panes.All() {
-		err = p.C.Process.Kill()
-		if err != nil && logger != nil {
-			logger.Error("Failed closing a process: %w", err)
-		}
-	}
-}
-
-// SetLastPeer sets the most recent peer
-func SetLastPeer(p *Peer) {
-	mostRecentPeer = p
-	lastReceived = time.Now()
-}
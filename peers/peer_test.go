@@ -10,11 +10,11 @@ import (
 
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
 func TestActivePeer(t *testing.T) {
-	resetActivePeer(t)
 	secretKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	require.NoError(t, err)
 	certs, err := webrtc.GenerateCertificate(secretKey)
@@ -34,21 +34,103 @@ func TestActivePeer(t *testing.T) {
 			return
 		},
 	}
-	peer, err := NewPeer("fingerprint", &conf)
+	s := NewServer(&conf)
+	peer, err := s.NewPeer("fingerprint")
 	require.NoError(t, err)
 	require.NotNil(t, peer)
 	require.NotNil(t, peer)
-	activePeer := GetActivePeer()
+	activePeer := s.ActivePeer()
 	require.Nil(t, activePeer)
-	SetLastPeer(peer)
-	activePeer = GetActivePeer()
+	s.SetLastPeer(peer)
+	activePeer = s.ActivePeer()
 	require.Equal(t, peer, activePeer)
 	// go back half a keep alive
-	lastReceived = time.Now().Add(time.Second / 2.0)
-	activePeer = GetActivePeer()
+	s.lastReceived = time.Now().Add(time.Second / 2.0)
+	activePeer = s.ActivePeer()
 	require.Equal(t, peer, activePeer)
 	// go back a long while
-	lastReceived = time.Now().Add(-5 * time.Second)
-	activePeer = GetActivePeer()
+	s.lastReceived = time.Now().Add(-5 * time.Second)
+	activePeer = s.ActivePeer()
 	require.Nil(t, activePeer)
 }
+
+func TestICERestart(t *testing.T) {
+	secretKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certs, err := webrtc.GenerateCertificate(secretKey)
+	require.NoError(t, err)
+	conf := Conf{
+		Certificate:       certs,
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		GatheringTimeout:  time.Second,
+		RestartTimeout:    time.Second,
+		GetICEServers: func() ([]webrtc.ICEServer, error) {
+			return []webrtc.ICEServer{}, nil
+		},
+		OnCTRLMsg: func(*Peer, *CTRLMessage, json.RawMessage) {},
+	}
+	s := NewServer(&conf)
+	peer, err := s.NewPeer("fingerprint")
+	require.NoError(t, err)
+	defer peer.Close()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	require.NoError(t, err)
+	defer client.Close()
+	dc, err := client.CreateDataChannel("signaling", nil)
+	require.NoError(t, err)
+	opened := make(chan bool, 1)
+	dc.OnOpen(func() { opened <- true })
+	// negotiate returns the server's answer to the client's offer
+	negotiate := func(opts *webrtc.OfferOptions, listen func(webrtc.SessionDescription) (*webrtc.SessionDescription, error)) {
+		offer, err := client.CreateOffer(opts)
+		require.NoError(t, err)
+		gatherComplete := webrtc.GatheringCompletePromise(client)
+		require.NoError(t, client.SetLocalDescription(offer))
+		<-gatherComplete
+		answer, err := listen(*client.LocalDescription())
+		require.NoError(t, err)
+		require.NoError(t, client.SetRemoteDescription(*answer))
+	}
+	negotiate(nil, peer.Listen)
+	select {
+	case <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for the data channel to open")
+	}
+	oldUfrag, _ := ICECredentials(peer.PC.LocalDescription().SDP)
+	// the server trickles its new candidates
+	candidates := make(chan webrtc.ICECandidateInit, 16)
+	peer.PC.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			candidates <- c.ToJSON()
+		}
+	})
+	negotiate(&webrtc.OfferOptions{ICERestart: true},
+		func(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+			require.True(t, peer.IsRestart(offer))
+			return peer.Restart(offer)
+		})
+	go func() {
+		for c := range candidates {
+			client.AddICECandidate(c)
+		}
+	}()
+	newUfrag, _ := ICECredentials(peer.PC.LocalDescription().SDP)
+	require.NotEqual(t, oldUfrag, newUfrag)
+	require.Equal(t, peer, s.Peer("fingerprint"))
+	require.Equal(t, webrtc.DataChannelStateOpen, dc.ReadyState())
+	require.NotNil(t, peer.PC)
+	// a new connection from the same client is not a restart
+	client2, err := webrtc.NewPeerConnection(webrtc.Configuration{
+		Certificates: client.GetConfiguration().Certificates})
+	require.NoError(t, err)
+	defer client2.Close()
+	_, err = client2.CreateDataChannel("signaling", nil)
+	require.NoError(t, err)
+	offer, err := client2.CreateOffer(nil)
+	require.NoError(t, err)
+	require.False(t, peer.IsRestart(offer))
+}
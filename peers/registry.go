@@ -0,0 +1,169 @@
+// This file holds the control messages registry, dispatching messages to
+// handlers by type through a chain of middleware
+package peers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// MessageHandler handles a control message. raw holds the message's args.
+type MessageHandler func(peer *Peer, m CTRLMessage, raw json.RawMessage)
+
+// Middleware wraps the handler of a message type. A middleware that
+// doesn't call next drops the message and should nack it.
+type Middleware func(typ string, next MessageHandler) MessageHandler
+
+// Registry holds the control message handlers by type
+type Registry struct {
+	handlers   map[string]MessageHandler
+	middleware []Middleware
+	m          sync.Mutex
+}
+
+// NewRegistry returns a new, empty, registry
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]MessageHandler)}
+}
+
+// Handle registers the handler of a message type, replacing the current one.
+// Registering a nil handler removes it.
+func (r *Registry) Handle(typ string, h MessageHandler) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if h == nil {
+		delete(r.handlers, typ)
+		return
+	}
+	r.handlers[typ] = h
+}
+
+// Use adds middleware, wrapping all the handlers. The first middleware
+// added is the outermost.
+func (r *Registry) Use(mw ...Middleware) {
+	r.m.Lock()
+	r.middleware = append(r.middleware, mw...)
+	r.m.Unlock()
+}
+
+// Types returns the sorted types of the registered messages
+func (r *Registry) Types() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	ret := make([]string, 0, len(r.handlers))
+	for typ := range r.handlers {
+		ret = append(ret, typ)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// Dispatch passes a message through the middleware to its handler.
+// Messages with no registered handler are passed to the peer's OnCTRLMsg and
+// nacked if there is none.
+func (r *Registry) Dispatch(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+	r.m.Lock()
+	h := r.handlers[m.Type]
+	mw := r.middleware
+	r.m.Unlock()
+	if h == nil {
+		h = unknownMessage
+	}
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](m.Type, h)
+	}
+	h(peer, m, raw)
+}
+
+// unknownMessage handles messages with no registered handler
+func unknownMessage(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+	if peer.Conf.OnCTRLMsg != nil {
+		peer.Conf.OnCTRLMsg(peer, &m, raw)
+		return
+	}
+	peer.logger.Errorf("Got a control message with unknown type: %q", m.Type)
+	err := peer.SendNack(m, "unknown control message type")
+	if err != nil {
+		peer.logger.Errorf("#%s: Failed to send nack: %v", peer.FP, err)
+	}
+}
+
+// Typed returns a message handler that decodes the message's args to T
+// before calling h. Messages with args that fail to decode are nacked.
+func Typed[T any](h func(peer *Peer, m CTRLMessage, args T)) MessageHandler {
+	return func(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+		var args T
+		if len(raw) > 0 && string(raw) != "null" {
+			err := json.Unmarshal(raw, &args)
+			if err != nil {
+				peer.logger.Infof("Failed to parse incoming control message: %v", err)
+				peer.SendNack(m, fmt.Sprintf("Failed to parse %s args: %s", m.Type, err))
+				return
+			}
+		}
+		h(peer, m, args)
+	}
+}
+
+// Authorize returns a middleware that nacks messages when allow returns an
+// error
+func Authorize(allow func(peer *Peer, typ string) error) Middleware {
+	return func(typ string, next MessageHandler) MessageHandler {
+		return func(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+			err := allow(peer, typ)
+			if err != nil {
+				peer.logger.Warnf("#%s: %s is not authorized: %s", peer.FP, typ, err)
+				peer.SendNack(m, fmt.Sprintf("Unauthorized: %s", err))
+				return
+			}
+			next(peer, m, raw)
+		}
+	}
+}
+
+// RateLimit returns a middleware that limits every client, by its
+// fingerprint, to perSecond messages a second with bursts of up to burst
+// messages. Messages over the limit are nacked.
+func RateLimit(perSecond float64, burst int) Middleware {
+	var (
+		limiters = make(map[string]*rate.Limiter)
+		m        sync.Mutex
+	)
+	limiter := func(fp string) *rate.Limiter {
+		m.Lock()
+		defer m.Unlock()
+		l, found := limiters[fp]
+		if !found {
+			l = rate.NewLimiter(rate.Limit(perSecond), burst)
+			limiters[fp] = l
+		}
+		return l
+	}
+	return func(typ string, next MessageHandler) MessageHandler {
+		return func(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+			if !limiter(peer.FP).Allow() {
+				peer.logger.Warnf("#%s: rate limited %s", peer.FP, typ)
+				peer.SendNack(m, "Rate limit exceeded")
+				return
+			}
+			next(peer, m, raw)
+		}
+	}
+}
+
+// Observe returns a middleware that calls observe after every message is
+// handled, with the time it took. It's used for logging & metrics.
+func Observe(observe func(peer *Peer, typ string, d time.Duration)) Middleware {
+	return func(typ string, next MessageHandler) MessageHandler {
+		return func(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+			start := time.Now()
+			next(peer, m, raw)
+			observe(peer, typ, time.Since(start))
+		}
+	}
+}
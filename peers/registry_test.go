@@ -0,0 +1,152 @@
+package peers
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// sentChannel is a control channel recording the messages sent on it
+type sentChannel struct {
+	Channel
+	sent []CTRLMessage
+	m    sync.Mutex
+}
+
+func (c *sentChannel) Send(b []byte) error {
+	var m CTRLMessage
+	err := json.Unmarshal(b, &m)
+	c.m.Lock()
+	c.sent = append(c.sent, m)
+	c.m.Unlock()
+	return err
+}
+
+// types returns the types of the messages sent
+func (c *sentChannel) types() []string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var ret []string
+	for _, m := range c.sent {
+		ret = append(ret, m.Type)
+	}
+	return ret
+}
+
+func newRegistryPeer(t *testing.T) (*Peer, *sentChannel) {
+	s := newTestServer(t)
+	cdc := &sentChannel{}
+	peer := &Peer{Server: s, Conf: s.Conf, FP: "A", cdc: cdc}
+	peer.logger = zaptest.NewLogger(t).Sugar()
+	return peer, cdc
+}
+
+func TestRegistryTyped(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	var got ResizeArgs
+	r := peer.Server.Messages
+	r.Handle("resize", Typed(func(peer *Peer, m CTRLMessage, args ResizeArgs) {
+		got = args
+	}))
+	require.Equal(t, []string{"hello", "mux", "resize", "subscribe"}, r.Types())
+	r.Dispatch(peer, CTRLMessage{Type: "resize"},
+		json.RawMessage(`{"pane_id": 3, "sx": 80, "sy": 24}`))
+	require.Equal(t, ResizeArgs{PaneID: 3, Sx: 80, Sy: 24}, got)
+	require.Empty(t, cdc.types())
+	// args of the wrong type are nacked
+	r.Dispatch(peer, CTRLMessage{Type: "resize"}, json.RawMessage(`{"pane_id": "3"}`))
+	require.Equal(t, []string{"nack"}, cdc.types())
+}
+
+func TestRegistryUnknown(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	r := peer.Server.Messages
+	r.Dispatch(peer, CTRLMessage{Type: "foo"}, nil)
+	require.Equal(t, []string{"nack"}, cdc.types())
+	// unknown messages are passed to OnCTRLMsg if there is one
+	var got string
+	peer.Conf.OnCTRLMsg = func(_ *Peer, m *CTRLMessage, _ json.RawMessage) {
+		got = m.Type
+	}
+	r.Dispatch(peer, CTRLMessage{Type: "foo"}, nil)
+	require.Equal(t, "foo", got)
+	require.Len(t, cdc.types(), 1)
+}
+
+func TestRegistryMiddleware(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	r := peer.Server.Messages
+	var calls []string
+	r.Handle("mark", func(*Peer, CTRLMessage, json.RawMessage) {
+		calls = append(calls, "mark")
+	})
+	r.Use(func(typ string, next MessageHandler) MessageHandler {
+		return func(peer *Peer, m CTRLMessage, raw json.RawMessage) {
+			calls = append(calls, "outer")
+			next(peer, m, raw)
+		}
+	}, Authorize(func(peer *Peer, typ string) error {
+		calls = append(calls, "authorize")
+		if peer.FP != "A" {
+			return fmt.Errorf("unknown peer")
+		}
+		return nil
+	}))
+	var observed []string
+	r.Use(Observe(func(peer *Peer, typ string, d time.Duration) {
+		observed = append(observed, typ)
+	}))
+	r.Dispatch(peer, CTRLMessage{Type: "mark"}, nil)
+	require.Equal(t, []string{"outer", "authorize", "mark"}, calls)
+	require.Equal(t, []string{"mark"}, observed)
+	require.Empty(t, cdc.types())
+	peer.FP = "B"
+	r.Dispatch(peer, CTRLMessage{Type: "mark"}, nil)
+	require.Equal(t, []string{"outer", "authorize", "mark", "outer", "authorize"}, calls)
+	require.Equal(t, []string{"nack"}, cdc.types())
+}
+
+func TestRegistryRateLimit(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	r := peer.Server.Messages
+	handled := 0
+	r.Handle("mark", func(*Peer, CTRLMessage, json.RawMessage) { handled++ })
+	r.Use(RateLimit(0.001, 2))
+	for i := 0; i < 3; i++ {
+		r.Dispatch(peer, CTRLMessage{Type: "mark"}, nil)
+	}
+	require.Equal(t, 2, handled)
+	require.Equal(t, []string{"nack"}, cdc.types())
+	// the limit is per client
+	peer.FP = "B"
+	r.Dispatch(peer, CTRLMessage{Type: "mark"}, nil)
+	require.Equal(t, 3, handled)
+}
+
+func TestHello(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	peer.Server.Version = "1.2.3"
+	peer.Server.AddCapabilities("tmux", CapLayout)
+	require.False(t, peer.HasCapability(CapLayout))
+	peer.Server.Messages.Dispatch(peer, CTRLMessage{Ref: 7, Type: "hello"},
+		json.RawMessage(`{"version": "0.1", "protocol": 2, "capabilities": ["layout"]}`))
+	require.Equal(t, 2, peer.Protocol)
+	require.True(t, peer.HasCapability(CapLayout))
+	require.Equal(t, []string{"ack"}, cdc.types())
+	args := cdc.sent[0].Args.(map[string]interface{})
+	require.Equal(t, float64(7), args["ref"])
+	var hello HelloArgs
+	require.NoError(t, json.Unmarshal([]byte(args["body"].(string)), &hello))
+	require.Equal(t, HelloArgs{
+		Version:  "1.2.3",
+		Protocol: ProtocolRevision,
+		Capabilities: []string{CapCompression, CapEchoHints, CapEvents,
+			CapLayout, CapMux, CapPaneHandlers, "tmux"},
+		Messages: []string{"hello", "mux", "subscribe"},
+	}, hello)
+}
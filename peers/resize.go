@@ -0,0 +1,187 @@
+// This file holds the resize arbitration, deciding the size of a pane
+// attached to clients with different viewports
+package peers
+
+import (
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// The resize policies of panes
+const (
+	// ResizeLatest sizes the pane to the viewport of the client that was
+	// active last, the default
+	ResizeLatest = "latest"
+	// ResizeSmallest sizes the pane to fit in all the clients' viewports,
+	// like tmux
+	ResizeSmallest = "smallest"
+	// ResizeFixed keeps the size the pane was opened with
+	ResizeFixed = "fixed"
+)
+
+// ValidResizePolicy returns true if the policy is known or empty
+func ValidResizePolicy(policy string) bool {
+	switch policy {
+	case "", ResizeLatest, ResizeSmallest, ResizeFixed:
+		return true
+	}
+	return false
+}
+
+// policy returns the pane's resize policy
+func (pane *Pane) policy() string {
+	if pane.ResizePolicy != "" {
+		return pane.ResizePolicy
+	}
+	if pane.peer.Conf != nil && pane.peer.Conf.ResizePolicy != "" {
+		return pane.peer.Conf.ResizePolicy
+	}
+	return ResizeLatest
+}
+
+// SetViewport sets the viewport of the peer's clients of the pane and
+// resizes the pane by its policy. It returns the pane's size.
+func (pane *Pane) SetViewport(peer *Peer, ws *pty.Winsize) pty.Winsize {
+	pane.server().CDB.setViewport(peer, pane, ws)
+	pane.sizeM.Lock()
+	pane.active = peer
+	pane.sizeM.Unlock()
+	pane.arbitrate(peer)
+	pane.sizeM.Lock()
+	defer pane.sizeM.Unlock()
+	if pane.Ws == nil {
+		return pty.Winsize{}
+	}
+	return *pane.Ws
+}
+
+// touch makes the peer the pane's active peer. When the pane's policy is
+// latest and the peer wasn't the last active, the pane is resized.
+func (pane *Pane) touch(peer *Peer) {
+	pane.sizeM.Lock()
+	changed := pane.active != peer
+	pane.active = peer
+	pane.sizeM.Unlock()
+	if changed && pane.policy() == ResizeLatest && pane.server().CDB.touch(peer, pane) {
+		pane.arbitrate(nil)
+	}
+}
+
+// arbitrate resizes the pane to the size its clients' viewports call for
+// and sends the new size to the peers with clients of the pane but except
+func (pane *Pane) arbitrate(except *Peer) {
+	ws := pane.arbitrateSize()
+	if ws == nil {
+		return
+	}
+	args := ResizeArgs{PaneID: pane.ID, Sx: ws.Cols, Sy: ws.Rows, X: ws.X, Y: ws.Y}
+	for _, p := range pane.server().CDB.peers4Pane(pane) {
+		if p == except || p.getCDC() == nil {
+			continue
+		}
+		err := p.SendControlMessage("resize", args)
+		if err != nil {
+			p.logger.Warnf("Failed to send a resize message: %v", err)
+		}
+	}
+}
+
+// arbitrateSize resizes the pane by its policy and its clients' viewports.
+// It returns the new size or nil when the size is unchanged.
+func (pane *Pane) arbitrateSize() *pty.Winsize {
+	pane.sizeM.Lock()
+	defer pane.sizeM.Unlock()
+	if pane.ctx == nil || pane.ctx.Err() != nil || pane.Ws == nil {
+		return nil
+	}
+	ws := pane.server().CDB.viewport(pane, pane.policy())
+	if ws == nil || *ws == *pane.Ws {
+		return nil
+	}
+	pane.Resize(ws)
+	return ws
+}
+
+// setViewport sets the viewport of the peer's clients of the pane
+func (db *ClientsDB) setViewport(peer *Peer, pane *Pane, ws *pty.Winsize) {
+	db.m.Lock()
+	defer db.m.Unlock()
+	now := time.Now()
+	for _, c := range db.clients {
+		if c.peer == peer && c.pane != nil && c.pane.ID == pane.ID {
+			v := *ws
+			c.viewport = &v
+			c.active = now
+		}
+	}
+}
+
+// touch marks the peer's clients of the pane as active. It returns true if
+// any of them has a viewport.
+func (db *ClientsDB) touch(peer *Peer, pane *Pane) bool {
+	db.m.Lock()
+	defer db.m.Unlock()
+	now := time.Now()
+	ret := false
+	for _, c := range db.clients {
+		if c.peer == peer && c.pane != nil && c.pane.ID == pane.ID {
+			c.active = now
+			ret = ret || c.viewport != nil
+		}
+	}
+	return ret
+}
+
+// peers4Pane returns the peers with clients of the pane
+func (db *ClientsDB) peers4Pane(pane *Pane) []*Peer {
+	db.m.Lock()
+	defer db.m.Unlock()
+	var ret []*Peer
+	found := make(map[*Peer]bool)
+	for _, c := range db.clients {
+		if c.pane == nil || c.pane.ID != pane.ID || found[c.peer] {
+			continue
+		}
+		found[c.peer] = true
+		ret = append(ret, c.peer)
+	}
+	return ret
+}
+
+// viewport returns the size of the pane by the policy and the viewports
+// of its clients or nil when no client has a viewport
+func (db *ClientsDB) viewport(pane *Pane, policy string) *pty.Winsize {
+	db.m.Lock()
+	defer db.m.Unlock()
+	var (
+		ret    *pty.Winsize
+		latest time.Time
+	)
+	for _, c := range db.clients {
+		if c.pane == nil || c.pane.ID != pane.ID || c.viewport == nil {
+			continue
+		}
+		v := *c.viewport
+		switch policy {
+		case ResizeLatest:
+			if ret == nil || c.active.After(latest) {
+				ret = &v
+				latest = c.active
+			}
+		case ResizeSmallest:
+			if ret == nil {
+				ret = &v
+				continue
+			}
+			// the pixels go with the cells
+			if v.Cols < ret.Cols {
+				ret.Cols, ret.X = v.Cols, v.X
+			}
+			if v.Rows < ret.Rows {
+				ret.Rows, ret.Y = v.Rows, v.Y
+			}
+		}
+	}
+	return ret
+}
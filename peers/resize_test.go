@@ -0,0 +1,48 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestResizePolicy(t *testing.T) {
+	peer, cdc := newRegistryPeer(t)
+	s := peer.Server
+	s.addPeer(peer)
+	other := &Peer{Server: s, Conf: s.Conf, FP: "B", cdc: &sentChannel{}}
+	other.logger = zaptest.NewLogger(t).Sugar()
+	s.addPeer(other)
+	// a peer with no client of the pane doesn't get its resize messages
+	stranger := &sentChannel{}
+	s.addPeer(&Peer{Server: s, Conf: s.Conf, FP: "C", cdc: stranger,
+		logger: zaptest.NewLogger(t).Sugar()})
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	mc := newMuxConn(peer, func(uint32, byte, []byte) error { return nil }, nil)
+	defer mc.close()
+	s.CDB.Add(mc.addStream(1, "1:1"), pane, peer)
+	c := s.CDB.Add(mc.addStream(2, "2:1"), pane, other)
+	require.Equal(t, pty.Winsize{Rows: 24, Cols: 80},
+		pane.SetViewport(peer, &pty.Winsize{Rows: 24, Cols: 80}))
+	// the latest client wins and the other peers get the new size
+	require.Equal(t, pty.Winsize{Rows: 30, Cols: 100, X: 1000, Y: 600},
+		pane.SetViewport(other, &pty.Winsize{Rows: 30, Cols: 100, X: 1000, Y: 600}))
+	require.Equal(t, []string{"resize"}, cdc.types())
+	require.Empty(t, stranger.types())
+	// typing makes a client the latest
+	pane.touch(peer)
+	require.Equal(t, pty.Winsize{Rows: 24, Cols: 80}, *pane.Ws)
+	pane.ResizePolicy = ResizeSmallest
+	require.Equal(t, pty.Winsize{Rows: 20, Cols: 80},
+		pane.SetViewport(other, &pty.Winsize{Rows: 20, Cols: 120}))
+	// the size is recomputed when a client detaches
+	require.NoError(t, s.CDB.Delete(c))
+	require.Equal(t, pty.Winsize{Rows: 24, Cols: 80}, *pane.Ws)
+	pane.ResizePolicy = ResizeFixed
+	require.Equal(t, pty.Winsize{Rows: 24, Cols: 80},
+		pane.SetViewport(peer, &pty.Winsize{Rows: 50, Cols: 200}))
+	require.False(t, ValidResizePolicy("biggest"))
+}
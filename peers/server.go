@@ -0,0 +1,210 @@
+// This file holds the Server type, owning a webexec server's state
+package peers
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Server holds the state of a webexec server - its peers, panes, clients
+// and layout. Servers are independent so a process can run a few of them.
+type Server struct {
+	Conf *Conf
+	// Panes holds the server's panes
+	Panes *PanesDB
+	// CDB holds the clients, connecting the panes to the peers
+	CDB *ClientsDB
+	// Layout holds the clients' layout
+	Layout *LayoutStore
+	// Messages holds the control message handlers
+	Messages *Registry
+	// Version is the server's version, sent in the hello ack
+	Version string
+	// caps holds the capabilities sent in the hello ack
+	caps  []string
+	capsM sync.Mutex
+	// peers holds all the peers (connected and disconnected) by fingerprint
+	peers  map[string]*Peer
+	peersM sync.Mutex
+	// payload holds the client's payload.
+	// Deprecated: clients should use Layout
+	payload  []byte
+	payloadM sync.Mutex
+	// handlers holds the in-process pane handlers by name
+	handlers  map[string]PaneHandler
+	handlersM sync.Mutex
+	// api is the gateway to webrtc calls
+	api  *webrtc.API
+	apiM sync.Mutex
+	// lastMarker is the id of the last marker used
+	lastMarker int32
+	// theses two go together - the last peer and the time it was last seen
+	mostRecentPeer *Peer
+	lastReceived   time.Time
+	recentM        sync.Mutex
+}
+
+// NewServer returns a new server using the given configuration
+func NewServer(conf *Conf) *Server {
+	panes := NewPanesDB()
+	s := &Server{
+		Conf:     conf,
+		Panes:    panes,
+		CDB:      NewClientsDB(),
+		Layout:   NewLayoutStore(panes),
+		Messages: NewRegistry(),
+		peers:    make(map[string]*Peer),
+		handlers: make(map[string]PaneHandler),
+		caps: []string{CapCompression, CapEchoHints, CapEvents, CapLayout,
+			CapMux, CapPaneHandlers},
+	}
+	s.Messages.Handle("hello", Typed(s.handleHello))
+	s.Messages.Handle("mux", s.handleMux)
+	s.Messages.Handle("subscribe", Typed(s.handleSubscribe))
+	s.CDB.onChange = s.clientChanged
+	s.Layout.onEvent = func(l Layout) {
+		s.Emit(EventArgs{Type: EventLayoutChanged, Version: l.Version})
+	}
+	return s
+}
+
+// webrtcAPI returns the server's webrtc api, creating it on first use
+func (s *Server) webrtcAPI() *webrtc.API {
+	s.apiM.Lock()
+	defer s.apiM.Unlock()
+	if s.api == nil {
+		conf := s.Conf
+		var se *webrtc.SettingEngine
+		if conf.WebrtcSetting != nil {
+			se = conf.WebrtcSetting
+		} else {
+			se = &webrtc.SettingEngine{}
+		}
+		if conf.PortMax > 0 {
+			se.SetEphemeralUDPPortRange(conf.PortMin, conf.PortMax)
+		}
+		se.SetICETimeouts(
+			conf.DisconnectTimeout, conf.FailedTimeout, conf.KeepAliveInterval)
+		s.api = webrtc.NewAPI(webrtc.WithSettingEngine(*se))
+	}
+	return s.api
+}
+
+// Peer returns the peer with the given fingerprint or nil
+func (s *Server) Peer(fp string) *Peer {
+	s.peersM.Lock()
+	defer s.peersM.Unlock()
+	return s.peers[fp]
+}
+
+// AllPeers returns a slice with all the peers
+func (s *Server) AllPeers() []*Peer {
+	s.peersM.Lock()
+	defer s.peersM.Unlock()
+	ret := make([]*Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// addPeer adds a peer, replacing an older one with the same fingerprint
+func (s *Server) addPeer(peer *Peer) {
+	s.peersM.Lock()
+	s.peers[peer.FP] = peer
+	s.peersM.Unlock()
+}
+
+// removePeer removes the peer unless it was replaced
+func (s *Server) removePeer(peer *Peer) {
+	s.peersM.Lock()
+	if s.peers[peer.FP] == peer {
+		delete(s.peers, peer.FP)
+	}
+	s.peersM.Unlock()
+}
+
+// Payload returns the clients' payload
+func (s *Server) Payload() []byte {
+	s.payloadM.Lock()
+	defer s.payloadM.Unlock()
+	return s.payload
+}
+
+// SetPayload sets the clients' payload
+func (s *Server) SetPayload(payload []byte) {
+	s.payloadM.Lock()
+	s.payload = payload
+	s.payloadM.Unlock()
+}
+
+// NextMarker returns a new id for the panes' buffer markers
+func (s *Server) NextMarker() int {
+	return int(atomic.AddInt32(&s.lastMarker, 1))
+}
+
+// ActivePeer returns the last active peer or nil if no peer has been
+// active for a while
+func (s *Server) ActivePeer() *Peer {
+	s.recentM.Lock()
+	defer s.recentM.Unlock()
+	if s.mostRecentPeer == nil ||
+		s.lastReceived.Add(keepAliveInterval).Before(time.Now()) {
+		return nil
+	}
+	return s.mostRecentPeer
+}
+
+// SetLastPeer sets the most recent peer
+func (s *Server) SetLastPeer(p *Peer) {
+	s.recentM.Lock()
+	s.mostRecentPeer = p
+	s.lastReceived = time.Now()
+	s.recentM.Unlock()
+}
+
+// BroadcastAll sends a control message to all the connected peers
+func (s *Server) BroadcastAll(typ string, args interface{}) {
+	for _, p := range s.AllPeers() {
+		if p.getCDC() != nil {
+			err := p.SendControlMessage(typ, args)
+			if err != nil {
+				p.logger.Warnf("Failed to send a broadcast message: %v", err)
+			}
+		}
+	}
+}
+
+// Shutdown shuts the server down with no drain period
+func (s *Server) Shutdown() {
+	s.GracefulShutdown(ShutdownOptions{Reason: "shutdown"})
+}
+
+// close closes the peers, kills the panes' processes and closes the
+// handlers' ttys.
+// Sweet dreams.
+func (s *Server) close() {
+	logger := s.Conf.Logger
+	for _, peer := range s.AllPeers() {
+		peer.Close()
+	}
+	for _, p := range s.Panes.All() {
+		if p.Handler != "" && p.TTY != nil {
+			p.TTY.Close()
+			continue
+		}
+		if p.C == nil || p.C.Process == nil {
+			continue
+		}
+		err := p.C.Process.Kill()
+		// processes that hung up are already done
+		if err != nil && !errors.Is(err, os.ErrProcessDone) && logger != nil {
+			logger.Errorf("Failed closing a process: %s", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// This file holds the graceful shutdown, letting the clients know and
+// giving the panes time to finish before the server goes down
+package peers
+
+import (
+	"syscall"
+	"time"
+)
+
+// flushTimeout is how long the shutdown waits for the panes' output to be
+// sent
+const flushTimeout = time.Second
+
+// hangupGrace is how long the panes' processes have to exit after a SIGHUP
+const hangupGrace = time.Second / 2
+
+// ShutdownOptions holds the settings of a graceful shutdown
+type ShutdownOptions struct {
+	// Reason is sent to the clients, i.e. "stop" or "restart"
+	Reason string
+	// Drain is how long the clients have before the connections are closed
+	Drain time.Duration
+	// ETA is how long until the server is expected back, zero when unknown
+	ETA time.Duration
+}
+
+// GracefulShutdown sends a server_shutdown message to all the clients,
+// waits for the drain period, flushes the panes' output, hangs up the
+// panes' processes and closes the server. The layout is saved before the
+// panes are hung up and the final state is logged for audit.
+func (s *Server) GracefulShutdown(opts ShutdownOptions) {
+	logger := s.Conf.Logger
+	if logger != nil {
+		logger.Infof("Shutting down: %s, draining for %s", opts.Reason, opts.Drain)
+	}
+	s.BroadcastAll("server_shutdown", ShutdownArgs{
+		Reason: opts.Reason,
+		Drain:  opts.Drain.Milliseconds(),
+		ETA:    opts.ETA.Milliseconds(),
+	})
+	s.Emit(EventArgs{Type: EventShuttingDown})
+	time.Sleep(opts.Drain)
+	s.flush(flushTimeout)
+	err := s.Layout.Close()
+	if err != nil && logger != nil {
+		logger.Errorf("Failed to save the layout: %s", err)
+	}
+	s.hangup(hangupGrace)
+	s.audit()
+	s.close()
+}
+
+// flush waits for the panes' pending output to be sent
+func (s *Server) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for _, p := range s.Panes.All() {
+		for len(p.outbuf) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// hangup sends a SIGHUP to the process groups of the panes and waits for
+// the panes to exit
+func (s *Server) hangup(grace time.Duration) {
+	logger := s.Conf.Logger
+	var running []*Pane
+	for _, p := range s.Panes.All() {
+		p.Lock()
+		ok := p.IsRunning && p.C != nil && p.C.Process != nil
+		p.Unlock()
+		if !ok {
+			continue
+		}
+		// the panes' processes lead their own session & process group
+		err := syscall.Kill(-p.C.Process.Pid, syscall.SIGHUP)
+		if err != nil && logger != nil {
+			logger.Warnf("Failed to hang up pane %d: %s", p.ID, err)
+			continue
+		}
+		running = append(running, p)
+	}
+	deadline := time.Now().Add(grace)
+	for _, p := range running {
+		for time.Now().Before(deadline) {
+			p.Lock()
+			done := !p.IsRunning
+			p.Unlock()
+			if done {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// audit logs the panes & peers the server had when it shut down
+func (s *Server) audit() {
+	logger := s.Conf.Logger
+	if logger == nil {
+		return
+	}
+	for _, p := range s.Panes.All() {
+		p.Lock()
+		running := p.IsRunning
+		p.Unlock()
+		var command []string
+		if p.C != nil {
+			command = p.C.Args
+		}
+		logger.Infof("Shutdown state: pane %d %v running: %t, handler: %q",
+			p.ID, command, running, p.Handler)
+	}
+	for _, peer := range s.AllPeers() {
+		logger.Infof("Shutdown state: peer %s with %d clients", peer.FP,
+			len(s.CDB.All4Peer(peer)))
+	}
+}
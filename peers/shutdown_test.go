@@ -0,0 +1,38 @@
+package peers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	if PtyMux == nil {
+		PtyMux = PtyMuxType{}
+	}
+	peer, cdc := newRegistryPeer(t)
+	// the pane's read loop outlives the test so it can't use the test's logger
+	peer.logger = zap.NewNop().Sugar()
+	s := peer.Server
+	s.Conf.Logger = peer.logger
+	s.addPeer(peer)
+	peer.events = []string{EventShuttingDown}
+	pane, err := NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, pane.Run([]string{"sleep", "10"}))
+	start := time.Now()
+	s.GracefulShutdown(ShutdownOptions{Reason: "stop", Drain: 50 * time.Millisecond,
+		ETA: time.Second})
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	// sleep exits on the hang up
+	require.Less(t, time.Since(start), 5*time.Second)
+	pane.Lock()
+	require.False(t, pane.IsRunning)
+	pane.Unlock()
+	require.Equal(t, []string{"server_shutdown", "event"}, cdc.types())
+	require.Equal(t, map[string]interface{}{"reason": "stop", "drain": float64(50),
+		"eta": float64(1000)}, cdc.sent[0].Args)
+}
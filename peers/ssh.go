@@ -0,0 +1,394 @@
+// This file holds the ssh transport, serving panes to ssh sessions
+package peers
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshExitTimeout is how long a session waits for its pane's exit status
+const sshExitTimeout = 2 * time.Second
+
+// lastSSHChannelID is used to give every ssh channel a unique id
+var lastSSHChannelID uint32
+
+// sshChannel is a Channel over an ssh session's channel
+type sshChannel struct {
+	ch     ssh.Channel
+	chID   uint16
+	label  string
+	paneID int
+	// out holds the data waiting to be written, a nil slice closes the
+	// channel after the data before it is written. It's not limited so
+	// sending never blocks, the buffered amount lets the pane's flow
+	// control pause when the session is slow.
+	out [][]byte
+	// wake is signaled when data is queued
+	wake chan struct{}
+	done chan struct{}
+	once sync.Once
+	// buffered is the number of bytes waiting to be written
+	buffered     uint64
+	lowThreshold uint64
+	m            sync.Mutex
+	closed       bool
+	onMessage    func(webrtc.DataChannelMessage)
+	onClose      func()
+	onLow        func()
+}
+
+// sshPTYRequest is the payload of a "pty-req" request, RFC 4254 6.2
+type sshPTYRequest struct {
+	Term   string
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+	Modes  string
+}
+
+// sshWindowChange is the payload of a "window-change" request, RFC 4254 6.7
+type sshWindowChange struct {
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+}
+
+// ServeSSH serves an ssh session until it's closed. A "shell" request
+// runs shell in a new pane and an "exec" request runs the command with
+// `shell -c`. The command `attach <pane id>` attaches the session to a
+// running pane instead. fp is the fingerprint of the client's key.
+func (s *Server) ServeSSH(fp string, shell string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	peer := s.newTransportPeer(fp)
+	defer s.removePeer(peer)
+	peer.logger.Infof("Peer %s connected over ssh", fp)
+	s.peerStateChanged(peer, webrtc.PeerConnectionStateConnected)
+	ws := &pty.Winsize{Rows: 24, Cols: 80}
+	var pane *Pane
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var r sshPTYRequest
+			err := ssh.Unmarshal(req.Payload, &r)
+			if err == nil && r.Rows > 0 && r.Cols > 0 {
+				ws = &pty.Winsize{Rows: uint16(r.Rows), Cols: uint16(r.Cols),
+					X: uint16(r.Width), Y: uint16(r.Height)}
+			}
+			req.Reply(err == nil, nil)
+		case "window-change":
+			var r sshWindowChange
+			err := ssh.Unmarshal(req.Payload, &r)
+			if err == nil && pane != nil {
+				pane.SetViewport(peer, &pty.Winsize{Rows: uint16(r.Rows), Cols: uint16(r.Cols),
+					X: uint16(r.Width), Y: uint16(r.Height)})
+			}
+			req.Reply(err == nil, nil)
+		case "shell", "exec":
+			if pane != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			var command string
+			if req.Type == "exec" {
+				var r struct{ Command string }
+				err := ssh.Unmarshal(req.Payload, &r)
+				if err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+				command = r.Command
+			}
+			var err error
+			pane, err = peer.startSSHPane(ch, shell, command, ws)
+			req.Reply(err == nil, nil)
+			if err != nil {
+				peer.logger.Warnf("Failed to start ssh pane: %s", err)
+				fmt.Fprintf(ch.Stderr(), "%s\r\n", err)
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+				ch.Close()
+			}
+		default:
+			req.Reply(false, nil)
+		}
+	}
+	// the requests channel is closed when the session is closed
+	peer.Lock()
+	sc := peer.ssh
+	peer.Unlock()
+	if sc != nil {
+		sc.closeLocal()
+	}
+	s.peerStateChanged(peer, webrtc.PeerConnectionStateClosed)
+	peer.logger.Infof("Peer %s ssh session closed", fp)
+}
+
+// startSSHPane attaches the session to a running pane or starts a new one
+func (peer *Peer) startSSHPane(ch ssh.Channel, shell string, command string,
+	ws *pty.Winsize) (*Pane, error) {
+
+	if fields := strings.Fields(command); len(fields) == 2 && fields[0] == "attach" {
+		id, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Bad pane id: %q", fields[1])
+		}
+		pane := peer.Server.Panes.Get(id)
+		if pane == nil {
+			return nil, fmt.Errorf("Pane %d not found", id)
+		}
+		pane.Lock()
+		running := pane.IsRunning
+		pane.Unlock()
+		if !running {
+			return nil, fmt.Errorf("Pane %d is not running", id)
+		}
+		d := peer.newSSHChannel(ch, id)
+		pane, err = peer.Reconnect(d, id, nil)
+		if err != nil {
+			return nil, err
+		}
+		pane.SetViewport(peer, ws)
+		return pane, nil
+	}
+	cmd := []string{shell}
+	if command != "" {
+		cmd = []string{shell, "-c", command}
+	}
+	pane, err := NewPane(peer, ws, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := peer.newSSHChannel(ch, pane.ID)
+	cdb := peer.Server.CDB
+	c := cdb.Add(d, pane, peer)
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		pane.OnMessage(peer, msg)
+	})
+	d.OnClose(func() {
+		cdb.Delete(c)
+	})
+	pane.SetViewport(peer, ws)
+	err = pane.Run(cmd)
+	if err != nil {
+		pane.Kill()
+		return nil, err
+	}
+	return pane, nil
+}
+
+// newSSHChannel wraps the session's channel and starts reading & writing it
+func (peer *Peer) newSSHChannel(ch ssh.Channel, paneID int) *sshChannel {
+	s := &sshChannel{
+		ch:     ch,
+		chID:   uint16(atomic.AddUint32(&lastSSHChannelID, 1)),
+		label:  fmt.Sprintf("ssh:%d", paneID),
+		paneID: paneID,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	peer.Lock()
+	peer.ssh = s
+	peer.Unlock()
+	go s.writeLoop(peer)
+	go s.readLoop()
+	return s
+}
+
+func (s *sshChannel) readLoop() {
+	for {
+		b := make([]byte, 32*1024)
+		n, err := s.ch.Read(b)
+		if n > 0 {
+			s.m.Lock()
+			f := s.onMessage
+			s.m.Unlock()
+			if f != nil {
+				f(webrtc.DataChannelMessage{IsString: false, Data: b[:n]})
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.closeLocal()
+			}
+			return
+		}
+	}
+}
+
+// push queues data to be written and wakes the write loop
+func (s *sshChannel) push(b []byte) error {
+	s.m.Lock()
+	if s.closed {
+		s.m.Unlock()
+		return fmt.Errorf("SSH channel %d is closed", s.chID)
+	}
+	s.out = append(s.out, b)
+	s.m.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop returns the next data to write, or false if there's none
+func (s *sshChannel) pop() ([]byte, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if len(s.out) == 0 {
+		return nil, false
+	}
+	b := s.out[0]
+	s.out[0] = nil
+	s.out = s.out[1:]
+	return b, true
+}
+
+func (s *sshChannel) writeLoop(peer *Peer) {
+	for {
+		b, ok := s.pop()
+		if !ok {
+			select {
+			case <-s.done:
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+		if b == nil {
+			// the pane is done, let the client know how it exited
+			s.sendExitStatus(peer)
+			s.closeLocal()
+			return
+		}
+		_, err := s.ch.Write(b)
+		if err != nil {
+			peer.logger.Warnf("Failed to write to ssh session: %s", err)
+			s.closeLocal()
+			return
+		}
+		s.sent(uint64(len(b)))
+	}
+}
+
+// sendExitStatus sends the exit status of the session's pane
+func (s *sshChannel) sendExitStatus(peer *Peer) {
+	pane := peer.Server.Panes.Get(s.paneID)
+	if pane == nil {
+		return
+	}
+	status := pane.ExitStatus(sshExitTimeout)
+	if status < 0 {
+		peer.logger.Warnf("@%d: Pane didn't exit, not sending an exit status", s.paneID)
+		return
+	}
+	s.ch.SendRequest("exit-status", false,
+		ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+func (s *sshChannel) Label() string { return s.label }
+func (s *sshChannel) ID() *uint16   { return &s.chID }
+
+// Send queues the data to be written to the session, it never blocks
+func (s *sshChannel) Send(b []byte) error {
+	s.m.Lock()
+	closed := s.closed
+	s.m.Unlock()
+	if closed {
+		return fmt.Errorf("SSH channel %d is closed", s.chID)
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	atomic.AddUint64(&s.buffered, uint64(len(b)))
+	err := s.push(b)
+	if err != nil {
+		atomic.AddUint64(&s.buffered, ^(uint64(len(b)) - 1))
+	}
+	return err
+}
+
+// sent is called after data is written
+func (s *sshChannel) sent(n uint64) {
+	left := atomic.AddUint64(&s.buffered, ^(n - 1))
+	s.m.Lock()
+	f := s.onLow
+	threshold := s.lowThreshold
+	s.m.Unlock()
+	if f != nil && left <= threshold && left+n > threshold {
+		f()
+	}
+}
+
+// Close closes the session once the queued data is written
+func (s *sshChannel) Close() error {
+	s.push(nil)
+	return nil
+}
+
+// closeLocal closes the session's channel
+func (s *sshChannel) closeLocal() {
+	s.once.Do(func() {
+		s.m.Lock()
+		s.closed = true
+		s.out = nil
+		f := s.onClose
+		s.m.Unlock()
+		close(s.done)
+		s.ch.Close()
+		if f != nil {
+			f()
+		}
+	})
+}
+
+func (s *sshChannel) ReadyState() webrtc.DataChannelState {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return webrtc.DataChannelStateClosed
+	}
+	return webrtc.DataChannelStateOpen
+}
+
+func (s *sshChannel) BufferedAmount() uint64 {
+	return atomic.LoadUint64(&s.buffered)
+}
+
+func (s *sshChannel) SetBufferedAmountLowThreshold(th uint64) {
+	s.m.Lock()
+	s.lowThreshold = th
+	s.m.Unlock()
+}
+
+func (s *sshChannel) OnBufferedAmountLow(f func()) {
+	s.m.Lock()
+	s.onLow = f
+	s.m.Unlock()
+}
+
+// OnOpen calls f as ssh channels are open when they're created
+func (s *sshChannel) OnOpen(f func()) {
+	go f()
+}
+
+func (s *sshChannel) OnMessage(f func(webrtc.DataChannelMessage)) {
+	s.m.Lock()
+	s.onMessage = f
+	s.m.Unlock()
+}
+
+func (s *sshChannel) OnClose(f func()) {
+	s.m.Lock()
+	s.onClose = f
+	s.m.Unlock()
+}
@@ -0,0 +1,80 @@
+package peers
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// stuckChannel is an ssh.Channel whose writes block until it's released
+type stuckChannel struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+var _ ssh.Channel = &stuckChannel{}
+
+func (c *stuckChannel) Read(b []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *stuckChannel) Write(b []byte) (int, error) {
+	select {
+	case <-c.release:
+		return len(b), nil
+	case <-c.closed:
+		return 0, io.EOF
+	}
+}
+
+func (c *stuckChannel) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return nil
+}
+
+func (c *stuckChannel) CloseWrite() error { return nil }
+func (c *stuckChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return true, nil
+}
+func (c *stuckChannel) Stderr() io.ReadWriter { return nil }
+
+func TestSSHSendNeverBlocks(t *testing.T) {
+	peer := &Peer{Server: newTestServer(t), logger: zap.NewNop().Sugar()}
+	ch := &stuckChannel{release: make(chan struct{}), closed: make(chan struct{})}
+	s := peer.newSSHChannel(ch, 1)
+	defer s.closeLocal()
+	low := make(chan bool, 1)
+	s.SetBufferedAmountLowThreshold(BufferedAmountLow)
+	s.OnBufferedAmountLow(func() { low <- true })
+	// the session is stuck, yet sending many small writes doesn't block
+	// and the channel looks saturated
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 1024; i++ {
+			s.Send(make([]byte, 1024))
+		}
+		sent <- true
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("Send blocked")
+	}
+	require.Greater(t, s.BufferedAmount(), uint64(MaxBufferedAmount))
+	require.True(t, (&Client{dc: s}).saturated())
+	close(ch.release)
+	select {
+	case <-low:
+	case <-time.After(time.Second):
+		t.Fatal("the channel didn't drain")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build darwin || freebsd || openbsd
+// +build darwin freebsd openbsd
+
+package peers
+
+import "golang.org/x/sys/unix"
+
+const (
+	ioctlReadTermios  = unix.TIOCGETA
+	ioctlWriteTermios = unix.TIOCSETA
+)
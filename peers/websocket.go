@@ -0,0 +1,78 @@
+// This file holds the websocket transport, used when webrtc can't connect
+package peers
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// WSWriteWait is the time allowed to write a frame to the websocket
+const WSWriteWait = 10 * time.Second
+
+// WSConn multiplexes a peer's cdc and pane streams over a websocket.
+// Every binary message is a frame: a 4 byte big endian pane id followed by
+// the payload. Pane id 0 is the cdc and an empty payload closes a stream.
+type WSConn struct {
+	*muxConn
+	conn *websocket.Conn
+}
+
+// ServeWebSocket creates a peer that uses the websocket for its cdc and
+// panes and serves it until the websocket is closed
+func (s *Server) ServeWebSocket(fp string, conn *websocket.Conn) error {
+	conf := s.Conf
+	peer := s.newTransportPeer(fp)
+	defer s.removePeer(peer)
+	ws := &WSConn{conn: conn}
+	ws.muxConn = newMuxConn(peer, ws.write, func() { conn.Close() })
+	peer.ws = ws
+	cdc := ws.addStream(0, "%")
+	peer.setCDC(cdc)
+	cdc.OnMessage(peer.handleCTRLMsg)
+	peer.logger.Infof("Peer %s connected over websocket", fp)
+	s.peerStateChanged(peer, webrtc.PeerConnectionStateConnected)
+	// cdc is open, let the caller know
+	if conf.OnCTRLMsg != nil {
+		conf.OnCTRLMsg(peer, nil, nil)
+	}
+	err := ws.readLoop()
+	ws.close()
+	s.peerStateChanged(peer, webrtc.PeerConnectionStateClosed)
+	peer.logger.Infof("Peer %s websocket closed: %s", fp, err)
+	return err
+}
+
+// write writes a frame to the websocket. Streams are open once they're
+// used so open frames are skipped and close frames have an empty payload.
+func (ws *WSConn) write(id uint32, typ byte, payload []byte) error {
+	if typ == FrameOpen {
+		return nil
+	}
+	b := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(b, id)
+	copy(b[4:], payload)
+	ws.conn.SetWriteDeadline(time.Now().Add(WSWriteWait))
+	return ws.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+func (ws *WSConn) readLoop() error {
+	for {
+		typ, b, err := ws.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if typ != websocket.BinaryMessage || len(b) < 4 {
+			ws.peer.logger.Warnf("Ignoring a bad websocket frame")
+			continue
+		}
+		id := binary.BigEndian.Uint32(b[:4])
+		if len(b) == 4 {
+			ws.deliver(id, FrameClose, nil)
+		} else {
+			ws.deliver(id, FrameData, b[4:])
+		}
+	}
+}
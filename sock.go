@@ -12,14 +12,19 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/dchest/uniuri"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
+	"github.com/tuzig/webexec/httpserver"
 	"github.com/tuzig/webexec/peers"
 	"go.uber.org/fx"
+	"go.uber.org/zap"
 )
 
 type SocketStartParams struct {
@@ -28,7 +33,19 @@ type SocketStartParams struct {
 type sockServer struct {
 	currentOffers map[string]*LiveOffer
 	coMutex       sync.Mutex
-	conf          *peers.Conf
+	server        *peers.Server
+	httpOptions   *httpserver.ServerOptions
+	logger        *zap.SugaredLogger
+	// shutdown gets the shutdown requests
+	shutdown chan peers.ShutdownOptions
+}
+
+// ShutdownRequest is the body of a shutdown request
+type ShutdownRequest struct {
+	Reason string `json:"reason"`
+	// Drain & ETA are in milliseconds, see peers.ShutdownArgs
+	Drain int64 `json:"drain"`
+	ETA   int64 `json:"eta,omitempty"`
 }
 
 type LiveOffer struct {
@@ -37,19 +54,29 @@ type LiveOffer struct {
 	m        sync.Mutex
 	incoming chan webrtc.ICECandidateInit
 	//TODO: refactor and remove '*'
-	cs chan *webrtc.ICECandidate
-	p  *peers.Peer
-	id string
+	cs     chan *webrtc.ICECandidate
+	p      *peers.Peer
+	id     string
+	logger *zap.SugaredLogger
 }
 
 // StatusMessage is a struct that holds the response to the status request
 type StatusMessage struct {
 	Version string                     `json:"version"`
 	Peers   []peers.CandidatePairStats `json:"peers,omitempty"`
+	// TLSFingerprint is the fingerprint of the http server's certificate
+	TLSFingerprint string `json:"tls_fingerprint,omitempty"`
 }
 
 const socketFileName = "webexec.sock"
 
+// PaneHeader is the header holding the id of the calling pane, taken from
+// its WEBEXEC_PANE environment variable
+const PaneHeader = "X-Webexec-Pane"
+
+// connKey is the request context key of the socket connection
+type connKey struct{}
+
 var socketFilePath string
 
 func (lo *LiveOffer) handleIncoming(ctx context.Context) {
@@ -59,13 +86,13 @@ func (lo *LiveOffer) handleIncoming(ctx context.Context) {
 			return
 		case can := <-lo.incoming:
 			if lo.p.PC != nil {
-				Logger.Infof("Adding ICE candidate: %v", can)
+				lo.logger.Infof("Adding ICE candidate: %v", can)
 				err := lo.p.PC.AddICECandidate(can)
 				if err != nil {
-					Logger.Errorf("Failed to add ICE candidate: " + err.Error())
+					lo.logger.Errorf("Failed to add ICE candidate: " + err.Error())
 				}
 			} else {
-				Logger.Warnf("Ignoring candidate: %v", can)
+				lo.logger.Warnf("Ignoring candidate: %v", can)
 			}
 		}
 	}
@@ -73,14 +100,19 @@ func (lo *LiveOffer) handleIncoming(ctx context.Context) {
 
 func (la *LiveOffer) OnCandidate(can *webrtc.ICECandidate) {
 	if can != nil {
-		Logger.Infof("appending a candidate to %q: %v", la.id, can)
+		la.logger.Infof("appending a candidate to %q: %v", la.id, can)
 		la.cs <- can
 	}
 }
-func NewSockServer(conf *peers.Conf) *sockServer {
+func NewSockServer(server *peers.Server, httpOptions *httpserver.ServerOptions,
+	logger *zap.SugaredLogger) *sockServer {
+
 	return &sockServer{
 		currentOffers: make(map[string]*LiveOffer),
-		conf:          conf,
+		server:        server,
+		httpOptions:   httpOptions,
+		logger:        logger,
+		shutdown:      make(chan peers.ShutdownOptions, 1),
 	}
 }
 
@@ -92,15 +124,62 @@ func GetSockFP() string {
 	return socketFilePath
 }
 
+// callerPane returns the pane the request came from. It returns nil when
+// the caller is not in a pane.
+func (s *sockServer) callerPane(r *http.Request) *peers.Pane {
+	pid := 0
+	if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		var err error
+		pid, err = peerPID(c)
+		if err != nil {
+			s.logger.Infof("Failed to get the caller's pid: %s", err)
+		}
+	}
+	return s.paneOf(pid, r.Header.Get(PaneHeader))
+}
+
+// paneOf returns the pane running the calling process or one of its
+// ancestors. The pane header, which any process can set, is used only when
+// the ancestry finds no pane, i.e. on platforms with no peer credentials.
+func (s *sockServer) paneOf(pid int, header string) *peers.Pane {
+	if pid > 0 {
+		if pane := s.server.PaneOfProcess(pid); pane != nil {
+			return pane
+		}
+	}
+	if header == "" {
+		return nil
+	}
+	id, err := strconv.Atoi(header)
+	if err == nil {
+		if pane := s.server.Panes.Get(id); pane != nil {
+			return pane
+		}
+	}
+	s.logger.Warnf("Ignoring a request from unknown pane %q", header)
+	return nil
+}
+
+// activePeer returns the peer using the calling pane or the last active
+// peer if the caller is not in a pane
+func (s *sockServer) activePeer(r *http.Request) *peers.Peer {
+	pane := s.callerPane(r)
+	if pane == nil {
+		return s.server.ActivePeer()
+	}
+	s.logger.Infof("Got a request from pane %d", pane.ID)
+	return pane.ActivePeer()
+}
+
 func (s *sockServer) handleClipboard(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		var reply []byte
-		peer := peers.GetActivePeer()
+		peer := s.activePeer(r)
 		if peer != nil {
-			Logger.Info("Reading the peers' clipboard")
+			s.logger.Info("Reading the peers' clipboard")
 			clip, err := peer.SendControlMessageAndWait("get_clipboard", nil)
 			if err != nil {
-				Logger.Errorf("Failed to send the paste message: %s", err)
+				s.logger.Errorf("Failed to send the paste message: %s", err)
 				http.Error(w, "Failed to send the paste message", http.StatusInternalServerError)
 				return
 			}
@@ -108,7 +187,7 @@ func (s *sockServer) handleClipboard(w http.ResponseWriter, r *http.Request) {
 		} else {
 			var err error
 			// use the local clipboard as a fallback
-			Logger.Info("Got clipboard GET, using local clipboard")
+			s.logger.Info("Got clipboard GET, using local clipboard")
 			reply, err = readClipboard()
 			if err != nil {
 				http.Error(w, "Failed to read the clipboard", http.StatusNotImplemented)
@@ -119,10 +198,10 @@ func (s *sockServer) handleClipboard(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		mimetype := r.Header.Get("Content-Type")
 		b, _ := ioutil.ReadAll(r.Body)
-		peer := peers.GetActivePeer()
+		peer := s.activePeer(r)
 		if peer != nil {
 			// check the incoming mime type and send the appropriate message
-			Logger.Infof("Setting peers' clipboard with mime type %q", mimetype)
+			s.logger.Infof("Setting peers' clipboard with mime type %q", mimetype)
 			args := peers.SetClipboardArgs{
 				MimeType: mimetype,
 				Data:     string(b),
@@ -130,12 +209,12 @@ func (s *sockServer) handleClipboard(w http.ResponseWriter, r *http.Request) {
 
 			err := peer.SendControlMessage("set_clipboard", args)
 			if err != nil {
-				Logger.Errorf("Failed to send the paste message: %s", err)
+				s.logger.Errorf("Failed to send the paste message: %s", err)
 				http.Error(w, "Failed to send the paste message", http.StatusInternalServerError)
 				return
 			}
 		} else {
-			Logger.Info("Got clipboard POST, using local clipboard")
+			s.logger.Info("Got clipboard POST, using local clipboard")
 			err := writeClipboard(b, mimetype)
 			if err != nil {
 				http.Error(w, "Failed to write to the clipboard", http.StatusNotImplemented)
@@ -151,10 +230,10 @@ func StartSocketServer(lc fx.Lifecycle, s *sockServer, params SocketStartParams)
 	socketFilePath = params.fp
 	_, err := os.Stat(params.fp)
 	if err == nil {
-		Logger.Infof("Removing stale socket file %q", socketFilePath)
+		s.logger.Infof("Removing stale socket file %q", socketFilePath)
 		err = os.Remove(socketFilePath)
 		if err != nil {
-			Logger.Errorf("Failed to remove stale socket file %q: %s", socketFilePath, err)
+			s.logger.Errorf("Failed to remove stale socket file %q: %s", socketFilePath, err)
 			return nil, err
 		}
 	} else if errors.Is(err, os.ErrNotExist) {
@@ -164,11 +243,11 @@ func StartSocketServer(lc fx.Lifecycle, s *sockServer, params SocketStartParams)
 		if errors.Is(err, os.ErrNotExist) {
 			err = os.Mkdir(dir, 0755)
 			if err != nil {
-				Logger.Errorf("Failed to make dir %q: %s", dir, err)
+				s.logger.Errorf("Failed to make dir %q: %s", dir, err)
 				return nil, err
 			}
 		} else if err != nil {
-			Logger.Errorf("Failed to stat dir %q: %s", dir, err)
+			s.logger.Errorf("Failed to stat dir %q: %s", dir, err)
 			return nil, err
 		}
 	}
@@ -177,7 +256,14 @@ func StartSocketServer(lc fx.Lifecycle, s *sockServer, params SocketStartParams)
 	m.Handle("/layout", http.HandlerFunc(s.handleLayout))
 	m.Handle("/offer/", http.HandlerFunc(s.handleOffer))
 	m.Handle("/clipboard", http.HandlerFunc(s.handleClipboard))
-	server := http.Server{Handler: &m}
+	m.Handle("/ws", http.HandlerFunc(s.handleWebSocket))
+	m.Handle("/shutdown", http.HandlerFunc(s.handleShutdown))
+	server := http.Server{Handler: &m,
+		// the connection is used to find the calling process
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, c)
+		},
+	}
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
 			l, err := net.Listen("unix", socketFilePath)
@@ -185,14 +271,14 @@ func StartSocketServer(lc fx.Lifecycle, s *sockServer, params SocketStartParams)
 				return fmt.Errorf("Failed to listen to unix socket: %s", err)
 			}
 			go server.Serve(l)
-			Logger.Infof("Listening for requests on %q", socketFilePath)
+			s.logger.Infof("Listening for requests on %q", socketFilePath)
 			return nil
 		},
 		OnStop: func(ctx context.Context) error {
-			Logger.Info("Stopping socket server")
+			s.logger.Info("Stopping socket server")
 			err := server.Shutdown(ctx)
 			os.Remove(socketFilePath)
-			Logger.Info("Socket server down")
+			s.logger.Info("Socket server down")
 			return err
 		},
 	})
@@ -207,7 +293,14 @@ func (s *sockServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ret := StatusMessage{Version: version}
-	for _, peer := range peers.Peers {
+	if s.httpOptions != nil && s.httpOptions.TLS != nil {
+		fp, err := s.httpOptions.TLS.Fingerprint()
+		ret.TLSFingerprint = fp
+		if err != nil {
+			s.logger.Warnf("Failed to get the TLS fingerprint: %s", err)
+		}
+	}
+	for _, peer := range s.server.AllPeers() {
 		var cp peers.CandidatePairStats
 		err := peer.GetCandidatePair(&cp)
 		if err == nil {
@@ -221,13 +314,69 @@ func (s *sockServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(b)
 }
+
+// handleShutdown asks the agent to shut down gracefully. The body is a
+// ShutdownRequest and the reply is sent before the shutdown starts.
+func (s *sockServer) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ShutdownRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to parse shutdown request: %s", err),
+			http.StatusBadRequest)
+		return
+	}
+	opts := peers.ShutdownOptions{
+		Reason: req.Reason,
+		Drain:  time.Duration(req.Drain) * time.Millisecond,
+		ETA:    time.Duration(req.ETA) * time.Millisecond,
+	}
+	select {
+	case s.shutdown <- opts:
+		s.logger.Infof("Got a shutdown request: %v", req)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Already shutting down", http.StatusConflict)
+	}
+}
+
+// handleLayout returns the layout on GET and updates it on POST.
+// A POST body is a peers.SetLayoutArgs and the reply holds the new layout.
 func (s *sockServer) handleLayout(w http.ResponseWriter, r *http.Request) {
+	var l peers.Layout
 	if r.Method == "GET" {
-		w.Write(peers.Payload)
+		l = s.server.Layout.Get()
 	} else if r.Method == "POST" {
-		b, _ := ioutil.ReadAll(r.Body)
-		peers.Payload = b
+		var args peers.SetLayoutArgs
+		err := json.NewDecoder(r.Body).Decode(&args)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse layout: %s", err),
+				http.StatusBadRequest)
+			return
+		}
+		l, err = s.server.Layout.Set(args.Version, args.Layout)
+		if errors.Is(err, peers.ErrLayoutConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		http.Error(w, "Failed to marshal layout", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
 func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
@@ -252,7 +401,7 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				http.Error(w, "Failed to marshal candidate", http.StatusInternalServerError)
 			} else {
-				Logger.Infof("replying to GET with: %v", string(m))
+				s.logger.Infof("replying to GET with: %v", string(m))
 				w.Write(m)
 			}
 			return
@@ -285,7 +434,7 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		peer, err := peers.NewPeer(fp, s.conf)
+		peer, err := s.server.NewPeer(fp)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to create a new peer: %s", err),
 				http.StatusInternalServerError)
@@ -293,7 +442,7 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 		}
 		h := uniuri.New()
 		// TODO: move the 5 to conf, to refactored ice section
-		lo := &LiveOffer{p: peer, id: h,
+		lo := &LiveOffer{p: peer, id: h, logger: s.logger,
 			cs:       make(chan *webrtc.ICECandidate, 5),
 			incoming: make(chan webrtc.ICECandidateInit, 5),
 		}
@@ -332,7 +481,7 @@ func (s *sockServer) handleOffer(w http.ResponseWriter, r *http.Request) {
 		}
 		// cleanup: 30 should be in the conf under the [ice] section
 		time.AfterFunc(30*time.Second, func() {
-			Logger.Info("After 30 secs")
+			s.logger.Info("After 30 secs")
 			cancel()
 			s.coMutex.Lock()
 			delete(s.currentOffers, h)
@@ -414,3 +563,16 @@ func writeClipboard(data []byte, mimeType string) error {
 	}
 	return cmd.Wait()
 }
+
+// handleWebSocket serves local clients, i.e. `webexec attach`, using the
+// websocket transport. The socket is only accessible to the user so there's
+// no need to authenticate.
+func (s *sockServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warnf("Failed to upgrade local websocket: %s", err)
+		return
+	}
+	s.server.ServeWebSocket("local-"+uuid.NewString(), conn)
+}
@@ -7,26 +7,32 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/creack/pty"
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 	"github.com/tuzig/webexec/peers"
 	"go.uber.org/fx/fxtest"
+	"go.uber.org/zap"
 )
 
 func TestOfferGetCandidate(t *testing.T) {
 	var id string
-	initTest(t)
+	logger := initTest(t)
 	lifecycle := fxtest.NewLifecycle(t)
 	k := KeyType{}
 	certificate, err := k.generate()
 	require.NoError(t, err, "Failed to generate a certificate", err)
 	conf := peers.Conf{
 		Certificate:       certificate,
-		Logger:            Logger,
+		Logger:            logger,
 		DisconnectTimeout: time.Second,
 		FailedTimeout:     time.Second,
 		KeepAliveInterval: time.Second,
@@ -35,7 +41,7 @@ func TestOfferGetCandidate(t *testing.T) {
 			return nil, nil
 		},
 	}
-	sockServer := NewSockServer(&conf)
+	sockServer := NewSockServer(newServer(&conf), nil, conf.Logger)
 	require.NotNil(t, sockServer, "Failed to create a new server")
 	startParams := SocketStartParams{t.TempDir()}
 	server, err := StartSocketServer(lifecycle, sockServer, startParams)
@@ -70,7 +76,7 @@ func TestOfferGetCandidate(t *testing.T) {
 	require.Nil(t, err, "Failed to set client's local Description client offer: %q", err)
 	buf, err := json.Marshal(offer)
 	require.Nil(t, err, "Failed decoding an offer: %v", offer)
-	Logger.Info("Sendiong post")
+	logger.Info("Sendiong post")
 	resp, err := httpc.Post("http://unix/offer/", "application/json", bytes.NewBuffer(buf))
 	require.NoError(t, err, "Failed sending a post request: %q", err)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
@@ -88,7 +94,7 @@ func TestOfferGetCandidate(t *testing.T) {
 		msg, _ := ioutil.ReadAll(r.Body)
 		err = r.Body.Close()
 		require.Nil(t, err, "Failed to close offer+body: %q", err)
-		Logger.Infof("Got candidate: %q", string(msg))
+		logger.Infof("Got candidate: %q", string(msg))
 		if r.StatusCode == http.StatusServiceUnavailable {
 			break
 		}
@@ -98,14 +104,14 @@ func TestOfferGetCandidate(t *testing.T) {
 }
 func TestOfferPutCandidates(t *testing.T) {
 	var id string
-	initTest(t)
+	logger := initTest(t)
 	lifecycle := fxtest.NewLifecycle(t)
 	k := KeyType{}
 	certificate, err := k.generate()
 	require.NoError(t, err, "Failed to generate a certificate", err)
 	conf := peers.Conf{
 		Certificate:       certificate,
-		Logger:            Logger,
+		Logger:            logger,
 		DisconnectTimeout: time.Second,
 		FailedTimeout:     time.Second,
 		KeepAliveInterval: time.Second,
@@ -114,7 +120,7 @@ func TestOfferPutCandidates(t *testing.T) {
 			return nil, nil
 		},
 	}
-	sockServer := NewSockServer(&conf)
+	sockServer := NewSockServer(newServer(&conf), nil, conf.Logger)
 	startParams := SocketStartParams{t.TempDir()}
 	server, err := StartSocketServer(lifecycle, sockServer, startParams)
 	lifecycle.RequireStart()
@@ -139,7 +145,7 @@ func TestOfferPutCandidates(t *testing.T) {
 	defer client.Close()
 	pendingCandidates := make(chan *webrtc.ICECandidate, 5)
 	client.OnICECandidate(func(c *webrtc.ICECandidate) {
-		Logger.Info("Got can")
+		logger.Info("Got can")
 		if c == nil {
 			return
 		}
@@ -153,7 +159,7 @@ func TestOfferPutCandidates(t *testing.T) {
 	require.Nil(t, err, "Failed to set client's local Description client offer: %q", err)
 	buf, err := json.Marshal(offer)
 	require.Nil(t, err, "Failed decoding an offer: %v", offer)
-	Logger.Info("Sendiong post")
+	logger.Info("Sendiong post")
 	resp, err := httpc.Post("http://unix/offer/", "application/json", bytes.NewBuffer(buf))
 	require.NoError(t, err, "Failed sending a post request: %q", err)
 	require.Equal(t, http.StatusOK, resp.StatusCode)
@@ -198,3 +204,55 @@ func TestOfferPutCandidates(t *testing.T) {
 	// For incoming handle to finish
 	lifecycle.RequireStop()
 }
+
+func TestSockShutdown(t *testing.T) {
+	logger := initTest(t)
+	s := NewSockServer(newServer(&peers.Conf{Logger: logger}), nil, logger)
+	w := httptest.NewRecorder()
+	s.handleShutdown(w, httptest.NewRequest("POST", "/shutdown", strings.NewReader("bad")))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = httptest.NewRecorder()
+	s.handleShutdown(w, httptest.NewRequest("POST", "/shutdown",
+		strings.NewReader(`{"reason": "stop", "drain": 30000}`)))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	require.Equal(t, peers.ShutdownOptions{Reason: "stop", Drain: 30 * time.Second},
+		<-s.shutdown)
+}
+
+func TestSockCallerPane(t *testing.T) {
+	initTest(t)
+	k := KeyType{}
+	certificate, err := k.generate()
+	require.NoError(t, err)
+	ps := newServer(&peers.Conf{
+		Certificate: certificate,
+		// the peer outlives the test so it can't use the test's logger
+		Logger:            zap.NewNop().Sugar(),
+		DisconnectTimeout: time.Second,
+		FailedTimeout:     time.Second,
+		KeepAliveInterval: time.Second,
+		GatheringTimeout:  time.Second,
+	})
+	s := NewSockServer(ps, nil, ps.Conf.Logger)
+	peer := newServerPeer(t, ps, "A")
+	pane, err := peers.NewPane(peer, nil, 0)
+	require.NoError(t, err)
+	r := httptest.NewRequest("GET", "/clipboard", nil)
+	require.Nil(t, s.callerPane(r))
+	r.Header.Set(PaneHeader, strconv.Itoa(pane.ID))
+	require.Equal(t, pane, s.callerPane(r))
+	// with no active peer in the pane, the server's active peer is used
+	ps.SetLastPeer(peer)
+	require.Equal(t, peer, s.activePeer(r))
+	r.Header.Set(PaneHeader, "9999")
+	require.Nil(t, s.callerPane(r))
+	// the process ancestry takes precedence over the header
+	running, err := peers.NewPane(peer, &pty.Winsize{Rows: 24, Cols: 80}, 0)
+	require.NoError(t, err)
+	require.NoError(t, running.Run([]string{"sleep", "10"}))
+	defer running.Kill()
+	header := strconv.Itoa(pane.ID)
+	require.Equal(t, running, s.paneOf(running.C.Process.Pid, header))
+	require.Equal(t, pane, s.paneOf(os.Getpid(), header))
+	require.Nil(t, s.paneOf(os.Getpid(), ""))
+}
@@ -0,0 +1,253 @@
+// This file holds the ssh server, serving the panes to ssh clients
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/riywo/loginshell"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHConf holds the configuration of the ssh server
+type SSHConf struct {
+	// Listen is the address the server listens on
+	Listen string
+	// HostKey is the path of the server's private key, generated if missing
+	HostKey string
+	// AuthorizedKeys is the path of the file with the authorized public
+	// keys, in OpenSSH's authorized_keys format
+	AuthorizedKeys string
+}
+
+// SSHServer serves ssh sessions with panes shared with the webrtc clients
+type SSHServer struct {
+	conf     *SSHConf
+	server   *peers.Server
+	config   *ssh.ServerConfig
+	listener net.Listener
+	m        sync.Mutex
+	conns    map[*ssh.ServerConn]struct{}
+	logger   *zap.SugaredLogger
+	// wg waits for the connections' sessions
+	wg sync.WaitGroup
+}
+
+// StartSSHServer starts the ssh server if it's configured
+func StartSSHServer(lc fx.Lifecycle, conf *AgentConf, server *peers.Server,
+	logger *zap.SugaredLogger) error {
+
+	if conf.ssh == nil {
+		return nil
+	}
+	var sshServer *SSHServer
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			s, err := NewSSHServer(conf.ssh, server, logger)
+			if err != nil {
+				return err
+			}
+			sshServer = s
+			go s.Serve()
+			logger.Infof("Started SSH server on %s", s.Addr())
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			if sshServer == nil {
+				return nil
+			}
+			logger.Info("Stopping SSH server")
+			err := sshServer.Close()
+			sshServer = nil
+			return err
+		},
+	})
+	return nil
+}
+
+// NewSSHServer loads the host key and listens for ssh connections
+func NewSSHServer(conf *SSHConf, server *peers.Server, logger *zap.SugaredLogger) (*SSHServer, error) {
+	s := &SSHServer{
+		conf:   conf,
+		server: server,
+		conns:  make(map[*ssh.ServerConn]struct{}),
+		logger: logger,
+	}
+	signer, err := loadHostKey(conf.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authorize}
+	s.config.AddHostKey(signer)
+	s.listener, err = net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on %s: %s", conf.Listen, err)
+	}
+	return s, nil
+}
+
+// loadHostKey reads the host's private key, generating it if it's missing
+func loadHostKey(path string) (ssh.Signer, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate SSH host key: %s", err)
+		}
+		block, err := ssh.MarshalPrivateKey(key, "webexec")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to marshal SSH host key: %s", err)
+		}
+		b = pem.EncodeToMemory(block)
+		err = os.WriteFile(path, b, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to save SSH host key: %s", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read SSH host key: %s", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse SSH host key: %s", err)
+	}
+	return signer, nil
+}
+
+// ReadAuthorizedKeys reads the authorized public keys file
+func (s *SSHServer) ReadAuthorizedKeys() ([]ssh.PublicKey, error) {
+	file, err := os.Open(s.conf.AuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open authorized keys: %w", err)
+	}
+	defer file.Close()
+	var keys []ssh.PublicKey
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			s.logger.Warnf("Ignoring a bad authorized key: %s", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read authorized keys: %s", err)
+	}
+	return keys, nil
+}
+
+// authorize checks the client's key against the authorized keys file. The
+// file is read on every login so keys can be added while running.
+func (s *SSHServer) authorize(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	keys, err := s.ReadAuthorizedKeys()
+	if err != nil {
+		s.logger.Warnf("Failed to authorize SSH client: %s", err)
+		return nil, err
+	}
+	b := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), b) {
+			return &ssh.Permissions{Extensions: map[string]string{
+				"fp": ssh.FingerprintSHA256(key)}}, nil
+		}
+	}
+	s.logger.Infof("Unauthorized SSH key %s from %s", ssh.FingerprintSHA256(key),
+		meta.RemoteAddr())
+	return nil, fmt.Errorf("Unauthorized key")
+}
+
+// Addr returns the address the server listens on
+func (s *SSHServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts connections until the server is closed
+func (s *SSHServer) Serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Errorf("Failed to accept SSH connection: %s", err)
+			}
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *SSHServer) handleConn(nc net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		s.logger.Infof("SSH handshake with %s failed: %s", nc.RemoteAddr(), err)
+		nc.Close()
+		return
+	}
+	s.m.Lock()
+	s.conns[conn] = struct{}{}
+	s.m.Unlock()
+	defer func() {
+		s.m.Lock()
+		delete(s.conns, conn)
+		s.m.Unlock()
+		conn.Close()
+	}()
+	s.logger.Infof("SSH client %s connected with key %s", conn.RemoteAddr(),
+		conn.Permissions.Extensions["fp"])
+	go ssh.DiscardRequests(reqs)
+	shell, err := loginshell.Shell()
+	if err != nil {
+		s.logger.Warnf("Failed to determine user's shell: %v", err)
+		shell = "/bin/bash"
+	}
+	var wg sync.WaitGroup
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			s.logger.Warnf("Failed to accept SSH session: %s", err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.server.ServeSSH(conn.Permissions.Extensions["fp"], shell, ch, chReqs)
+		}()
+	}
+	wg.Wait()
+}
+
+// Close stops listening, closes the connections and waits for their
+// sessions to end. The panes keep running.
+func (s *SSHServer) Close() error {
+	err := s.listener.Close()
+	s.m.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.m.Unlock()
+	s.wg.Wait()
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
+	"golang.org/x/crypto/ssh"
+)
+
+// syncBuffer is a buffer safe for concurrent writes & reads
+type syncBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.b.String()
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	return signer
+}
+
+func TestSSHServer(t *testing.T) {
+	logger := initTest(t)
+	dir := t.TempDir()
+	signer := newSSHSigner(t)
+	authorized := filepath.Join(dir, "authorized_keys")
+	err := os.WriteFile(authorized, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600)
+	require.NoError(t, err)
+	conf := &peers.Conf{
+		AckTimeout: time.Second,
+		Logger:     logger,
+	}
+	server := newServer(conf)
+	s, err := NewSSHServer(&SSHConf{
+		Listen:         "127.0.0.1:0",
+		HostKey:        filepath.Join(dir, "ssh_host_key"),
+		AuthorizedKeys: authorized,
+	}, server, logger)
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+	require.FileExists(t, filepath.Join(dir, "ssh_host_key"))
+	dial := func(signer ssh.Signer) (*ssh.Client, error) {
+		return ssh.Dial("tcp", s.Addr().String(), &ssh.ClientConfig{
+			User:            "webexec",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         time.Second,
+		})
+	}
+	_, err = dial(newSSHSigner(t))
+	require.Error(t, err, "an unauthorized key was accepted")
+	client, err := dial(signer)
+	require.NoError(t, err)
+	defer client.Close()
+	// the first session runs a command in a new pane
+	s1, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, s1.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+	in, err := s1.StdinPipe()
+	require.NoError(t, err)
+	var out1 syncBuffer
+	s1.Stdout = &out1
+	require.NoError(t, s1.Start("read l; echo got $l"))
+	var pane *peers.Pane
+	require.Eventually(t, func() bool {
+		for _, p := range server.Panes.All() {
+			if p.IsRunning && p.C != nil && strings.Contains(
+				strings.Join(p.C.Args, " "), "echo got") {
+				pane = p
+				return true
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+	// the session's peer is identified by the client's key
+	fp := ssh.FingerprintSHA256(signer.PublicKey())
+	var fps []string
+	for _, p := range server.AllPeers() {
+		fps = append(fps, p.FP)
+	}
+	require.Contains(t, fps, fp)
+	// the second session attaches to the pane & writes to it
+	s2, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, s2.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+	in2, err := s2.StdinPipe()
+	require.NoError(t, err)
+	var out2 syncBuffer
+	s2.Stdout = &out2
+	require.NoError(t, s2.Start(fmt.Sprintf("attach %d", pane.ID)))
+	_, err = in2.Write([]byte("BADWOLF\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return strings.Contains(out1.String(), "got BADWOLF") &&
+			strings.Contains(out2.String(), "got BADWOLF")
+	}, 2*time.Second, 10*time.Millisecond)
+	// both sessions end when the pane exits
+	require.NoError(t, s1.Wait())
+	require.NoError(t, s2.Wait())
+	in.Close()
+	// the session gets the exit status of the pane's process
+	s3, err := client.NewSession()
+	require.NoError(t, err)
+	require.NoError(t, s3.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+	err = s3.Run("exit 3")
+	var exitErr *ssh.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 3, exitErr.ExitStatus())
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/pion/webrtc/v4"
 	"github.com/stretchr/testify/require"
 	"github.com/tuzig/webexec/peers"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 	"golang.org/x/sys/unix"
 )
@@ -40,18 +41,11 @@ func isAlive(pid int) bool {
 	return unix.Kill(pid, 0) == nil
 }
 
-func initTest(t *testing.T) {
+// initTest prepares the test's dependencies and returns the test's logger
+func initTest(t *testing.T) *zap.SugaredLogger {
 	if peers.PtyMux == nil {
 		peers.PtyMux = peers.PtyMuxType{}
 	}
-	Logger = zaptest.NewLogger(t).Sugar()
-	conf, addr, err := parseConf(defaultConf)
-	require.Nil(t, err, "parseConf failed with: %s", err)
-	conf.Logger = Logger
-	require.NotNil(t, conf)
-	require.Equal(t, "0.0.0.0:7777", string(addr))
-	Conf.insecure = true
-	Conf.iceServers = nil
 	f, err := ioutil.TempFile("", "private.key")
 	require.Nil(t, err)
 	f.Close()
@@ -59,12 +53,13 @@ func initTest(t *testing.T) {
 	cert, err := key.generate()
 	require.Nil(t, err)
 	key.save(cert)
+	return zaptest.NewLogger(t).Sugar()
 }
 func newPeer(t *testing.T, fp string, certificate *webrtc.Certificate) *peers.Peer {
 	conf := peers.Conf{
 		Certificate:       certificate,
 		AckTimeout:        time.Second,
-		Logger:            Logger,
+		Logger:            zaptest.NewLogger(t).Sugar(),
 		DisconnectTimeout: time.Second,
 		FailedTimeout:     time.Second,
 		KeepAliveInterval: time.Second,
@@ -72,9 +67,13 @@ func newPeer(t *testing.T, fp string, certificate *webrtc.Certificate) *peers.Pe
 		GetICEServers: func() ([]webrtc.ICEServer, error) {
 			return []webrtc.ICEServer{}, nil
 		},
-		OnCTRLMsg: handleCTRLMsg,
 	}
-	peer, err := peers.NewPeer(fp, &conf)
+	return newServerPeer(t, newServer(&conf), fp)
+}
+
+// newServerPeer returns a new peer of the given server
+func newServerPeer(t *testing.T, server *peers.Server, fp string) *peers.Peer {
+	peer, err := server.NewPeer(fp)
 	require.NoError(t, err)
 	require.NotNil(t, peer)
 	return peer
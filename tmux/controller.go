@@ -0,0 +1,469 @@
+// Package tmux drives a tmux session in control mode, mapping its panes to
+// webexec panes.
+// tmux is started with -C, the same protocol -CC clients such as iTerm2 use,
+// over pipes. Each tmux pane gets a peers.Pane whose tty reads the pane's
+// %output notifications and writes keys to it. Clients connect to these
+// panes with `reconnect_pane` and get layout updates when the session
+// changes.
+package tmux
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/zap"
+)
+
+var (
+	// Command is the tmux executable
+	Command = "tmux"
+	// SocketName, when set, is passed to tmux as the -L option
+	SocketName string
+)
+
+// reply is called with the output of a command
+type reply func(lines []string, err error)
+
+// Registry holds the controllers of a server's sessions by name. Pane ids
+// are unique only in a server, so every server has its own registry.
+type Registry struct {
+	controllers map[string]*Controller
+	m           sync.Mutex
+}
+
+// NewRegistry returns a new, empty, registry
+func NewRegistry() *Registry {
+	return &Registry{controllers: make(map[string]*Controller)}
+}
+
+// Controller is a tmux control mode client attached to a session
+type Controller struct {
+	Session string
+	// OnLayout is called when the session's layout changes
+	OnLayout func(*Controller, Layout)
+	registry *Registry
+	peer     *peers.Peer
+	logger   *zap.SugaredLogger
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	// replies holds the callbacks of commands waiting for a reply
+	replies []reply
+	m       sync.Mutex
+	panes   map[string]*peers.Pane
+	ttys    map[string]*paneTTY
+	layout  Layout
+	panesM  sync.Mutex
+	refresh chan struct{}
+	done    chan struct{}
+}
+
+// Attach returns the controller of a session, starting tmux if needed.
+// ws is the size of the tmux client and can be nil.
+func (r *Registry) Attach(peer *peers.Peer, session string, ws *pty.Winsize,
+	onLayout func(*Controller, Layout)) (*Controller, error) {
+
+	r.m.Lock()
+	c, found := r.controllers[session]
+	if !found {
+		var err error
+		c, err = start(r, peer, session, onLayout)
+		if err != nil {
+			r.m.Unlock()
+			return nil, err
+		}
+		r.controllers[session] = c
+	}
+	// the lock is released before talking to tmux as the read loop takes it
+	// when tmux exits
+	r.m.Unlock()
+	if ws != nil {
+		err := c.Resize(ws)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := c.Refresh()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get returns the controller of a session or nil
+func (r *Registry) Get(session string) *Controller {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.controllers[session]
+}
+
+// ForPane returns the controller of a webexec pane and the pane's tmux id.
+// It returns nil if the pane is not a tmux pane.
+func (r *Registry) ForPane(id int) (*Controller, string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, c := range r.controllers {
+		c.panesM.Lock()
+		for tmuxID, pane := range c.panes {
+			if pane.ID == id {
+				c.panesM.Unlock()
+				return c, tmuxID
+			}
+		}
+		c.panesM.Unlock()
+	}
+	return nil, ""
+}
+
+func start(r *Registry, peer *peers.Peer, session string,
+	onLayout func(*Controller, Layout)) (*Controller, error) {
+
+	var args []string
+	if SocketName != "" {
+		args = append(args, "-L", SocketName)
+	}
+	args = append(args, "-C", "new-session", "-A", "-s", session)
+	cmd := exec.Command(Command, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open tmux's stdin: %s", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open tmux's stdout: %s", err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start tmux: %s", err)
+	}
+	c := &Controller{
+		Session:  session,
+		OnLayout: onLayout,
+		registry: r,
+		peer:     peer,
+		logger:   peer.Conf.Logger,
+		cmd:      cmd,
+		stdin:    stdin,
+		panes:    make(map[string]*peers.Pane),
+		ttys:     make(map[string]*paneTTY),
+		refresh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go c.readLoop(stdout)
+	go c.refreshLoop()
+	return c, nil
+}
+
+// Send sends a command to tmux without waiting for its reply
+func (c *Controller) Send(command string) error {
+	return c.do(command, nil)
+}
+
+// Run sends a command to tmux and returns its output
+func (c *Controller) Run(command string) ([]string, error) {
+	type result struct {
+		lines []string
+		err   error
+	}
+	ch := make(chan result, 1)
+	err := c.do(command, func(lines []string, err error) {
+		ch <- result{lines, err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.lines, r.err
+	case <-c.done:
+		return nil, fmt.Errorf("tmux exited")
+	}
+}
+
+func (c *Controller) do(command string, r reply) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	select {
+	case <-c.done:
+		return fmt.Errorf("tmux exited")
+	default:
+	}
+	c.logger.Debugf("tmux %s: sending %q", c.Session, command)
+	_, err := io.WriteString(c.stdin, command+"\n")
+	if err != nil {
+		return fmt.Errorf("Failed to send a tmux command: %s", err)
+	}
+	c.replies = append(c.replies, r)
+	return nil
+}
+
+// Resize sets the size of the tmux client
+func (c *Controller) Resize(ws *pty.Winsize) error {
+	return c.Send(fmt.Sprintf("refresh-client -C %d,%d", ws.Cols, ws.Rows))
+}
+
+// Split splits a tmux pane. When topBottom is true the new pane is created
+// below the pane, otherwise to its right. size is passed to tmux's -l
+// option, i.e. "20" or "50%", and can be empty.
+func (c *Controller) Split(tmuxID string, topBottom bool, size string) error {
+	dir := "-h"
+	if topBottom {
+		dir = "-v"
+	}
+	command := fmt.Sprintf("split-window %s -t %s", dir, tmuxID)
+	if size != "" {
+		command += " -l " + size
+	}
+	_, err := c.Run(command)
+	return err
+}
+
+// Zoom toggles the zoom of a tmux pane
+func (c *Controller) Zoom(tmuxID string) error {
+	_, err := c.Run("resize-pane -Z -t " + tmuxID)
+	return err
+}
+
+// Layout returns the session's last known layout
+func (c *Controller) Layout() Layout {
+	c.panesM.Lock()
+	defer c.panesM.Unlock()
+	return c.layout
+}
+
+// Close detaches from the tmux session, leaving it running
+func (c *Controller) Close() error {
+	err := c.Send("detach-client")
+	if err != nil {
+		return err
+	}
+	<-c.done
+	return nil
+}
+
+// Refresh lists the session's panes, creates webexec panes for new tmux
+// panes, closes the ones that are gone and publishes the layout if it
+// changed.
+func (c *Controller) Refresh() error {
+	lines, err := c.Run(fmt.Sprintf("list-panes -s -F '%s'", paneFormat))
+	if err != nil {
+		return fmt.Errorf("Failed to list tmux panes: %s", err)
+	}
+	infos := make([]paneInfo, 0, len(lines))
+	for _, line := range lines {
+		info, err := parsePaneInfo(line)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+	c.panesM.Lock()
+	seen := make(map[string]bool)
+	for _, info := range infos {
+		seen[info.id] = true
+		ws := &pty.Winsize{Rows: uint16(info.height), Cols: uint16(info.width)}
+		pane, found := c.panes[info.id]
+		if found {
+			if pane.Ws == nil || pane.Ws.Rows != ws.Rows || pane.Ws.Cols != ws.Cols {
+				pane.SetSize(ws)
+			}
+			continue
+		}
+		pane, err = peers.NewPane(c.peer, ws, 0)
+		if err != nil {
+			c.logger.Errorf("Failed to create a pane for tmux pane %s: %s", info.id, err)
+			continue
+		}
+		c.logger.Infof("tmux %s: pane %s is webexec pane %d", c.Session, info.id, pane.ID)
+		tty := newPaneTTY(c, info.id)
+		c.panes[info.id] = pane
+		c.ttys[info.id] = tty
+		pane.RunTTY(tty)
+		c.capture(tty)
+	}
+	for id, tty := range c.ttys {
+		if !seen[id] {
+			c.logger.Infof("tmux %s: pane %s is gone", c.Session, id)
+			tty.Close()
+			delete(c.ttys, id)
+			delete(c.panes, id)
+		}
+	}
+	layout := buildLayout(c.Session, infos, c.panes)
+	changed := !reflect.DeepEqual(layout, c.layout)
+	c.layout = layout
+	c.panesM.Unlock()
+	if changed && c.OnLayout != nil {
+		c.OnLayout(c, layout)
+	}
+	return nil
+}
+
+// capture sends a new pane its screen content and cursor position.
+// The replies are handled by the read loop so later output is sent after.
+func (c *Controller) capture(tty *paneTTY) {
+	err := c.do("capture-pane -p -e -t "+tty.id, func(lines []string, err error) {
+		if err != nil {
+			c.logger.Warnf("Failed to capture tmux pane %s: %s", tty.id, err)
+			return
+		}
+		tty.pushAlways([]byte("\x1b[H\x1b[2J" + strings.Join(lines, "\r\n")))
+	})
+	if err != nil {
+		c.logger.Warnf("Failed to capture tmux pane %s: %s", tty.id, err)
+	}
+	err = c.do(fmt.Sprintf("display-message -p -t %s '#{cursor_y} #{cursor_x}'", tty.id),
+		func(lines []string, err error) {
+			var x, y int
+			if err == nil && len(lines) == 1 {
+				fmt.Sscanf(lines[0], "%d %d", &y, &x)
+			}
+			tty.pushAlways([]byte(fmt.Sprintf("\x1b[%d;%dH", y+1, x+1)))
+			tty.setReady()
+		})
+	if err != nil {
+		c.logger.Warnf("Failed to get tmux pane's cursor %s: %s", tty.id, err)
+	}
+}
+
+// readLoop reads tmux's stdout, dispatching command replies and
+// notifications
+func (c *Controller) readLoop(r io.Reader) {
+	var (
+		block []string
+		guard []string
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		n, isNotification := parseNotification(line)
+		if guard != nil {
+			// inside a command's reply. it ends with %end or %error with
+			// the same time & command number as the %begin
+			if isNotification && (n.name == "end" || n.name == "error") &&
+				reflect.DeepEqual(strings.Fields(n.args), guard) {
+
+				var err error
+				if n.name == "error" {
+					err = fmt.Errorf("%s", strings.Join(block, "\n"))
+				}
+				flags, _ := strconv.Atoi(guard[2])
+				// replies to commands not sent by us, like the
+				// new-session command, have no flags
+				if flags&1 == 1 {
+					c.reply(block, err)
+				}
+				block = nil
+				guard = nil
+			} else {
+				block = append(block, line)
+			}
+			continue
+		}
+		if !isNotification {
+			c.logger.Warnf("tmux %s: unexpected line %q", c.Session, line)
+			continue
+		}
+		c.handleNotification(n, &guard)
+	}
+	c.exit()
+}
+
+func (c *Controller) handleNotification(n notification, guard *[]string) {
+	switch n.name {
+	case "begin":
+		_, err := parseReplyFlags(n.args)
+		if err != nil {
+			c.logger.Warnf("tmux %s: %s", c.Session, err)
+			return
+		}
+		*guard = strings.Fields(n.args)
+	case "output":
+		id, b, err := parseOutput(n.args)
+		if err != nil {
+			c.logger.Warnf("tmux %s: %s", c.Session, err)
+			return
+		}
+		c.panesM.Lock()
+		tty := c.ttys[id]
+		c.panesM.Unlock()
+		if tty != nil {
+			tty.push(b)
+		}
+	case "layout-change", "window-add", "window-close", "unlinked-window-close",
+		"window-renamed", "window-pane-changed", "session-window-changed",
+		"session-changed":
+		select {
+		case c.refresh <- struct{}{}:
+		default:
+		}
+	case "exit":
+		c.logger.Infof("tmux %s: exiting %s", c.Session, n.args)
+	}
+}
+
+// reply calls the callback of the oldest command waiting for a reply
+func (c *Controller) reply(lines []string, err error) {
+	c.m.Lock()
+	if len(c.replies) == 0 {
+		c.m.Unlock()
+		c.logger.Warnf("tmux %s: got an unexpected reply: %v", c.Session, lines)
+		return
+	}
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	c.m.Unlock()
+	if r != nil {
+		r(lines, err)
+	} else if err != nil {
+		c.logger.Warnf("tmux %s: command failed: %s", c.Session, err)
+	}
+}
+
+func (c *Controller) refreshLoop() {
+	for {
+		select {
+		case <-c.refresh:
+			err := c.Refresh()
+			if err != nil {
+				c.logger.Warnf("tmux %s: %s", c.Session, err)
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// exit is called when tmux exits. It closes all the session's panes.
+func (c *Controller) exit() {
+	c.registry.m.Lock()
+	if c.registry.controllers[c.Session] == c {
+		delete(c.registry.controllers, c.Session)
+	}
+	c.registry.m.Unlock()
+	c.panesM.Lock()
+	for id, tty := range c.ttys {
+		tty.Close()
+		delete(c.ttys, id)
+		delete(c.panes, id)
+	}
+	c.layout = Layout{Session: c.Session, Windows: []Window{}}
+	c.panesM.Unlock()
+	c.m.Lock()
+	close(c.done)
+	c.stdin.Close()
+	c.m.Unlock()
+	c.cmd.Wait()
+	c.logger.Infof("tmux %s: control client exited", c.Session)
+	if c.OnLayout != nil {
+		c.OnLayout(c, c.Layout())
+	}
+}
@@ -0,0 +1,116 @@
+package tmux
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+	"github.com/tuzig/webexec/peers"
+	"go.uber.org/zap"
+)
+
+func newTestPeer(t *testing.T) *peers.Peer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certificate, err := webrtc.GenerateCertificate(key)
+	require.NoError(t, err)
+	peer, err := peers.NewServer(&peers.Conf{
+		Certificate: certificate,
+		// the peer's state changes are logged after the test is done
+		Logger: zap.NewNop().Sugar(),
+	}).NewPeer("tmuxtest")
+	require.NoError(t, err)
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func TestController(t *testing.T) {
+	if _, err := exec.LookPath(Command); err != nil {
+		t.Skip("tmux is not installed")
+	}
+	SocketName = fmt.Sprintf("webexec-test-%d", os.Getpid())
+	t.Setenv("SHELL", "/bin/sh")
+	t.Cleanup(func() {
+		exec.Command(Command, "-L", SocketName, "kill-server").Run()
+		SocketName = ""
+	})
+	layouts := make(chan Layout, 16)
+	peer := newTestPeer(t)
+	r := NewRegistry()
+	c, err := r.Attach(peer, "test", &pty.Winsize{Rows: 24, Cols: 80},
+		func(_ *Controller, l Layout) { layouts <- l })
+	require.NoError(t, err)
+	require.Equal(t, c, r.Get("test"))
+	layout := c.Layout()
+	require.Len(t, layout.Windows, 1)
+	require.Len(t, layout.Windows[0].Panes, 1)
+	tmuxPane := layout.Windows[0].Panes[0]
+	require.NotZero(t, tmuxPane.ID)
+	ctrl, tmuxID := r.ForPane(tmuxPane.ID)
+	require.Equal(t, c, ctrl)
+	require.Equal(t, tmuxPane.TmuxID, tmuxID)
+	// other servers' registries don't share the sessions & panes
+	other := NewRegistry()
+	require.Nil(t, other.Get("test"))
+	ctrl, _ = other.ForPane(tmuxPane.ID)
+	require.Nil(t, ctrl)
+
+	pane := peer.Server.Panes.Get(tmuxPane.ID)
+	require.NotNil(t, pane)
+	_, err = pane.TTY.Write([]byte("echo BAD$((1+1))WOLF\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return bytes.Contains(pane.Buffer.GetSinceMarker(-1), []byte("BAD2WOLF"))
+	}, 5*time.Second, 50*time.Millisecond)
+
+	err = c.Split(tmuxID, true, "")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		l := c.Layout()
+		return len(l.Windows) == 1 && len(l.Windows[0].Panes) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	err = c.Zoom(tmuxID)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return c.Layout().Windows[0].Zoomed
+	}, 5*time.Second, 50*time.Millisecond)
+	require.NotEmpty(t, layouts)
+
+	err = c.Close()
+	require.NoError(t, err)
+	require.Nil(t, r.Get("test"))
+	require.Eventually(t, func() bool {
+		pane.Lock()
+		defer pane.Unlock()
+		return !pane.IsRunning
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestAttachExited(t *testing.T) {
+	Command = "false"
+	t.Cleanup(func() { Command = "tmux" })
+	peer := newTestPeer(t)
+	r := NewRegistry()
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Attach(peer, "exited", nil, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Attach hangs when tmux exits")
+	}
+	require.Eventually(t, func() bool { return r.Get("exited") == nil },
+		time.Second, 10*time.Millisecond)
+}
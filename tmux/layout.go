@@ -0,0 +1,67 @@
+package tmux
+
+import (
+	"github.com/tuzig/webexec/peers"
+)
+
+// Layout describes the windows and panes of a tmux session
+type Layout struct {
+	Session string   `json:"session"`
+	Windows []Window `json:"windows"`
+}
+
+// Window describes a tmux window
+type Window struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+	Zoomed bool   `json:"zoomed"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Panes  []Pane `json:"panes"`
+}
+
+// Pane describes a tmux pane. ID is the id of the webexec pane clients use
+// to connect to it.
+type Pane struct {
+	ID     int    `json:"id"`
+	TmuxID string `json:"tmux_id"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Active bool   `json:"active"`
+}
+
+// buildLayout builds a session's layout from list-panes output, keeping the
+// order tmux listed the windows and panes in
+func buildLayout(session string, infos []paneInfo, panes map[string]*peers.Pane) Layout {
+	layout := Layout{Session: session, Windows: []Window{}}
+	for _, info := range infos {
+		l := len(layout.Windows)
+		if l == 0 || layout.Windows[l-1].ID != info.windowID {
+			layout.Windows = append(layout.Windows, Window{
+				ID:     info.windowID,
+				Name:   info.windowName,
+				Active: info.windowActive,
+				Zoomed: info.zoomed,
+				Width:  info.windowWidth,
+				Height: info.windowHeight,
+			})
+			l++
+		}
+		pane := Pane{
+			TmuxID: info.id,
+			Width:  info.width,
+			Height: info.height,
+			X:      info.x,
+			Y:      info.y,
+			Active: info.active,
+		}
+		if p, found := panes[info.id]; found {
+			pane.ID = p.ID
+		}
+		layout.Windows[l-1].Panes = append(layout.Windows[l-1].Panes, pane)
+	}
+	return layout
+}
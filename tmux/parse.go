@@ -0,0 +1,127 @@
+// This file contains the parsers for tmux's control mode protocol
+package tmux
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// paneFormat is the format used to list the session's panes. The window's
+// name is last as it may contain spaces
+const paneFormat = "#{window_id} #{window_active} #{window_zoomed_flag} " +
+	"#{window_width} #{window_height} #{pane_id} #{pane_width} " +
+	"#{pane_height} #{pane_left} #{pane_top} #{pane_active} #{window_name}"
+
+// notification is a line tmux sends that starts with a '%'
+type notification struct {
+	name string
+	args string
+}
+
+// paneInfo is a line of list-panes output
+type paneInfo struct {
+	windowID     string
+	windowName   string
+	windowActive bool
+	zoomed       bool
+	windowWidth  int
+	windowHeight int
+	id           string
+	width        int
+	height       int
+	x            int
+	y            int
+	active       bool
+}
+
+// parseNotification splits a notification line to its name and arguments
+func parseNotification(line string) (notification, bool) {
+	if !strings.HasPrefix(line, "%") {
+		return notification{}, false
+	}
+	fields := strings.SplitN(line[1:], " ", 2)
+	n := notification{name: fields[0]}
+	if len(fields) > 1 {
+		n.args = fields[1]
+	}
+	return n, true
+}
+
+// parseOutput parses the arguments of an %output notification and returns
+// the pane's tmux id and its unescaped output
+func parseOutput(args string) (string, []byte, error) {
+	fields := strings.SplitN(args, " ", 2)
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "%") {
+		return "", nil, fmt.Errorf("Bad output notification: %q", args)
+	}
+	return fields[0], unescape(fields[1]), nil
+}
+
+// unescape decodes tmux's output escaping, where characters smaller than
+// space and backslash are sent as a backslash followed by 3 octal digits
+func unescape(s string) []byte {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1:i+4]) {
+			v, _ := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			b.WriteByte(byte(v))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.Bytes()
+}
+
+func isOctal(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseReplyFlags parses the flags of a %begin, %end or %error line.
+// The flags are 1 when the command was sent by this client.
+func parseReplyFlags(args string) (int, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 3 {
+		return 0, fmt.Errorf("Bad command reply guard: %q", args)
+	}
+	return strconv.Atoi(fields[2])
+}
+
+// parsePaneInfo parses a line of list-panes output formatted with paneFormat
+func parsePaneInfo(line string) (paneInfo, error) {
+	var (
+		info paneInfo
+		err  error
+	)
+	fields := strings.SplitN(line, " ", 12)
+	if len(fields) < 11 {
+		return info, fmt.Errorf("Bad pane line: %q", line)
+	}
+	if len(fields) == 12 {
+		info.windowName = fields[11]
+	}
+	info.windowID = fields[0]
+	info.windowActive = fields[1] == "1"
+	info.zoomed = fields[2] == "1"
+	info.id = fields[5]
+	info.active = fields[10] == "1"
+	ints := []*int{nil, nil, nil, &info.windowWidth, &info.windowHeight, nil,
+		&info.width, &info.height, &info.x, &info.y}
+	for i, p := range ints {
+		if p == nil {
+			continue
+		}
+		*p, err = strconv.Atoi(fields[i])
+		if err != nil {
+			return info, fmt.Errorf("Bad pane line: %q: %s", line, err)
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,59 @@
+package tmux
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutput(t *testing.T) {
+	id, b, err := parseOutput(`%12 echo hi\015\012\033[?2004h\134`)
+	require.NoError(t, err)
+	require.Equal(t, "%12", id)
+	require.Equal(t, "echo hi\r\n\x1b[?2004h\\", string(b))
+	_, _, err = parseOutput("%12")
+	require.Error(t, err)
+	// a backslash that isn't followed by 3 octal digits is kept as is
+	require.Equal(t, `a\9b\01`, string(unescape(`a\9b\01`)))
+}
+
+func TestParseNotification(t *testing.T) {
+	n, ok := parseNotification("%layout-change @0 a87d,100x30,0,0,0 a87d,100x30,0,0,0 *")
+	require.True(t, ok)
+	require.Equal(t, "layout-change", n.name)
+	require.Equal(t, "@0 a87d,100x30,0,0,0 a87d,100x30,0,0,0 *", n.args)
+	n, ok = parseNotification("%exit")
+	require.True(t, ok)
+	require.Equal(t, "exit", n.name)
+	require.Empty(t, n.args)
+	_, ok = parseNotification("@0 %0")
+	require.False(t, ok)
+	flags, err := parseReplyFlags("1792398514 266 1")
+	require.NoError(t, err)
+	require.Equal(t, 1, flags)
+}
+
+func TestBuildLayout(t *testing.T) {
+	lines := []string{
+		"@1 0 0 80 24 %1 80 24 0 0 1 root",
+		"@2 1 1 80 24 %2 40 24 0 0 1 my window",
+		"@2 1 1 80 24 %3 39 24 41 0 0 my window",
+	}
+	infos := make([]paneInfo, 0, len(lines))
+	for _, l := range lines {
+		info, err := parsePaneInfo(l)
+		require.NoError(t, err)
+		infos = append(infos, info)
+	}
+	layout := buildLayout("s", infos, nil)
+	require.Equal(t, "s", layout.Session)
+	require.Len(t, layout.Windows, 2)
+	w := layout.Windows[1]
+	require.Equal(t, "my window", w.Name)
+	require.True(t, w.Active)
+	require.True(t, w.Zoomed)
+	require.Len(t, w.Panes, 2)
+	require.Equal(t, Pane{TmuxID: "%3", Width: 39, Height: 24, X: 41}, w.Panes[1])
+	_, err := parsePaneInfo("@1 0 0 80")
+	require.Error(t, err)
+}
@@ -0,0 +1,148 @@
+// This file contains paneTTY, the tty of a pane that runs inside tmux
+package tmux
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/creack/pty"
+)
+
+// maxKeysLen is the maximum number of bytes sent in a single send-keys command
+const maxKeysLen = 256
+
+// maxPendingOutput is the number of output bytes a pane can have waiting to
+// be read. Beyond it, the output is dropped and the pane's screen is
+// captured again.
+const maxPendingOutput = 1024 * 1024
+
+// paneTTY implements peers.Pane's TTY for a tmux pane. Reads return the
+// pane's %output notifications, writes are sent as keys and resizing is
+// forwarded to tmux. The output is coalesced so the controller's read loop,
+// shared by all the panes, never blocks on a slow pane.
+type paneTTY struct {
+	c  *Controller
+	id string
+	// pending holds the output waiting to be read
+	pending []byte
+	// wake is signaled when output is pending
+	wake chan struct{}
+	left []byte
+	// resync captures the pane's screen after its output was dropped
+	resync func()
+	// ready is set once the pane's content was captured, earlier output is
+	// part of the capture and is dropped
+	ready bool
+	done  chan struct{}
+	once  sync.Once
+	m     sync.Mutex
+}
+
+func newPaneTTY(c *Controller, id string) *paneTTY {
+	t := &paneTTY{
+		c:    c,
+		id:   id,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	t.resync = func() { c.capture(t) }
+	return t
+}
+
+// Read reads the pane's output
+func (t *paneTTY) Read(b []byte) (int, error) {
+	for len(t.left) == 0 {
+		select {
+		case <-t.wake:
+		case <-t.done:
+			return 0, io.EOF
+		}
+		t.m.Lock()
+		t.left = t.pending
+		t.pending = nil
+		t.m.Unlock()
+	}
+	n := copy(b, t.left)
+	t.left = t.left[n:]
+	return n, nil
+}
+
+// Write sends the bytes to the tmux pane as keys
+func (t *paneTTY) Write(b []byte) (int, error) {
+	for i := 0; i < len(b); i += maxKeysLen {
+		end := i + maxKeysLen
+		if end > len(b) {
+			end = len(b)
+		}
+		keys := hex.EncodeToString(b[i:end])
+		var cmd strings.Builder
+		fmt.Fprintf(&cmd, "send-keys -H -t %s", t.id)
+		for j := 0; j < len(keys); j += 2 {
+			cmd.WriteByte(' ')
+			cmd.WriteString(keys[j : j+2])
+		}
+		err := t.c.Send(cmd.String())
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(b), nil
+}
+
+// Close stops reading the pane's output. The tmux pane is left running.
+func (t *paneTTY) Close() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
+// Resize resizes the tmux pane
+func (t *paneTTY) Resize(ws *pty.Winsize) error {
+	return t.c.Send(fmt.Sprintf(
+		"resize-pane -t %s -x %d -y %d", t.id, ws.Cols, ws.Rows))
+}
+
+// push adds output to the pane. Output that is pushed before the pane is
+// ready is dropped.
+func (t *paneTTY) push(b []byte) {
+	t.m.Lock()
+	ready := t.ready
+	t.m.Unlock()
+	if ready {
+		t.pushAlways(b)
+	}
+}
+
+// pushAlways adds output to the pane even if it's not ready. It never
+// blocks, when too much output is pending it's dropped and the pane is
+// resynced.
+func (t *paneTTY) pushAlways(b []byte) {
+	t.m.Lock()
+	if len(t.pending)+len(b) > maxPendingOutput {
+		t.pending = nil
+		t.ready = false
+		t.m.Unlock()
+		go t.resync()
+		return
+	}
+	t.pending = append(t.pending, b...)
+	t.m.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setReady marks the pane as ready for output notifications
+func (t *paneTTY) setReady() {
+	t.m.Lock()
+	t.ready = true
+	t.m.Unlock()
+}
+
+// String returns the pane's tmux id
+func (t *paneTTY) String() string {
+	return "tmux pane " + t.id
+}
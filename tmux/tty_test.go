@@ -0,0 +1,49 @@
+package tmux
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaneTTYOverflow(t *testing.T) {
+	tty := newPaneTTY(nil, "%1")
+	resynced := make(chan bool, 1)
+	tty.resync = func() { resynced <- true }
+	tty.setReady()
+	// output is coalesced while nobody reads it
+	tty.push([]byte("hello "))
+	tty.push([]byte("world"))
+	b := make([]byte, 64)
+	n, err := tty.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b[:n]))
+	// a pane that isn't read doesn't block the pushes, its output is
+	// dropped and the pane is resynced
+	pushed := make(chan bool)
+	go func() {
+		chunk := make([]byte, 64*1024)
+		for i := 0; i < 32; i++ {
+			tty.push(chunk)
+		}
+		pushed <- true
+	}()
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked")
+	}
+	select {
+	case <-resynced:
+	case <-time.After(time.Second):
+		t.Fatal("the pane wasn't resynced")
+	}
+	// output is dropped until the capture is pushed
+	tty.push([]byte("lost"))
+	tty.pushAlways([]byte("screen"))
+	tty.setReady()
+	n, err = tty.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "screen", string(b[:n]))
+}
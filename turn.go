@@ -0,0 +1,206 @@
+// This file holds the embedded STUN & TURN server and TURN credentials
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/turn/v5"
+	"github.com/pion/webrtc/v4"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+// TURNConf holds the configuration of the embedded STUN & TURN server
+type TURNConf struct {
+	// Listen is the UDP & TCP address the server listens on
+	Listen string
+	// PublicIP is the address clients use to reach the server and the
+	// address of the relays
+	PublicIP string
+	Realm    string
+	// RelayPortMin & RelayPortMax are the range of relay ports
+	RelayPortMin uint16
+	RelayPortMax uint16
+	// TTL is how long the credentials are valid
+	TTL time.Duration
+}
+
+// TURNServer is an embedded STUN & TURN server with short lived credentials
+type TURNServer struct {
+	conf   *TURNConf
+	server *turn.Server
+	// secret is used to sign the credentials and is generated on start
+	secret string
+	port   int
+}
+
+// StartTURNServer starts the embedded TURN server if it's configured and
+// adds it to the ICE servers
+func StartTURNServer(lc fx.Lifecycle, conf *AgentConf, ice *ICEServers,
+	logger *zap.SugaredLogger) error {
+
+	if conf.turn == nil {
+		return nil
+	}
+	var running *TURNServer
+	lc.Append(fx.Hook{
+		OnStart: func(context.Context) error {
+			s, err := NewTURNServer(conf.turn)
+			if err != nil {
+				return err
+			}
+			running = s
+			ice.setTURN(s)
+			logger.Infof("Started TURN server on %s", conf.turn.Listen)
+			return nil
+		},
+		OnStop: func(context.Context) error {
+			if running == nil {
+				return nil
+			}
+			logger.Info("Stopping TURN server")
+			ice.setTURN(nil)
+			err := running.Close()
+			running = nil
+			return err
+		},
+	})
+	return nil
+}
+
+// NewTURNServer starts a STUN & TURN server listening on both UDP & TCP
+func NewTURNServer(conf *TURNConf) (*TURNServer, error) {
+	relayIP := net.ParseIP(conf.PublicIP)
+	if relayIP == nil {
+		return nil, fmt.Errorf("Bad TURN public IP: %q", conf.PublicIP)
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate TURN secret: %s", err)
+	}
+	s := &TURNServer{conf: conf, secret: hex.EncodeToString(b)}
+	udpConn, err := net.ListenPacket("udp4", conf.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen on UDP %s: %s", conf.Listen, err)
+	}
+	s.port = udpConn.LocalAddr().(*net.UDPAddr).Port
+	// TCP listens on the same port, for firewalls that block UDP
+	tcpAddr := net.JoinHostPort(udpConn.LocalAddr().(*net.UDPAddr).IP.String(),
+		strconv.Itoa(s.port))
+	tcpListener, err := net.Listen("tcp4", tcpAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("Failed to listen on TCP %s: %s", tcpAddr, err)
+	}
+	relay := func() turn.RelayAddressGenerator {
+		return &turn.RelayAddressGeneratorPortRange{
+			RelayAddress: relayIP,
+			Address:      "0.0.0.0",
+			MinPort:      conf.RelayPortMin,
+			MaxPort:      conf.RelayPortMax,
+		}
+	}
+	s.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       conf.Realm,
+		AuthHandler: turn.NewLongTermAuthHandler(s.secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            udpConn,
+			RelayAddressGenerator: relay(),
+		}},
+		ListenerConfigs: []turn.ListenerConfig{{
+			Listener:              tcpListener,
+			RelayAddressGenerator: relay(),
+		}},
+	})
+	if err != nil {
+		udpConn.Close()
+		tcpListener.Close()
+		return nil, fmt.Errorf("Failed to start TURN server: %s", err)
+	}
+	return s, nil
+}
+
+// ICEServer returns the server's URLs with new credentials, valid for the
+// configured TTL
+func (s *TURNServer) ICEServer() (webrtc.ICEServer, error) {
+	username, password, err := turn.GenerateLongTermCredentials(s.secret, s.conf.TTL)
+	if err != nil {
+		return webrtc.ICEServer{}, fmt.Errorf("Failed to generate TURN credentials: %s", err)
+	}
+	addr := net.JoinHostPort(s.conf.PublicIP, strconv.Itoa(s.port))
+	return webrtc.ICEServer{
+		URLs: []string{
+			"stun:" + addr,
+			"turn:" + addr + "?transport=udp",
+			"turn:" + addr + "?transport=tcp",
+		},
+		Username:       username,
+		Credential:     password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}, nil
+}
+
+// Close stops the server
+func (s *TURNServer) Close() error {
+	return s.server.Close()
+}
+
+// defaultRESTTTL is how long TURN REST credentials are valid by default
+const defaultRESTTTL = 24 * time.Hour
+
+// WebRTC returns the webrtc ICE server. When the server has a shared
+// secret it returns new TURN REST credentials: the username is the expiry
+// time followed by the configured username and the password is the
+// username's HMAC-SHA1.
+func (s ICEServer) WebRTC(now time.Time) webrtc.ICEServer {
+	ret := webrtc.ICEServer{
+		URLs:           s.URLs,
+		Username:       s.Username,
+		Credential:     s.Password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}
+	if s.Secret == "" {
+		return ret
+	}
+	ttl := defaultRESTTTL
+	if s.TTL > 0 {
+		ttl = time.Duration(s.TTL) * time.Millisecond
+	}
+	ret.Username = strconv.FormatInt(now.Add(ttl).Unix(), 10)
+	if s.Username != "" {
+		ret.Username += ":" + s.Username
+	}
+	mac := hmac.New(sha1.New, []byte(s.Secret))
+	mac.Write([]byte(ret.Username))
+	ret.Credential = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return ret
+}
+
+// iceServersExpire returns when the servers should be refreshed: a minute
+// before the first TURN REST credentials expire or def if it's earlier
+func iceServersExpire(servers []webrtc.ICEServer, def time.Time) time.Time {
+	ret := def
+	for _, s := range servers {
+		ts := strings.SplitN(s.Username, ":", 2)[0]
+		expiry, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(expiry, 0).Add(-time.Minute)
+		if t.Before(ret) {
+			ret = t
+		}
+	}
+	return ret
+}
@@ -0,0 +1,140 @@
+// This files contains tests of the embedded TURN server
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v5"
+	"github.com/pion/webrtc/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTURNServer(t *testing.T) {
+	s, err := NewTURNServer(&TURNConf{
+		Listen:       "127.0.0.1:0",
+		PublicIP:     "127.0.0.1",
+		Realm:        "webexec",
+		RelayPortMin: 62001,
+		RelayPortMax: 62100,
+		TTL:          time.Minute,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	iceServer, err := s.ICEServer()
+	require.NoError(t, err)
+	require.Len(t, iceServer.URLs, 3)
+	addr := strings.TrimPrefix(iceServer.URLs[0], "stun:")
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: addr,
+		TURNServerAddr: addr,
+		Conn:           conn,
+		Username:       iceServer.Username,
+		Password:       iceServer.Credential.(string),
+		Realm:          "webexec",
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.Listen())
+	mapped, err := client.SendBindingRequest()
+	require.NoError(t, err)
+	require.Equal(t, conn.LocalAddr().String(), mapped.String())
+	relay, err := client.Allocate()
+	require.NoError(t, err)
+	defer relay.Close()
+	require.Equal(t, "127.0.0.1", relay.LocalAddr().(*net.UDPAddr).IP.String())
+	// bad credentials are refused
+	conn2, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn2.Close()
+	client2, err := turn.NewClient(&turn.ClientConfig{
+		TURNServerAddr: addr,
+		Conn:           conn2,
+		Username:       iceServer.Username,
+		Password:       "wrong",
+		Realm:          "webexec",
+	})
+	require.NoError(t, err)
+	defer client2.Close()
+	require.NoError(t, client2.Listen())
+	_, err = client2.Allocate()
+	require.Error(t, err)
+}
+
+func TestTURNRESTCredentials(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := ICEServer{
+		URLs:     []string{"turn:192.0.2.1:3478"},
+		Username: "webexec",
+		Secret:   "secret",
+		TTL:      3600000,
+	}
+	server := s.WebRTC(now)
+	require.Equal(t, "1700003600:webexec", server.Username)
+	mac := hmac.New(sha1.New, []byte("secret"))
+	mac.Write([]byte("1700003600:webexec"))
+	require.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), server.Credential)
+	// static credentials are left as is
+	s = ICEServer{URLs: s.URLs, Username: "user", Password: "pass"}
+	server = s.WebRTC(now)
+	require.Equal(t, "user", server.Username)
+	require.Equal(t, "pass", server.Credential)
+}
+
+func TestPBICEServersRefresh(t *testing.T) {
+	logger := initTest(t)
+	conf, err := parseConf(defaultConf)
+	require.NoError(t, err)
+	conf.insecure = true
+	conf.iceServers = nil
+	expiry := time.Now().Add(2 * time.Minute).Unix()
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode([]webrtc.ICEServer{{
+			URLs:       []string{"turn:192.0.2.1:3478"},
+			Username:   fmt.Sprintf("%d:webexec", expiry),
+			Credential: "pass",
+		}})
+	}))
+	defer ts.Close()
+	conf.peerbookHost = strings.TrimPrefix(ts.URL, "http://")
+	conf.iceRefresh = time.Hour
+	ice := NewICEServers(conf, logger)
+	servers, err := ice.Get()
+	require.NoError(t, err)
+	require.Len(t, servers, 1)
+	require.Equal(t, 1, requests)
+	// the credentials expire in 2 minutes so the servers are refreshed in 1
+	require.WithinDuration(t, time.Unix(expiry, 0).Add(-time.Minute),
+		ice.pbExpire, time.Second)
+	_, err = ice.Get()
+	require.NoError(t, err)
+	require.Equal(t, 1, requests)
+	ice.pbExpire = time.Now().Add(-time.Second)
+	_, err = ice.Get()
+	require.NoError(t, err)
+	require.Equal(t, 2, requests)
+	// when peerbook is unreachable the expired servers and the configured
+	// ones are used
+	ts.Close()
+	ice.pbExpire = time.Now().Add(-time.Second)
+	conf.iceServers = []ICEServer{{URLs: []string{"stun:192.0.2.2:3478"}}}
+	servers, err = ice.Get()
+	require.NoError(t, err)
+	require.Len(t, servers, 2)
+	require.Equal(t, []string{"stun:192.0.2.2:3478"}, servers[0].URLs)
+	require.Equal(t, []string{"turn:192.0.2.1:3478"}, servers[1].URLs)
+}
@@ -16,7 +16,6 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
-	"sync"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -41,8 +40,6 @@ type GHReleaseInfo struct {
 }
 
 var (
-	// Logger is our global logger
-	Logger *zap.SugaredLogger
 	// generated by go-gitver
 	commit  = "0000000"
 	version = "UNRELEASED"
@@ -56,45 +53,43 @@ var (
 		version *semver.Version
 		expire  time.Time
 	}
-	markerM sync.RWMutex
-	// the id of the last marker used
-	lastMarker = 0
 )
 
-func GetWelcome() string {
+// GetWelcome returns the message sent to new panes
+func GetWelcome(logger *zap.SugaredLogger) string {
 	msg := "Connected over WebRTC\r\n"
-	note := getVersionNote()
+	note := getVersionNote(logger)
 	if note != "" {
 		msg += "└─ " + note + "\r\n"
 	}
 	return msg
 }
 
-func getVersionNote() string {
+func getVersionNote(logger *zap.SugaredLogger) string {
 	if cachedVersion.version == nil || cachedVersion.expire.After(time.Now()) {
 		resp, err := http.Get("https://api.github.com/repos/tuzig/webexec/releases/latest")
 		if err != nil {
-			Logger.Warnf("Get version request failed: %s", err)
+			logger.Warnf("Get version request failed: %s", err)
 			return ""
 		}
 		defer resp.Body.Close()
 
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			Logger.Warnf("Could not read the latest version description: %s", err)
+			logger.Warnf("Could not read the latest version description: %s", err)
 			return ""
 		}
 
 		var releaseInfo GHReleaseInfo
 		err = json.Unmarshal(body, &releaseInfo)
 		if err != nil {
-			Logger.Warnf("Could not unmarshal the latest version body: %s", err)
+			logger.Warnf("Could not unmarshal the latest version body: %s", err)
 			return ""
 		}
 		s := strings.TrimPrefix(releaseInfo.TagName, "v")
 		cachedVersion.version, err = semver.NewVersion(s)
 		if err != nil {
-			Logger.Warnf("Could not parse the latest version: %s", err)
+			logger.Warnf("Could not parse the latest version: %s", err)
 			return ""
 		}
 		cachedVersion.expire = time.Now().Add(time.Hour)
@@ -115,11 +110,11 @@ func PIDFilePath() string {
 	return RunPath("webexec.pid")
 }
 
-// InitAgentLogger intializes an agent logger and sets the global Logger
-func InitAgentLogger() *zap.SugaredLogger {
+// InitAgentLogger intializes an agent logger
+func InitAgentLogger(conf *AgentConf) *zap.SugaredLogger {
 	// rotate the log file
 	logWriter = &lumberjack.Logger{
-		Filename:   Conf.logFilePath,
+		Filename:   conf.logFilePath,
 		MaxSize:    10, // megabytes
 		MaxBackups: 3,
 		MaxAge:     28, // days
@@ -136,16 +131,15 @@ func InitAgentLogger() *zap.SugaredLogger {
 			EncodeTime:  zapcore.ISO8601TimeEncoder,
 		}),
 		w,
-		Conf.logLevel,
+		conf.logLevel,
 	)
 	logger := zap.New(core)
 	defer logger.Sync()
-	Logger = logger.Sugar()
 	// redirect stderr
 	e, _ := os.OpenFile(
-		Conf.errFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		conf.errFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	Dup2(int(e.Fd()), 2)
-	return Logger
+	return logger.Sugar()
 }
 
 // InitDevLogger starts a logger for development
@@ -167,12 +161,11 @@ func InitDevLogger() *zap.SugaredLogger {
 		panic(err)
 	}
 	l, err := cfg.Build()
-	Logger = l.Sugar()
 	if err != nil {
 		panic(err)
 	}
-	defer Logger.Sync()
-	return Logger
+	defer l.Sync()
+	return l.Sugar()
 }
 
 // versionCMD prints version information
@@ -189,7 +182,7 @@ func stop(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("Failed to load certificates: %s", err)
 	}
-	_, _, err = LoadConf(certs)
+	conf, err := LoadConf(certs)
 	if err != nil {
 		return err
 	}
@@ -207,13 +200,57 @@ func stop(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("Failed to read the pidfile: %s", err)
 	}
-	process, err := os.FindProcess(pid)
+	drain := conf.drain
+	if c.IsSet("drain") {
+		drain = c.Duration("drain")
+	}
+	req := ShutdownRequest{Reason: c.Command.Name, Drain: drain.Milliseconds()}
+	if c.Command.Name == "restart" {
+		// restart waits a second before starting the agent
+		req.ETA = (drain + time.Second).Milliseconds()
+	}
+	err = requestShutdown(req)
+	if err != nil {
+		fmt.Printf("Failed to request a shutdown, sending a signal: %s\n", err)
+		process, err := os.FindProcess(pid)
+		if err != nil {
+			return fmt.Errorf("Failed to find the agetnt's process: %s", err)
+		}
+		fmt.Printf("Sending a SIGINT to agent process %d\n", pid)
+		return process.Signal(syscall.SIGINT)
+	}
+	fmt.Printf("Stopping agent process %d, draining for %s\n", pid, drain)
+	// wait for the agent to hang up the panes & exit
+	deadline := time.Now().Add(drain + 5*time.Second)
+	for pidf.Running() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if pidf.Running() {
+		return fmt.Errorf("Agent process %d is still running", pid)
+	}
+	return nil
+}
+
+// requestShutdown asks the agent to shut down over its socket
+func requestShutdown(req ShutdownRequest) error {
+	httpc := newSocketClient()
+	if httpc == nil {
+		return fmt.Errorf("Agent's socket not found")
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal the shutdown request: %s", err)
+	}
+	r, err := httpc.Post("http://unix/shutdown", "application/json", bytes.NewReader(b))
 	if err != nil {
-		return fmt.Errorf("Failed to find the agetnt's process: %s", err)
+		return fmt.Errorf("Failed to post the shutdown request: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusAccepted {
+		msg, _ := io.ReadAll(r.Body)
+		return fmt.Errorf("Agent returned %d: %s", r.StatusCode, msg)
 	}
-	fmt.Printf("Sending a SIGINT to agent process %d\n", pid)
-	err = process.Signal(syscall.SIGINT)
-	return err
+	return nil
 }
 
 // createPIDFile creates the pid file or returns an error if it exists
@@ -228,7 +265,7 @@ func createPIDFile() error {
 	return nil
 }
 
-func forkAgent(address httpserver.AddressType) (int, error) {
+func forkAgent(conf *AgentConf, address httpserver.AddressType) (int, error) {
 	pidf, err := pidfile.Open(PIDFilePath())
 	if pidf != nil && !os.IsNotExist(err) && pidf.Running() {
 		fmt.Println("agent is already running, doing nothing")
@@ -241,7 +278,7 @@ func forkAgent(address httpserver.AddressType) (int, error) {
 	}
 	cmd := exec.Command("bash", "-c",
 		fmt.Sprintf("%s start --agent --address %s >> %s",
-			execPath, string(address), Conf.logFilePath))
+			execPath, string(address), conf.logFilePath))
 	cmd.Env = nil
 	err = cmd.Start()
 	if err != nil {
@@ -266,12 +303,12 @@ func start(c *cli.Context) error {
 	if err != nil {
 		return fmt.Errorf("Failed to get the certificates: %s", err)
 	}
-	_, address, err := LoadConf(certs)
+	conf, err := LoadConf(certs)
 	if err != nil {
 		return err
 	}
 	if c.IsSet("address") {
-		address = httpserver.AddressType(c.String("address"))
+		conf.address = httpserver.AddressType(c.String("address"))
 	}
 	// TODO: do we need this?
 	peers.PtyMux = peers.PtyMuxType{}
@@ -285,12 +322,12 @@ func start(c *cli.Context) error {
 		}
 	} else {
 		if !c.Bool("agent") {
-			pid, err := forkAgent(address)
+			pid, err := forkAgent(conf, conf.address)
 			if err != nil {
 				return err
 			}
 			fmt.Printf("Agent started as process #%d\n", pid)
-			versionNote := getVersionNote()
+			versionNote := getVersionNote(zap.NewNop().Sugar())
 			if versionNote != "" {
 				fmt.Println(versionNote)
 			}
@@ -306,31 +343,51 @@ func start(c *cli.Context) error {
 	}
 	// the code below runs for both --debug and --agent
 	sigChan := make(chan os.Signal, 1)
+	var (
+		server *peers.Server
+		sock   *sockServer
+		logger *zap.SugaredLogger
+	)
 	app := fx.New(
 		loggerOption,
 		fx.Supply(""),
+		fx.Supply(conf),
 		fx.Provide(
-			LoadConf,
+			PeersConf,
+			HTTPAddress,
+			newServer,
 			httpserver.NewConnectHandler,
 			fx.Annotate(NewFileAuth, fx.As(new(httpserver.AuthBackend))),
 			NewSockServer,
 			NewPeerbookClient,
-			GetCerts,
+			NewICEServers,
+			GetHTTPOptions,
 			func() SocketStartParams {
 				return SocketStartParams{RunPath("webexec.sock")}
 			},
 		),
-		fx.Invoke(httpserver.StartHTTPServer, StartSocketServer, StartPeerbookClient),
+		fx.Invoke(SetICEServers, LoadLayout, StartICE, StartTURNServer, SetWSTokens,
+			httpserver.StartHTTPServer, StartSocketServer, StartPeerbookClient,
+			StartSSHServer),
+		fx.Populate(&server, &sock, &logger),
 	)
-	if debug {
-		app.Run()
-		return nil
-	} else {
-		err = app.Start(context.Background())
+	err = app.Start(context.Background())
+	if err != nil {
+		os.Remove(PIDFilePath())
+		return err
 	}
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
-	Logger.Infof("Shutting down")
+	var opts peers.ShutdownOptions
+	select {
+	case sig := <-sigChan:
+		opts = peers.ShutdownOptions{Reason: sig.String(), Drain: conf.drain}
+	case opts = <-sock.shutdown:
+	}
+	server.GracefulShutdown(opts)
+	err = app.Stop(context.Background())
+	if err != nil {
+		logger.Errorf("Failed to stop: %s", err)
+	}
 	os.Remove(PIDFilePath())
 	return nil
 }
@@ -369,7 +426,7 @@ func accept(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	_, _, err = LoadConf(certs)
+	conf, err := LoadConf(certs)
 	if err != nil {
 		return err
 	}
@@ -386,7 +443,7 @@ func accept(c *cli.Context) error {
 		} else {
 			address = defaultHTTPServer
 		}
-		_, err = forkAgent(address)
+		_, err = forkAgent(conf, address)
 		if err != nil {
 			return fmt.Errorf("Failed to fork agent: %s", err)
 		}
@@ -539,8 +596,8 @@ func statusCMD(c *cli.Context) error {
 	label := color.New().PrintfFunc()
 	value := color.New(color.FgGreen).PrintfFunc()
 	header := color.New(color.FgYellow).FprintfFunc()
-	fp := getFP()
-	if fp == "" {
+	fp, err := getFP()
+	if err != nil {
 		fmt.Println("Unitialized, please run `webexec init`")
 	} else {
 		label("FP")
@@ -591,6 +648,11 @@ func statusCMD(c *cli.Context) error {
 	label("Agent version")
 	fmt.Print(": ")
 	value("%s\n", stats.Version)
+	if stats.TLSFingerprint != "" {
+		label("TLS fingerprint")
+		fmt.Print(": ")
+		value("%s\n", stats.TLSFingerprint)
+	}
 	label("Connected peers")
 	if len(stats.Peers) == 0 {
 		fmt.Print(": ")
@@ -607,8 +669,6 @@ func statusCMD(c *cli.Context) error {
 	return nil
 }
 func initCMD(c *cli.Context) error {
-	// init the dev logger so log messages are printed on the console
-	InitDevLogger()
 	homePath := ConfPath("")
 	_, err := os.Stat(homePath)
 	if os.IsNotExist(err) {
@@ -653,14 +713,17 @@ func initCMD(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	_, _, err = LoadConf([]webrtc.Certificate{*cert})
+	conf, err := LoadConf([]webrtc.Certificate{*cert})
 	if err != nil {
 		return cli.Exit(fmt.Sprintf("Failed to parse default conf: %s", err), 1)
 	}
-	fp := getFP()
+	fp, err := getFP()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Fingerprint:  %s\n", fp)
 	if uid != "" {
-		verified, err := verifyPeer(Conf.peerbookHost)
+		verified, err := verifyPeer(conf)
 		if err != nil {
 			return fmt.Errorf("Got an error verifying peer: %s", err)
 		}
@@ -673,7 +736,7 @@ func initCMD(c *cli.Context) error {
 	return nil
 }
 func upgrade(c *cli.Context) error {
-	if getVersionNote() == "" {
+	if getVersionNote(InitDevLogger()) == "" {
 		fmt.Println("You are already running the latest version")
 		return nil
 	}
@@ -715,7 +778,12 @@ func copyCMD(c *cli.Context) error {
 			},
 		},
 	}
-	resp, err := httpc.Post("http://unix/clipboard", mimeType, bytes.NewReader(b))
+	req, err := newClipboardRequest("POST", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mimeType)
+	resp, err := httpc.Do(req)
 	if err != nil {
 		return fmt.Errorf("Failed to create the request: %s", err)
 	}
@@ -737,7 +805,11 @@ func pasteCMD(c *cli.Context) error {
 			},
 		},
 	}
-	resp, err := httpc.Get("http://unix/clipboard")
+	req, err := newClipboardRequest("GET", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpc.Do(req)
 	if err != nil {
 		return fmt.Errorf("Failed to communicate with agent: %s", err)
 	}
@@ -753,36 +825,48 @@ func pasteCMD(c *cli.Context) error {
 	return nil
 }
 
-// handleCTRLMsg handles incoming control messages
-func handleCTRLMsg(peer *peers.Peer, m *peers.CTRLMessage, raw json.RawMessage) {
-	// do nothing on connection open and nil messages
-	if m == nil {
-		return
-	}
-	switch m.Type {
-	case "resize":
-		handleResize(peer, *m, raw)
-	case "restore":
-		handleRestore(peer, *m, raw)
-	case "get_payload":
-		handleGetPayload(peer, *m)
-	case "set_payload":
-		handleSetPayload(peer, *m, raw)
-	case "mark":
-		handleMark(peer, *m)
-	case "reconnect_pane":
-		handleReconnectPane(peer, *m, raw)
-	case "add_pane":
-		handleAddPane(peer, *m, raw)
-	default:
-		Logger.Errorf("Got a control message with unknown type: %q", m.Type)
-		// send nack
-		err := peer.SendNack(*m, "unknown control message type")
-		if err != nil {
-			Logger.Errorf("#%d: Failed to send nack: %v", peer.FP, err)
-		}
+// newClipboardRequest returns a request to the agent's clipboard. When
+// running in a pane, the pane's id is sent so the agent uses the
+// clipboard of the device using the pane.
+func newClipboardRequest(method string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, "http://unix/clipboard", body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the request: %s", err)
 	}
-	return
+	if id := os.Getenv(peers.PaneEnvVar); id != "" {
+		req.Header.Set(PaneHeader, id)
+	}
+	return req, nil
+}
+
+// newServer returns a peers server handling webexec's control messages
+func newServer(conf *peers.Conf) *peers.Server {
+	server := peers.NewServer(conf)
+	server.Version = version
+	server.AddCapabilities("tmux")
+	registerCTRLHandlers(server.Messages, conf.Logger)
+	return server
+}
+
+// registerCTRLHandlers registers the handlers of the control messages
+func registerCTRLHandlers(r *peers.Registry, logger *zap.SugaredLogger) {
+	r.Use(peers.Observe(func(peer *peers.Peer, typ string, d time.Duration) {
+		logger.Debugf("#%s: handled %s in %s", peer.FP, typ, d)
+	}))
+	h := newCTRLHandlers(logger)
+	r.Handle("resize", peers.Typed(h.handleResize))
+	r.Handle("restore", peers.Typed(h.handleRestore))
+	r.Handle("get_payload", h.handleGetPayload)
+	r.Handle("set_payload", peers.Typed(h.handleSetPayload))
+	r.Handle("get_layout", h.handleGetLayout)
+	r.Handle("set_layout", peers.Typed(h.handleSetLayout))
+	r.Handle("mark", h.handleMark)
+	r.Handle("reconnect_pane", peers.Typed(h.handleReconnectPane))
+	r.Handle("add_pane", peers.Typed(h.handleAddPane))
+	r.Handle("echo_hints", peers.Typed(h.handleEchoHints))
+	r.Handle("tmux_attach", peers.Typed(h.handleAttach))
+	r.Handle("tmux_split", peers.Typed(h.handleSplit))
+	r.Handle("tmux_zoom", peers.Typed(h.handleZoom))
 }
 
 func main() {
@@ -837,8 +921,14 @@ func main() {
 				Usage:  "webexec agent's status",
 				Action: statusCMD,
 			}, {
-				Name:   "stop",
-				Usage:  "stop the user's agent",
+				Name:  "stop",
+				Usage: "stop the user's agent",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "drain",
+						Usage: "how long clients have before the agent closes the connections, i.e. 30s",
+					},
+				},
 				Action: stop,
 			}, {
 				Name:   "init",
@@ -854,6 +944,40 @@ func main() {
 				Action: upgrade,
 			},
 			{
+				Name:      "attach",
+				Usage:     "attach the terminal to a running pane, Ctrl-] detaches",
+				ArgsUsage: "<pane id>",
+				Action:    attachCMD,
+			}, {
+				Name:      "new",
+				Usage:     "run a command, or the user's shell, in a new pane and attach to it",
+				ArgsUsage: "[-- command [args...]]",
+				Action:    newCMD,
+			}, {
+				Name:      "connect",
+				Usage:     "open a pane on a remote agent and attach to it, Ctrl-] detaches",
+				ArgsUsage: "<host[:port]|fingerprint> [command [args...]]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "token",
+						Usage:   "The token the remote agent authorizes",
+						EnvVars: []string{"WEBEXEC_TOKEN"},
+					},
+					&cli.IntFlag{
+						Name:  "attach",
+						Usage: "Attach to a running pane instead of adding one",
+					},
+					&cli.BoolFlag{
+						Name:  "peerbook",
+						Usage: "Connect through peerbook, the host is the agent's fingerprint",
+					},
+					&cli.BoolFlag{
+						Name:  "insecure",
+						Usage: "Skip verifying the remote's TLS certificate",
+					},
+				},
+				Action: connectCMD,
+			}, {
 				Name:   "copy",
 				Usage:  "Copy data from stdin to the active peer's clipboard. If no active peer, use local clipboard",
 				Action: copyCMD,
@@ -7,11 +7,11 @@ import (
 )
 
 func TestGetVersionNote(t *testing.T) {
-	initTest(t)
+	logger := initTest(t)
 	version = "0.0.1"
-	versionNote := getVersionNote()
+	versionNote := getVersionNote(logger)
 	require.NotEmpty(t, versionNote)
 	version = cachedVersion.version.String()
-	versionNote2 := getVersionNote()
+	versionNote2 := getVersionNote(logger)
 	require.Empty(t, versionNote2)
 }